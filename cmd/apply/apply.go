@@ -0,0 +1,13 @@
+package apply
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func GetApplyCommand() *cobra.Command {
+	return getApplyCommand()
+}
+
+func GetExportCommand() *cobra.Command {
+	return getExportCommand()
+}
@@ -0,0 +1,237 @@
+package apply
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/api"
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/spec"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// errStateChanged aborts the connections update when the state changed
+// between the plan and its approval, since the approved plan no longer holds.
+var errStateChanged = errors.New("the tower state changed since the plan was computed, run apply again")
+
+func getApplyCommand() *cobra.Command {
+	var file string
+	var force bool
+	var autoApprove bool
+
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Apply a declarative tower spec (tower command)",
+		Long: `Converge the tower towards the spec file: networks and their CIDRs, allowed keys, join tokens,
+peers static IPs and DNS forwards. The plan is computed against the current state and printed,
+then applied once confirmed, or right away with --auto-approve. With --dry-run the plan and the
+files it would change are printed and nothing is applied. Networks, keys, tokens and forwards missing
+from the spec are removed, networks that still have peers are only removed with --force.
+The spec format is the one written by 'upduck export'.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			desired, err := spec.Load(file)
+			if err != nil {
+				return fmt.Errorf("failed to load spec: %w", err)
+			}
+
+			nodeConfig, err := config.LoadNodeConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load node config: %w", err)
+			}
+
+			// the plan is computed on a copy of the state, which becomes the
+			// new state once approved
+			planned, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			current, err := json.Marshal(planned)
+			if err != nil {
+				return err
+			}
+
+			result, err := spec.Apply(planned, desired, spec.Options{
+				PortRange: nodeConfig.WGPortRange,
+				Force:     force,
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, warning := range result.Warnings {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+
+			if len(result.Changes) == 0 {
+				fmt.Println("✅ No changes, the tower matches the spec")
+				return nil
+			}
+
+			joinTokens, err := encodeJoinTokens(desired.Address, result.Tokens)
+			if err != nil {
+				return err
+			}
+
+			printPlan(result)
+
+			if !autoApprove && !system.DryRun() {
+				if file == "-" {
+					return fmt.Errorf("the spec is read from stdin, approve the plan with --auto-approve")
+				}
+
+				if !confirm("Apply these changes? Only 'yes' is accepted: ") {
+					return fmt.Errorf("apply cancelled")
+				}
+			}
+
+			// the DNS forwards are applied with the connections update, a
+			// failed Nginx reload restores the sites and keeps the state as is
+			tx := system.NewTransaction()
+			err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				state, err := json.Marshal(connectionsConfig)
+				if err != nil {
+					return err
+				}
+
+				if !bytes.Equal(state, current) {
+					return errStateChanged
+				}
+
+				*connectionsConfig = *planned
+
+				_, err = dns.ReconcileForwards(tx, connectionsConfig)
+				return err
+			})
+			if err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					fmt.Printf("Warning: failed to restore the DNS forwards: %v\n", rollbackErr)
+				}
+				return err
+			}
+			tx.Commit()
+
+			for _, removed := range result.RemovedNetworks {
+				netName := network.InterfaceName("tower", &removed)
+				if err := network.DeleteTowerInterface(netName, removed.Address); err != nil {
+					fmt.Printf("Warning: %v (the upduck service will remove it on its next reload)\n", err)
+				}
+			}
+
+			fmt.Printf("✅ Applied %d change(s)\n", len(result.Changes))
+
+			if len(joinTokens) > 0 {
+				fmt.Printf("\nJoin tokens created, run on the servers:\n")
+				for _, token := range joinTokens {
+					fmt.Printf("  upduck network join %s\n", token)
+				}
+			}
+
+			if len(result.Passwords) > 0 {
+				fmt.Printf("\nBasic auth passwords created, shown only once:\n")
+				for _, password := range result.Passwords {
+					fmt.Printf("  %s %s: %s\n", password.Domain, password.User, password.Password)
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Spec file to apply ('-' reads it from stdin)")
+	cmd.Flags().BoolVar(&force, "force", false, "Remove networks missing from the spec even if they still have peers")
+	cmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Apply the plan without asking for confirmation")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+// confirm asks the question on stdin and reports whether it was answered
+// with yes.
+func confirm(question string) bool {
+	fmt.Print(question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+
+	return strings.TrimSpace(answer) == "yes"
+}
+
+func printPlan(result *spec.Result) {
+	created, updated, deleted := 0, 0, 0
+	for _, change := range result.Changes {
+		switch change.Action {
+		case spec.ActionCreate:
+			created++
+		case spec.ActionUpdate:
+			updated++
+		case spec.ActionDelete:
+			deleted++
+		}
+	}
+
+	fmt.Printf("Plan: %d to add, %d to change, %d to remove\n\n", created, updated, deleted)
+	for _, change := range result.Changes {
+		fmt.Printf("  %s\n", change)
+	}
+	fmt.Println()
+}
+
+// encodeJoinTokens builds the join tokens printed for the tokens created
+// with a new secret, the same way 'upduck network token create' does.
+func encodeJoinTokens(towerAddress string, tokens []spec.CreatedToken) ([]string, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	if towerAddress == "" {
+		return nil, fmt.Errorf("the spec needs the tower 'address' to create join tokens without a secret_hash")
+	}
+
+	towerAddress, err := api.NormalizeTowerAddress(towerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaConfig, err := crypto.LoadRSAKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load RSA config: %w", err)
+	}
+
+	towerFingerprint, err := crypto.LoadTLSFingerprint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate, is the upduck service running?: %w", err)
+	}
+
+	var encoded []string
+	for _, token := range tokens {
+		joinToken, err := crypto.EncodeJoinToken(&types.JoinTokenPayload{
+			TowerAddress:     towerAddress,
+			NetworkID:        token.NetworkID,
+			TowerKeyDigest:   crypto.GetPublicKeyDigest(rsaConfig.PublicKey),
+			TowerFingerprint: towerFingerprint,
+			Secret:           token.Secret,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode join token %s: %w", token.TokenID, err)
+		}
+		encoded = append(encoded, joinToken)
+	}
+
+	return encoded, nil
+}
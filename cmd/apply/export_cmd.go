@@ -0,0 +1,55 @@
+package apply
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/spec"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+func getExportCommand() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the tower state as a spec (tower command)",
+		Long: `Write the networks, allowed keys, join tokens, peers static IPs and DNS forwards of the tower
+in the format read by 'upduck apply -f'. Join tokens and basic auth users are exported with the
+hash of their secret, not the secret.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			exported := spec.Export(connectionsConfig)
+
+			if output == "" || output == "-" {
+				return spec.Write(os.Stdout, exported)
+			}
+
+			var data bytes.Buffer
+			if err := spec.Write(&data, exported); err != nil {
+				return fmt.Errorf("failed to encode spec: %w", err)
+			}
+
+			if err := system.WriteFile(output, data.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", output, err)
+			}
+
+			fmt.Printf("✅ Tower state exported to %s\n", output)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the spec to (defaults to stdout)")
+
+	return cmd
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/certs"
+	"github.com/duck-labs/upduck/pkg/config"
+)
+
+func getACMECommand() *cobra.Command {
+	var directory string
+	var email string
+
+	cmd := &cobra.Command{
+		Use:   "acme",
+		Short: "Show or set the ACME account used for TLS forwards (tower command)",
+		Long: `Show or set the ACME directory and contact email the upduck service requests the certificates
+of TLS forwards from. The directory defaults to Let's Encrypt, point it to a local Pebble instance
+for tests (its CA can be trusted with the SSL_CERT_FILE environment variable of the service).
+Changes are picked up by the service on its next certificate check.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nodeConfig, err := config.LoadNodeConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load node config: %w", err)
+			}
+
+			if !cmd.Flags().Changed("directory") && !cmd.Flags().Changed("email") {
+				currentDirectory := nodeConfig.ACMEDirectory
+				if currentDirectory == "" {
+					currentDirectory = certs.DefaultDirectory + " (default)"
+				}
+
+				fmt.Printf("Directory: %s\n", currentDirectory)
+				fmt.Printf("Email: %s\n", valueOrNone(nodeConfig.ACMEEmail))
+				return nil
+			}
+
+			if cmd.Flags().Changed("directory") {
+				if directory != "" {
+					if parsed, err := url.Parse(directory); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+						return fmt.Errorf("invalid ACME directory %s, expected an https URL", directory)
+					}
+				}
+				nodeConfig.ACMEDirectory = directory
+			}
+
+			if cmd.Flags().Changed("email") {
+				nodeConfig.ACMEEmail = email
+			}
+
+			if err := config.WriteNodeConfig(nodeConfig); err != nil {
+				return fmt.Errorf("failed to write config file: %w", err)
+			}
+
+			fmt.Println("✅ ACME settings updated")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&directory, "directory", "", "ACME directory URL, empty for Let's Encrypt")
+	cmd.Flags().StringVar(&email, "email", "", "Contact email of the ACME account")
+
+	return cmd
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func GetConfigCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Config file management commands",
+		Long:  `Manage the upduck config files stored in the config directory.`,
+		// config files are migrated explicitly by the subcommands
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+	}
+
+	configCmd.AddCommand(getMigrateCommand())
+	configCmd.AddCommand(getACMECommand())
+
+	return configCmd
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+func getMigrateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the config files to the current schema",
+		Long: `Upgrade the config files written by older versions of upduck to the current schema version.
+The original of every upgraded file is kept next to it as <file>.v<version>.bak.
+Config files are also migrated automatically whenever upduck runs, except in dry runs.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun := system.DryRun()
+
+			results, err := config.MigrateConfigFiles(dryRun)
+			if err != nil {
+				return fmt.Errorf("failed to migrate config files: %w", err)
+			}
+
+			if len(results) == 0 {
+				fmt.Println("✅ All config files are up to date")
+				return nil
+			}
+
+			for _, result := range results {
+				fmt.Printf("%s: version %d -> %d\n", result.Path, result.FromVersion, result.ToVersion)
+				for _, migration := range result.Migrations {
+					fmt.Printf("   v%d: %s\n", migration.Version, migration.Description)
+					for _, note := range migration.Notes {
+						fmt.Printf("      %s\n", note)
+					}
+				}
+
+				if !dryRun {
+					fmt.Printf("✅ Migrated, original kept in %s\n", result.BackupPath)
+				}
+				fmt.Println()
+			}
+
+			if dryRun {
+				fmt.Println("Dry run, no file was changed")
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
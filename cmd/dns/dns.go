@@ -12,6 +12,12 @@ func GetDNSCommand() *cobra.Command {
 	}
 
 	dnsCmd.AddCommand(getForwardCommand())
+	dnsCmd.AddCommand(getListCommand())
+	dnsCmd.AddCommand(getUpdateCommand())
+	dnsCmd.AddCommand(getRemoveCommand())
+	dnsCmd.AddCommand(getRouteCommand())
+	dnsCmd.AddCommand(getForwardPortCommand())
+	dnsCmd.AddCommand(getRemovePortCommand())
 
 	return dnsCmd
 }
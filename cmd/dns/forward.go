@@ -1,56 +1,173 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/duck-labs/upduck/pkg/config"
-	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/dns"
 	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
 )
 
 func getForwardCommand() *cobra.Command {
-	return &cobra.Command{
-		Use:   "forward [domain] [server] [port]",
-		Short: "Forward domain to server (tower command)",
-		Long: `Create an Nginx configuration to forward a domain to a specific server's private IP and port.
-The server parameter can be either a server name or IP address from your connections.`,
-		Args: cobra.ExactArgs(3),
+	var strategy string
+	var tls bool
+	var hsts bool
+	var passthrough bool
+	var auth []string
+
+	cmd := &cobra.Command{
+		Use:   "forward [domain] [server:port]...",
+		Short: "Forward domain to servers (tower command)",
+		Long: `Create an Nginx configuration to forward a domain to the private IP and port of one or more servers.
+Each target is a server name or IP address from your connections and a port, like peerA:3000. Forwards to
+a server follow it when its address changes. The "forward [domain] [server] [port]" form is still accepted.
+With several targets the traffic is balanced with --strategy (round_robin, least_conn, ip_hash or
+random). Nginx stops sending traffic to a target failing requests for a while, and the upduck service
+probes every target over the WireGuard network, taking the failing ones out of rotation until they
+answer again.
+With --tls, the upduck service obtains and renews a certificate for the domain through ACME
+HTTP-01: the domain must resolve to the tower. HTTPS is served once the certificate is issued,
+HTTP is then redirected to it.
+With --passthrough, the tower does not decrypt the TLS connections of the domain: they are routed to the
+targets, which terminate TLS themselves, by the server name they ask for. Nginx then owns port 443 in
+its stream module and the HTTPS forwards are served behind it. HTTP on port 80 is not forwarded for
+passthrough domains.
+With --auth, repeated for each option, the access to the domain is restricted: allow=<ip or cidr> and
+deny=<ip or cidr> filter the client addresses, user=<name> adds a basic auth user with a generated
+password printed once, forward-auth=<url> asks an authentication service like oauth2-proxy about every
+request, and signin=<url> is where it sends the clients it refuses with a 401.`,
+		Args: cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			domain := args[0]
-			server := args[1]
-			serverPort := args[2]
+			targets := args[1:]
 
-			connectionsConfig, err := config.LoadConnectionsConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load connections config: %w", err)
+			if len(args) == 3 && !strings.Contains(args[1], ":") {
+				if _, err := strconv.Atoi(args[2]); err != nil {
+					return fmt.Errorf("invalid port: %s", args[2])
+				}
+				targets = []string{net.JoinHostPort(args[1], args[2])}
 			}
 
-			serverIP, err := network.ResolveServerToIP(connectionsConfig, server)
-			if err != nil {
-				return fmt.Errorf("failed to resolve server '%s': %w", server, err)
-			}
+			var addresses []string
+			var passwords map[string]string
+			err := updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				if dns.FindForward(connectionsConfig, domain) != -1 {
+					return fmt.Errorf("forward %s already exists, use 'upduck dns update' to change it", domain)
+				}
 
-			fmt.Printf("Configuring DNS forwarding for %s -> %s:%s (via %s)\n", domain, serverIP, serverPort, server)
+				forward, err := dns.AddForward(connectionsConfig, domain, targets, strategy)
+				if err != nil {
+					return err
+				}
 
-			if err := system.CreateNginxConfig(domain, serverIP, serverPort); err != nil {
-				return fmt.Errorf("failed to create Nginx config: %w", err)
-			}
+				if err := dns.SetTLS(forward, tls, hsts); err != nil {
+					return err
+				}
 
-			if err := exec.Command("nginx", "-t").Run(); err != nil {
-				return fmt.Errorf("nginx configuration test failed: %w", err)
-			}
+				if err := dns.SetPassthrough(forward, passthrough); err != nil {
+					return err
+				}
+
+				passwords, err = dns.ApplyAuth(forward, auth, nil)
+				if err != nil {
+					return err
+				}
+
+				addresses, err = resolveTargets(connectionsConfig, forward.Routes[0].Targets)
+				if err != nil {
+					return err
+				}
 
-			if err := exec.Command("systemctl", "reload", "nginx").Run(); err != nil {
-				return fmt.Errorf("failed to reload Nginx: %w", err)
+				fmt.Printf("Configuring DNS forwarding for %s -> %s (via %s)\n", domain, strings.Join(addresses, ", "), strings.Join(targets, ", "))
+				return nil
+			})
+			if err != nil {
+				return err
 			}
 
 			fmt.Printf("✅ Successfully configured DNS forwarding for %s\n", domain)
-			fmt.Printf("Domain %s will now forward to %s:%s\n", domain, serverIP, serverPort)
+			fmt.Printf("Domain %s will now forward to %s\n", domain, strings.Join(addresses, ", "))
+			if tls {
+				fmt.Println("The certificate is requested by the upduck service, check its status with 'upduck dns list'")
+			}
+			printPasswords(domain, passwords, tls)
 
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&strategy, "strategy", dns.StrategyRoundRobin, "Load balancing strategy across the targets ("+strings.Join(dns.Strategies, ", ")+")")
+	cmd.Flags().BoolVar(&tls, "tls", false, "Serve the domain over HTTPS with a certificate obtained through ACME")
+	cmd.Flags().BoolVar(&hsts, "hsts", false, "Send the Strict-Transport-Security header (needs --tls)")
+	cmd.Flags().BoolVar(&passthrough, "passthrough", false, "Route the TLS connections of the domain to the targets by server name, without decrypting them")
+	cmd.Flags().StringArrayVar(&auth, "auth", nil, "Access option as key=value ("+strings.Join(dns.AuthKeys, ", ")+"), repeatable")
+
+	return cmd
+}
+
+// resolveTargets returns the addresses of all the targets, failing if any of
+// them cannot be resolved.
+func resolveTargets(connectionsConfig *types.ConnectionsConfig, targets []types.ForwardTarget) ([]string, error) {
+	addresses, errs := dns.ResolveTargets(connectionsConfig, targets)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return addresses, nil
+}
+
+// printPasswords prints the passwords generated for the basic auth users of
+// the domain, only their hash is kept.
+func printPasswords(domain string, passwords map[string]string, tls bool) {
+	if len(passwords) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(passwords))
+	for name := range passwords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("\nBasic auth passwords of %s, shown only once:\n", domain)
+	for _, name := range names {
+		fmt.Printf("  %s: %s\n", name, passwords[name])
+	}
+
+	if !tls {
+		fmt.Println("Warning: the domain is served over HTTP, the passwords are sent in clear, consider --tls")
+	}
+}
+
+// updateForwards updates the connections config and regenerates the Nginx
+// sites from it. A failed Nginx reload restores the previous sites and
+// leaves the config untouched.
+func updateForwards(update func(connectionsConfig *types.ConnectionsConfig) error) error {
+	tx := system.NewTransaction()
+
+	err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+		if err := update(connectionsConfig); err != nil {
+			return err
+		}
+
+		_, err := dns.ReconcileForwards(tx, connectionsConfig)
+		return err
+	})
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (failed to restore the Nginx sites: %v)", err, rollbackErr)
+		}
+		return err
+	}
+
+	tx.Commit()
+	return nil
 }
@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getForwardPortCommand() *cobra.Command {
+	var protocol string
+
+	cmd := &cobra.Command{
+		Use:   "forward-port [public-port] [server] [port]",
+		Short: "Forward a TCP or UDP port of the tower to a server (tower command)",
+		Long: `Forward the TCP or UDP traffic received on a public port of the tower to a port of a server, for
+services that do not speak HTTP like SSH, databases, game or DNS servers. The server parameter can be
+either a server name or IP address from your connections.
+The traffic goes through an Nginx stream server, which needs the Nginx stream module (installed by
+'upduck install tower'). The servers see the connections coming from the tower.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			publicPort, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid public port: %s", args[0])
+			}
+
+			server := args[1]
+
+			port, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid port: %s", args[2])
+			}
+
+			var address string
+			err = updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				if err := network.CheckPublicPort(connectionsConfig, protocol, publicPort); err != nil {
+					return err
+				}
+
+				forward, err := dns.AddPortForward(connectionsConfig, protocol, publicPort, server, port)
+				if err != nil {
+					return err
+				}
+
+				address, err = dns.ResolveTarget(connectionsConfig, &forward.Target)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("Configuring %s port %d -> %s (via %s)\n", protocol, publicPort, address, server)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Successfully forwarded %s port %d to %s\n", protocol, publicPort, address)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&protocol, "proto", dns.ProtocolTCP, "Protocol to forward (tcp or udp)")
+
+	return cmd
+}
+
+func getRemovePortCommand() *cobra.Command {
+	var protocol string
+
+	cmd := &cobra.Command{
+		Use:   "remove-port <public-port>",
+		Short: "Remove a port forward (tower command)",
+		Long:  `Stop forwarding a TCP or UDP port of the tower and remove its Nginx stream server.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			publicPort, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid public port: %s", args[0])
+			}
+
+			err = updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindPortForward(connectionsConfig, protocol, publicPort)
+				if index == -1 {
+					return fmt.Errorf("%s port %d is not forwarded", protocol, publicPort)
+				}
+
+				connectionsConfig.PortForwards = append(connectionsConfig.PortForwards[:index:index], connectionsConfig.PortForwards[index+1:]...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Port forward of %s port %d removed\n", protocol, publicPort)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&protocol, "proto", dns.ProtocolTCP, "Protocol of the forward (tcp or udp)")
+
+	return cmd
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/certs"
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List DNS forwards (tower command)",
+		Long: `List the domains forwarded by the tower with the targets they are sent to, one line per routed
+path, how the traffic is balanced across them and who can reach them. Targets the upduck service found
+failing are marked down. The TCP and UDP port forwards are listed after them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			if len(connectionsConfig.Forwards) == 0 && len(connectionsConfig.PortForwards) == 0 {
+				fmt.Println("No DNS forwards found.")
+				return nil
+			}
+
+			if len(connectionsConfig.Forwards) > 0 {
+				if err := listForwards(connectionsConfig); err != nil {
+					return err
+				}
+			}
+
+			if len(connectionsConfig.PortForwards) > 0 {
+				if len(connectionsConfig.Forwards) > 0 {
+					fmt.Println()
+				}
+				return listPortForwards(connectionsConfig)
+			}
+
+			return nil
+		},
+	}
+}
+
+func listForwards(connectionsConfig *types.ConnectionsConfig) error {
+	forwards := connectionsConfig.Forwards
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].Domain < forwards[j].Domain
+	})
+
+	health, err := dns.LoadHealth()
+	if err != nil {
+		fmt.Printf("Warning: Failed to load the health of the targets: %v\n", err)
+		health = dns.Health{}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "DOMAIN\tPATH\tTARGETS\tSTRATEGY\tOPTIONS\tCREATED\tTLS\tACCESS")
+
+	for _, forward := range forwards {
+		access := strings.Join(dns.AuthOptions(&forward), ", ")
+		if access == "" {
+			access = "-"
+		}
+
+		for _, route := range forward.Routes {
+			options := strings.Join(dns.RouteOptions(&route), ", ")
+			if options == "" {
+				options = "-"
+			}
+
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				forward.Domain,
+				route.Path,
+				describeTargets(connectionsConfig, route.Targets, health),
+				dns.Strategy(&route),
+				options,
+				forward.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+				tlsStatus(&forward),
+				access,
+			)
+		}
+	}
+
+	return writer.Flush()
+}
+
+func listPortForwards(connectionsConfig *types.ConnectionsConfig) error {
+	forwards := connectionsConfig.PortForwards
+	sort.Slice(forwards, func(i, j int) bool {
+		if forwards[i].PublicPort != forwards[j].PublicPort {
+			return forwards[i].PublicPort < forwards[j].PublicPort
+		}
+		return forwards[i].Protocol < forwards[j].Protocol
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PROTO\tPUBLIC PORT\tTARGET\tADDRESS\tCREATED")
+
+	for _, forward := range forwards {
+		address, err := dns.ResolveTarget(connectionsConfig, &forward.Target)
+		if err != nil {
+			address = "not found"
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\n",
+			forward.Protocol,
+			forward.PublicPort,
+			dns.Target(&forward.Target),
+			address,
+			forward.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+		)
+	}
+
+	return writer.Flush()
+}
+
+// describeTargets lists the targets with the address they resolve to and
+// whether they are down.
+func describeTargets(connectionsConfig *types.ConnectionsConfig, targets []types.ForwardTarget, health dns.Health) string {
+	descriptions := make([]string, 0, len(targets))
+
+	for _, target := range targets {
+		address, err := dns.ResolveTarget(connectionsConfig, &target)
+		switch {
+		case err != nil:
+			descriptions = append(descriptions, fmt.Sprintf("%s (not found)", dns.Target(&target)))
+		case health.Down(address):
+			descriptions = append(descriptions, fmt.Sprintf("%s (%s, down)", dns.Target(&target), address))
+		case target.PeerID != "":
+			descriptions = append(descriptions, fmt.Sprintf("%s (%s)", dns.Target(&target), address))
+		default:
+			descriptions = append(descriptions, address)
+		}
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+// tlsStatus describes the certificate of a TLS forward, as maintained by the
+// upduck service.
+func tlsStatus(forward *types.Forward) string {
+	if forward.Passthrough {
+		return "passthrough"
+	}
+
+	if !forward.TLS {
+		return "-"
+	}
+
+	status, err := certs.LoadStatus(forward.Domain)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+
+	summary := status.Summary(time.Now())
+	if forward.HSTS {
+		summary += " (HSTS)"
+	}
+
+	return summary
+}
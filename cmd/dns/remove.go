@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <domain>",
+		Short: "Remove a DNS forward (tower command)",
+		Long:  `Stop forwarding a domain and remove its Nginx configuration.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+
+			err := updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindForward(connectionsConfig, domain)
+				if index == -1 {
+					return fmt.Errorf("forward %s not found", domain)
+				}
+
+				connectionsConfig.Forwards = append(connectionsConfig.Forwards[:index:index], connectionsConfig.Forwards[index+1:]...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ DNS forward %s removed\n", domain)
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,284 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getRouteCommand() *cobra.Command {
+	routeCmd := &cobra.Command{
+		Use:   "route",
+		Short: "Path routing commands (tower command)",
+		Long: `Send the requests under a path of a forwarded domain to other targets, like /api to peerB:8080
+while the rest of the domain goes to peerA:3000. All the routes of a domain are served by its Nginx site,
+the longest matching path wins.`,
+	}
+
+	routeCmd.AddCommand(getRouteAddCommand())
+	routeCmd.AddCommand(getRouteUpdateCommand())
+	routeCmd.AddCommand(getRouteRemoveCommand())
+
+	return routeCmd
+}
+
+// routeOptions are the flags of the options of a route, shared by route add
+// and route update. Only the flags given are applied.
+type routeOptions struct {
+	stripPrefix    bool
+	headers        []string
+	maxBodySize    string
+	connectTimeout string
+	timeout        string
+}
+
+func (o *routeOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&o.stripPrefix, "strip-prefix", false, "Remove the path from the requests sent to the targets, /api/users reaching them as /users")
+	cmd.Flags().StringArrayVar(&o.headers, "header", nil, "Header to set on the requests sent to the targets as Name=Value, repeatable, an empty value removes the header")
+	cmd.Flags().StringVar(&o.maxBodySize, "max-body-size", "", "Largest request body accepted, like 10m (Nginx client_max_body_size)")
+	cmd.Flags().StringVar(&o.connectTimeout, "connect-timeout", "", "Time to wait for a target to accept the connection, like 3s (default 5s)")
+	cmd.Flags().StringVar(&o.timeout, "timeout", "", "Time to wait between two reads or writes of a response, like 120s (default 60s)")
+}
+
+func (o *routeOptions) apply(cmd *cobra.Command, route *types.ForwardRoute) error {
+	if cmd.Flags().Changed("strip-prefix") {
+		if err := dns.SetStripPrefix(route, o.stripPrefix); err != nil {
+			return err
+		}
+	}
+
+	for _, header := range o.headers {
+		name, value, err := dns.ParseHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if err := dns.SetHeader(route, name, value); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Flags().Changed("max-body-size") {
+		if err := dns.SetMaxBodySize(route, o.maxBodySize); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Flags().Changed("connect-timeout") {
+		if err := dns.SetConnectTimeout(route, o.connectTimeout); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Flags().Changed("timeout") {
+		if err := dns.SetTimeout(route, o.timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getRouteAddCommand() *cobra.Command {
+	var strategy string
+	var options routeOptions
+
+	cmd := &cobra.Command{
+		Use:   "add <domain> <path> <server:port>...",
+		Short: "Route a path of a domain to servers",
+		Long: `Send the requests under a path of a domain to one or more targets, each a server name or IP address
+from your connections and a port, like peerB:8080. The domain is forwarded if it was not already,
+requests matching none of its routes then get a 404.
+The path matches itself and what is below it: /api matches /api/users but not /apis.`,
+		Args: cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+			targets := args[2:]
+
+			var routePath string
+			var addresses []string
+			err := updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindForward(connectionsConfig, domain)
+
+				forward := &types.Forward{Domain: domain, CreatedAt: time.Now().UTC()}
+				if index != -1 {
+					forward = &connectionsConfig.Forwards[index]
+				} else if err := dns.CheckDomain(domain); err != nil {
+					return err
+				}
+
+				route, err := dns.AddRoute(connectionsConfig, forward, args[1], targets, strategy)
+				if err != nil {
+					return err
+				}
+				routePath = route.Path
+
+				if err := options.apply(cmd, route); err != nil {
+					return err
+				}
+
+				addresses, err = resolveTargets(connectionsConfig, route.Targets)
+				if err != nil {
+					return err
+				}
+
+				if index == -1 {
+					connectionsConfig.Forwards = append(connectionsConfig.Forwards, *forward)
+				}
+
+				fmt.Printf("Configuring route %s of %s -> %s (via %s)\n", routePath, domain, strings.Join(addresses, ", "), strings.Join(targets, ", "))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Route %s of %s now forwards to %s\n", routePath, domain, strings.Join(addresses, ", "))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&strategy, "strategy", dns.StrategyRoundRobin, "Load balancing strategy across the targets ("+strings.Join(dns.Strategies, ", ")+")")
+	options.addFlags(cmd)
+
+	return cmd
+}
+
+func getRouteUpdateCommand() *cobra.Command {
+	var targets []string
+	var strategy string
+	var removeHeaders []string
+	var options routeOptions
+
+	cmd := &cobra.Command{
+		Use:   "update <domain> <path>",
+		Short: "Change a route of a domain",
+		Long: `Point a route to other targets with --target, repeated for each server:port to balance across,
+change how the traffic is balanced with --strategy, and its options. --strip-prefix=false keeps the
+path again, --remove-header goes back to the header upduck sets by default, and an empty
+--max-body-size, --connect-timeout or --timeout to the default of Nginx.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+
+			if cmd.Flags().NFlag() == 0 {
+				return fmt.Errorf("nothing to update, use --target, --strategy, --strip-prefix, --header, --remove-header, --max-body-size, --connect-timeout or --timeout")
+			}
+
+			routePath, err := dns.NormalizePath(args[1])
+			if err != nil {
+				return err
+			}
+
+			var addresses []string
+			err = updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindForward(connectionsConfig, domain)
+				if index == -1 {
+					return fmt.Errorf("forward %s not found", domain)
+				}
+				forward := &connectionsConfig.Forwards[index]
+
+				route := dns.FindRoute(forward, routePath)
+				if route == nil {
+					return fmt.Errorf("route %s of %s not found", routePath, domain)
+				}
+
+				if forward.Passthrough {
+					return fmt.Errorf("forward %s is a passthrough forward, use 'upduck dns update' to change its targets", domain)
+				}
+
+				if cmd.Flags().Changed("target") {
+					if err := dns.SetTargets(connectionsConfig, route, targets); err != nil {
+						return err
+					}
+				}
+
+				if cmd.Flags().Changed("strategy") {
+					if err := dns.SetStrategy(route, strategy); err != nil {
+						return err
+					}
+				}
+
+				for _, name := range removeHeaders {
+					if err := dns.RemoveHeader(route, name); err != nil {
+						return err
+					}
+				}
+
+				if err := options.apply(cmd, route); err != nil {
+					return err
+				}
+
+				addresses, err = resolveTargets(connectionsConfig, route.Targets)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Route %s of %s now forwards to %s\n", routePath, domain, strings.Join(addresses, ", "))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&targets, "target", nil, "Target to forward to as server:port, repeat it to balance across several")
+	cmd.Flags().StringVar(&strategy, "strategy", "", "Load balancing strategy across the targets ("+strings.Join(dns.Strategies, ", ")+")")
+	cmd.Flags().StringArrayVar(&removeHeaders, "remove-header", nil, "Header to stop setting, repeatable")
+	options.addFlags(cmd)
+
+	return cmd
+}
+
+func getRouteRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <domain> <path>",
+		Short: "Remove a route of a domain",
+		Long:  `Stop routing a path of a domain. Removing the last route of a domain removes its forward.`,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+
+			routePath, err := dns.NormalizePath(args[1])
+			if err != nil {
+				return err
+			}
+
+			forwardRemoved := false
+			err = updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindForward(connectionsConfig, domain)
+				if index == -1 {
+					return fmt.Errorf("forward %s not found", domain)
+				}
+				forward := &connectionsConfig.Forwards[index]
+
+				if err := dns.RemoveRoute(forward, routePath); err != nil {
+					return err
+				}
+
+				if len(forward.Routes) == 0 {
+					connectionsConfig.Forwards = append(connectionsConfig.Forwards[:index:index], connectionsConfig.Forwards[index+1:]...)
+					forwardRemoved = true
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Route %s of %s removed\n", routePath, domain)
+			if forwardRemoved {
+				fmt.Printf("It was the last route, DNS forward %s removed\n", domain)
+			}
+
+			return nil
+		},
+	}
+}
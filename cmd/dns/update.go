@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getUpdateCommand() *cobra.Command {
+	var targets []string
+	var strategy string
+	var server string
+	var port int
+	var tls bool
+	var hsts bool
+	var passthrough bool
+	var auth []string
+	var authRemove []string
+
+	cmd := &cobra.Command{
+		Use:   "update <domain>",
+		Short: "Change the targets of a DNS forward (tower command)",
+		Long: `Point an existing DNS forward to other targets with --target, repeated for each server:port to
+balance across, change how the traffic is balanced with --strategy, turn HTTPS on or off with --tls
+and --hsts, and TLS passthrough with --passthrough. Forwards to a single target can also change its
+server, a server name or IP address from your connections, with --server and its port with --port.
+The targets are the ones of the / route, the other routes are changed with 'upduck dns route update'.
+--auth adds access options as 'upduck dns forward' does, a user given again gets a new password.
+--auth-remove takes them out, as key=value or a key alone to clear it, like allow or forward-auth,
+and all removes the whole access policy.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain := args[0]
+
+			changed := func(names ...string) bool {
+				for _, name := range names {
+					if cmd.Flags().Changed(name) {
+						return true
+					}
+				}
+				return false
+			}
+
+			if !changed("target", "strategy", "server", "port", "tls", "hsts", "passthrough", "auth", "auth-remove") {
+				return fmt.Errorf("nothing to update, use --target, --strategy, --server, --port, --tls, --hsts, --passthrough, --auth or --auth-remove")
+			}
+
+			if changed("target") && changed("server", "port") {
+				return fmt.Errorf("--target cannot be combined with --server or --port")
+			}
+
+			var addresses []string
+			var passwords map[string]string
+			var servedTLS bool
+			err := updateForwards(func(connectionsConfig *types.ConnectionsConfig) error {
+				index := dns.FindForward(connectionsConfig, domain)
+				if index == -1 {
+					return fmt.Errorf("forward %s not found", domain)
+				}
+				forward := &connectionsConfig.Forwards[index]
+
+				route := dns.FindRoute(forward, "/")
+				if route == nil && changed("target", "strategy", "server", "port") {
+					return fmt.Errorf("forward %s has no route of /, use 'upduck dns route' to change its routes", domain)
+				}
+
+				if changed("target") {
+					if err := dns.SetTargets(connectionsConfig, route, targets); err != nil {
+						return err
+					}
+				}
+
+				if changed("server", "port") && len(route.Targets) != 1 {
+					return fmt.Errorf("forward %s has %d targets, use --target", domain, len(route.Targets))
+				}
+
+				if changed("server") {
+					if err := dns.SetServer(connectionsConfig, &route.Targets[0], server); err != nil {
+						return err
+					}
+				}
+
+				if changed("port") {
+					if err := dns.SetPort(&route.Targets[0], port); err != nil {
+						return err
+					}
+				}
+
+				if changed("strategy") {
+					if err := dns.SetStrategy(route, strategy); err != nil {
+						return err
+					}
+				}
+
+				// passthrough is turned off before TLS and the access policy
+				// are turned on and on after they are turned off, so they can
+				// all change at once
+				if changed("passthrough") && !passthrough {
+					if err := dns.SetPassthrough(forward, false); err != nil {
+						return err
+					}
+				}
+
+				if changed("auth", "auth-remove") {
+					var err error
+					passwords, err = dns.ApplyAuth(forward, auth, authRemove)
+					if err != nil {
+						return err
+					}
+				}
+
+				if changed("tls", "hsts") {
+					newTLS, newHSTS := forward.TLS, forward.HSTS
+					if cmd.Flags().Changed("tls") {
+						newTLS = tls
+						newHSTS = newHSTS && tls
+					}
+					if cmd.Flags().Changed("hsts") {
+						newHSTS = hsts
+					}
+
+					if err := dns.SetTLS(forward, newTLS, newHSTS); err != nil {
+						return err
+					}
+				}
+
+				if changed("passthrough") && passthrough {
+					if err := dns.SetPassthrough(forward, true); err != nil {
+						return err
+					}
+				}
+
+				servedTLS = forward.TLS
+
+				var err error
+				addresses, err = resolveTargets(connectionsConfig, dns.AllTargets(forward))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Domain %s now forwards to %s\n", domain, strings.Join(addresses, ", "))
+			printPasswords(domain, passwords, servedTLS)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&targets, "target", nil, "Target to forward to as server:port, repeat it to balance across several")
+	cmd.Flags().StringVar(&strategy, "strategy", "", "Load balancing strategy across the targets ("+strings.Join(dns.Strategies, ", ")+")")
+	cmd.Flags().StringVar(&server, "server", "", "Server name or IP address to forward to, for forwards to a single target")
+	cmd.Flags().IntVar(&port, "port", 0, "Port to forward to, for forwards to a single target")
+	cmd.Flags().BoolVar(&tls, "tls", false, "Serve the domain over HTTPS with a certificate obtained through ACME (--tls=false turns it off)")
+	cmd.Flags().BoolVar(&hsts, "hsts", false, "Send the Strict-Transport-Security header (needs TLS)")
+	cmd.Flags().BoolVar(&passthrough, "passthrough", false, "Route the TLS connections to the targets without decrypting them (--passthrough=false turns it off)")
+	cmd.Flags().StringArrayVar(&auth, "auth", nil, "Access option to add as key=value ("+strings.Join(dns.AuthKeys, ", ")+"), repeatable")
+	cmd.Flags().StringArrayVar(&authRemove, "auth-remove", nil, "Access option to remove as key=value, a key alone or all, repeatable")
+
+	return cmd
+}
@@ -10,10 +10,16 @@ import (
 	"github.com/duck-labs/upduck/pkg/crypto"
 	"github.com/duck-labs/upduck/pkg/network"
 	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
 )
 
 func getInstallCommand() *cobra.Command {
-	return &cobra.Command{
+	var wgPortRange string
+	var stateBackend string
+	var acmeDirectory string
+	var acmeEmail string
+
+	cmd := &cobra.Command{
 		Use:   "install [server|tower]",
 		Short: "Install and configure upduck as server or tower",
 		Long: `Install and configure upduck as either a server or tower node.
@@ -28,9 +34,17 @@ This command will:
 				return fmt.Errorf("invalid node type: %s (must be 'server' or 'tower')", nodeType)
 			}
 
+			if _, _, err := network.ParsePortRange(wgPortRange); err != nil {
+				return err
+			}
+
+			if _, err := config.NewStore(stateBackend); err != nil {
+				return err
+			}
+
 			fmt.Printf("Installing upduck as %s...\n", nodeType)
 
-			if os.Geteuid() != 0 {
+			if os.Geteuid() != 0 && !system.DryRun() {
 				return fmt.Errorf("this command must be run as root (use sudo)")
 			}
 
@@ -70,7 +84,25 @@ This command will:
 				fmt.Println("RSA keys already exist")
 			}
 
-			err = config.WriteNodeConfig(nodeType)
+			_, err = crypto.LoadTLSCertificate()
+			if err != nil {
+				fmt.Println("Generating TLS certificate...")
+				certificate, err := crypto.GenerateTLSCertificate()
+				if err != nil {
+					return fmt.Errorf("failed to generate TLS certificate: %w", err)
+				}
+				fmt.Printf("TLS certificate generated and saved to [%s], fingerprint: %s\n", config.TLSCertificate, crypto.GetCertificateFingerprint(certificate.Certificate[0]))
+			} else {
+				fmt.Println("TLS certificate already exists")
+			}
+
+			err = config.WriteNodeConfig(&types.NodeConfig{
+				Type:          nodeType,
+				WGPortRange:   wgPortRange,
+				StateBackend:  stateBackend,
+				ACMEDirectory: acmeDirectory,
+				ACMEEmail:     acmeEmail,
+			})
 			if err != nil {
 				return fmt.Errorf("failed to write config file: %w", err)
 			}
@@ -94,7 +126,10 @@ This command will:
 				}
 			}
 
-			if err := createSystemdService(nodeType); err != nil {
+			err = system.WithTransaction(func(tx *system.Transaction) error {
+				return createSystemdService(tx, nodeType)
+			})
+			if err != nil {
 				return fmt.Errorf("failed to create systemd service: %w", err)
 			}
 
@@ -104,9 +139,18 @@ This command will:
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&wgPortRange, "wg-port-range", network.DefaultPortRange, "Port range for the WireGuard listen ports of tower networks")
+	cmd.Flags().StringVar(&stateBackend, "state-backend", config.StateBackendJSON, "Where the networks state is stored: 'json' files or an embedded 'bolt' database")
+	cmd.Flags().StringVar(&acmeDirectory, "acme-directory", "", "ACME directory TLS forwards get their certificates from (tower only, defaults to Let's Encrypt)")
+	cmd.Flags().StringVar(&acmeEmail, "acme-email", "", "Contact email of the ACME account (tower only)")
+
+	return cmd
 }
 
-func createSystemdService(nodeType string) error {
+// createSystemdService writes, enables and starts the upduck unit. Rolling
+// the transaction back restores the previous unit and its state.
+func createSystemdService(tx *system.Transaction, nodeType string) error {
 	execPath, err := os.Executable()
 	if err != nil {
 		return err
@@ -128,19 +172,19 @@ WantedBy=multi-user.target
 `, nodeType, execPath)
 
 	serviceFile := "/etc/systemd/system/upduck.service"
-	if err := os.WriteFile(serviceFile, []byte(serviceContent), 0644); err != nil {
+	if err := tx.WriteFile(serviceFile, []byte(serviceContent), 0644); err != nil {
 		return err
 	}
 
-	if err := system.RunCommand("systemctl", "daemon-reload"); err != nil {
+	if err := tx.DaemonReload(); err != nil {
 		return err
 	}
 
-	if err := system.RunCommand("systemctl", "enable", "upduck"); err != nil {
+	if err := tx.Systemctl("enable", "upduck"); err != nil {
 		return err
 	}
 
-	if err := system.RunCommand("systemctl", "start", "upduck"); err != nil {
+	if err := tx.Systemctl("start", "upduck"); err != nil {
 		return err
 	}
 
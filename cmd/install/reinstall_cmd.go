@@ -18,7 +18,7 @@ func GetReinstallCommand() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fmt.Println("Recreating upduck systemd service...")
 
-			if os.Geteuid() != 0 {
+			if os.Geteuid() != 0 && !system.DryRun() {
 				return fmt.Errorf("this command must be run as root (use sudo)")
 			}
 
@@ -31,10 +31,14 @@ func GetReinstallCommand() *cobra.Command {
 				return fmt.Errorf("node type not configured - run 'upduck install [server|tower]' first")
 			}
 
-			fmt.Println("Stopping existing service...")
-			system.RunCommand("systemctl", "stop", "upduck")
+			// the previous service is started again if the new one fails
+			err = system.WithTransaction(func(tx *system.Transaction) error {
+				fmt.Println("Stopping existing service...")
+				tx.Systemctl("stop", "upduck")
 
-			if err := createSystemdService(nodeConfig.Type); err != nil {
+				return createSystemdService(tx, nodeConfig.Type)
+			})
+			if err != nil {
 				return fmt.Errorf("failed to recreate systemd service: %w", err)
 			}
 
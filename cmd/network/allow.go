@@ -2,42 +2,86 @@ package network
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
 )
 
 func getAllowCommand() *cobra.Command {
-	return &cobra.Command{
+	var networkID string
+	var maxPeers int
+	var expires string
+
+	cmd := &cobra.Command{
 		Use:   "allow [server-pub-key]",
 		Short: "Allow a server to connect (tower command)",
-		Long:  `Add a server's public key to the list of allowed servers that can connect to this tower.`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Allow a server's public key digest to connect to a network of this tower.
+The authorization can be limited to a number of peers and can expire at a given date.`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			serverPubKeyDigest := args[0]
 
-			connectionsConfig, err := config.LoadConnectionsConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load connections config: %w", err)
+			if maxPeers < 0 {
+				return fmt.Errorf("--max-peers must be 0 (unlimited) or more")
 			}
 
-			for _, allowedKey := range connectionsConfig.AllowedKeys {
-				if allowedKey == serverPubKeyDigest {
-					fmt.Printf("Server public key %s is already allowed\n", serverPubKeyDigest)
-					return nil
+			var expiresAt time.Time
+			if expires != "" {
+				var err error
+				expiresAt, err = parseExpiry(expires)
+				if err != nil {
+					return err
 				}
 			}
 
-			connectionsConfig.AllowedKeys = append(connectionsConfig.AllowedKeys, serverPubKeyDigest)
+			authorization := types.KeyAuthorization{
+				KeyDigest: serverPubKeyDigest,
+				MaxPeers:  maxPeers,
+				ExpiresAt: expiresAt,
+			}
+
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, networkID)
+				if err != nil {
+					return err
+				}
+
+				authorization.NetworkID = connectionsConfig.Networks[networkIndex].ID
+				network.AllowKey(connectionsConfig, authorization)
 
-			if err := config.SaveConnectionsConfig(connectionsConfig); err != nil {
-				return fmt.Errorf("failed to save connections config: %w", err)
+				return nil
+			})
+			if err != nil {
+				return err
 			}
 
-			fmt.Printf("✅ Successfully allowed server with public key digest: %s\n", serverPubKeyDigest)
+			fmt.Printf("✅ Successfully allowed server with public key digest %s on network %s\n", serverPubKeyDigest, authorization.NetworkID)
 
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&networkID, "network", "", "Network the server is allowed to join")
+	cmd.Flags().IntVar(&maxPeers, "max-peers", 0, "Maximum number of peers the key can add to the network (0 for unlimited)")
+	cmd.Flags().StringVar(&expires, "expires", "", "Date the authorization expires (YYYY-MM-DD or RFC3339)")
+	cmd.MarkFlagRequired("network")
+
+	return cmd
+}
+
+func parseExpiry(value string) (time.Time, error) {
+	if expiresAt, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiresAt.UTC(), nil
+	}
+
+	expiresAt, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %s, expected YYYY-MM-DD or RFC3339", value)
+	}
+
+	return expiresAt.UTC(), nil
 }
@@ -1,116 +1,240 @@
 package network
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/duck-labs/upduck/pkg/api"
 	"github.com/duck-labs/upduck/pkg/config"
 	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/system"
 	"github.com/duck-labs/upduck/pkg/types"
 )
 
+const (
+	defaultJoinWait  = 10 * time.Minute
+	joinPollInterval = 5 * time.Second
+)
+
 func getConnectCommand() *cobra.Command {
-	return &cobra.Command{
+	var towerKeyDigest string
+	var towerFingerprint string
+	var wait time.Duration
+
+	cmd := &cobra.Command{
 		Use:   "connect <tower-dns> <network-id>",
 		Short: "Connect to a tower (server command)",
-		Long:  `Connect this server to a tower node. The tower must have allowed this server's public key first.`,
-		Args:  cobra.ExactArgs(2),
+		Long: `Connect this server to a tower node. If the tower has not allowed this server's public key yet, a join
+request is queued on the tower and the command waits until it is approved or rejected.
+Requests are signed with this server's RSA key and encrypted for the tower's RSA key, which can be
+checked against the digest shown by 'upduck network connections' on the tower with --tower-key-digest.
+The tower API is served over HTTPS with a self-signed certificate pinned by its fingerprint, given with
+--tower-fingerprint or trusted on first use and stored in connections.json. The tower address defaults to
+the port of the upduck daemon, 8080, when it has none.`,
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			towerAddress := args[0]
-			networkID := args[1]
+			return connectToTower(args[0], args[1], towerKeyDigest, towerFingerprint, "", wait)
+		},
+	}
 
-			wgConfig, err := config.LoadWireguardConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load WireGuard config: %w", err)
-			}
+	cmd.Flags().StringVar(&towerKeyDigest, "tower-key-digest", "", "Expected digest of the tower public key")
+	cmd.Flags().StringVar(&towerFingerprint, "tower-fingerprint", "", "Expected fingerprint of the tower TLS certificate")
+	cmd.Flags().DurationVar(&wait, "wait", defaultJoinWait, "How long to wait for the tower to approve this server (0 to not wait)")
 
-			rsaConfig, err := crypto.LoadRSAKeys()
-			if err != nil {
-				return fmt.Errorf("failed to load RSA config: %w", err)
-			}
+	return cmd
+}
 
-			request := types.ConnectRequest{
-				PublicKey:   rsaConfig.PublicKey,
-				WGPublicKey: wgConfig.PublicKey,
-			}
+// connectToTower runs the connect handshake against the tower and stores the
+// resulting network. The join token is optional when the tower already
+// allowed this server's key, otherwise the tower queues a join request and
+// the handshake is retried until it is decided or the wait time runs out.
+func connectToTower(towerAddress, networkID, towerKeyDigest, towerFingerprint, joinToken string, wait time.Duration) error {
+	towerAddress, err := api.NormalizeTowerAddress(towerAddress)
+	if err != nil {
+		return err
+	}
 
-			requestData, err := json.Marshal(request)
-			if err != nil {
-				return fmt.Errorf("failed to marshal request: %w", err)
-			}
+	wgConfig, err := config.LoadWireguardConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load WireGuard config: %w", err)
+	}
 
-			towerURL, err := url.Parse(towerAddress)
-			if err != nil {
-				return fmt.Errorf("failed to parse tower URL: %w", err)
-			}
+	rsaConfig, err := crypto.LoadRSAKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load RSA config: %w", err)
+	}
 
-			apiURL := fmt.Sprintf("%s/api/servers/network/%s/connect", towerAddress, networkID)
-			fmt.Printf("Connecting to tower at %s...\n", apiURL)
+	hostname, _ := os.Hostname()
 
-			resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(requestData))
-			if err != nil {
-				return fmt.Errorf("failed to connect to tower: %w", err)
-			}
-			defer resp.Body.Close()
+	request := types.ConnectRequest{
+		PublicKey:   rsaConfig.PublicKey,
+		WGPublicKey: wgConfig.PublicKey,
+		JoinToken:   joinToken,
+		Hostname:    hostname,
+	}
 
-			if resp.StatusCode == http.StatusConflict {
-				return fmt.Errorf("conflict: server already connected to this tower")
-			}
+	towerURL, err := url.Parse(towerAddress)
+	if err != nil {
+		return fmt.Errorf("failed to parse tower URL: %w", err)
+	}
 
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("tower responded with status %d", resp.StatusCode)
-			}
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load connections config: %w", err)
+	}
 
-			var response types.ConnectResponse
-			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-				return fmt.Errorf("failed to decode response: %w", err)
-			}
+	towerFingerprint, err = resolveTowerFingerprint(connectionsConfig, towerAddress, towerFingerprint)
+	if err != nil {
+		return err
+	}
 
-			connectionsConfig, err := config.LoadConnectionsConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load connections config: %w", err)
-			}
+	towerKey, err := api.FetchTowerKey(towerAddress, towerFingerprint, towerKeyDigest)
+	if err != nil {
+		return fmt.Errorf("failed to get tower key: %w", err)
+	}
+	fmt.Printf("Tower key digest: %s\n", crypto.GetPublicKeyDigest(towerKey))
 
-			peer := types.Peer{
-				ID:        response.PeerID,
-				PublicKey: response.WGPublicKey,
-				Address:   response.WGNetworkBlock,
-				Endpoint:  towerURL.Hostname(),
-			}
+	apiPath := fmt.Sprintf("/api/servers/network/%s/connect", networkID)
+	fmt.Printf("Connecting to tower at %s%s...\n", towerAddress, apiPath)
 
-			var existingNetworkIndex = -1
-			for i, network := range connectionsConfig.Networks {
-				if network.ID == response.NetworkID {
-					existingNetworkIndex = i
-					break
-				}
-			}
+	// the request changes the tower state, a dry run stops before it
+	if system.DryRun() {
+		return system.Do(fmt.Sprintf("send the connect request to %s%s", towerAddress, apiPath), nil)
+	}
 
-			if existingNetworkIndex >= 0 {
-				connectionsConfig.Networks[existingNetworkIndex].Peers = append(connectionsConfig.Networks[existingNetworkIndex].Peers, peer)
-			} else {
-				network := types.Network{
-					ID:      response.NetworkID,
-					Address: response.WGAddress,
-					Peers:   []types.Peer{peer},
-				}
-				connectionsConfig.Networks = append(connectionsConfig.Networks, network)
+	var response types.ConnectResponse
+	client := api.NewTowerClient(towerAddress, towerFingerprint, towerKey, rsaConfig)
+	deadline := time.Now().Add(wait)
+	waiting := false
+
+	for {
+		err := client.Call(http.MethodPost, apiPath, request, &response)
+		if err == nil {
+			break
+		}
+
+		var statusErr *api.StatusError
+		if !errors.As(err, &statusErr) {
+			return fmt.Errorf("failed to connect to tower: %w", err)
+		}
+
+		switch statusErr.StatusCode {
+		case http.StatusConflict:
+			return fmt.Errorf("conflict: server already connected to this tower")
+		case http.StatusForbidden:
+			return fmt.Errorf("the tower refused this server: %s", statusErr.Message)
+		case http.StatusAccepted:
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s, run the command again once it is approved", statusErr.Message)
 			}
-
-			if err := config.SaveConnectionsConfig(connectionsConfig); err != nil {
-				return fmt.Errorf("failed to save connections config: %w", err)
+			if !waiting {
+				fmt.Printf("⏳ %s, waiting for a decision on the tower ('upduck network pending')...\n", statusErr.Message)
+				waiting = true
 			}
+			time.Sleep(joinPollInterval)
+		default:
+			return fmt.Errorf("failed to connect to tower: %w", err)
+		}
+	}
 
-			fmt.Printf("✅ Successfully connected to tower %s\n", towerAddress)
-			fmt.Printf("Network block: %s\n", response.WGNetworkBlock)
-			fmt.Printf("This node address: %s\n", response.WGAddress)
+	if response.PublicKey != towerKey {
+		return fmt.Errorf("tower answered with a different key than the one it advertised")
+	}
+
+	peer := types.Peer{
+		ID:           response.PeerID,
+		PublicKey:    response.WGPublicKey,
+		Address:      response.WGNetworkBlock,
+		Endpoint:     towerURL.Hostname(),
+		EndpointPort: response.WGPort,
+	}
 
+	refreshed := false
+	err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+		// connecting again to the same tower refreshes the address of this node
+		if network.ApplyServerAddress(connectionsConfig, &response) {
+			refreshed = true
 			return nil
-		},
+		}
+
+		var existingNetworkIndex = -1
+		for i, netw := range connectionsConfig.Networks {
+			if netw.ID == response.NetworkID {
+				existingNetworkIndex = i
+				break
+			}
+		}
+
+		if existingNetworkIndex >= 0 {
+			connectionsConfig.Networks[existingNetworkIndex].Peers = append(connectionsConfig.Networks[existingNetworkIndex].Peers, peer)
+		} else {
+			newNetwork := types.Network{
+				ID:               response.NetworkID,
+				Address:          response.WGAddress,
+				Peers:            []types.Peer{peer},
+				Interface:        network.GenerateInterfaceName("server", response.NetworkID),
+				TowerAddress:     towerAddress,
+				TowerKey:         towerKey,
+				TowerFingerprint: towerFingerprint,
+			}
+			connectionsConfig.Networks = append(connectionsConfig.Networks, newNetwork)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	if refreshed {
+		fmt.Printf("✅ Already connected to tower %s, address refreshed\n", towerAddress)
+		fmt.Printf("This node address: %s\n", response.WGAddress)
+		return nil
+	}
+
+	fmt.Printf("✅ Successfully connected to tower %s\n", towerAddress)
+	fmt.Printf("Network block: %s\n", response.WGNetworkBlock)
+	fmt.Printf("This node address: %s\n", response.WGAddress)
+
+	return nil
+}
+
+// resolveTowerFingerprint returns the certificate fingerprint to pin for the
+// tower. A fingerprint stored by a previous connection to the same tower wins
+// and must match the given one. Without either, the fingerprint presented by
+// the tower is trusted on first use.
+func resolveTowerFingerprint(connectionsConfig *types.ConnectionsConfig, towerAddress, fingerprint string) (string, error) {
+	for _, netw := range connectionsConfig.Networks {
+		if netw.TowerAddress != towerAddress || netw.TowerFingerprint == "" {
+			continue
+		}
+
+		if fingerprint != "" && !strings.EqualFold(fingerprint, netw.TowerFingerprint) {
+			return "", fmt.Errorf("tower %s is pinned to certificate fingerprint %s (network %s), not %s", towerAddress, netw.TowerFingerprint, netw.ID, fingerprint)
+		}
+
+		return netw.TowerFingerprint, nil
+	}
+
+	if fingerprint != "" {
+		return strings.ToLower(fingerprint), nil
+	}
+
+	fingerprint, err := api.FetchTowerFingerprint(towerAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tower certificate: %w", err)
+	}
+
+	fmt.Printf("⚠️  Trusting tower certificate fingerprint %s on first use\n", fingerprint)
+	fmt.Printf("   Compare it with the one logged by the upduck service on the tower or pass it with --tower-fingerprint\n")
+
+	return fingerprint, nil
 }
@@ -27,6 +27,9 @@ func getConnectionsCommand() *cobra.Command {
 
 			fmt.Println("=== UpDuck Node Information ===")
 			fmt.Printf("Public Key Digest: %s\n", crypto.GetPublicKeyDigest(rsaConfig.PublicKey))
+			if tlsFingerprint, err := crypto.LoadTLSFingerprint(); err == nil {
+				fmt.Printf("TLS Certificate Fingerprint: %s\n", tlsFingerprint)
+			}
 			fmt.Println()
 
 			if len(connectionsConfig.Networks) > 0 {
@@ -34,12 +37,31 @@ func getConnectionsCommand() *cobra.Command {
 				for i, net := range connectionsConfig.Networks {
 					fmt.Printf("Network %d:\n", i+1)
 					fmt.Printf("   ID: %s\n", net.ID)
+					if net.Name != "" {
+						fmt.Printf("   Name: %s\n", net.Name)
+					}
 					fmt.Printf("   Address: %s\n", net.Address)
+					if net.TowerAddress != "" {
+						fmt.Printf("   Tower: %s\n", net.TowerAddress)
+					}
+					if net.TowerFingerprint != "" {
+						fmt.Printf("   Tower Fingerprint: %s\n", net.TowerFingerprint)
+					}
 					fmt.Printf("   Peers: %d\n", len(net.Peers))
+					staticLeases := make(map[string]bool)
+					for _, lease := range net.Leases {
+						if lease.Static {
+							staticLeases[lease.PeerID] = true
+						}
+					}
 					for j, peer := range net.Peers {
 						fmt.Printf("   Peer %d:\n", j+1)
 						fmt.Printf("      ID: %s\n", peer.ID)
-						fmt.Printf("      Address: %s\n", peer.Address)
+						if staticLeases[peer.ID] {
+							fmt.Printf("      Address: %s (static)\n", peer.Address)
+						} else {
+							fmt.Printf("      Address: %s\n", peer.Address)
+						}
 						if peer.Endpoint != "" {
 							fmt.Printf("      Endpoint: %s\n", peer.Endpoint)
 						}
@@ -50,10 +72,17 @@ func getConnectionsCommand() *cobra.Command {
 				fmt.Println("No networks found.")
 			}
 
-			if len(connectionsConfig.AllowedKeys) > 0 {
-				fmt.Println("=== Allowed Server Keys ===")
-				for i, key := range connectionsConfig.AllowedKeys {
-					fmt.Printf("%d. (digest: %s)\n", i+1, key)
+			if len(connectionsConfig.Authorizations) > 0 {
+				fmt.Println("=== Network Authorizations ===")
+				for i, authorization := range connectionsConfig.Authorizations {
+					fmt.Printf("%d. (digest: %s) network: %s", i+1, authorization.KeyDigest, authorization.NetworkID)
+					if authorization.MaxPeers > 0 {
+						fmt.Printf(", max peers: %d", authorization.MaxPeers)
+					}
+					if !authorization.ExpiresAt.IsZero() {
+						fmt.Printf(", expires: %s", formatExpiry(authorization.ExpiresAt))
+					}
+					fmt.Println()
 				}
 			}
 
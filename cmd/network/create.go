@@ -2,6 +2,7 @@ package network
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/spf13/cobra"
 
@@ -11,41 +12,71 @@ import (
 )
 
 func getCreateCommand() *cobra.Command {
-	return &cobra.Command{
+	var cidr string
+	var prefix int
+	var name string
+
+	cmd := &cobra.Command{
 		Use:   "create",
 		Short: "Create a new network (tower command)",
-		Long:  `Create a new virtual network on the local tower. Returns a network ID that can be used for server connections.`,
-		Args:  cobra.NoArgs,
+		Long: `Create a new virtual network on the local tower. Returns a network ID that can be used for server connections.
+The network block can be any private (RFC1918) CIDR given with --cidr, otherwise the next free block
+of --prefix size is picked from 10.5.0.0/16.`,
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			connectionsConfig, err := config.LoadConnectionsConfig()
+			nodeConfig, err := config.LoadNodeConfig()
 			if err != nil {
-				return fmt.Errorf("failed to load connections config: %w", err)
+				return fmt.Errorf("failed to load node config: %w", err)
 			}
 
-			wgNetworkBlock, err := network.GetNextAvailableNetworkBlock(connectionsConfig)
-			if err != nil {
-				return fmt.Errorf("failed to get network block: %w", err)
-			}
+			var newNetwork types.Network
+			err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				if name != "" {
+					if _, err := findNetwork(connectionsConfig, name); err == nil {
+						return fmt.Errorf("a network named %s already exists", name)
+					}
+				}
 
-			newNetwork := types.Network{
-				ID:      network.GenerateTimeOrderedID(),
-				Address: wgNetworkBlock.String(),
-				Peers:   []types.Peer{},
-			}
+				var wgNetworkBlock *net.IPNet
 
-			connectionsConfig.Networks = append(connectionsConfig.Networks, newNetwork)
+				if cidr != "" {
+					wgNetworkBlock, err = network.ParseNetworkBlock(cidr)
+					if err != nil {
+						return err
+					}
+				} else {
+					wgNetworkBlock, err = network.GetNextAvailableNetworkBlock(connectionsConfig, prefix)
+					if err != nil {
+						return fmt.Errorf("failed to get network block: %w", err)
+					}
+				}
 
-			if err := config.SaveConnectionsConfig(connectionsConfig); err != nil {
-				return fmt.Errorf("failed to save connections config: %w", err)
+				created, err := network.CreateNetwork(connectionsConfig, wgNetworkBlock, name, nodeConfig.WGPortRange)
+				if err != nil {
+					return err
+				}
+				newNetwork = *created
+
+				return nil
+			})
+			if err != nil {
+				return err
 			}
 
 			fmt.Printf("✅ Network created successfully!\n")
 			fmt.Printf("Network ID: %s\n", newNetwork.ID)
 			fmt.Printf("Network Address: %s\n", newNetwork.Address)
+			fmt.Printf("Interface: %s (port %d)\n", newNetwork.Interface, newNetwork.ListenPort)
 			fmt.Printf("\nUse this Network ID when connecting servers:\n")
 			fmt.Printf("  upduck network connect <tower-address> %s\n", newNetwork.ID)
 
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Human friendly name for the network")
+	cmd.Flags().StringVar(&cidr, "cidr", "", "Private CIDR block for the network (e.g. 10.20.0.0/20)")
+	cmd.Flags().IntVar(&prefix, "prefix", network.DefaultNetworkPrefix, "Prefix size used when picking a block automatically")
+
+	return cmd
 }
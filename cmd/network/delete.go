@@ -0,0 +1,135 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getDeleteCommand() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "delete <network-id>",
+		Short: "Delete a network (tower command)",
+		Long: `Delete a network from the tower, tearing down its WireGuard interface, its firewall rules
+and the DNS forwards pointing at addresses of the network. Networks with peers are only
+deleted with --force, which also revokes every peer.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var targetNetwork types.Network
+			tx := system.NewTransaction()
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, args[0])
+				if err != nil {
+					return err
+				}
+
+				targetNetwork = connectionsConfig.Networks[networkIndex]
+
+				if len(targetNetwork.Peers) > 0 && !force {
+					return fmt.Errorf("network %s still has %d peer(s), revoke them first or use --force", targetNetwork.ID, len(targetNetwork.Peers))
+				}
+
+				_, block, err := net.ParseCIDR(targetNetwork.Address)
+				if err != nil {
+					return fmt.Errorf("failed to parse network address: %w", err)
+				}
+
+				var keptForwards []types.Forward
+				for _, forward := range connectionsConfig.Forwards {
+					var keptRoutes []types.ForwardRoute
+					var removed []string
+					for _, route := range forward.Routes {
+						var keptTargets []types.ForwardTarget
+						for _, target := range route.Targets {
+							address, err := dns.ResolveTarget(connectionsConfig, &target)
+							if err == nil && inBlock(block, address) {
+								if !slices.Contains(removed, address) {
+									removed = append(removed, address)
+								}
+								continue
+							}
+							keptTargets = append(keptTargets, target)
+						}
+
+						if len(keptTargets) > 0 {
+							route.Targets = keptTargets
+							keptRoutes = append(keptRoutes, route)
+						}
+					}
+
+					switch {
+					case len(removed) == 0:
+						keptForwards = append(keptForwards, forward)
+					case len(keptRoutes) == 0:
+						fmt.Printf("Removed DNS forward %s -> %s\n", forward.Domain, strings.Join(removed, ", "))
+					default:
+						forward.Routes = keptRoutes
+						keptForwards = append(keptForwards, forward)
+						fmt.Printf("Removed %s from DNS forward %s\n", strings.Join(removed, ", "), forward.Domain)
+					}
+				}
+				connectionsConfig.Forwards = keptForwards
+
+				var keptPortForwards []types.PortForward
+				for _, forward := range connectionsConfig.PortForwards {
+					address, err := dns.ResolveTarget(connectionsConfig, &forward.Target)
+					if err != nil || !inBlock(block, address) {
+						keptPortForwards = append(keptPortForwards, forward)
+						continue
+					}
+
+					fmt.Printf("Removed port forward %s/%d -> %s\n", forward.Protocol, forward.PublicPort, address)
+				}
+				connectionsConfig.PortForwards = keptPortForwards
+
+				if _, err := network.DeleteNetwork(connectionsConfig, targetNetwork.ID); err != nil {
+					return fmt.Errorf("failed to delete network: %w", err)
+				}
+
+				_, err = dns.ReconcileForwards(tx, connectionsConfig)
+				return err
+			})
+			if err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					fmt.Printf("Warning: failed to restore the DNS forwards: %v\n", rollbackErr)
+				}
+				return err
+			}
+			tx.Commit()
+
+			netName := network.InterfaceName("tower", &targetNetwork)
+			if err := network.DeleteTowerInterface(netName, targetNetwork.Address); err != nil {
+				fmt.Printf("Warning: %v (the upduck service will remove it on its next reload)\n", err)
+			}
+
+			fmt.Printf("✅ Network %s deleted\n", targetNetwork.ID)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "Delete the network even if it still has peers")
+
+	return cmd
+}
+
+// inBlock reports whether the "ip:port" address is in the network block.
+func inBlock(block *net.IPNet, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	return block.Contains(net.ParseIP(host))
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/network"
+)
+
+func getDescribeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "describe <network-id>",
+		Short: "Show the details of a network (tower command)",
+		Long:  `Show the address block, interface, peers, address leases and DNS forwards of a network.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			networkIndex, err := findNetwork(connectionsConfig, args[0])
+			if err != nil {
+				return err
+			}
+
+			targetNetwork := connectionsConfig.Networks[networkIndex]
+
+			fmt.Println("=== Network ===")
+			fmt.Printf("ID: %s\n", targetNetwork.ID)
+			if targetNetwork.Name != "" {
+				fmt.Printf("Name: %s\n", targetNetwork.Name)
+			}
+			fmt.Printf("Address: %s\n", targetNetwork.Address)
+			fmt.Printf("Interface: %s\n", network.InterfaceName("tower", &targetNetwork))
+			fmt.Printf("Listen Port: %d\n", network.ListenPort(&targetNetwork))
+			fmt.Println()
+
+			encryptionKeys := make(map[string]string)
+			for _, key := range connectionsConfig.EncryptionKeys {
+				encryptionKeys[key.ID] = key.PublicKey
+			}
+
+			leases := make(map[string]string)
+			for _, lease := range targetNetwork.Leases {
+				if lease.Static {
+					leases[lease.PeerID] = "static"
+				} else {
+					leases[lease.PeerID] = "dynamic"
+				}
+			}
+
+			fmt.Printf("=== Peers (%d) ===\n", len(targetNetwork.Peers))
+			for i, peer := range targetNetwork.Peers {
+				fmt.Printf("Peer %d:\n", i+1)
+				fmt.Printf("   ID: %s\n", peer.ID)
+				fmt.Printf("   Address: %s\n", peer.Address)
+				if lease, ok := leases[peer.ID]; ok {
+					fmt.Printf("   Lease: %s\n", lease)
+				}
+				fmt.Printf("   WireGuard Key: %s\n", peer.PublicKey)
+				if publicKey, ok := encryptionKeys[peer.ID]; ok {
+					fmt.Printf("   Key Digest: %s\n", crypto.GetPublicKeyDigest(publicKey))
+				}
+			}
+			fmt.Println()
+
+			_, block, err := net.ParseCIDR(targetNetwork.Address)
+			if err != nil {
+				return fmt.Errorf("failed to parse network address: %w", err)
+			}
+
+			fmt.Println("=== DNS Forwards ===")
+			found := false
+			for _, forward := range connectionsConfig.Forwards {
+				addresses, _ := dns.ResolveTargets(connectionsConfig, dns.AllTargets(&forward))
+				for _, address := range addresses {
+					if inBlock(block, address) {
+						fmt.Printf("%s -> %s\n", forward.Domain, strings.Join(addresses, ", "))
+						found = true
+						break
+					}
+				}
+			}
+			for _, forward := range connectionsConfig.PortForwards {
+				address, err := dns.ResolveTarget(connectionsConfig, &forward.Target)
+				if err == nil && inBlock(block, address) {
+					fmt.Printf("%s/%d -> %s\n", forward.Protocol, forward.PublicPort, address)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Println("No DNS forwards found.")
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package network
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+)
+
+func getJoinCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "join <token>",
+		Short: "Join a tower network with a join token (server command)",
+		Long: `Connect this server to the tower network embedded in a token created with 'upduck network token create'.
+The tower key and TLS certificate are checked against the digest and fingerprint embedded in the token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload, err := crypto.DecodeJoinToken(args[0])
+			if err != nil {
+				return err
+			}
+
+			return connectToTower(payload.TowerAddress, payload.NetworkID, payload.TowerKeyDigest, payload.TowerFingerprint, payload.Secret, 0)
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/api"
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getLeaveCommand() *cobra.Command {
+	var towerAddress string
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "leave <network-id>",
+		Short: "Leave a tower network (server command)",
+		Long: `Notify the tower that this server is leaving the network, then remove the network
+and its WireGuard interface from this server.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			networkID := args[0]
+
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			networkIndex, err := findNetwork(connectionsConfig, networkID)
+			if err != nil {
+				return err
+			}
+
+			targetNetwork := connectionsConfig.Networks[networkIndex]
+			if towerAddress == "" {
+				towerAddress = targetNetwork.TowerAddress
+			}
+
+			if err := notifyTowerLeave(towerAddress, targetNetwork); err != nil {
+				if !force {
+					return fmt.Errorf("%w (use --force to remove the network locally anyway)", err)
+				}
+				fmt.Printf("Warning: %v\n", err)
+			}
+
+			err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, targetNetwork.ID)
+				if err != nil {
+					return err
+				}
+
+				connectionsConfig.Networks = append(connectionsConfig.Networks[:networkIndex:networkIndex], connectionsConfig.Networks[networkIndex+1:]...)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			netName := network.InterfaceName("server", &targetNetwork)
+
+			if err := network.DeleteInterface(netName); err != nil {
+				fmt.Printf("Warning: %v (the upduck service will remove it on its next reload)\n", err)
+			}
+
+			fmt.Printf("✅ Left network %s\n", networkID)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&towerAddress, "tower", "", "Tower address, defaults to the one used when connecting")
+	cmd.Flags().BoolVar(&force, "force", false, "Remove the network locally even if the tower cannot be notified")
+
+	return cmd
+}
+
+func notifyTowerLeave(towerAddress string, targetNetwork types.Network) error {
+	if towerAddress == "" {
+		return fmt.Errorf("unknown tower address, pass it with --tower")
+	}
+
+	if len(targetNetwork.Peers) == 0 {
+		return fmt.Errorf("network %s has no tower peer", targetNetwork.ID)
+	}
+
+	rsaConfig, err := crypto.LoadRSAKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load RSA config: %w", err)
+	}
+
+	towerAddress, err = api.NormalizeTowerAddress(towerAddress)
+	if err != nil {
+		return err
+	}
+
+	if targetNetwork.TowerFingerprint == "" {
+		return fmt.Errorf("no tower certificate fingerprint is pinned for network %s", targetNetwork.ID)
+	}
+
+	towerKey := targetNetwork.TowerKey
+	if towerKey == "" {
+		towerKey, err = api.FetchTowerKey(towerAddress, targetNetwork.TowerFingerprint, "")
+		if err != nil {
+			return fmt.Errorf("failed to get tower key: %w", err)
+		}
+	}
+
+	// the tower peer is stored with the ID the tower assigned to this server
+	peerID := targetNetwork.Peers[0].ID
+	apiPath := fmt.Sprintf("/api/servers/network/%s/peers/%s", targetNetwork.ID, peerID)
+
+	fmt.Printf("Notifying tower at %s%s...\n", towerAddress, apiPath)
+
+	if system.DryRun() {
+		return system.Do(fmt.Sprintf("send the leave request to %s%s", towerAddress, apiPath), nil)
+	}
+
+	client := api.NewTowerClient(towerAddress, targetNetwork.TowerFingerprint, towerKey, rsaConfig)
+	if err := client.Call(http.MethodDelete, apiPath, struct{}{}, nil); err != nil {
+		var statusErr *api.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
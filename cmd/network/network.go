@@ -1,9 +1,12 @@
 package network
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 
 	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/types"
 )
 
 func GetNetworkCommand() *cobra.Command {
@@ -14,18 +17,45 @@ func GetNetworkCommand() *cobra.Command {
 	}
 
 	networkCmd.AddCommand(getConnectionsCommand())
+	networkCmd.AddCommand(getStatusCommand())
 
 	nodeConfig, err := config.LoadNodeConfig()
 	if err == nil {
 		if nodeConfig.Type == "tower" {
 			networkCmd.AddCommand(getCreateCommand())
 			networkCmd.AddCommand(getAllowCommand())
+			networkCmd.AddCommand(getPeerCommand())
+			networkCmd.AddCommand(getRevokeCommand())
+			networkCmd.AddCommand(getDeleteCommand())
+			networkCmd.AddCommand(getRenameCommand())
+			networkCmd.AddCommand(getDescribeCommand())
+			networkCmd.AddCommand(getTokenCommand())
+			networkCmd.AddCommand(getPendingCommand())
 		}
 
 		if nodeConfig.Type == "server" {
 			networkCmd.AddCommand(getConnectCommand())
+			networkCmd.AddCommand(getJoinCommand())
+			networkCmd.AddCommand(getLeaveCommand())
 		}
 	}
 
 	return networkCmd
 }
+
+// findNetwork returns the index of the network with the given ID or name.
+func findNetwork(connectionsConfig *types.ConnectionsConfig, networkID string) (int, error) {
+	for i, netw := range connectionsConfig.Networks {
+		if netw.ID == networkID {
+			return i, nil
+		}
+	}
+
+	for i, netw := range connectionsConfig.Networks {
+		if netw.Name != "" && netw.Name == networkID {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("network %s not found", networkID)
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getPeerCommand() *cobra.Command {
+	peerCmd := &cobra.Command{
+		Use:   "peer",
+		Short: "Peer management commands (tower command)",
+		Long:  `Manage the peers connected to the tower networks.`,
+	}
+
+	peerCmd.AddCommand(getPeerSetIPCommand())
+
+	return peerCmd
+}
+
+func getPeerSetIPCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set-ip <network-id> <peer-id> <ip>",
+		Short: "Reserve a static address for a peer",
+		Long: `Pin a peer to a static address inside its network block. The address is kept for the peer until it is removed.
+The tower moves the peer right away, the server picks its new address up from the tower within a minute,
+or when 'upduck network connect' is run on it again.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			networkID := args[0]
+			peerID := args[1]
+			ipAddress := args[2]
+
+			var address *net.IPNet
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, networkID)
+				if err != nil {
+					return err
+				}
+
+				address, err = network.ReserveAddress(&connectionsConfig.Networks[networkIndex], peerID, ipAddress)
+				if err != nil {
+					return fmt.Errorf("failed to reserve address: %w", err)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Peer %s now has the static address %s\n", peerID, address)
+			fmt.Printf("The server switches to it on its next address refresh from the tower\n")
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getPendingCommand() *cobra.Command {
+	var all bool
+
+	pendingCmd := &cobra.Command{
+		Use:   "pending",
+		Short: "List join requests waiting for approval (tower command)",
+		Long: `List the connection attempts from servers whose key is not allowed yet. Use
+'upduck network pending approve <request-id>' or 'upduck network pending reject <request-id>' to decide.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "ID\tNETWORK\tDIGEST\tHOSTNAME\tSOURCE IP\tREQUESTED\tSTATUS")
+
+			found := false
+			for _, request := range connectionsConfig.JoinRequests {
+				if !all && request.Status != network.JoinRequestPending {
+					continue
+				}
+
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					request.ID,
+					request.NetworkID,
+					request.KeyDigest,
+					valueOrDash(request.Hostname),
+					valueOrDash(request.SourceIP),
+					request.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+					request.Status,
+				)
+				found = true
+			}
+
+			if !found {
+				fmt.Println("No join requests found.")
+				return nil
+			}
+
+			return writer.Flush()
+		},
+	}
+
+	pendingCmd.Flags().BoolVar(&all, "all", false, "Also show approved and rejected requests")
+
+	pendingCmd.AddCommand(getPendingDecisionCommand(true))
+	pendingCmd.AddCommand(getPendingDecisionCommand(false))
+
+	return pendingCmd
+}
+
+func getPendingDecisionCommand(approve bool) *cobra.Command {
+	use, short := "reject <request-id>", "Reject a join request"
+	if approve {
+		use, short = "approve <request-id>", "Approve a join request, allowing the server key"
+	}
+
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var request *types.JoinRequest
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				var err error
+				request, err = network.DecideJoinRequest(connectionsConfig, args[0], approve)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Join request %s from %s (digest: %s) %s\n", request.ID, valueOrDash(request.Hostname), request.KeyDigest, request.Status)
+
+			return nil
+		},
+	}
+}
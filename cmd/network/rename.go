@@ -0,0 +1,46 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getRenameCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rename <network-id> <name>",
+		Short: "Rename a network (tower command)",
+		Long:  `Set the human friendly name of a network. The name can be used instead of the network ID in other network commands.`,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[1]
+
+			var networkID string
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, args[0])
+				if err != nil {
+					return err
+				}
+
+				if existingIndex, err := findNetwork(connectionsConfig, name); err == nil && existingIndex != networkIndex {
+					return fmt.Errorf("a network named %s already exists", name)
+				}
+
+				connectionsConfig.Networks[networkIndex].Name = name
+				networkID = connectionsConfig.Networks[networkIndex].ID
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Network %s renamed to %s\n", networkID, name)
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getRevokeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <peer-id>",
+		Short: "Remove a server from the tower (tower command)",
+		Long: `Remove a peer from its network, dropping its encryption key and its allowed key digest.
+The peer is removed from the running WireGuard interface right away.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peerID := args[0]
+
+			var targetNetwork *types.Network
+			var peer *types.Peer
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				var err error
+				targetNetwork, peer, err = network.RemovePeer(connectionsConfig, peerID)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := network.RemoveInterfacePeer(network.InterfaceName("tower", targetNetwork), peer.PublicKey); err != nil {
+				fmt.Printf("Warning: %v (the upduck service will remove it on its next reload)\n", err)
+			}
+
+			fmt.Printf("✅ Revoked peer %s from network %s\n", peerID, targetNetwork.ID)
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getStatusCommand() *cobra.Command {
+	var watch bool
+	var interval time.Duration
+	var threshold time.Duration
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the live status of the network peers",
+		Long: `Show the last handshake, transferred bytes, endpoint and online state of every peer,
+read from the running WireGuard interfaces. A peer is online when its last handshake is
+more recent than --threshold.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nodeConfig, err := config.LoadNodeConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load node config: %w", err)
+			}
+
+			if !watch {
+				return printStatus(nodeConfig.Type, threshold, jsonOutput)
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				// clear the terminal before redrawing
+				fmt.Print("\033[H\033[2J")
+				if err := printStatus(nodeConfig.Type, threshold, jsonOutput); err != nil {
+					return err
+				}
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&watch, "watch", "w", false, "Keep refreshing the status")
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "Refresh interval in watch mode")
+	cmd.Flags().DurationVar(&threshold, "threshold", network.DefaultHandshakeThreshold, "Maximum handshake age for a peer to be considered online")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the status as JSON")
+
+	return cmd
+}
+
+func printStatus(nodeType string, threshold time.Duration, jsonOutput bool) error {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load connections config: %w", err)
+	}
+
+	statuses, err := network.GetNetworksStatus(nodeType, connectionsConfig, threshold)
+	if err != nil {
+		return fmt.Errorf("failed to read network status: %w", err)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	if len(statuses) == 0 {
+		fmt.Println("No networks found.")
+		return nil
+	}
+
+	for _, status := range statuses {
+		title := status.ID
+		if status.Name != "" {
+			title = fmt.Sprintf("%s (%s)", status.Name, status.ID)
+		}
+
+		state := "up"
+		if !status.Up {
+			state = "down"
+		}
+
+		fmt.Printf("=== Network %s on %s [%s] ===\n", title, status.Interface, state)
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "PEER\tADDRESS\tENDPOINT\tLAST HANDSHAKE\tRX\tTX\tSTATE")
+		for _, peer := range status.Peers {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				peer.ID,
+				peer.Address,
+				valueOrDash(peer.Endpoint),
+				formatHandshake(peer.LastHandshake),
+				formatBytes(peer.ReceiveBytes),
+				formatBytes(peer.TransmitBytes),
+				formatOnline(peer),
+			)
+		}
+		writer.Flush()
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func formatHandshake(lastHandshake time.Time) string {
+	if lastHandshake.IsZero() {
+		return "never"
+	}
+
+	return fmt.Sprintf("%s ago", time.Since(lastHandshake).Truncate(time.Second))
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func formatOnline(peer types.PeerStatus) string {
+	if peer.Online {
+		return "online"
+	}
+	return "offline"
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
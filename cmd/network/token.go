@@ -0,0 +1,199 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/duck-labs/upduck/pkg/api"
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func getTokenCommand() *cobra.Command {
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Join token management commands (tower command)",
+		Long:  `Manage the one-time, expiring tokens servers use to join a network with 'upduck network join'.`,
+	}
+
+	tokenCmd.AddCommand(getTokenCreateCommand())
+	tokenCmd.AddCommand(getTokenListCommand())
+	tokenCmd.AddCommand(getTokenRevokeCommand())
+
+	return tokenCmd
+}
+
+func getTokenCreateCommand() *cobra.Command {
+	var networkID string
+	var towerAddress string
+	var ttl time.Duration
+	var uses int
+
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a join token for a network",
+		Long: `Create a join token embedding the tower address, the network ID, the tower key digest and the
+fingerprint of the tower TLS certificate.
+Running 'upduck network join <token>' on a server connects it without allowing its key first.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if uses < 0 {
+				return fmt.Errorf("--uses must be 0 (unlimited) or more")
+			}
+
+			rsaConfig, err := crypto.LoadRSAKeys()
+			if err != nil {
+				return fmt.Errorf("failed to load RSA config: %w", err)
+			}
+
+			towerFingerprint, err := crypto.LoadTLSFingerprint()
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate, is the upduck service running?: %w", err)
+			}
+
+			towerAddress, err = api.NormalizeTowerAddress(towerAddress)
+			if err != nil {
+				return err
+			}
+
+			secret, err := crypto.GenerateTokenSecret()
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().UTC()
+			joinToken := types.JoinToken{
+				ID:         network.GenerateTimeOrderedID(),
+				SecretHash: crypto.HashTokenSecret(secret),
+				MaxUses:    uses,
+				CreatedAt:  now,
+			}
+
+			if ttl > 0 {
+				joinToken.ExpiresAt = now.Add(ttl)
+			}
+
+			var token string
+			err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				networkIndex, err := findNetwork(connectionsConfig, networkID)
+				if err != nil {
+					return err
+				}
+				joinToken.NetworkID = connectionsConfig.Networks[networkIndex].ID
+
+				token, err = crypto.EncodeJoinToken(&types.JoinTokenPayload{
+					TowerAddress:     towerAddress,
+					NetworkID:        joinToken.NetworkID,
+					TowerKeyDigest:   crypto.GetPublicKeyDigest(rsaConfig.PublicKey),
+					TowerFingerprint: towerFingerprint,
+					Secret:           secret,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to encode join token: %w", err)
+				}
+
+				connectionsConfig.JoinTokens = append(connectionsConfig.JoinTokens, joinToken)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Join token %s created for network %s\n", joinToken.ID, joinToken.NetworkID)
+			fmt.Printf("Expires: %s\n", formatExpiry(joinToken.ExpiresAt))
+			fmt.Printf("Uses: %s\n", formatUses(joinToken))
+			fmt.Printf("\nRun on the server:\n")
+			fmt.Printf("  upduck network join %s\n", token)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&networkID, "network", "", "Network the token joins")
+	cmd.Flags().StringVar(&towerAddress, "address", "", "Tower API address servers connect to (e.g. https://tower.example.com:8080)")
+	cmd.Flags().DurationVar(&ttl, "ttl", time.Hour, "Time until the token expires (0 for no expiry)")
+	cmd.Flags().IntVar(&uses, "uses", 1, "Number of times the token can be used (0 for unlimited)")
+	cmd.MarkFlagRequired("network")
+	cmd.MarkFlagRequired("address")
+
+	return cmd
+}
+
+func getTokenListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List join tokens",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			connectionsConfig, err := config.LoadConnectionsConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load connections config: %w", err)
+			}
+
+			if len(connectionsConfig.JoinTokens) == 0 {
+				fmt.Println("No join tokens found.")
+				return nil
+			}
+
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "ID\tNETWORK\tUSES\tEXPIRES\tSTATE")
+			for _, token := range connectionsConfig.JoinTokens {
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", token.ID, token.NetworkID, formatUses(token), formatExpiry(token.ExpiresAt), tokenState(token))
+			}
+			writer.Flush()
+
+			return nil
+		},
+	}
+}
+
+func getTokenRevokeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <token-id>",
+		Short: "Revoke a join token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+				return network.RevokeJoinToken(connectionsConfig, args[0])
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ Join token %s revoked\n", args[0])
+
+			return nil
+		},
+	}
+}
+
+func formatUses(token types.JoinToken) string {
+	if token.MaxUses == 0 {
+		return fmt.Sprintf("%d/unlimited", token.Uses)
+	}
+	return fmt.Sprintf("%d/%d", token.Uses, token.MaxUses)
+}
+
+func formatExpiry(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return "never"
+	}
+	return expiresAt.Local().Format(time.RFC3339)
+}
+
+func tokenState(token types.JoinToken) string {
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		return "expired"
+	}
+	if token.MaxUses > 0 && token.Uses >= token.MaxUses {
+		return "used"
+	}
+	return "active"
+}
@@ -1,23 +1,38 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/spf13/cobra"
 
+	"github.com/duck-labs/upduck/cmd/apply"
+	configcmd "github.com/duck-labs/upduck/cmd/config"
 	"github.com/duck-labs/upduck/cmd/dns"
 	"github.com/duck-labs/upduck/cmd/install"
 	"github.com/duck-labs/upduck/cmd/network"
 	"github.com/duck-labs/upduck/cmd/server"
 	"github.com/duck-labs/upduck/cmd/version"
 	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
 )
 
+var dryRun bool
+
 var rootCmd = &cobra.Command{
 	Use:   "upduck",
 	Short: "UpDuck - Self-hosted datacenter management CLI",
 	Long: `UpDuck is a Golang CLI that helps developers create on-premise datacenters 
 for self-hosted applications using existing tools like WireGuard, K3s, and Nginx.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		migrateConfigFiles()
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if system.DryRun() {
+			fmt.Printf("\nDry run: %d change(s) recorded, nothing was changed\n", system.DryRunChanges())
+		}
+	},
 }
 
 func Execute() error {
@@ -25,6 +40,14 @@ func Execute() error {
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print the files, commands and services a command would change instead of changing them")
+
+	cobra.OnInitialize(func() {
+		if dryRun {
+			system.SetDryRun(os.Stdout)
+		}
+	})
+
 	nodeConfig, err := config.LoadNodeConfig()
 	if err != nil {
 		if err.Error() == "not configured" {
@@ -38,6 +61,7 @@ func init() {
 	}
 
 	rootCmd.AddCommand(install.GetReinstallCommand())
+	rootCmd.AddCommand(configcmd.GetConfigCommand())
 	rootCmd.AddCommand(server.GetServerCommand())
 	rootCmd.AddCommand(version.GetVersionCommand())
 
@@ -45,7 +69,28 @@ func init() {
 
 	if nodeConfig.Type == "tower" {
 		rootCmd.AddCommand(dns.GetDNSCommand())
+		rootCmd.AddCommand(apply.GetApplyCommand())
+		rootCmd.AddCommand(apply.GetExportCommand())
 	}
 
 	rootCmd.AddCommand(networkCmd)
 }
+
+// migrateConfigFiles upgrades the config files left by older versions before
+// any command runs. Config files are also upgraded in memory when loaded, so
+// a failure, like missing permissions, only delays the upgrade.
+func migrateConfigFiles() {
+	results, err := config.MigrateConfigFiles(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to migrate config files: %v\n", err)
+	}
+
+	// in dry runs the files the migration would write are already printed
+	if system.DryRun() {
+		return
+	}
+
+	for _, result := range results {
+		fmt.Fprintf(os.Stderr, "Migrated %s from version %d to %d, original kept in %s\n", result.Path, result.FromVersion, result.ToVersion, result.BackupPath)
+	}
+}
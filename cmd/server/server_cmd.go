@@ -52,7 +52,7 @@ func getServerCommand() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&serverPort, "port", "8080", "Port to listen on")
+	cmd.Flags().StringVar(&serverPort, "port", api.DefaultPort, "Port to listen on")
 	cmd.MarkFlagRequired("type")
 
 	return cmd
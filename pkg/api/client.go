@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// StatusError is returned by the tower client when the tower answers with a
+// non successful status code, or with 202 when the request was queued.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("tower responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("tower responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// TowerClient calls the tower management API over TLS pinned to the tower
+// certificate fingerprint. Requests are signed with the node RSA keys and
+// encrypted for the tower key, responses are verified against the tower key
+// and decrypted with the node keys.
+type TowerClient struct {
+	Address    string
+	TowerKey   string
+	Keys       *types.RSAKeysConfig
+	HTTPClient *http.Client
+}
+
+func NewTowerClient(address, fingerprint, towerKey string, keys *types.RSAKeysConfig) *TowerClient {
+	return &TowerClient{
+		Address:    strings.TrimSuffix(address, "/"),
+		TowerKey:   towerKey,
+		Keys:       keys,
+		HTTPClient: newPinnedHTTPClient(fingerprint),
+	}
+}
+
+// Call sends the request payload to the given API path and decodes the
+// response payload into response, when it is not nil.
+func (c *TowerClient) Call(method, path string, request interface{}, response interface{}) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	requestEnvelope, err := sealEnvelope(method, path, "", payload, c.Keys, c.TowerKey)
+	if err != nil {
+		return fmt.Errorf("failed to seal request: %w", err)
+	}
+
+	body, err := json.Marshal(requestEnvelope)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest(method, c.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach tower: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// accepted requests are queued by the tower and carry no sealed payload
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusAccepted {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	if response == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	var responseEnvelope types.Envelope
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxEnvelopeSize)).Decode(&responseEnvelope); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	towerKeyResolver := func(keyDigest string, payload []byte) (string, error) {
+		return c.TowerKey, nil
+	}
+
+	responsePayload, err := openEnvelope(responseKind, path, requestEnvelope.Nonce, &responseEnvelope, c.Keys, towerKeyResolver)
+	if err != nil {
+		return fmt.Errorf("invalid tower response: %w", err)
+	}
+
+	if err := json.Unmarshal(responsePayload, response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// FetchTowerKey retrieves the RSA public key of the tower, over TLS pinned to
+// the given fingerprint. When an expected digest is given, the key must match it.
+func FetchTowerKey(address, fingerprint, expectedDigest string) (string, error) {
+	httpClient := newPinnedHTTPClient(fingerprint)
+
+	resp, err := httpClient.Get(strings.TrimSuffix(address, "/") + "/api/tower/key")
+	if err != nil {
+		return "", fmt.Errorf("failed to reach tower: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var keyResponse types.TowerKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&keyResponse); err != nil {
+		return "", fmt.Errorf("failed to decode tower key: %w", err)
+	}
+
+	if expectedDigest != "" && crypto.GetPublicKeyDigest(keyResponse.PublicKey) != expectedDigest {
+		return "", fmt.Errorf("tower key digest %s does not match the expected %s", crypto.GetPublicKeyDigest(keyResponse.PublicKey), expectedDigest)
+	}
+
+	return keyResponse.PublicKey, nil
+}
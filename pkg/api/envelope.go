@@ -0,0 +1,169 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	maxEnvelopeAge  = 5 * time.Minute
+	maxEnvelopeSize = 1 << 20
+
+	responseKind = "RESPONSE"
+)
+
+// keyResolver returns the PEM public key of the sender of an envelope, given
+// the digest it claims and the decrypted payload.
+type keyResolver func(keyDigest string, payload []byte) (string, error)
+
+// sealEnvelope encrypts the payload for the recipient and signs it with the
+// sender keys. Requests are bound to their method and path, responses to the
+// nonce of the request they answer.
+func sealEnvelope(kind, path, requestNonce string, payload []byte, senderKeys *types.RSAKeysConfig, recipientPublicKey string) (*types.Envelope, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	encryptedKey, ciphertext, err := crypto.Seal(recipientPublicKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &types.Envelope{
+		KeyDigest:    crypto.GetPublicKeyDigest(senderKeys.PublicKey),
+		Timestamp:    time.Now().Unix(),
+		Nonce:        hex.EncodeToString(nonce),
+		EncryptedKey: encryptedKey,
+		Ciphertext:   ciphertext,
+	}
+
+	envelope.Signature, err = crypto.SignMessage(senderKeys.PrivateKey, envelopeSigningMessage(kind, path, requestNonce, envelope))
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// openEnvelope checks the envelope age, decrypts it with the recipient keys
+// and verifies the signature against the key returned by resolveKey.
+func openEnvelope(kind, path, requestNonce string, envelope *types.Envelope, recipientKeys *types.RSAKeysConfig, resolveKey keyResolver) ([]byte, error) {
+	age := time.Since(time.Unix(envelope.Timestamp, 0))
+	if age > maxEnvelopeAge || age < -maxEnvelopeAge {
+		return nil, fmt.Errorf("envelope timestamp outside of the allowed window")
+	}
+
+	if envelope.Nonce == "" {
+		return nil, fmt.Errorf("missing envelope nonce")
+	}
+
+	payload, err := crypto.Open(recipientKeys.PrivateKey, envelope.EncryptedKey, envelope.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	senderPublicKey, err := resolveKey(envelope.KeyDigest, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if crypto.GetPublicKeyDigest(senderPublicKey) != envelope.KeyDigest {
+		return nil, fmt.Errorf("sender key does not match the envelope key digest")
+	}
+
+	if err := crypto.VerifySignature(senderPublicKey, envelopeSigningMessage(kind, path, requestNonce, envelope), envelope.Signature); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func envelopeSigningMessage(kind, path, requestNonce string, envelope *types.Envelope) []byte {
+	return []byte(strings.Join([]string{
+		kind,
+		path,
+		envelope.KeyDigest,
+		strconv.FormatInt(envelope.Timestamp, 10),
+		envelope.Nonce,
+		requestNonce,
+		envelope.EncryptedKey,
+		envelope.Ciphertext,
+	}, "\n"))
+}
+
+// nonceCache remembers the nonces seen within the envelope age window so a
+// captured request cannot be replayed.
+type nonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+// use records the nonce and reports whether it was already used.
+func (c *nonceCache) use(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for seen, at := range c.nonces {
+		if now.Sub(at) > 2*maxEnvelopeAge {
+			delete(c.nonces, seen)
+		}
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return true
+	}
+
+	c.nonces[nonce] = now
+	return false
+}
+
+// readRequest decodes and opens the envelope sent as the request body.
+func (s *Server) readRequest(r *http.Request, resolveKey keyResolver) ([]byte, *types.Envelope, error) {
+	var envelope types.Envelope
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxEnvelopeSize)).Decode(&envelope); err != nil {
+		return nil, nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	payload, err := openEnvelope(r.Method, r.URL.Path, "", &envelope, s.rsaKeys, resolveKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.nonces.use(envelope.Nonce) {
+		return nil, nil, fmt.Errorf("replayed request")
+	}
+
+	return payload, &envelope, nil
+}
+
+// writeResponse seals the response for the caller, bound to the request envelope.
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, request *types.Envelope, recipientPublicKey string, response interface{}) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := sealEnvelope(responseKind, r.URL.Path, request.Nonce, payload, s.rsaKeys, recipientPublicKey)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(envelope)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// addressRefreshInterval is how often a server asks its towers for its
+// assignment, so a static address reserved on a tower with
+// 'upduck network peer set-ip' reaches the server without touching it.
+const addressRefreshInterval = time.Minute
+
+// refreshAddresses periodically asks the towers of the server networks for
+// the address of this server until ctx is done. A changed address is stored
+// in the connections config, the reconciler then moves the interface to it.
+func (s *Server) refreshAddresses(ctx context.Context) {
+	ticker := time.NewTicker(addressRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refreshAddressesOnce(); err != nil {
+				log.Printf("Error refreshing network addresses: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) refreshAddressesOnce() error {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load connections config: %v", err)
+	}
+
+	for _, netw := range connectionsConfig.Networks {
+		if netw.TowerAddress == "" || netw.TowerKey == "" || netw.TowerFingerprint == "" || len(netw.Peers) == 0 {
+			continue
+		}
+
+		// the tower peer is stored with the ID the tower assigned to this server
+		var response types.ConnectResponse
+		client := NewTowerClient(netw.TowerAddress, netw.TowerFingerprint, netw.TowerKey, s.rsaKeys)
+		apiPath := fmt.Sprintf("/api/servers/network/%s/peers/%s", netw.ID, netw.Peers[0].ID)
+		if err := client.Call(http.MethodGet, apiPath, struct{}{}, &response); err != nil {
+			log.Printf("Warning: Failed to refresh the address of network %s from %s: %v", netw.ID, netw.TowerAddress, err)
+			continue
+		}
+
+		if response.NetworkID != netw.ID || response.WGAddress == netw.Address {
+			continue
+		}
+
+		err := config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+			if !network.ApplyServerAddress(connectionsConfig, &response) {
+				return fmt.Errorf("network %s not found", netw.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Warning: Failed to store the address of network %s: %v", netw.ID, err)
+			continue
+		}
+
+		log.Printf("Address of network %s changed by the tower from %s to %s", netw.ID, netw.Address, response.WGAddress)
+	}
+
+	return nil
+}
@@ -2,38 +2,42 @@ package api
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
+	"github.com/duck-labs/upduck/pkg/certs"
 	"github.com/duck-labs/upduck/pkg/config"
 	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/dns"
 	"github.com/duck-labs/upduck/pkg/network"
 	"github.com/duck-labs/upduck/pkg/types"
 )
 
 type Server struct {
-	nodeType            string
-	port                string
-	fileWatcherCtx      context.Context
-	fileWatcherCancel   context.CancelFunc
-	lastConnectionsHash string
-	httpServer          *http.Server
+	nodeType         string
+	port             string
+	reconcilerCtx    context.Context
+	reconcilerCancel context.CancelFunc
+	httpServer       *http.Server
+	rsaKeys          *types.RSAKeysConfig
+	nonces           *nonceCache
 }
 
 func NewServer(nodeType, port string) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		nodeType:          nodeType,
-		port:              port,
-		fileWatcherCtx:    ctx,
-		fileWatcherCancel: cancel,
+		nodeType:         nodeType,
+		port:             port,
+		reconcilerCtx:    ctx,
+		reconcilerCancel: cancel,
+		nonces:           newNonceCache(),
 		httpServer: &http.Server{
 			Addr: ":" + port,
 		},
@@ -41,86 +45,356 @@ func NewServer(nodeType, port string) *Server {
 }
 
 func (s *Server) Start() error {
-	go s.watchConnectionsFile()
+	rsaKeys, err := crypto.LoadRSAKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load RSA keys: %w", err)
+	}
+	s.rsaKeys = rsaKeys
+
+	certificate, err := crypto.LoadOrGenerateTLSCertificate()
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	s.httpServer.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	reconciler := network.NewReconciler(s.nodeType)
+	go reconciler.Run(s.reconcilerCtx)
 
-	http.HandleFunc("/api/servers/network/", s.handleServerConnect)
+	if s.nodeType == "tower" {
+		go certs.NewManager(reconciler.Trigger).Run(s.reconcilerCtx)
+		go dns.NewHealthChecker(reconciler.Trigger).Run(s.reconcilerCtx)
+	} else {
+		go s.refreshAddresses(s.reconcilerCtx)
+	}
+
+	http.HandleFunc("/api/tower/key", s.handleTowerKey)
+	http.HandleFunc("/api/servers/network/", s.handleServerNetwork)
+	http.HandleFunc("/api/network/status", s.handleNetworkStatus)
 	http.HandleFunc("/health", s.handleHealth)
 
 	log.Printf("Starting UpDuck %s server on port %s", s.nodeType, s.port)
-	log.Printf("File watcher started for connections config")
-	return s.httpServer.ListenAndServe()
+	log.Printf("TLS certificate fingerprint: %s", crypto.GetCertificateFingerprint(certificate.Certificate[0]))
+	log.Printf("Reconciler started for WireGuard interfaces")
+	return s.httpServer.ListenAndServeTLS("", "")
 }
 
-func (s *Server) handleServerConnect(w http.ResponseWriter, r *http.Request) {
+// handleTowerKey exposes the tower RSA public key, used by servers to encrypt
+// their requests and verify the tower responses.
+func (s *Server) handleTowerKey(w http.ResponseWriter, r *http.Request) {
 	if s.nodeType != "tower" {
 		http.Error(w, "This endpoint is only available on tower nodes", http.StatusForbidden)
 		return
 	}
 
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.TowerKeyResponse{
+		PublicKey: s.rsaKeys.PublicKey,
+	})
+}
+
+func (s *Server) handleServerNetwork(w http.ResponseWriter, r *http.Request) {
+	if s.nodeType != "tower" {
+		http.Error(w, "This endpoint is only available on tower nodes", http.StatusForbidden)
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/api/servers/network/")
 	parts := strings.Split(path, "/")
-	if len(parts) != 2 || parts[1] != "connect" {
-		http.Error(w, "Invalid URL format. Expected: /api/servers/network/{networkID}/connect", http.StatusBadRequest)
-		return
+
+	switch {
+	case len(parts) == 2 && parts[1] == "connect":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleServerConnect(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "peers":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleServerAssignment(w, r, parts[0], parts[2])
+		case http.MethodDelete:
+			s.handleServerLeave(w, r, parts[0], parts[2])
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.Error(w, "Invalid URL format. Expected: /api/servers/network/{networkID}/connect or /api/servers/network/{networkID}/peers/{peerID}", http.StatusBadRequest)
 	}
-	networkID := parts[0]
+}
 
+func (s *Server) handleServerConnect(w http.ResponseWriter, r *http.Request, networkID string) {
 	var request types.ConnectRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+	payloadKey := func(keyDigest string, payload []byte) (string, error) {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return "", fmt.Errorf("invalid JSON payload: %v", err)
+		}
+		return request.PublicKey, nil
+	}
+
+	_, requestEnvelope, err := s.readRequest(r, payloadKey)
+	if err != nil {
+		log.Printf("Rejected connect request: %v", err)
+		http.Error(w, "Invalid request envelope", http.StatusUnauthorized)
 		return
 	}
 
 	pubKeyDigest := crypto.GetPublicKeyDigest(request.PublicKey)
 
-	connectionsConfig, err := config.LoadConnectionsConfig()
+	wgConfig, err := config.LoadWireguardConfig()
 	if err != nil {
-		log.Printf("Error loading connections config: %v", err)
+		log.Printf("Error loading WireGuard config: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	allowed := false
-	for _, allowedKey := range connectionsConfig.AllowedKeys {
-		if allowedKey == pubKeyDigest {
-			allowed = true
-			break
+	var response types.ConnectResponse
+	var joinRequest *types.JoinRequest
+
+	refreshed := false
+	err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+		// a server already connected with the same keys gets its current
+		// assignment back
+		if targetNetwork, peer := findConnectedPeer(connectionsConfig, networkID, &request); peer != nil {
+			var err error
+			response, err = s.connectResponse(wgConfig, targetNetwork, peer)
+			refreshed = true
+			return err
+		}
+
+		authErr := network.AuthorizeKey(connectionsConfig, pubKeyDigest, networkID)
+
+		// a valid join token admits any key the network does not accept on its
+		// own, including keys allowed on other networks only
+		if authErr != nil && request.JoinToken != "" {
+			token, err := network.UseJoinToken(connectionsConfig, request.JoinToken, networkID)
+			if err != nil {
+				log.Printf("Rejected join token from public key %s: %v", pubKeyDigest, err)
+				return &httpError{status: http.StatusUnauthorized, message: "Invalid join token"}
+			}
+
+			log.Printf("Join token %s used by public key %s (%d use(s))", token.ID, pubKeyDigest, token.Uses)
+			authErr = nil
+		}
+
+		if errors.Is(authErr, network.ErrKeyUnknown) {
+			var err error
+			joinRequest, err = queueJoinRequest(r, connectionsConfig, networkID, pubKeyDigest, &request)
+			return err
+		}
+
+		if authErr != nil {
+			log.Printf("Forbidden connection attempt: %v", authErr)
+			return &httpError{status: http.StatusForbidden, message: fmt.Sprintf("Forbidden: %v", authErr)}
+		}
+
+		var targetNetwork *types.Network
+		for i, netw := range connectionsConfig.Networks {
+			if netw.ID == networkID {
+				targetNetwork = &connectionsConfig.Networks[i]
+				break
+			}
+		}
+
+		if targetNetwork == nil {
+			return &httpError{status: http.StatusNotFound, message: "Network not found"}
+		}
+
+		for _, peer := range targetNetwork.Peers {
+			if request.WGPublicKey == peer.PublicKey {
+				return &httpError{status: http.StatusConflict, message: "Server already connected to this network"}
+			}
+		}
+
+		peerID := network.GenerateTimeOrderedID()
+
+		wgAddress, err := network.AllocateAddress(targetNetwork, peerID)
+		if err != nil {
+			return fmt.Errorf("failed to generate new address: %v", err)
 		}
+
+		newPeer := types.Peer{
+			ID:        peerID,
+			PublicKey: request.WGPublicKey,
+			Address:   wgAddress.String(),
+		}
+
+		targetNetwork.Peers = append(targetNetwork.Peers, newPeer)
+
+		newEncryptionKey := types.EncryptionKey{
+			ID:        newPeer.ID,
+			Type:      "network_peer",
+			PublicKey: request.PublicKey,
+		}
+
+		connectionsConfig.EncryptionKeys = append(connectionsConfig.EncryptionKeys, newEncryptionKey)
+		network.ClearJoinRequests(connectionsConfig, pubKeyDigest, networkID)
+
+		response, err = s.connectResponse(wgConfig, targetNetwork, &newPeer)
+		return err
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
 	}
 
-	if !allowed {
-		log.Printf("Unauthorized connection attempt from public key: %s", pubKeyDigest)
-		http.Error(w, "Server public key not allowed", http.StatusUnauthorized)
+	if joinRequest != nil {
+		log.Printf("Join request %s from public key %s (%s, %s) is pending approval", joinRequest.ID, pubKeyDigest, joinRequest.Hostname, joinRequest.SourceIP)
+		http.Error(w, fmt.Sprintf("Join request %s is pending approval", joinRequest.ID), http.StatusAccepted)
 		return
 	}
 
-	var targetNetwork *types.Network
-	var networkIndex int
-	for i, netw := range connectionsConfig.Networks {
+	if err := s.writeResponse(w, r, requestEnvelope, request.PublicKey, response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if refreshed {
+		log.Printf("Server %s refreshed its address on network %s: %s", response.PeerID, networkID, response.WGAddress)
+		return
+	}
+
+	log.Printf("✅ Server connected to network %s: %s", networkID, pubKeyDigest)
+}
+
+// findConnectedPeer returns the peer of the network using the WireGuard key
+// of the request, when its encryption key is the one of the request too.
+func findConnectedPeer(connectionsConfig *types.ConnectionsConfig, networkID string, request *types.ConnectRequest) (*types.Network, *types.Peer) {
+	for i := range connectionsConfig.Networks {
+		netw := &connectionsConfig.Networks[i]
+		if netw.ID != networkID {
+			continue
+		}
+
+		for j := range netw.Peers {
+			peer := &netw.Peers[j]
+			if peer.PublicKey != request.WGPublicKey {
+				continue
+			}
+
+			for _, key := range connectionsConfig.EncryptionKeys {
+				if key.ID == peer.ID && key.PublicKey == request.PublicKey {
+					return netw, peer
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Server) connectResponse(wgConfig *types.WireguardConfig, targetNetwork *types.Network, peer *types.Peer) (types.ConnectResponse, error) {
+	_, wgNetworkBlock, err := net.ParseCIDR(targetNetwork.Address)
+	if err != nil {
+		return types.ConnectResponse{}, fmt.Errorf("failed to parse network address: %v", err)
+	}
+
+	return types.ConnectResponse{
+		WGPublicKey:    wgConfig.PublicKey,
+		WGNetworkBlock: wgNetworkBlock.String(),
+		WGAddress:      peer.Address,
+		PublicKey:      s.rsaKeys.PublicKey,
+		PeerID:         peer.ID,
+		NetworkID:      targetNetwork.ID,
+		WGPort:         network.ListenPort(targetNetwork),
+	}, nil
+}
+
+// queueJoinRequest records the connection attempt of an unknown key as a join
+// request an admin can approve or reject on the tower. The server keeps
+// polling while the request is pending.
+func queueJoinRequest(r *http.Request, connectionsConfig *types.ConnectionsConfig, networkID string, pubKeyDigest string, request *types.ConnectRequest) (*types.JoinRequest, error) {
+	networkFound := false
+	for _, netw := range connectionsConfig.Networks {
 		if netw.ID == networkID {
-			targetNetwork = &connectionsConfig.Networks[i]
-			networkIndex = i
+			networkFound = true
 			break
 		}
 	}
 
-	if targetNetwork == nil {
-		http.Error(w, "Network not found", http.StatusNotFound)
+	if !networkFound {
+		return nil, &httpError{status: http.StatusNotFound, message: "Network not found"}
+	}
+
+	sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	joinRequest, err := network.RecordJoinRequest(connectionsConfig, types.JoinRequest{
+		NetworkID:   networkID,
+		KeyDigest:   pubKeyDigest,
+		WGPublicKey: request.WGPublicKey,
+		Hostname:    request.Hostname,
+		SourceIP:    sourceIP,
+	})
+	if err != nil {
+		log.Printf("Dropped join request from public key %s: %v", pubKeyDigest, err)
+		return nil, &httpError{status: http.StatusTooManyRequests, message: "Too many pending join requests"}
+	}
+
+	if joinRequest.Status == network.JoinRequestRejected {
+		log.Printf("Rejected connection attempt from public key: %s", pubKeyDigest)
+		return nil, &httpError{status: http.StatusForbidden, message: "Join request rejected"}
+	}
+
+	return joinRequest, nil
+}
+
+// handleServerAssignment answers a connected server with its current
+// assignment on the network, which is how it learns about a new static
+// address. The request must be signed with the key of the peer, and nothing
+// is allocated or queued for peers the tower does not know.
+func (s *Server) handleServerAssignment(w http.ResponseWriter, r *http.Request, networkID string, peerID string) {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		log.Printf("Error loading connections config: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	for _, peer := range targetNetwork.Peers {
-		if request.WGPublicKey == peer.PublicKey {
-			http.Error(w, "Server already connected to this network", http.StatusConflict)
-			return
+	peerPublicKey := peerEncryptionKey(connectionsConfig, peerID)
+	if peerPublicKey == "" {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	peerKey := func(keyDigest string, payload []byte) (string, error) {
+		return peerPublicKey, nil
+	}
+
+	_, requestEnvelope, err := s.readRequest(r, peerKey)
+	if err != nil {
+		log.Printf("Unauthorized assignment request for peer %s: %v", peerID, err)
+		http.Error(w, "Invalid request envelope", http.StatusUnauthorized)
+		return
+	}
+
+	var targetNetwork *types.Network
+	var peer *types.Peer
+	for i := range connectionsConfig.Networks {
+		if connectionsConfig.Networks[i].ID != networkID {
+			continue
+		}
+
+		targetNetwork = &connectionsConfig.Networks[i]
+		for j := range targetNetwork.Peers {
+			if targetNetwork.Peers[j].ID == peerID {
+				peer = &targetNetwork.Peers[j]
+			}
 		}
 	}
 
+	if peer == nil {
+		http.Error(w, "Peer not found in this network", http.StatusNotFound)
+		return
+	}
+
 	wgConfig, err := config.LoadWireguardConfig()
 	if err != nil {
 		log.Printf("Error loading WireGuard config: %v", err)
@@ -128,99 +402,178 @@ func (s *Server) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, wgNetworkBlock, err := net.ParseCIDR(targetNetwork.Address)
+	response, err := s.connectResponse(wgConfig, targetNetwork, peer)
 	if err != nil {
-		log.Printf("Error parsing network address: %v", err)
+		log.Printf("Error building the assignment of peer %s: %v", peerID, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	wgAddress, err := network.GetNextAvailableNetworkAddress(connectionsConfig, wgNetworkBlock)
+	if err := s.writeResponse(w, r, requestEnvelope, peerPublicKey, response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleServerLeave(w http.ResponseWriter, r *http.Request, networkID string, peerID string) {
+	connectionsConfig, err := config.LoadConnectionsConfig()
 	if err != nil {
-		log.Printf("Error generating new address: %v", err)
+		log.Printf("Error loading connections config: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	newPeer := types.Peer{
-		ID:        network.GenerateTimeOrderedID(),
-		PublicKey: request.WGPublicKey,
-		Address:   wgAddress.String(),
+	peerPublicKey := peerEncryptionKey(connectionsConfig, peerID)
+	if peerPublicKey == "" {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
 	}
 
-	connectionsConfig.Networks[networkIndex].Peers = append(connectionsConfig.Networks[networkIndex].Peers, newPeer)
-
-	newEncryptionKey := types.EncryptionKey{
-		ID:        newPeer.ID,
-		Type:      "network_peer",
-		PublicKey: request.PublicKey,
+	peerKey := func(keyDigest string, payload []byte) (string, error) {
+		return peerPublicKey, nil
 	}
 
-	connectionsConfig.EncryptionKeys = append(connectionsConfig.EncryptionKeys, newEncryptionKey)
+	if _, _, err := s.readRequest(r, peerKey); err != nil {
+		log.Printf("Unauthorized leave attempt for peer %s: %v", peerID, err)
+		http.Error(w, "Invalid request envelope", http.StatusUnauthorized)
+		return
+	}
 
-	if err := config.SaveConnectionsConfig(connectionsConfig); err != nil {
-		log.Printf("Error saving connections config: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	var targetNetwork *types.Network
+	var peer *types.Peer
+	err = config.UpdateConnectionsConfig(func(connectionsConfig *types.ConnectionsConfig) error {
+		var err error
+		targetNetwork, peer, err = network.RemovePeer(connectionsConfig, peerID)
+		if err != nil || targetNetwork.ID != networkID {
+			return &httpError{status: http.StatusNotFound, message: "Peer not found in this network"}
+		}
+		return nil
+	})
+	if err != nil {
+		writeHTTPError(w, err)
 		return
 	}
 
-	response := types.ConnectResponse{
-		WGPublicKey:    wgConfig.PublicKey,
-		WGNetworkBlock: wgNetworkBlock.String(),
-		WGAddress:      wgAddress.String(),
-		PublicKey:      wgConfig.PublicKey,
-		PeerID:         newPeer.ID,
-		NetworkID:      targetNetwork.ID,
+	if err := network.RemoveInterfacePeer(network.InterfaceName(s.nodeType, targetNetwork), peer.PublicKey); err != nil {
+		log.Printf("Warning: failed to remove peer from interface, it will be removed on the next reload: %v", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	w.WriteHeader(http.StatusNoContent)
+
+	log.Printf("✅ Peer %s left network %s", peerID, networkID)
+}
+
+// peerEncryptionKey returns the RSA public key the peer signs its requests
+// with, empty for unknown peers.
+func peerEncryptionKey(connectionsConfig *types.ConnectionsConfig, peerID string) string {
+	for _, key := range connectionsConfig.EncryptionKeys {
+		if key.ID == peerID {
+			return key.PublicKey
+		}
+	}
+
+	return ""
+}
+
+// httpError aborts a connections config update with the status and message
+// answered to the client.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		http.Error(w, httpErr.message, httpErr.status)
 		return
 	}
 
-	log.Printf("✅ Server connected to network %s: %s", networkID, crypto.GetPublicKeyDigest(request.PublicKey))
+	log.Printf("Error updating connections config: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
 }
 
-func (s *Server) watchConnectionsFile() {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+// handleNetworkStatus reports the live peer status of the tower networks. It is
+// only served to local clients and to peers of the tower networks, since it
+// exposes the public endpoints of every peer.
+func (s *Server) handleNetworkStatus(w http.ResponseWriter, r *http.Request) {
+	if s.nodeType != "tower" {
+		http.Error(w, "This endpoint is only available on tower nodes", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	for {
-		select {
-		case <-s.fileWatcherCtx.Done():
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		log.Printf("Error loading connections config: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !isInternalRequest(r, connectionsConfig) {
+		http.Error(w, "Status is only available from the tower or its networks", http.StatusForbidden)
+		return
+	}
+
+	threshold := network.DefaultHandshakeThreshold
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		threshold, err = time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "Invalid threshold duration", http.StatusBadRequest)
 			return
-		case <-ticker.C:
-			currentHash := s.getConnectionsFileHash()
-			if currentHash != s.lastConnectionsHash && currentHash != "" {
-				log.Printf("Connections file changed, reloading WireGuard interfaces...")
-				if err := network.WriteWireguardInterfaces(s.nodeType); err != nil {
-					log.Printf("Error writing WireGuard interfaces: %v", err)
-				} else {
-					log.Printf("WireGuard interfaces updated successfully")
-				}
-				s.lastConnectionsHash = currentHash
-			}
 		}
 	}
+
+	statuses, err := network.GetNetworksStatus(s.nodeType, connectionsConfig, threshold)
+	if err != nil {
+		log.Printf("Error reading network status: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
 }
 
-func (s *Server) getConnectionsFileHash() string {
-	data, err := os.ReadFile(config.ConnectionsConfigFile)
+// isInternalRequest tells if the request comes from the tower itself or from
+// an address inside one of the tower networks.
+func isInternalRequest(r *http.Request, connectionsConfig *types.ConnectionsConfig) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("Warning: Failed to read connections file for hash: %v", err)
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	for _, netw := range connectionsConfig.Networks {
+		_, block, err := net.ParseCIDR(netw.Address)
+		if err == nil && block.Contains(ip) {
+			return true
 		}
-		return ""
 	}
 
-	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:])
+	return false
 }
 
 func (s *Server) Stop() {
-	s.fileWatcherCancel()
+	s.reconcilerCancel()
 
 	if err := s.httpServer.Shutdown(context.Background()); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
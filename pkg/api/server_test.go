@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// TestMain keeps the state of the handlers in a temporary config directory,
+// the connections store is picked once per process.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "upduck-api")
+	if err != nil {
+		panic(err)
+	}
+
+	config.ConnectionsConfigFile = filepath.Join(dir, "connections.json")
+	config.NodeConfigFile = filepath.Join(dir, "config.json")
+	config.WireguardConfigFile = filepath.Join(dir, "wireguard-config.json")
+
+	if testKeys.tower, err = crypto.GenerateRSAKeys(); err != nil {
+		panic(err)
+	}
+	if testKeys.server, err = crypto.GenerateRSAKeys(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testKeys are the RSA keys of the tower and of a server.
+var testKeys struct {
+	tower  *types.RSAKeysConfig
+	server *types.RSAKeysConfig
+}
+
+// newTestTower returns a tower with the given connections config, serving
+// the requests of the server keys.
+func newTestTower(t *testing.T, connectionsConfig *types.ConnectionsConfig) *Server {
+	t.Helper()
+
+	if err := config.SaveWireguardConfig(&types.WireguardConfig{PublicKey: "tower-wg-key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := config.UpdateConnectionsConfig(func(current *types.ConnectionsConfig) error {
+		*current = *connectionsConfig
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("tower", DefaultPort)
+	server.rsaKeys = testKeys.tower
+
+	return server
+}
+
+// serveSealed sends the payload sealed with the server keys to the tower and
+// returns the recorded response.
+func serveSealed(t *testing.T, server *Server, method, path string, payload interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := sealEnvelope(method, path, "", data, testKeys.server, testKeys.tower.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleServerNetwork(recorder, httptest.NewRequest(method, path, bytes.NewReader(body)))
+
+	return recorder
+}
+
+func TestHandleServerConnectJoinToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedOn  string
+		joinToken  string
+		wantStatus int
+	}{
+		{name: "unknown key with a token", joinToken: "secret1", wantStatus: http.StatusOK},
+		{name: "key known elsewhere with a token", allowedOn: "net2", joinToken: "secret1", wantStatus: http.StatusOK},
+		{name: "key known elsewhere", allowedOn: "net2", wantStatus: http.StatusForbidden},
+		{name: "key known elsewhere with a bad token", allowedOn: "net2", joinToken: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", wantStatus: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connectionsConfig := &types.ConnectionsConfig{
+				Networks: []types.Network{
+					{ID: "net1", Address: "10.8.0.0/24", Peers: []types.Peer{}},
+					{ID: "net2", Address: "10.9.0.0/24", Peers: []types.Peer{}},
+				},
+				JoinTokens: []types.JoinToken{{ID: "token1", NetworkID: "net1", SecretHash: crypto.HashTokenSecret("secret1")}},
+			}
+
+			if tt.allowedOn != "" {
+				connectionsConfig.Authorizations = []types.KeyAuthorization{{
+					KeyDigest: crypto.GetPublicKeyDigest(testKeys.server.PublicKey),
+					NetworkID: tt.allowedOn,
+				}}
+			}
+
+			server := newTestTower(t, connectionsConfig)
+
+			recorder := serveSealed(t, server, http.MethodPost, "/api/servers/network/net1/connect", types.ConnectRequest{
+				PublicKey:   testKeys.server.PublicKey,
+				WGPublicKey: "server-wg-key",
+				JoinToken:   tt.joinToken,
+			})
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", recorder.Code, recorder.Body, tt.wantStatus)
+			}
+
+			state, err := config.LoadConnectionsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peers := state.Networks[0].Peers
+			if tt.wantStatus == http.StatusOK && (len(peers) != 1 || peers[0].PublicKey != "server-wg-key") {
+				t.Errorf("peers of net1 = %+v, want the server", peers)
+			}
+			if tt.wantStatus != http.StatusOK && len(peers) != 0 {
+				t.Errorf("peers of net1 = %+v, want none", peers)
+			}
+		})
+	}
+}
+
+func TestHandleServerAssignment(t *testing.T) {
+	tests := []struct {
+		name       string
+		peerKey    string
+		path       string
+		wantStatus int
+	}{
+		{name: "connected peer", peerKey: testKeys.server.PublicKey, path: "/api/servers/network/net1/peers/peerA", wantStatus: http.StatusOK},
+		{name: "unknown peer", peerKey: testKeys.server.PublicKey, path: "/api/servers/network/net1/peers/peerB", wantStatus: http.StatusNotFound},
+		{name: "other network", peerKey: testKeys.server.PublicKey, path: "/api/servers/network/net2/peers/peerA", wantStatus: http.StatusNotFound},
+		{name: "signed with another key", peerKey: testKeys.tower.PublicKey, path: "/api/servers/network/net1/peers/peerA", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connectionsConfig := &types.ConnectionsConfig{
+				Networks: []types.Network{
+					{
+						ID:      "net1",
+						Address: "10.8.0.0/24",
+						Peers:   []types.Peer{{ID: "peerA", PublicKey: "server-wg-key", Address: "10.8.0.10/32"}},
+						Leases:  []types.Lease{{Address: "10.8.0.10/32", PeerID: "peerA", Static: true}},
+					},
+					{ID: "net2", Address: "10.9.0.0/24", Peers: []types.Peer{}},
+				},
+				EncryptionKeys: []types.EncryptionKey{{ID: "peerA", Type: "network_peer", PublicKey: tt.peerKey}},
+			}
+
+			server := newTestTower(t, connectionsConfig)
+			before, err := config.LoadConnectionsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := serveSealed(t, server, http.MethodGet, tt.path, struct{}{})
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", recorder.Code, recorder.Body, tt.wantStatus)
+			}
+
+			// the assignment is read-only, whatever the answer
+			after, err := config.LoadConnectionsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(before, after) {
+				t.Errorf("connections changed:\n%+v\n%+v", before, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/crypto"
+)
+
+// FingerprintError is returned when the tower presents a certificate that
+// does not match the pinned fingerprint.
+type FingerprintError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *FingerprintError) Error() string {
+	return fmt.Sprintf("tower certificate fingerprint changed: expected %s, got %s. "+
+		"If the tower certificate was regenerated on purpose, pass the new fingerprint with --tower-fingerprint, "+
+		"otherwise someone may be intercepting the connection", e.Expected, e.Actual)
+}
+
+// DefaultPort is the port the upduck daemon serves its API on, assumed for
+// tower addresses without one.
+const DefaultPort = config.DefaultAPIPort
+
+// NormalizeTowerAddress returns the tower address as an https URL with a
+// port. Addresses without a scheme are assumed to be https, plain http is
+// refused since the tower API is only served over TLS, and addresses without
+// a port get the DefaultPort of the daemon.
+func NormalizeTowerAddress(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+
+	towerURL, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse tower URL: %w", err)
+	}
+
+	if towerURL.Scheme != "https" {
+		return "", fmt.Errorf("tower API is served over https, got %s://", towerURL.Scheme)
+	}
+
+	if towerURL.Host == "" {
+		return "", fmt.Errorf("missing tower host in %s", address)
+	}
+
+	if towerURL.Port() == "" {
+		towerURL.Host = net.JoinHostPort(towerURL.Hostname(), DefaultPort)
+	}
+
+	return strings.TrimSuffix(towerURL.String(), "/"), nil
+}
+
+// FetchTowerFingerprint connects to the tower without verifying its
+// certificate and returns the fingerprint it presents, to be trusted on first use.
+func FetchTowerFingerprint(address string) (string, error) {
+	towerURL, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse tower URL: %w", err)
+	}
+
+	host := towerURL.Host
+	if towerURL.Port() == "" {
+		host = net.JoinHostPort(towerURL.Hostname(), DefaultPort)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to reach tower: %w", err)
+	}
+	defer conn.Close()
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return "", fmt.Errorf("tower presented no certificate")
+	}
+
+	return crypto.GetCertificateFingerprint(certificates[0].Raw), nil
+}
+
+// newPinnedHTTPClient returns an HTTP client that only talks to a server
+// presenting the certificate with the given fingerprint. The certificate is
+// self-signed, so the usual chain and hostname checks are replaced by the pin.
+func newPinnedHTTPClient(fingerprint string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if fingerprint == "" {
+				return fmt.Errorf("no pinned tower certificate fingerprint")
+			}
+
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("tower presented no certificate")
+			}
+
+			actual := crypto.GetCertificateFingerprint(state.PeerCertificates[0].Raw)
+			if !strings.EqualFold(actual, fingerprint) {
+				return &FingerprintError{Expected: fingerprint, Actual: actual}
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
@@ -0,0 +1,210 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+const (
+	// DefaultDirectory is the ACME directory used when the node config does
+	// not set one.
+	DefaultDirectory = acme.LetsEncryptURL
+
+	// issueTimeout bounds a whole issuance, validation included.
+	issueTimeout = 2 * time.Minute
+)
+
+// Issuer obtains certificates from an ACME directory, validating the domains
+// with the HTTP-01 challenge. The challenge responses are written to
+// config.ACMEChallengeDir, which the Nginx sites of TLS forwards serve.
+type Issuer struct {
+	client *acme.Client
+	email  string
+}
+
+// NewIssuer returns an issuer for the directory, registering with the account
+// key stored in the config directory, created on first use.
+func NewIssuer(directoryURL string, email string) (*Issuer, error) {
+	if directoryURL == "" {
+		directoryURL = DefaultDirectory
+	}
+
+	accountKey, err := loadOrCreateAccountKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %v", err)
+	}
+
+	return &Issuer{
+		client: &acme.Client{Key: accountKey, DirectoryURL: directoryURL},
+		email:  email,
+	}, nil
+}
+
+// Issue obtains a certificate for the domain and stores it with its key.
+func (i *Issuer) Issue(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, issueTimeout)
+	defer cancel()
+
+	account := &acme.Account{}
+	if i.email != "" {
+		account.Contact = []string{"mailto:" + i.email}
+	}
+
+	if _, err := i.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	order, err := i.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+
+	order, err = i.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return err
+	}
+
+	chain, _, err := i.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %v", err)
+	}
+
+	return storeCertificate(domain, chain, key)
+}
+
+// authorize completes the HTTP-01 challenge of an authorization.
+func (i *Issuer) authorize(ctx context.Context, authzURL string) error {
+	authz, err := i.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %v", err)
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	response, err := i.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	responsePath := filepath.Join(config.ACMEChallengeDir, filepath.FromSlash(i.client.HTTP01ChallengePath(challenge.Token)))
+	if err := system.MkdirAll(filepath.Dir(responsePath), 0755); err != nil {
+		return err
+	}
+
+	if err := system.WriteFile(responsePath, []byte(response), 0644); err != nil {
+		return fmt.Errorf("failed to write challenge response: %v", err)
+	}
+	defer system.RemoveFile(responsePath)
+
+	if _, err := i.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge: %v", err)
+	}
+
+	if _, err := i.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("validation of %s failed: %v", authz.Identifier.Value, err)
+	}
+
+	return nil
+}
+
+func storeCertificate(domain string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	if err := system.MkdirAll(filepath.Dir(CertificateFile(domain)), 0755); err != nil {
+		return err
+	}
+
+	var chainPEM []byte
+	for _, der := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := system.WriteFile(KeyFile(domain), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write certificate key: %v", err)
+	}
+
+	if err := system.WriteFile(CertificateFile(domain), chainPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+
+	return nil
+}
+
+func loadOrCreateAccountKey() (crypto.Signer, error) {
+	data, err := os.ReadFile(config.ACMEAccountKey)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid key in %s", config.ACMEAccountKey)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := system.WriteFile(config.ACMEAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
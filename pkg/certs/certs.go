@@ -0,0 +1,131 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+const (
+	// renewBefore is how long before expiry a certificate is renewed.
+	renewBefore = 30 * 24 * time.Hour
+
+	// retryAfter is how long a failed issuance waits before being retried,
+	// ACME servers rate limit failed validations.
+	retryAfter = time.Hour
+)
+
+// Status is the state of the certificate of a domain. NotAfter is read from
+// the certificate, the rest is kept next to it by the daemon.
+type Status struct {
+	NotAfter    time.Time `json:"-"`
+	IssuedAt    time.Time `json:"issued_at,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// CertificateFile returns the path of the certificate chain of the domain.
+func CertificateFile(domain string) string {
+	return filepath.Join(config.CertificatesDir, domain, "fullchain.pem")
+}
+
+// KeyFile returns the path of the private key of the domain certificate.
+func KeyFile(domain string) string {
+	return filepath.Join(config.CertificatesDir, domain, "privkey.pem")
+}
+
+func statusFile(domain string) string {
+	return filepath.Join(config.CertificatesDir, domain, "status.json")
+}
+
+// Exists reports whether a certificate was issued for the domain.
+func Exists(domain string) bool {
+	if _, err := os.Stat(CertificateFile(domain)); err != nil {
+		return false
+	}
+
+	_, err := os.Stat(KeyFile(domain))
+	return err == nil
+}
+
+// LoadStatus returns the certificate status of the domain, an empty status
+// when no certificate was requested yet.
+func LoadStatus(domain string) (*Status, error) {
+	status := &Status{}
+
+	data, err := os.ReadFile(statusFile(domain))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, status); err != nil {
+			return nil, fmt.Errorf("invalid certificate status of %s: %v", domain, err)
+		}
+	}
+
+	chain, err := os.ReadFile(CertificateFile(domain))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status, nil
+		}
+		return nil, err
+	}
+
+	block, _ := pem.Decode(chain)
+	if block == nil {
+		return nil, fmt.Errorf("invalid certificate of %s", domain)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate of %s: %v", domain, err)
+	}
+	status.NotAfter = certificate.NotAfter
+
+	return status, nil
+}
+
+func saveStatus(domain string, status *Status) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return system.WriteFile(statusFile(domain), data, 0644)
+}
+
+// NeedsRenewal reports whether a certificate has to be requested, because
+// there is none or it expires soon.
+func (s *Status) NeedsRenewal(now time.Time) bool {
+	return s.NotAfter.IsZero() || s.NotAfter.Sub(now) < renewBefore
+}
+
+// CanRetry reports whether enough time passed since the last failed attempt.
+func (s *Status) CanRetry(now time.Time) bool {
+	return s.LastError == "" || now.Sub(s.LastAttempt) >= retryAfter
+}
+
+// Summary describes the status in a few words, for listings.
+func (s *Status) Summary(now time.Time) string {
+	switch {
+	case s.LastError != "" && s.NotAfter.IsZero():
+		return fmt.Sprintf("failed: %s", s.LastError)
+	case s.LastError != "":
+		return fmt.Sprintf("expires %s, renewal failed: %s", s.NotAfter.Local().Format("2006-01-02"), s.LastError)
+	case s.NotAfter.IsZero():
+		return "pending"
+	case !s.NotAfter.After(now):
+		return "expired"
+	case s.NeedsRenewal(now):
+		return fmt.Sprintf("renewal due, expires %s", s.NotAfter.Local().Format("2006-01-02"))
+	default:
+		return fmt.Sprintf("valid until %s", s.NotAfter.Local().Format("2006-01-02"))
+	}
+}
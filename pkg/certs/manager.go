@@ -0,0 +1,100 @@
+package certs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+)
+
+// checkInterval is how often the manager looks for certificates to request,
+// new TLS forwards get their certificate within this delay.
+const checkInterval = time.Minute
+
+// Manager requests and renews the certificates of the TLS forwards of the
+// tower. It runs in the daemon.
+type Manager struct {
+	onIssued func(reason string)
+}
+
+// NewManager returns a manager calling onIssued after certificates are
+// issued, so the Nginx sites can be switched to them.
+func NewManager(onIssued func(reason string)) *Manager {
+	return &Manager{onIssued: onIssued}
+}
+
+// Run checks the certificates at startup and then periodically until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) check(ctx context.Context) {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		log.Printf("Error checking certificates: %v", err)
+		return
+	}
+
+	var issuer *Issuer
+	for _, forward := range connectionsConfig.Forwards {
+		if !forward.TLS {
+			continue
+		}
+
+		status, err := LoadStatus(forward.Domain)
+		if err != nil {
+			log.Printf("Error checking certificate of %s: %v", forward.Domain, err)
+			continue
+		}
+
+		now := time.Now()
+		if !status.NeedsRenewal(now) || !status.CanRetry(now) {
+			continue
+		}
+
+		if issuer == nil {
+			// the node config is read on every check, so a new ACME
+			// directory is used without restarting the daemon
+			nodeConfig, err := config.LoadNodeConfig()
+			if err != nil {
+				log.Printf("Error checking certificates: %v", err)
+				return
+			}
+
+			issuer, err = NewIssuer(nodeConfig.ACMEDirectory, nodeConfig.ACMEEmail)
+			if err != nil {
+				log.Printf("Error checking certificates: %v", err)
+				return
+			}
+		}
+
+		log.Printf("Requesting certificate for %s", forward.Domain)
+
+		status.LastAttempt = now.UTC()
+		if err := issuer.Issue(ctx, forward.Domain); err != nil {
+			log.Printf("Error requesting certificate for %s: %v", forward.Domain, err)
+			status.LastError = err.Error()
+		} else {
+			log.Printf("Certificate issued for %s", forward.Domain)
+			status.LastError = ""
+			status.IssuedAt = status.LastAttempt
+			m.onIssued("certificate issued for " + forward.Domain)
+		}
+
+		if err := saveStatus(forward.Domain, status); err != nil {
+			log.Printf("Error saving certificate status of %s: %v", forward.Domain, err)
+		}
+	}
+}
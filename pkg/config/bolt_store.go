@@ -0,0 +1,386 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const boltOpenTimeout = 10 * time.Second
+
+var (
+	boltMetaBucket           = []byte("meta")
+	boltNetworksBucket       = []byte("networks")
+	boltAuthorizationsBucket = []byte("authorizations")
+	boltEncryptionKeysBucket = []byte("encryption_keys")
+	boltJoinTokensBucket     = []byte("join_tokens")
+	boltJoinRequestsBucket   = []byte("join_requests")
+	boltForwardsBucket       = []byte("forwards")
+	boltPortForwardsBucket   = []byte("port_forwards")
+
+	boltVersionKey  = []byte("version")
+	boltRevisionKey = []byte("revision")
+)
+
+// boltCollectionBuckets are the buckets holding the collections of the
+// connections config.
+var boltCollectionBuckets = [][]byte{
+	boltNetworksBucket,
+	boltAuthorizationsBucket,
+	boltEncryptionKeysBucket,
+	boltJoinTokensBucket,
+	boltJoinRequestsBucket,
+	boltForwardsBucket,
+	boltPortForwardsBucket,
+}
+
+// boltStore keeps the connections config in an embedded bbolt database, one
+// bucket per collection keyed by record ID, so an update only rewrites the
+// records it changed. A load still decodes every bucket, only the writes stay
+// small as the config grows. The database is opened for every operation,
+// which lets the CLI and the daemon share it: bbolt locks the file,
+// exclusively for updates and shared for reads.
+type boltStore struct {
+	path       string
+	importPath string
+}
+
+// NewBoltStore returns a store kept in the database at path. A new database
+// imports the JSON connections config at importPath, when it exists.
+func NewBoltStore(path, importPath string) Store {
+	return &boltStore{path: path, importPath: importPath}
+}
+
+func (s *boltStore) open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			if err := s.init(); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %v", s.path, err)
+	}
+
+	return db, nil
+}
+
+// init creates the database with an update that changes nothing, which also
+// runs the import.
+func (s *boltStore) init() error {
+	return s.Update(func(config *types.ConnectionsConfig) error {
+		return nil
+	})
+}
+
+func (s *boltStore) Load() (*types.ConnectionsConfig, error) {
+	// a dry run must not create the database, show what it would import
+	if _, err := os.Stat(s.path); os.IsNotExist(err) && system.DryRun() {
+		return s.importConfig()
+	}
+
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var config *types.ConnectionsConfig
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		config, err = readBoltConfig(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (s *boltStore) Update(update func(config *types.ConnectionsConfig) error) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+
+		var config *types.ConnectionsConfig
+		if meta == nil {
+			config, err = s.importConfig()
+			if err != nil {
+				return err
+			}
+		} else {
+			config, err = readBoltConfig(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := update(config); err != nil {
+			return err
+		}
+
+		return writeBoltConfig(tx, config)
+	})
+}
+
+func (s *boltStore) Revision() (string, error) {
+	db, err := s.open(true)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var revision string
+	err = db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(boltMetaBucket); meta != nil {
+			revision = string(meta.Get(boltRevisionKey))
+		}
+		return nil
+	})
+
+	return revision, err
+}
+
+// importConfig returns the JSON connections config the database starts from.
+func (s *boltStore) importConfig() (*types.ConnectionsConfig, error) {
+	if s.importPath == "" {
+		return newConnectionsConfig(), nil
+	}
+
+	config, err := NewJSONStore(s.importPath).Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to import %s: %v", s.importPath, err)
+	}
+
+	return config, nil
+}
+
+func readBoltConfig(tx *bolt.Tx) (*types.ConnectionsConfig, error) {
+	config := newConnectionsConfig()
+
+	meta := tx.Bucket(boltMetaBucket)
+	if meta == nil {
+		return config, nil
+	}
+
+	version, err := strconv.Atoi(string(meta.Get(boltVersionKey)))
+	if err != nil {
+		version = config.Version
+	}
+
+	if version > config.Version {
+		return nil, fmt.Errorf("state database has schema version %d, this upduck only supports up to %d", version, config.Version)
+	}
+
+	if version < config.Version {
+		return upgradeBoltConfig(tx, version)
+	}
+
+	if config.Networks, err = readBoltRecords[types.Network](tx, boltNetworksBucket); err != nil {
+		return nil, err
+	}
+	if config.Authorizations, err = readBoltRecords[types.KeyAuthorization](tx, boltAuthorizationsBucket); err != nil {
+		return nil, err
+	}
+	if config.EncryptionKeys, err = readBoltRecords[types.EncryptionKey](tx, boltEncryptionKeysBucket); err != nil {
+		return nil, err
+	}
+	if config.JoinTokens, err = readBoltRecords[types.JoinToken](tx, boltJoinTokensBucket); err != nil {
+		return nil, err
+	}
+	if config.JoinRequests, err = readBoltRecords[types.JoinRequest](tx, boltJoinRequestsBucket); err != nil {
+		return nil, err
+	}
+	if config.Forwards, err = readBoltRecords[types.Forward](tx, boltForwardsBucket); err != nil {
+		return nil, err
+	}
+	if config.PortForwards, err = readBoltRecords[types.PortForward](tx, boltPortForwardsBucket); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// upgradeBoltConfig runs the migrations of the connections config file on the
+// records of a database written by an older version. The records are read as
+// they were stored, since their fields may have changed since, and each
+// bucket is named after its collection in the config file. The result is
+// persisted by the next update.
+func upgradeBoltConfig(tx *bolt.Tx, version int) (*types.ConnectionsConfig, error) {
+	raw := map[string]interface{}{"version": version}
+
+	for _, name := range boltCollectionBuckets {
+		records, err := readBoltRecords[json.RawMessage](tx, name)
+		if err != nil {
+			return nil, err
+		}
+		raw[string(name)] = records
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	upgraded := newConnectionsConfig()
+	if _, _, err := connectionsConfigSchema.upgrade(data, upgraded); err != nil {
+		return nil, err
+	}
+
+	return upgraded, nil
+}
+
+func writeBoltConfig(tx *bolt.Tx, config *types.ConnectionsConfig) error {
+	err := writeBoltRecords(tx, boltNetworksBucket, config.Networks, func(netw types.Network) string {
+		return netw.ID
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltAuthorizationsBucket, config.Authorizations, func(authorization types.KeyAuthorization) string {
+		return authorization.NetworkID + "/" + authorization.KeyDigest
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltEncryptionKeysBucket, config.EncryptionKeys, func(key types.EncryptionKey) string {
+		return key.ID
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltJoinTokensBucket, config.JoinTokens, func(token types.JoinToken) string {
+		return token.ID
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltJoinRequestsBucket, config.JoinRequests, func(request types.JoinRequest) string {
+		return request.ID
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltForwardsBucket, config.Forwards, func(forward types.Forward) string {
+		return forward.Domain
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeBoltRecords(tx, boltPortForwardsBucket, config.PortForwards, func(forward types.PortForward) string {
+		return fmt.Sprintf("%s/%d", forward.Protocol, forward.PublicPort)
+	})
+	if err != nil {
+		return err
+	}
+
+	meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+
+	revision, _ := strconv.ParseUint(string(meta.Get(boltRevisionKey)), 10, 64)
+	if err := meta.Put(boltRevisionKey, []byte(strconv.FormatUint(revision+1, 10))); err != nil {
+		return err
+	}
+
+	return meta.Put(boltVersionKey, []byte(strconv.Itoa(connectionsConfigSchema.version())))
+}
+
+func readBoltRecords[T any](tx *bolt.Tx, name []byte) ([]T, error) {
+	records := []T{}
+
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return records, nil
+	}
+
+	err := bucket.ForEach(func(key, value []byte) error {
+		var record T
+		if err := json.Unmarshal(value, &record); err != nil {
+			return fmt.Errorf("invalid %s record %s: %v", name, key, err)
+		}
+		records = append(records, record)
+		return nil
+	})
+
+	return records, err
+}
+
+// writeBoltRecords makes the bucket hold exactly the given records, writing
+// only the ones that changed.
+func writeBoltRecords[T any](tx *bolt.Tx, name []byte, records []T, recordKey func(T) string) error {
+	bucket, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string][]byte, len(records))
+	for _, record := range records {
+		key := recordKey(record)
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("duplicate %s record %s", name, key)
+		}
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+
+	var removed [][]byte
+	err = bucket.ForEach(func(key, value []byte) error {
+		if _, ok := values[string(key)]; !ok {
+			removed = append(removed, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range removed {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range values {
+		if bytes.Equal(bucket.Get([]byte(key)), value) {
+			continue
+		}
+
+		if err := bucket.Put([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
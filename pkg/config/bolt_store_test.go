@@ -0,0 +1,18 @@
+package config_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/config/storetest"
+)
+
+func TestBoltStore(t *testing.T) {
+	err := storetest.TestStore(func(dir string) (config.Store, error) {
+		return config.NewBoltStore(filepath.Join(dir, "state.db"), filepath.Join(dir, "connections.json")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
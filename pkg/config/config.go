@@ -6,9 +6,14 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/duck-labs/upduck/pkg/system"
 	"github.com/duck-labs/upduck/pkg/types"
 )
 
+// DefaultAPIPort is the port the upduck daemon serves its API on when it is
+// not given --port.
+const DefaultAPIPort = "8080"
+
 var (
 	ConfigDir             = getConfigDir()
 	WireguardConfigDir    = filepath.Join(ConfigDir, "wg-config")
@@ -17,6 +22,16 @@ var (
 	NodeConfigFile        = filepath.Join(ConfigDir, "config.json")
 	RSAPublicKey          = filepath.Join(ConfigDir, "public-key.pem")
 	RSAPrivateKey         = filepath.Join(ConfigDir, "private-key.pem")
+	TLSCertificate        = filepath.Join(ConfigDir, "tls-cert.pem")
+	TLSPrivateKey         = filepath.Join(ConfigDir, "tls-key.pem")
+	StateDatabaseFile     = filepath.Join(ConfigDir, "state.db")
+	CertificatesDir       = filepath.Join(ConfigDir, "certs")
+	ACMEAccountKey        = filepath.Join(ConfigDir, "acme-account-key.pem")
+	ACMEChallengeDir      = filepath.Join(ConfigDir, "acme-challenges")
+	ForwardHealthFile     = filepath.Join(ConfigDir, "forward-health.json")
+
+	connectionsBackupFile = ConnectionsConfigFile + ".bak"
+	connectionsLockFile   = ConnectionsConfigFile + ".lock"
 )
 
 func getConfigDir() string {
@@ -28,28 +43,26 @@ func getConfigDir() string {
 }
 
 func EnsureConfigDir() error {
-	return os.MkdirAll(ConfigDir, 0755)
+	return system.MkdirAll(ConfigDir, 0755)
 }
 
 func EnsureWireguardDir() error {
-	return os.MkdirAll(WireguardConfigDir, 0755)
+	return system.MkdirAll(WireguardConfigDir, 0755)
 }
 
-func WriteNodeConfig(nodeType string) error {
+func WriteNodeConfig(config *types.NodeConfig) error {
 	if err := EnsureConfigDir(); err != nil {
 		return err
 	}
 
-	config := types.NodeConfig{
-		Type: nodeType,
-	}
+	config.Version = nodeConfigSchema.version()
 
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(NodeConfigFile, data, 0600)
+	return system.WriteFile(NodeConfigFile, data, 0600)
 }
 
 func LoadNodeConfig() (*types.NodeConfig, error) {
@@ -62,7 +75,7 @@ func LoadNodeConfig() (*types.NodeConfig, error) {
 	}
 
 	var config types.NodeConfig
-	if err := json.Unmarshal(data, &config); err != nil {
+	if _, _, err := nodeConfigSchema.upgrade(data, &config); err != nil {
 		return nil, err
 	}
 
@@ -74,12 +87,14 @@ func SaveWireguardConfig(config *types.WireguardConfig) error {
 		return err
 	}
 
+	config.Version = wireguardConfigSchema.version()
+
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(WireguardConfigFile, data, 0600)
+	return system.WriteFile(WireguardConfigFile, data, 0600)
 }
 
 func LoadWireguardConfig() (*types.WireguardConfig, error) {
@@ -89,43 +104,9 @@ func LoadWireguardConfig() (*types.WireguardConfig, error) {
 	}
 
 	var config types.WireguardConfig
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, err
-	}
-
-	return &config, nil
-}
-
-func LoadConnectionsConfig() (*types.ConnectionsConfig, error) {
-	data, err := os.ReadFile(ConnectionsConfigFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &types.ConnectionsConfig{
-				Networks:       []types.Network{},
-				AllowedKeys:    []string{},
-				EncryptionKeys: []types.EncryptionKey{},
-			}, nil
-		}
-		return nil, err
-	}
-
-	var config types.ConnectionsConfig
-	if err := json.Unmarshal(data, &config); err != nil {
+	if _, _, err := wireguardConfigSchema.upgrade(data, &config); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
-
-func SaveConnectionsConfig(config *types.ConnectionsConfig) error {
-	if err := EnsureConfigDir(); err != nil {
-		return err
-	}
-
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(ConnectionsConfigFile, data, 0644)
-}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// CorruptedConfigError is returned when a config file exists but cannot be
+// decoded, usually after a crash in the middle of a non atomic write.
+type CorruptedConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptedConfigError) Error() string {
+	return fmt.Sprintf("%s is corrupted: %v", e.Path, e.Err)
+}
+
+func (e *CorruptedConfigError) Unwrap() error {
+	return e.Err
+}
+
+// lockFile takes an exclusive lock on path, blocking until it is available.
+// The lock is held on a separate file so renaming the config over itself does
+// not release it.
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
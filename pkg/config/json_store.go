@@ -0,0 +1,138 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// jsonStore keeps the connections config in a single JSON file. Updates hold
+// a lock on a file next to it and replace it atomically, the last good copy
+// is kept to recover from a corrupted file.
+type jsonStore struct {
+	path       string
+	backupPath string
+	lockPath   string
+}
+
+func NewJSONStore(path string) Store {
+	return &jsonStore{
+		path:       path,
+		backupPath: path + ".bak",
+		lockPath:   path + ".lock",
+	}
+}
+
+// Load reads the file without locking it, writes are atomic so readers
+// always see a complete file. A corrupted file is replaced by the last good copy.
+func (s *jsonStore) Load() (*types.ConnectionsConfig, error) {
+	config, err := readConnectionsConfig(s.path)
+	if err == nil {
+		return config, nil
+	}
+
+	if os.IsNotExist(err) {
+		return newConnectionsConfig(), nil
+	}
+
+	var corruptedErr *CorruptedConfigError
+	if !errors.As(err, &corruptedErr) {
+		return nil, err
+	}
+
+	config, backupErr := readConnectionsConfig(s.backupPath)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%v, and no last good copy could be loaded from %s: %v", err, s.backupPath, backupErr)
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: %v, using the last good copy from %s\n", err, s.backupPath)
+
+	return config, nil
+}
+
+func (s *jsonStore) Update(update func(config *types.ConnectionsConfig) error) error {
+	if err := system.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return fmt.Errorf("failed to lock connections config: %v", err)
+	}
+	defer unlock()
+
+	config, err := s.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load connections config: %v", err)
+	}
+
+	if err := update(config); err != nil {
+		return err
+	}
+
+	config.Version = connectionsConfigSchema.version()
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode connections config: %v", err)
+	}
+
+	// keep a copy of a corrupted file for inspection before it is replaced
+	var corruptedErr *CorruptedConfigError
+	if _, err := readConnectionsConfig(s.path); errors.As(err, &corruptedErr) {
+		if corrupted, err := os.ReadFile(s.path); err == nil {
+			system.WriteFile(s.path+".corrupted", corrupted, 0600)
+		}
+	}
+
+	if err := system.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save connections config: %v", err)
+	}
+
+	// the copy is only refreshed once the new config is safely on disk
+	if err := system.WriteFile(s.backupPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save connections config backup: %v", err)
+	}
+
+	return nil
+}
+
+// Revision is the hash of the file content.
+func (s *jsonStore) Revision() (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func readConnectionsConfig(path string) (*types.ConnectionsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var syntaxCheck map[string]interface{}
+	if err := json.Unmarshal(data, &syntaxCheck); err != nil {
+		return nil, &CorruptedConfigError{Path: path, Err: err}
+	}
+
+	var config types.ConnectionsConfig
+	if _, _, err := connectionsConfigSchema.upgrade(data, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
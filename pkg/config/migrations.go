@@ -0,0 +1,428 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// migration upgrades the raw JSON of a config file by one schema version and
+// returns a note for every change it made.
+type migration struct {
+	description string
+	apply       func(raw map[string]interface{}) ([]string, error)
+}
+
+// versionedFile is a config file with its migrations. The migration at index i
+// upgrades the file from version i to i+1, files written before the version
+// field existed are version 0.
+type versionedFile struct {
+	path       string
+	migrations []migration
+}
+
+// AppliedMigration is a migration run, or to be run, on a config file.
+type AppliedMigration struct {
+	Version     int
+	Description string
+	Notes       []string
+}
+
+// MigrationResult describes the upgrade of one config file.
+type MigrationResult struct {
+	Path        string
+	FromVersion int
+	ToVersion   int
+	Migrations  []AppliedMigration
+	BackupPath  string
+}
+
+var addSchemaVersion = migration{
+	description: "add the schema version",
+	apply: func(raw map[string]interface{}) ([]string, error) {
+		return nil, nil
+	},
+}
+
+var (
+	nodeConfigSchema = &versionedFile{
+		path:       NodeConfigFile,
+		migrations: []migration{addSchemaVersion},
+	}
+
+	wireguardConfigSchema = &versionedFile{
+		path:       WireguardConfigFile,
+		migrations: []migration{addSchemaVersion},
+	}
+
+	connectionsConfigSchema = &versionedFile{
+		path: ConnectionsConfigFile,
+		migrations: []migration{
+			addSchemaVersion,
+			{
+				description: "scope the global allowed_keys to the existing networks",
+				apply:       scopeAllowedKeys,
+			},
+			{
+				description: "import the DNS forwards from the Nginx sites",
+				apply:       importNginxForwards,
+			},
+			{
+				description: "move the target of the DNS forwards into a list of targets",
+				apply:       listForwardTargets,
+			},
+			{
+				description: "move the targets of the DNS forwards into a route of the / path",
+				apply:       routeForwardTargets,
+			},
+		},
+	}
+)
+
+func (f *versionedFile) version() int {
+	return len(f.migrations)
+}
+
+// upgrade decodes the file data into target, running the migrations needed
+// to bring it to the current version in memory.
+func (f *versionedFile) upgrade(data []byte, target interface{}) (int, []AppliedMigration, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return 0, nil, err
+	}
+
+	fromVersion := 0
+	if version, ok := raw["version"].(float64); ok {
+		fromVersion = int(version)
+	}
+
+	if fromVersion > f.version() {
+		return fromVersion, nil, fmt.Errorf("%s has schema version %d, this upduck only supports up to %d", f.path, fromVersion, f.version())
+	}
+
+	var applied []AppliedMigration
+	for i, m := range f.migrations[fromVersion:] {
+		notes, err := m.apply(raw)
+		if err != nil {
+			return fromVersion, nil, fmt.Errorf("failed to %s in %s: %v", m.description, f.path, err)
+		}
+
+		applied = append(applied, AppliedMigration{
+			Version:     fromVersion + i + 1,
+			Description: m.description,
+			Notes:       notes,
+		})
+	}
+
+	if len(applied) > 0 {
+		raw["version"] = f.version()
+
+		var err error
+		data, err = json.Marshal(raw)
+		if err != nil {
+			return fromVersion, nil, err
+		}
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return fromVersion, nil, err
+	}
+
+	return fromVersion, applied, nil
+}
+
+// MigrateConfigFiles upgrades the config files written by older versions of
+// upduck to the current schema. The original of every upgraded file is kept
+// next to it as <file>.v<version>.bak. With dryRun, nothing is written.
+func MigrateConfigFiles(dryRun bool) ([]MigrationResult, error) {
+	var results []MigrationResult
+
+	nodeResult, err := migrateConfigFile(nodeConfigSchema, &types.NodeConfig{}, 0600, dryRun)
+	if err != nil {
+		return results, err
+	}
+	if nodeResult != nil {
+		results = append(results, *nodeResult)
+	}
+
+	wireguardResult, err := migrateConfigFile(wireguardConfigSchema, &types.WireguardConfig{}, 0600, dryRun)
+	if err != nil {
+		return results, err
+	}
+	if wireguardResult != nil {
+		results = append(results, *wireguardResult)
+	}
+
+	if _, err := os.Stat(ConnectionsConfigFile); os.IsNotExist(err) {
+		return results, nil
+	}
+
+	if !dryRun {
+		unlock, err := lockFile(connectionsLockFile)
+		if err != nil {
+			return results, fmt.Errorf("failed to lock connections config: %v", err)
+		}
+		defer unlock()
+	}
+
+	connectionsResult, err := migrateConfigFile(connectionsConfigSchema, &types.ConnectionsConfig{}, 0644, dryRun)
+	if err != nil {
+		return results, err
+	}
+	if connectionsResult != nil {
+		results = append(results, *connectionsResult)
+
+		if !dryRun {
+			// the last good copy must follow the schema of the file it stands for
+			if data, err := os.ReadFile(ConnectionsConfigFile); err == nil {
+				system.WriteFile(connectionsBackupFile, data, 0644)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+func migrateConfigFile(f *versionedFile, target interface{}, perm os.FileMode, dryRun bool) (*MigrationResult, error) {
+	original, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fromVersion, applied, err := f.upgrade(original, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	result := &MigrationResult{
+		Path:        f.path,
+		FromVersion: fromVersion,
+		ToVersion:   f.version(),
+		Migrations:  applied,
+		BackupPath:  fmt.Sprintf("%s.v%d.bak", f.path, fromVersion),
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	data, err := json.MarshalIndent(target, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := system.WriteFile(result.BackupPath, original, 0600); err != nil {
+		return nil, fmt.Errorf("failed to back up %s: %v", f.path, err)
+	}
+
+	if err := system.WriteFile(f.path, data, perm); err != nil {
+		return nil, fmt.Errorf("failed to write migrated %s: %v", f.path, err)
+	}
+
+	return result, nil
+}
+
+// scopeAllowedKeys replaces the allowed_keys list, which allowed a key on
+// every network, with an authorization of the key for each existing network.
+func scopeAllowedKeys(raw map[string]interface{}) ([]string, error) {
+	allowedKeys, _ := raw["allowed_keys"].([]interface{})
+	delete(raw, "allowed_keys")
+
+	if len(allowedKeys) == 0 {
+		return nil, nil
+	}
+
+	networks, _ := raw["networks"].([]interface{})
+	authorizations, _ := raw["authorizations"].([]interface{})
+
+	authorized := make(map[string]bool)
+	for _, a := range authorizations {
+		if authorization, ok := a.(map[string]interface{}); ok {
+			authorized[fmt.Sprintf("%v/%v", authorization["key_digest"], authorization["network_id"])] = true
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var notes []string
+	for _, key := range allowedKeys {
+		keyDigest, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid allowed key %v", key)
+		}
+
+		if len(networks) == 0 {
+			notes = append(notes, fmt.Sprintf("key %s dropped, there is no network to allow it on", keyDigest))
+			continue
+		}
+
+		for _, n := range networks {
+			netw, _ := n.(map[string]interface{})
+			networkID, _ := netw["id"].(string)
+			if networkID == "" || authorized[keyDigest+"/"+networkID] {
+				continue
+			}
+
+			authorizations = append(authorizations, map[string]interface{}{
+				"key_digest": keyDigest,
+				"network_id": networkID,
+				"created_at": now,
+			})
+			notes = append(notes, fmt.Sprintf("key %s allowed on network %s", keyDigest, networkID))
+		}
+	}
+
+	raw["authorizations"] = authorizations
+
+	return notes, nil
+}
+
+// importNginxForwards records the forwards of the Nginx sites written by
+// upduck, which were not kept in the state before. Forwards to the address of
+// a peer are recorded as forwards to the peer. Only towers forward domains,
+// the sites of other nodes are not theirs.
+func importNginxForwards(raw map[string]interface{}) ([]string, error) {
+	nodeConfig, err := LoadNodeConfig()
+	if err != nil || nodeConfig.Type != "tower" {
+		return nil, nil
+	}
+
+	sites, err := system.ListNginxForwards()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sites) == 0 {
+		return nil, nil
+	}
+
+	forwards, _ := raw["forwards"].([]interface{})
+
+	existing := make(map[string]bool)
+	for _, f := range forwards {
+		if forward, ok := f.(map[string]interface{}); ok {
+			existing[fmt.Sprint(forward["domain"])] = true
+		}
+	}
+
+	peerIDs := make(map[string]string)
+	networks, _ := raw["networks"].([]interface{})
+	for _, n := range networks {
+		netw, _ := n.(map[string]interface{})
+		peers, _ := netw["peers"].([]interface{})
+		for _, p := range peers {
+			peer, _ := p.(map[string]interface{})
+			address, _ := peer["address"].(string)
+			peerID, _ := peer["id"].(string)
+			if ip, _, err := net.ParseCIDR(address); err == nil && peerID != "" {
+				peerIDs[ip.String()] = peerID
+			}
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var notes []string
+	for _, site := range sites {
+		if existing[site.Domain] {
+			continue
+		}
+
+		port, err := strconv.Atoi(site.Port)
+		if err != nil {
+			continue
+		}
+
+		forward := map[string]interface{}{
+			"domain":     site.Domain,
+			"port":       port,
+			"created_at": now,
+		}
+
+		if peerID, ok := peerIDs[site.ServerIP]; ok {
+			forward["peer_id"] = peerID
+			notes = append(notes, fmt.Sprintf("forward %s -> peer %s:%d imported", site.Domain, peerID, port))
+		} else {
+			forward["address"] = site.ServerIP
+			notes = append(notes, fmt.Sprintf("forward %s -> %s:%d imported", site.Domain, site.ServerIP, port))
+		}
+
+		forwards = append(forwards, forward)
+	}
+
+	raw["forwards"] = forwards
+
+	return notes, nil
+}
+
+// listForwardTargets replaces the single peer_id or address and port of the
+// forwards with a list of targets, forwards can be balanced across several.
+func listForwardTargets(raw map[string]interface{}) ([]string, error) {
+	forwards, _ := raw["forwards"].([]interface{})
+
+	for _, f := range forwards {
+		forward, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid forward %v", f)
+		}
+
+		if _, ok := forward["targets"]; ok {
+			continue
+		}
+
+		target := map[string]interface{}{"port": forward["port"]}
+		for _, key := range []string{"peer_id", "address"} {
+			if value, ok := forward[key]; ok {
+				target[key] = value
+			}
+		}
+
+		forward["targets"] = []interface{}{target}
+		delete(forward, "peer_id")
+		delete(forward, "address")
+		delete(forward, "port")
+	}
+
+	return nil, nil
+}
+
+// routeForwardTargets moves the targets and strategy of the forwards into a
+// route of the / path, forwards can route paths to different targets.
+func routeForwardTargets(raw map[string]interface{}) ([]string, error) {
+	forwards, _ := raw["forwards"].([]interface{})
+
+	for _, f := range forwards {
+		forward, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid forward %v", f)
+		}
+
+		if _, ok := forward["routes"]; ok {
+			continue
+		}
+
+		route := map[string]interface{}{"path": "/", "targets": forward["targets"]}
+		if strategy, ok := forward["strategy"]; ok {
+			route["strategy"] = strategy
+		}
+
+		forward["routes"] = []interface{}{route}
+		delete(forward, "targets")
+		delete(forward, "strategy")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// withoutNodeConfig points the node config at a missing file, the Nginx
+// sites are only imported on towers.
+func withoutNodeConfig(t *testing.T) {
+	t.Helper()
+
+	previous := NodeConfigFile
+	NodeConfigFile = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { NodeConfigFile = previous })
+}
+
+func TestUpgradeConnectionsConfig(t *testing.T) {
+	withoutNodeConfig(t)
+
+	data := `{
+		"networks": [{"id": "net1", "peers": []}, {"id": "net2", "peers": []}],
+		"allowed_keys": ["digest1"],
+		"authorizations": [{"key_digest": "digest1", "network_id": "net1", "created_at": "2024-01-01T00:00:00Z"}],
+		"forwards": [
+			{"domain": "app.example.com", "peer_id": "peerA", "port": 3000},
+			{"domain": "old.example.com", "address": "192.168.1.10", "port": 80}
+		]
+	}`
+
+	var connectionsConfig types.ConnectionsConfig
+	fromVersion, applied, err := connectionsConfigSchema.upgrade([]byte(data), &connectionsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fromVersion != 0 || len(applied) != connectionsConfigSchema.version() {
+		t.Fatalf("upgraded from version %d with %d migrations, want 0 with %d", fromVersion, len(applied), connectionsConfigSchema.version())
+	}
+	for i, migration := range applied {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d has version %d", i, migration.Version)
+		}
+	}
+
+	if want := []string{"key digest1 allowed on network net2"}; !reflect.DeepEqual(applied[1].Notes, want) {
+		t.Errorf("notes of the allowed keys migration = %v, want %v", applied[1].Notes, want)
+	}
+
+	if connectionsConfig.Version != connectionsConfigSchema.version() {
+		t.Errorf("version = %d, want %d", connectionsConfig.Version, connectionsConfigSchema.version())
+	}
+
+	var authorizations []string
+	for _, authorization := range connectionsConfig.Authorizations {
+		authorizations = append(authorizations, authorization.KeyDigest+"/"+authorization.NetworkID)
+	}
+	if want := []string{"digest1/net1", "digest1/net2"}; !reflect.DeepEqual(authorizations, want) {
+		t.Errorf("authorizations = %v, want %v", authorizations, want)
+	}
+
+	want := [][]types.ForwardRoute{
+		{{Path: "/", Targets: []types.ForwardTarget{{PeerID: "peerA", Port: 3000}}}},
+		{{Path: "/", Targets: []types.ForwardTarget{{Address: "192.168.1.10", Port: 80}}}},
+	}
+	if len(connectionsConfig.Forwards) != len(want) {
+		t.Fatalf("forwards = %+v, want %d", connectionsConfig.Forwards, len(want))
+	}
+	for i, forward := range connectionsConfig.Forwards {
+		if !reflect.DeepEqual(forward.Routes, want[i]) {
+			t.Errorf("routes of %s = %+v, want %+v", forward.Domain, forward.Routes, want[i])
+		}
+	}
+}
+
+func TestUpgradeConnectionsConfigFromVersion(t *testing.T) {
+	withoutNodeConfig(t)
+
+	data := `{
+		"version": 3,
+		"networks": [],
+		"forwards": [{
+			"domain": "app.example.com",
+			"targets": [{"peer_id": "peerA", "port": 3000}, {"peer_id": "peerB", "port": 3000}],
+			"strategy": "least_conn"
+		}]
+	}`
+
+	var connectionsConfig types.ConnectionsConfig
+	fromVersion, applied, err := connectionsConfigSchema.upgrade([]byte(data), &connectionsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fromVersion != 3 || len(applied) != 2 || applied[0].Version != 4 {
+		t.Fatalf("upgraded from version %d with %+v, want the migrations after version 3", fromVersion, applied)
+	}
+
+	want := []types.ForwardRoute{{
+		Path:     "/",
+		Strategy: "least_conn",
+		Targets:  []types.ForwardTarget{{PeerID: "peerA", Port: 3000}, {PeerID: "peerB", Port: 3000}},
+	}}
+	if !reflect.DeepEqual(connectionsConfig.Forwards[0].Routes, want) {
+		t.Errorf("routes = %+v, want %+v", connectionsConfig.Forwards[0].Routes, want)
+	}
+}
+
+func TestUpgradeCurrentVersion(t *testing.T) {
+	data := `{"version": 1, "node_type": "tower"}`
+
+	var nodeConfig types.NodeConfig
+	fromVersion, applied, err := nodeConfigSchema.upgrade([]byte(data), &nodeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fromVersion != 1 || len(applied) != 0 {
+		t.Errorf("upgraded from version %d with %+v, want no migrations", fromVersion, applied)
+	}
+
+	if nodeConfig.Type != "tower" {
+		t.Errorf("node type = %q, want tower", nodeConfig.Type)
+	}
+}
+
+func TestUpgradeNewerVersion(t *testing.T) {
+	var nodeConfig types.NodeConfig
+	_, _, err := nodeConfigSchema.upgrade([]byte(`{"version": 2}`), &nodeConfig)
+	if err == nil || !strings.Contains(err.Error(), "only supports up to 1") {
+		t.Errorf("expected an error for a newer schema, got %v", err)
+	}
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	original := []byte(`{"node_type": "server"}`)
+	if err := os.WriteFile(path, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := &versionedFile{path: path, migrations: []migration{addSchemaVersion}}
+
+	result, err := migrateConfigFile(schema, &types.NodeConfig{}, 0600, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.FromVersion != 0 || result.ToVersion != 1 || result.BackupPath != path+".v0.bak" {
+		t.Fatalf("dry run result = %+v", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(original) {
+		t.Errorf("dry run changed the file to %s", data)
+	}
+	if _, err := os.Stat(result.BackupPath); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the backup %s", result.BackupPath)
+	}
+
+	if _, err := migrateConfigFile(schema, &types.NodeConfig{}, 0600, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(result.BackupPath); string(data) != string(original) {
+		t.Errorf("backup = %s, want the original file", data)
+	}
+
+	var nodeConfig types.NodeConfig
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &nodeConfig); err != nil || nodeConfig.Version != 1 || nodeConfig.Type != "server" {
+		t.Errorf("migrated file = %s", data)
+	}
+
+	// an upgraded file is left alone
+	if result, err := migrateConfigFile(schema, &types.NodeConfig{}, 0600, false); err != nil || result != nil {
+		t.Errorf("migrating again returned %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	StateBackendJSON = "json"
+	StateBackendBolt = "bolt"
+)
+
+// Store persists the connections config. Implementations must be safe to use
+// from several goroutines and processes at once, the CLI commands and the
+// daemon share the same store.
+type Store interface {
+	// Load returns a snapshot of the connections config, changes to it are
+	// not persisted.
+	Load() (*types.ConnectionsConfig, error)
+
+	// Update runs update on the current connections config within an
+	// exclusive transaction and persists the result. Nothing is persisted
+	// when update returns an error, which is returned as is.
+	Update(update func(config *types.ConnectionsConfig) error) error
+
+	// Revision returns a value that changes whenever the config is updated,
+	// cheap enough to be polled.
+	Revision() (string, error)
+}
+
+var (
+	storeOnce    sync.Once
+	defaultStore Store
+
+	changeHandlersMu sync.Mutex
+	changeHandlers   []func()
+)
+
+// NewStore returns the store for the given state backend, kept in the config directory.
+func NewStore(backend string) (Store, error) {
+	switch backend {
+	case "", StateBackendJSON:
+		return NewJSONStore(ConnectionsConfigFile), nil
+	case StateBackendBolt:
+		return NewBoltStore(StateDatabaseFile, ConnectionsConfigFile), nil
+	default:
+		return nil, fmt.Errorf("invalid state backend: %s (must be '%s' or '%s')", backend, StateBackendJSON, StateBackendBolt)
+	}
+}
+
+// ConnectionsStore returns the store selected by the node config, the JSON
+// files when the node is not configured yet.
+func ConnectionsStore() Store {
+	storeOnce.Do(func() {
+		defaultStore = NewJSONStore(ConnectionsConfigFile)
+
+		nodeConfig, err := LoadNodeConfig()
+		if err != nil {
+			return
+		}
+
+		store, err := NewStore(nodeConfig.StateBackend)
+		if err != nil {
+			return
+		}
+		defaultStore = store
+	})
+
+	return defaultStore
+}
+
+func LoadConnectionsConfig() (*types.ConnectionsConfig, error) {
+	return ConnectionsStore().Load()
+}
+
+// UpdateConnectionsConfig updates the connections config in the store. In
+// dry runs the update is made on a copy and the resulting diff is printed.
+func UpdateConnectionsConfig(update func(config *types.ConnectionsConfig) error) error {
+	if system.DryRun() {
+		return showConnectionsUpdate(update)
+	}
+
+	if err := ConnectionsStore().Update(update); err != nil {
+		return err
+	}
+
+	changeHandlersMu.Lock()
+	handlers := append([]func(){}, changeHandlers...)
+	changeHandlersMu.Unlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+
+	return nil
+}
+
+// OnConnectionsChange registers a handler called after every successful
+// UpdateConnectionsConfig made by this process. Changes made by other
+// processes are not reported, watch the config directory for those.
+func OnConnectionsChange(handler func()) {
+	changeHandlersMu.Lock()
+	defer changeHandlersMu.Unlock()
+
+	changeHandlers = append(changeHandlers, handler)
+}
+
+func showConnectionsUpdate(update func(config *types.ConnectionsConfig) error) error {
+	config, err := LoadConnectionsConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load connections config: %v", err)
+	}
+
+	before, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := update(config); err != nil {
+		return err
+	}
+
+	after, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	system.ShowChange("connections config", before, after)
+
+	return nil
+}
+
+func ConnectionsRevision() (string, error) {
+	return ConnectionsStore().Revision()
+}
+
+func newConnectionsConfig() *types.ConnectionsConfig {
+	return &types.ConnectionsConfig{
+		Version:        connectionsConfigSchema.version(),
+		Networks:       []types.Network{},
+		EncryptionKeys: []types.EncryptionKey{},
+	}
+}
@@ -0,0 +1,407 @@
+// Package storetest checks that config.Store implementations behave the same
+// way, so the state backends can be swapped on a node.
+package storetest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// NewStoreFunc returns the store kept in dir. It is called with an empty
+// directory for a new store, and again with the same directory to check what
+// another process opening the store sees.
+type NewStoreFunc func(dir string) (config.Store, error)
+
+type check struct {
+	name string
+	run  func(newStore NewStoreFunc, dir string) error
+}
+
+var checks = []check{
+	{"empty store", checkEmpty},
+	{"update persists every collection", checkRoundTrip},
+	{"failed update persists nothing", checkFailedUpdate},
+	{"removed records are deleted", checkRemove},
+	{"loaded config is a copy", checkLoadCopy},
+	{"revision changes on update", checkRevision},
+	{"concurrent updates are serialized", checkConcurrentUpdates},
+}
+
+// TestStore runs the conformance checks against the stores returned by
+// newStore and returns the failures.
+func TestStore(newStore NewStoreFunc) error {
+	var failures []error
+
+	for _, c := range checks {
+		dir, err := os.MkdirTemp("", "upduck-storetest-")
+		if err != nil {
+			return err
+		}
+
+		if err := c.run(newStore, dir); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", c.name, err))
+		}
+
+		os.RemoveAll(dir)
+	}
+
+	return errors.Join(failures...)
+}
+
+func checkEmpty(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	connectionsConfig, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if connectionsConfig.Networks == nil || len(connectionsConfig.Networks) != 0 {
+		return fmt.Errorf("expected an empty networks list, got %v", connectionsConfig.Networks)
+	}
+
+	if connectionsConfig.Version == 0 {
+		return fmt.Errorf("expected the current schema version")
+	}
+
+	return nil
+}
+
+func checkRoundTrip(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	want := sampleConfig()
+	err = store.Update(func(connectionsConfig *types.ConnectionsConfig) error {
+		*connectionsConfig = *sampleConfig()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if err := compareConfigs(got, want); err != nil {
+		return err
+	}
+
+	// another process opening the same store sees the update
+	reopened, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	got, err = reopened.Load()
+	if err != nil {
+		return err
+	}
+
+	return compareConfigs(got, want)
+}
+
+func checkFailedUpdate(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Update(addNetwork("01A", "10.5.0.0/24")); err != nil {
+		return err
+	}
+
+	updateErr := errors.New("update failed")
+	err = store.Update(func(connectionsConfig *types.ConnectionsConfig) error {
+		connectionsConfig.Networks = append(connectionsConfig.Networks, types.Network{ID: "01B", Peers: []types.Peer{}})
+		return updateErr
+	})
+	if !errors.Is(err, updateErr) {
+		return fmt.Errorf("expected the update error to be returned, got %v", err)
+	}
+
+	connectionsConfig, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if len(connectionsConfig.Networks) != 1 {
+		return fmt.Errorf("expected 1 network, got %d", len(connectionsConfig.Networks))
+	}
+
+	return nil
+}
+
+func checkRemove(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	err = store.Update(func(connectionsConfig *types.ConnectionsConfig) error {
+		*connectionsConfig = *sampleConfig()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.Update(func(connectionsConfig *types.ConnectionsConfig) error {
+		connectionsConfig.Networks = connectionsConfig.Networks[:1]
+		connectionsConfig.Authorizations = nil
+		connectionsConfig.JoinTokens = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	connectionsConfig, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if len(connectionsConfig.Networks) != 1 || len(connectionsConfig.Authorizations) != 0 || len(connectionsConfig.JoinTokens) != 0 {
+		return fmt.Errorf("expected 1 network, no authorization and no join token, got %d, %d and %d",
+			len(connectionsConfig.Networks), len(connectionsConfig.Authorizations), len(connectionsConfig.JoinTokens))
+	}
+
+	if len(connectionsConfig.EncryptionKeys) != 2 {
+		return fmt.Errorf("expected the untouched encryption keys to be kept, got %d", len(connectionsConfig.EncryptionKeys))
+	}
+
+	return nil
+}
+
+func checkLoadCopy(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Update(addNetwork("01A", "10.5.0.0/24")); err != nil {
+		return err
+	}
+
+	connectionsConfig, err := store.Load()
+	if err != nil {
+		return err
+	}
+	connectionsConfig.Networks[0].Name = "changed"
+
+	connectionsConfig, err = store.Load()
+	if err != nil {
+		return err
+	}
+
+	if connectionsConfig.Networks[0].Name != "" {
+		return fmt.Errorf("changing a loaded config changed the store")
+	}
+
+	return nil
+}
+
+func checkRevision(newStore NewStoreFunc, dir string) error {
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Update(addNetwork("01A", "10.5.0.0/24")); err != nil {
+		return err
+	}
+
+	before, err := store.Revision()
+	if err != nil {
+		return err
+	}
+
+	unchanged, err := store.Revision()
+	if err != nil {
+		return err
+	}
+
+	if unchanged != before {
+		return fmt.Errorf("revision changed without an update: %s, then %s", before, unchanged)
+	}
+
+	if err := store.Update(addNetwork("01B", "10.5.1.0/24")); err != nil {
+		return err
+	}
+
+	after, err := store.Revision()
+	if err != nil {
+		return err
+	}
+
+	if after == before {
+		return fmt.Errorf("revision %s did not change after an update", after)
+	}
+
+	return nil
+}
+
+func checkConcurrentUpdates(newStore NewStoreFunc, dir string) error {
+	const updates = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, updates)
+
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// every update goes through its own store, like separate processes
+			store, err := newStore(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			errs <- store.Update(addNetwork(fmt.Sprintf("01C%02d", i), fmt.Sprintf("10.6.%d.0/24", i)))
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := newStore(dir)
+	if err != nil {
+		return err
+	}
+
+	connectionsConfig, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if len(connectionsConfig.Networks) != updates {
+		return fmt.Errorf("expected %d networks, got %d, updates were lost", updates, len(connectionsConfig.Networks))
+	}
+
+	return nil
+}
+
+func addNetwork(id, address string) func(*types.ConnectionsConfig) error {
+	return func(connectionsConfig *types.ConnectionsConfig) error {
+		connectionsConfig.Networks = append(connectionsConfig.Networks, types.Network{
+			ID:      id,
+			Address: address,
+			Peers:   []types.Peer{},
+		})
+		return nil
+	}
+}
+
+func sampleConfig() *types.ConnectionsConfig {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	return &types.ConnectionsConfig{
+		Networks: []types.Network{
+			{
+				ID:      "01HX0000000000000000000001",
+				Name:    "home",
+				Address: "10.5.0.0/24",
+				Peers: []types.Peer{
+					{ID: "01HX0000000000000000000011", PublicKey: "peer-wg-key-1", Address: "10.5.0.2/32"},
+					{ID: "01HX0000000000000000000012", PublicKey: "peer-wg-key-2", Address: "10.5.0.3/32"},
+				},
+				Leases: []types.Lease{
+					{Address: "10.5.0.2", PeerID: "01HX0000000000000000000011", CreatedAt: createdAt},
+					{Address: "10.5.0.3", PeerID: "01HX0000000000000000000012", Static: true, CreatedAt: createdAt},
+				},
+				Interface:  "udck-t00000001",
+				ListenPort: 51820,
+			},
+			{
+				ID:         "01HX0000000000000000000002",
+				Address:    "10.5.1.0/24",
+				Peers:      []types.Peer{},
+				Interface:  "udck-t00000002",
+				ListenPort: 51821,
+			},
+		},
+		Authorizations: []types.KeyAuthorization{
+			{KeyDigest: "0123456789abcdef", NetworkID: "01HX0000000000000000000001", MaxPeers: 2, CreatedAt: createdAt},
+			{KeyDigest: "0123456789abcdef", NetworkID: "01HX0000000000000000000002", ExpiresAt: createdAt.Add(time.Hour), CreatedAt: createdAt},
+		},
+		EncryptionKeys: []types.EncryptionKey{
+			{ID: "01HX0000000000000000000011", Type: "network_peer", PublicKey: "peer-rsa-key-1"},
+			{ID: "01HX0000000000000000000012", Type: "network_peer", PublicKey: "peer-rsa-key-2"},
+		},
+		JoinTokens: []types.JoinToken{
+			{ID: "01HX0000000000000000000021", NetworkID: "01HX0000000000000000000001", SecretHash: "hash", MaxUses: 1, CreatedAt: createdAt},
+		},
+		JoinRequests: []types.JoinRequest{
+			{ID: "01HX0000000000000000000031", NetworkID: "01HX0000000000000000000002", KeyDigest: "fedcba9876543210", Status: "pending", CreatedAt: createdAt},
+		},
+	}
+}
+
+// compareConfigs compares the configs regardless of the order of their
+// collections, which stores are free to change.
+func compareConfigs(got, want *types.ConnectionsConfig) error {
+	gotJSON, err := canonicalJSON(got)
+	if err != nil {
+		return err
+	}
+
+	wantJSON, err := canonicalJSON(want)
+	if err != nil {
+		return err
+	}
+
+	if gotJSON != wantJSON {
+		return fmt.Errorf("loaded config differs from the saved one:\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+
+	return nil
+}
+
+func canonicalJSON(connectionsConfig *types.ConnectionsConfig) (string, error) {
+	sorted := *connectionsConfig
+	sorted.Version = 0
+
+	sorted.Networks = append([]types.Network(nil), sorted.Networks...)
+	sort.Slice(sorted.Networks, func(i, j int) bool { return sorted.Networks[i].ID < sorted.Networks[j].ID })
+
+	sorted.Authorizations = append([]types.KeyAuthorization(nil), sorted.Authorizations...)
+	sort.Slice(sorted.Authorizations, func(i, j int) bool {
+		a, b := sorted.Authorizations[i], sorted.Authorizations[j]
+		return a.NetworkID+a.KeyDigest < b.NetworkID+b.KeyDigest
+	})
+
+	sorted.EncryptionKeys = append([]types.EncryptionKey(nil), sorted.EncryptionKeys...)
+	sort.Slice(sorted.EncryptionKeys, func(i, j int) bool { return sorted.EncryptionKeys[i].ID < sorted.EncryptionKeys[j].ID })
+
+	sorted.JoinTokens = append([]types.JoinToken(nil), sorted.JoinTokens...)
+	sort.Slice(sorted.JoinTokens, func(i, j int) bool { return sorted.JoinTokens[i].ID < sorted.JoinTokens[j].ID })
+
+	sorted.JoinRequests = append([]types.JoinRequest(nil), sorted.JoinRequests...)
+	sort.Slice(sorted.JoinRequests, func(i, j int) bool { return sorted.JoinRequests[i].ID < sorted.JoinRequests[j].ID })
+
+	data, err := json.Marshal(sorted)
+	return string(data), err
+}
@@ -1,16 +1,21 @@
 package crypto
 
 import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"os"
 
 	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
 	"github.com/duck-labs/upduck/pkg/types"
 )
 
@@ -45,11 +50,11 @@ func GenerateRSAKeys() (*types.RSAKeysConfig, error) {
 		return nil, fmt.Errorf("failed to ensure config directory: %v", err)
 	}
 
-	if err := os.WriteFile(config.RSAPrivateKey, privateKeyPEM, 0600); err != nil {
+	if err := system.WriteFile(config.RSAPrivateKey, privateKeyPEM, 0600); err != nil {
 		return nil, fmt.Errorf("failed to write private key file: %v", err)
 	}
 
-	if err := os.WriteFile(config.RSAPublicKey, publicKeyPEM, 0644); err != nil {
+	if err := system.WriteFile(config.RSAPublicKey, publicKeyPEM, 0644); err != nil {
 		return nil, fmt.Errorf("failed to write public key file: %v", err)
 	}
 
@@ -80,3 +85,167 @@ func GetPublicKeyDigest(publicKey string) string {
 	hash := sha256.Sum256([]byte(publicKey))
 	return hex.EncodeToString(hash[:])[:16]
 }
+
+// SignMessage signs the message with the PEM encoded RSA private key and
+// returns the base64 encoded signature.
+func SignMessage(privateKeyPEM string, message []byte) (string, error) {
+	privateKey, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(message)
+	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign message: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// VerifySignature checks a base64 encoded signature created by SignMessage
+// against the PEM encoded RSA public key.
+func VerifySignature(publicKeyPEM string, message []byte, signature string) error {
+	publicKey, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	hash := sha256.Sum256(message)
+	if err := rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signatureBytes, nil); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	return nil
+}
+
+func parsePrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not a RSA key")
+	}
+
+	return privateKey, nil
+}
+
+func parsePublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key PEM")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not a RSA key")
+	}
+
+	return publicKey, nil
+}
+
+// Seal encrypts the plaintext for the owner of the PEM encoded RSA public key.
+// A random AES-256-GCM key encrypts the data and is itself encrypted with
+// RSA-OAEP. Both values are returned base64 encoded.
+func Seal(publicKeyPEM string, plaintext []byte) (string, string, error) {
+	publicKey, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt data key: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(encryptedKey), base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Open decrypts data sealed by Seal with the PEM encoded RSA private key.
+func Open(privateKeyPEM string, encryptedKey string, ciphertext string) ([]byte, error) {
+	privateKey, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKeyBytes, err := base64.StdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key encoding: %v", err)
+	}
+
+	ciphertextBytes, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext encoding: %v", err)
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKeyBytes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %v", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertextBytes) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, data := ciphertextBytes[:gcm.NonceSize()], ciphertextBytes[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	return gcm, nil
+}
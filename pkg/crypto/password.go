@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// cryptAlphabet is the base64 alphabet of the crypt(3) hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	sha512CryptRounds     = 5000
+	sha512CryptMinRounds  = 1000
+	sha512CryptMaxRounds  = 999999999
+	sha512CryptSaltLength = 16
+)
+
+// GeneratePassword returns a random password for HTTP basic auth.
+func GeneratePassword() (string, error) {
+	password := make([]byte, 18)
+	if _, err := rand.Read(password); err != nil {
+		return "", fmt.Errorf("failed to generate password: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(password), nil
+}
+
+// HashPassword returns the SHA-512 crypt(3) hash of a password, the "$6$"
+// format Nginx checks basic auth passwords against on every libc.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, sha512CryptSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	for i := range salt {
+		salt[i] = cryptAlphabet[int(salt[i])%len(cryptAlphabet)]
+	}
+
+	return sha512Crypt([]byte(password), salt, 0), nil
+}
+
+// sha512Crypt implements the SHA-512 based crypt of Ulrich Drepper. Rounds
+// of 0 use the default number of rounds, other rounds are clamped to the
+// range of the specification and written in the hash as "rounds=N$". The
+// salt is cut to its first 16 bytes.
+func sha512Crypt(password, salt []byte, rounds int) string {
+	if len(salt) > sha512CryptSaltLength {
+		salt = salt[:sha512CryptSaltLength]
+	}
+
+	prefix := "$6$"
+	if rounds == 0 {
+		rounds = sha512CryptRounds
+	} else {
+		rounds = max(sha512CryptMinRounds, min(rounds, sha512CryptMaxRounds))
+		prefix += fmt.Sprintf("rounds=%d$", rounds)
+	}
+
+	alternate := sha512.New()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	alternateSum := alternate.Sum(nil)
+
+	digest := sha512.New()
+	digest.Write(password)
+	digest.Write(salt)
+
+	n := len(password)
+	for ; n > sha512.Size; n -= sha512.Size {
+		digest.Write(alternateSum)
+	}
+	digest.Write(alternateSum[:n])
+
+	for n = len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(password)
+		}
+	}
+	digestSum := digest.Sum(nil)
+
+	passwordDigest := sha512.New()
+	for range password {
+		passwordDigest.Write(password)
+	}
+	passwordSequence := repeatDigest(passwordDigest.Sum(nil), len(password))
+
+	saltDigest := sha512.New()
+	for i := 0; i < 16+int(digestSum[0]); i++ {
+		saltDigest.Write(salt)
+	}
+	saltSequence := repeatDigest(saltDigest.Sum(nil), len(salt))
+
+	sum := digestSum
+	for round := 0; round < rounds; round++ {
+		h := sha512.New()
+		if round&1 != 0 {
+			h.Write(passwordSequence)
+		} else {
+			h.Write(sum)
+		}
+		if round%3 != 0 {
+			h.Write(saltSequence)
+		}
+		if round%7 != 0 {
+			h.Write(passwordSequence)
+		}
+		if round&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(passwordSequence)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < 21; i++ {
+		// the bytes are taken 21 apart, rotating which one comes first
+		a, b, c := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			a, b, c = i+21, i+42, i
+		case 2:
+			a, b, c = i+42, i, i+21
+		}
+		encodeCrypt64(&encoded, uint(sum[a])<<16|uint(sum[b])<<8|uint(sum[c]), 4)
+	}
+	encodeCrypt64(&encoded, uint(sum[63]), 2)
+
+	return fmt.Sprintf("%s%s$%s", prefix, salt, encoded.String())
+}
+
+// repeatDigest repeats the digest up to length bytes.
+func repeatDigest(sum []byte, length int) []byte {
+	sequence := make([]byte, 0, length)
+	for len(sequence) < length {
+		sequence = append(sequence, sum[:min(len(sum), length-len(sequence))]...)
+	}
+
+	return sequence
+}
+
+func encodeCrypt64(encoded *strings.Builder, value uint, chars int) {
+	for ; chars > 0; chars-- {
+		encoded.WriteByte(cryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+const tlsCertificateValidity = 10 * 365 * 24 * time.Hour
+
+// GenerateTLSCertificate creates the self-signed certificate served by the
+// upduck API. Clients do not verify it against a CA but pin its fingerprint.
+func GenerateTLSCertificate() (*tls.Certificate, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TLS private key: %v", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial number: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "upduck " + hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(tlsCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if hostname != "" {
+		template.DNSNames = []string{hostname}
+	}
+
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS certificate: %v", err)
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal TLS private key: %v", err)
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes})
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+
+	if err := config.EnsureConfigDir(); err != nil {
+		return nil, fmt.Errorf("failed to ensure config directory: %v", err)
+	}
+
+	if err := system.WriteFile(config.TLSPrivateKey, privateKeyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write TLS private key file: %v", err)
+	}
+
+	if err := system.WriteFile(config.TLSCertificate, certificatePEM, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write TLS certificate file: %v", err)
+	}
+
+	certificate, err := tls.X509KeyPair(certificatePEM, privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	return &certificate, nil
+}
+
+func LoadTLSCertificate() (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(config.TLSCertificate, config.TLSPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+// LoadOrGenerateTLSCertificate loads the API certificate, generating it on
+// first use.
+func LoadOrGenerateTLSCertificate() (*tls.Certificate, error) {
+	if _, err := os.Stat(config.TLSCertificate); os.IsNotExist(err) {
+		return GenerateTLSCertificate()
+	}
+
+	return LoadTLSCertificate()
+}
+
+// LoadTLSFingerprint returns the fingerprint of the API certificate of this node.
+func LoadTLSFingerprint() (string, error) {
+	data, err := os.ReadFile(config.TLSCertificate)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("invalid TLS certificate PEM")
+	}
+
+	return GetCertificateFingerprint(block.Bytes), nil
+}
+
+// GetCertificateFingerprint returns the hex SHA-256 of a DER encoded certificate.
+func GetCertificateFingerprint(certificate []byte) string {
+	hash := sha256.Sum256(certificate)
+	return hex.EncodeToString(hash[:])
+}
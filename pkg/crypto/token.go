@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const joinTokenPrefix = "upduck-"
+
+// GenerateTokenSecret returns a random hex secret for a join token.
+func GenerateTokenSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate token secret: %v", err)
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// HashTokenSecret returns the hash stored by the tower for a token secret.
+func HashTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// EncodeJoinToken serializes the join token payload into the string handed to servers.
+func EncodeJoinToken(payload *types.JoinTokenPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return joinTokenPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeJoinToken parses a token created by EncodeJoinToken.
+func DecodeJoinToken(token string) (*types.JoinTokenPayload, error) {
+	if !strings.HasPrefix(token, joinTokenPrefix) {
+		return nil, fmt.Errorf("invalid join token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, joinTokenPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid join token encoding: %v", err)
+	}
+
+	var payload types.JoinTokenPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("invalid join token payload: %v", err)
+	}
+
+	if payload.TowerAddress == "" || payload.NetworkID == "" || payload.TowerKeyDigest == "" || payload.Secret == "" {
+		return nil, fmt.Errorf("incomplete join token")
+	}
+
+	return &payload, nil
+}
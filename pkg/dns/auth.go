@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// The keys of the access options, given as key=value.
+const (
+	AuthAllow       = "allow"
+	AuthDeny        = "deny"
+	AuthUser        = "user"
+	AuthForwardAuth = "forward-auth"
+	AuthSignIn      = "signin"
+)
+
+// AuthKeys are the keys of the access options.
+var AuthKeys = []string{AuthAllow, AuthDeny, AuthUser, AuthForwardAuth, AuthSignIn}
+
+var (
+	authUserRegexp    = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+	invalidURLRegexp  = regexp.MustCompile(`[\s"'\\;{}]`)
+	invalidHashRegexp = regexp.MustCompile(`[\s:]`)
+)
+
+// ApplyAuth changes the access policy of the forward: the options of remove
+// are taken out first, then the options of add are added. Both are given as
+// key=value, and remove also takes a key alone to clear it, or "all". A user
+// added gets a new random password, returned by name since only its hash is
+// kept.
+func ApplyAuth(forward *types.Forward, add []string, remove []string) (map[string]string, error) {
+	var auth types.ForwardAuth
+	if forward.Auth != nil {
+		auth = *forward.Auth
+		auth.Allow = slices.Clone(auth.Allow)
+		auth.Deny = slices.Clone(auth.Deny)
+		auth.Users = slices.Clone(auth.Users)
+	}
+
+	for _, spec := range remove {
+		key, value, _ := strings.Cut(spec, "=")
+
+		var err error
+		switch key {
+		case "all":
+			auth = types.ForwardAuth{}
+		case AuthAllow:
+			auth.Allow, err = removeAddress(auth.Allow, key, value)
+		case AuthDeny:
+			auth.Deny, err = removeAddress(auth.Deny, key, value)
+		case AuthUser:
+			auth.Users, err = removeUser(auth.Users, value)
+		case AuthForwardAuth:
+			auth.ForwardAuthURL = ""
+			auth.SignInURL = ""
+		case AuthSignIn:
+			auth.SignInURL = ""
+		default:
+			err = fmt.Errorf("unknown access option %s, expected all or one of %s", key, strings.Join(AuthKeys, ", "))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	passwords := make(map[string]string)
+	for _, spec := range add {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid access option '%s', expected <key>=<value> with key one of %s", spec, strings.Join(AuthKeys, ", "))
+		}
+
+		switch key {
+		case AuthAllow:
+			auth.Allow = append(auth.Allow, value)
+		case AuthDeny:
+			auth.Deny = append(auth.Deny, value)
+		case AuthUser:
+			password, err := crypto.GeneratePassword()
+			if err != nil {
+				return nil, err
+			}
+
+			hash, err := crypto.HashPassword(password)
+			if err != nil {
+				return nil, err
+			}
+
+			auth.Users, _ = removeUser(auth.Users, value)
+			auth.Users = append(auth.Users, types.ForwardUser{Name: value, PasswordHash: hash})
+			passwords[value] = password
+		case AuthForwardAuth:
+			auth.ForwardAuthURL = value
+		case AuthSignIn:
+			auth.SignInURL = value
+		default:
+			return nil, fmt.Errorf("unknown access option %s, expected one of %s", key, strings.Join(AuthKeys, ", "))
+		}
+	}
+
+	if err := SetAuth(forward, &auth); err != nil {
+		return nil, err
+	}
+
+	return passwords, nil
+}
+
+// SetAuth replaces the access policy of the forward, an empty policy lets
+// everyone in. Addresses are normalized and given once.
+func SetAuth(forward *types.Forward, auth *types.ForwardAuth) error {
+	if auth == nil || (len(auth.Allow) == 0 && len(auth.Deny) == 0 && len(auth.Users) == 0 && auth.ForwardAuthURL == "" && auth.SignInURL == "") {
+		forward.Auth = nil
+		return nil
+	}
+
+	if forward.Passthrough {
+		return errors.New("the requests of passthrough forwards are not seen by the tower, their access cannot be restricted")
+	}
+
+	normalized := types.ForwardAuth{
+		ForwardAuthURL: auth.ForwardAuthURL,
+		SignInURL:      auth.SignInURL,
+	}
+
+	var err error
+	if normalized.Allow, err = normalizeAddresses(auth.Allow); err != nil {
+		return err
+	}
+	if normalized.Deny, err = normalizeAddresses(auth.Deny); err != nil {
+		return err
+	}
+
+	for _, user := range auth.Users {
+		if !authUserRegexp.MatchString(user.Name) {
+			return fmt.Errorf("invalid user name '%s'", user.Name)
+		}
+
+		if user.PasswordHash == "" || invalidHashRegexp.MatchString(user.PasswordHash) {
+			return fmt.Errorf("invalid password hash of user %s", user.Name)
+		}
+
+		if findUser(normalized.Users, user.Name) != -1 {
+			return fmt.Errorf("user %s is given twice", user.Name)
+		}
+
+		normalized.Users = append(normalized.Users, user)
+	}
+
+	if normalized.ForwardAuthURL != "" {
+		if err := checkAuthURL(normalized.ForwardAuthURL); err != nil {
+			return fmt.Errorf("invalid forward auth URL: %v", err)
+		}
+
+		if len(normalized.Users) > 0 {
+			return errors.New("basic auth users cannot be combined with forward auth")
+		}
+	}
+
+	if normalized.SignInURL != "" {
+		if normalized.ForwardAuthURL == "" {
+			return errors.New("a sign in URL needs forward auth")
+		}
+
+		if err := checkAuthURL(normalized.SignInURL); err != nil {
+			return fmt.Errorf("invalid sign in URL: %v", err)
+		}
+	}
+
+	forward.Auth = &normalized
+
+	return nil
+}
+
+// AuthOptions describes the access policy of the forward.
+func AuthOptions(forward *types.Forward) []string {
+	if forward.Auth == nil {
+		return nil
+	}
+
+	var options []string
+	auth := forward.Auth
+
+	if len(auth.Deny) > 0 {
+		options = append(options, "deny "+strings.Join(auth.Deny, " "))
+	}
+	if len(auth.Allow) > 0 {
+		options = append(options, "allow "+strings.Join(auth.Allow, " "))
+	}
+	if len(auth.Users) > 0 {
+		names := make([]string, 0, len(auth.Users))
+		for _, user := range auth.Users {
+			names = append(names, user.Name)
+		}
+		options = append(options, "basic auth "+strings.Join(names, " "))
+	}
+	if auth.ForwardAuthURL != "" {
+		option := "forward auth " + auth.ForwardAuthURL
+		if auth.SignInURL != "" {
+			option += " (sign in " + auth.SignInURL + ")"
+		}
+		options = append(options, option)
+	}
+
+	return options
+}
+
+// normalizeAddresses checks the IP addresses and CIDR blocks of an access
+// list and drops the duplicates.
+func normalizeAddresses(addresses []string) ([]string, error) {
+	var normalized []string
+
+	for _, address := range addresses {
+		value, err := normalizeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(normalized, value) {
+			normalized = append(normalized, value)
+		}
+	}
+
+	return normalized, nil
+}
+
+func normalizeAddress(address string) (string, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String(), nil
+	}
+
+	ip, block, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address '%s', expected an IP address or a CIDR block", address)
+	}
+
+	if !ip.Equal(block.IP) {
+		return "", fmt.Errorf("%s is not a network address, did you mean %s?", address, block)
+	}
+
+	return block.String(), nil
+}
+
+func removeAddress(addresses []string, key string, address string) ([]string, error) {
+	if address == "" {
+		return nil, nil
+	}
+
+	value, err := normalizeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	index := slices.Index(addresses, value)
+	if index == -1 {
+		return nil, fmt.Errorf("%s is not in the %s list", address, key)
+	}
+
+	return slices.Delete(addresses, index, index+1), nil
+}
+
+func removeUser(users []types.ForwardUser, name string) ([]types.ForwardUser, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	index := findUser(users, name)
+	if index == -1 {
+		return users, fmt.Errorf("user %s not found", name)
+	}
+
+	return slices.Delete(users, index, index+1), nil
+}
+
+func findUser(users []types.ForwardUser, name string) int {
+	for i, user := range users {
+		if user.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func checkAuthURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("'%s' is not an http or https URL", value)
+	}
+
+	if invalidURLRegexp.MatchString(value) {
+		return fmt.Errorf("'%s' has characters Nginx cannot take unquoted", value)
+	}
+
+	return nil
+}
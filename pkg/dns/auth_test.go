@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// testHash is a SHA-512 crypt hash, SetAuth only checks its characters.
+const testHash = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+
+func TestSetAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    *types.ForwardAuth
+		want    *types.ForwardAuth
+		wantErr bool
+	}{
+		{name: "no policy", auth: nil, want: nil},
+		{name: "empty policy", auth: &types.ForwardAuth{}, want: nil},
+		{
+			name: "addresses",
+			auth: &types.ForwardAuth{Allow: []string{"10.0.0.0/8", "192.168.1.10", "10.0.0.0/8"}, Deny: []string{"2001:db8:0::1"}},
+			want: &types.ForwardAuth{Allow: []string{"10.0.0.0/8", "192.168.1.10"}, Deny: []string{"2001:db8::1"}},
+		},
+		{name: "host bits in a block", auth: &types.ForwardAuth{Allow: []string{"10.0.0.1/8"}}, wantErr: true},
+		{name: "invalid address", auth: &types.ForwardAuth{Deny: []string{"example.com"}}, wantErr: true},
+		{
+			name: "users",
+			auth: &types.ForwardAuth{Users: []types.ForwardUser{{Name: "alice", PasswordHash: testHash}}},
+			want: &types.ForwardAuth{Users: []types.ForwardUser{{Name: "alice", PasswordHash: testHash}}},
+		},
+		{name: "invalid user name", auth: &types.ForwardAuth{Users: []types.ForwardUser{{Name: "al:ice", PasswordHash: testHash}}}, wantErr: true},
+		{name: "missing hash", auth: &types.ForwardAuth{Users: []types.ForwardUser{{Name: "alice"}}}, wantErr: true},
+		{name: "hash with a colon", auth: &types.ForwardAuth{Users: []types.ForwardUser{{Name: "alice", PasswordHash: "$6$a:b"}}}, wantErr: true},
+		{
+			name:    "user given twice",
+			auth:    &types.ForwardAuth{Users: []types.ForwardUser{{Name: "alice", PasswordHash: testHash}, {Name: "alice", PasswordHash: testHash}}},
+			wantErr: true,
+		},
+		{
+			name: "forward auth with sign in",
+			auth: &types.ForwardAuth{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", SignInURL: "https://auth.example.com/oauth2/start"},
+			want: &types.ForwardAuth{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", SignInURL: "https://auth.example.com/oauth2/start"},
+		},
+		{name: "forward auth without a scheme", auth: &types.ForwardAuth{ForwardAuthURL: "10.8.0.2:4180/oauth2/auth"}, wantErr: true},
+		{name: "forward auth with a semicolon", auth: &types.ForwardAuth{ForwardAuthURL: "http://10.8.0.2:4180/;return 200"}, wantErr: true},
+		{
+			name:    "forward auth with users",
+			auth:    &types.ForwardAuth{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", Users: []types.ForwardUser{{Name: "alice", PasswordHash: testHash}}},
+			wantErr: true,
+		},
+		{name: "sign in without forward auth", auth: &types.ForwardAuth{SignInURL: "https://auth.example.com/oauth2/start"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		forward := types.Forward{Domain: "app.example.com", Auth: &types.ForwardAuth{Allow: []string{"172.16.0.0/12"}}}
+
+		err := SetAuth(&forward, tt.auth)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, forward.Auth)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(forward.Auth, tt.want) {
+			t.Errorf("%s: auth = %+v, want %+v", tt.name, forward.Auth, tt.want)
+		}
+	}
+}
+
+func TestSetAuthPassthrough(t *testing.T) {
+	forward := types.Forward{Domain: "tls.example.com", Passthrough: true}
+
+	if err := SetAuth(&forward, &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}}); err == nil {
+		t.Error("expected an error for a passthrough forward")
+	}
+
+	if err := SetAuth(&forward, nil); err != nil {
+		t.Errorf("clearing the policy of a passthrough forward: %v", err)
+	}
+}
+
+func TestApplyAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    *types.ForwardAuth
+		add     []string
+		remove  []string
+		want    *types.ForwardAuth
+		wantErr bool
+	}{
+		{
+			name: "add addresses",
+			add:  []string{"allow=10.0.0.0/8", "deny=10.0.0.5"},
+			want: &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.5"}},
+		},
+		{
+			name:   "replace an address",
+			auth:   &types.ForwardAuth{Allow: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+			remove: []string{"allow=10.0.0.0/8"},
+			add:    []string{"allow=172.16.0.0/12"},
+			want:   &types.ForwardAuth{Allow: []string{"192.168.0.0/16", "172.16.0.0/12"}},
+		},
+		{
+			name:   "clear a list",
+			auth:   &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.5"}},
+			remove: []string{"allow"},
+			want:   &types.ForwardAuth{Deny: []string{"10.0.0.5"}},
+		},
+		{
+			name:   "clear everything",
+			auth:   &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}, ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth"},
+			remove: []string{"all"},
+			want:   nil,
+		},
+		{
+			name:   "remove forward auth and its sign in",
+			auth:   &types.ForwardAuth{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", SignInURL: "https://auth.example.com/oauth2/start"},
+			remove: []string{"forward-auth"},
+			want:   nil,
+		},
+		{name: "missing address", auth: &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}}, remove: []string{"allow=192.168.0.0/16"}, wantErr: true},
+		{name: "missing user", remove: []string{"user=alice"}, wantErr: true},
+		{name: "unknown key", add: []string{"password=secret"}, wantErr: true},
+		{name: "missing value", add: []string{"allow="}, wantErr: true},
+		{name: "invalid policy", add: []string{"signin=https://auth.example.com/oauth2/start"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		forward := types.Forward{Domain: "app.example.com", Auth: tt.auth}
+		before := copyAuth(tt.auth)
+
+		passwords, err := ApplyAuth(&forward, tt.add, tt.remove)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, forward.Auth)
+			}
+			if !reflect.DeepEqual(forward.Auth, before) {
+				t.Errorf("%s: a refused change altered the policy: %+v", tt.name, forward.Auth)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(forward.Auth, tt.want) {
+			t.Errorf("%s: auth = %+v, want %+v", tt.name, forward.Auth, tt.want)
+		}
+		if len(passwords) != 0 {
+			t.Errorf("%s: unexpected passwords %v", tt.name, passwords)
+		}
+	}
+}
+
+func TestApplyAuthUsers(t *testing.T) {
+	forward := types.Forward{Domain: "app.example.com"}
+
+	passwords, err := ApplyAuth(&forward, []string{"user=alice", "user=bob"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(passwords) != 2 || passwords["alice"] == "" || passwords["bob"] == "" {
+		t.Fatalf("passwords = %v, want one for alice and bob", passwords)
+	}
+
+	aliceHash := forward.Auth.Users[0].PasswordHash
+	if !strings.HasPrefix(aliceHash, "$6$") || strings.Contains(aliceHash, passwords["alice"]) {
+		t.Errorf("password of alice stored as %s", aliceHash)
+	}
+
+	// adding a user again gives it a new password
+	passwords, err = ApplyAuth(&forward, []string{"user=alice"}, []string{"user=bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(forward.Auth.Users) != 1 || forward.Auth.Users[0].Name != "alice" || forward.Auth.Users[0].PasswordHash == aliceHash {
+		t.Errorf("users = %+v, want alice with a new password", forward.Auth.Users)
+	}
+	if len(passwords) != 1 || passwords["alice"] == "" {
+		t.Errorf("passwords = %v, want one for alice", passwords)
+	}
+}
+
+func TestAuthOptions(t *testing.T) {
+	forward := types.Forward{Auth: &types.ForwardAuth{
+		Allow:          []string{"10.0.0.0/8", "192.168.0.0/16"},
+		Deny:           []string{"10.0.0.5"},
+		ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth",
+		SignInURL:      "https://auth.example.com/oauth2/start",
+	}}
+
+	want := []string{
+		"deny 10.0.0.5",
+		"allow 10.0.0.0/8 192.168.0.0/16",
+		"forward auth http://10.8.0.2:4180/oauth2/auth (sign in https://auth.example.com/oauth2/start)",
+	}
+	if got := AuthOptions(&forward); !reflect.DeepEqual(got, want) {
+		t.Errorf("AuthOptions = %v, want %v", got, want)
+	}
+}
+
+func copyAuth(auth *types.ForwardAuth) *types.ForwardAuth {
+	if auth == nil {
+		return nil
+	}
+
+	copied := *auth
+	copied.Allow = slices.Clone(auth.Allow)
+	copied.Deny = slices.Clone(auth.Deny)
+
+	return &copied
+}
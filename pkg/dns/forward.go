@@ -0,0 +1,566 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/certs"
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// FindForward returns the index of the forward of the domain, or -1.
+func FindForward(connectionsConfig *types.ConnectionsConfig, domain string) int {
+	for i, forward := range connectionsConfig.Forwards {
+		if forward.Domain == domain {
+			return i
+		}
+	}
+
+	return -1
+}
+
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyIPHash     = "ip_hash"
+	StrategyRandom     = "random"
+)
+
+// Strategies are the load balancing strategies of the forwards, named after
+// the Nginx directives.
+var Strategies = []string{StrategyRoundRobin, StrategyLeastConn, StrategyIPHash, StrategyRandom}
+
+var domainLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// CheckDomain checks that the domain is a host name made of RFC 1123 labels,
+// like app.example.com, or a wildcard like *.example.com. The domain ends up
+// in Nginx directives and in the names of the files of its site.
+func CheckDomain(domain string) error {
+	if domain == "" {
+		return errors.New("domain cannot be empty")
+	}
+
+	name := strings.TrimPrefix(domain, "*.")
+	if len(name) > 253 {
+		return fmt.Errorf("invalid domain '%s', it is longer than 253 characters", domain)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if !domainLabelRegexp.MatchString(label) {
+			return fmt.Errorf("invalid domain '%s', expected a host name like app.example.com or *.example.com", domain)
+		}
+	}
+
+	return nil
+}
+
+// AddForward adds a forward of the domain with a route of the / path balanced
+// across targets, each a "server:port" where server is a peer ID or an IP
+// address.
+func AddForward(connectionsConfig *types.ConnectionsConfig, domain string, targets []string, strategy string) (*types.Forward, error) {
+	if err := CheckDomain(domain); err != nil {
+		return nil, err
+	}
+
+	if FindForward(connectionsConfig, domain) != -1 {
+		return nil, fmt.Errorf("forward %s already exists", domain)
+	}
+
+	forward := types.Forward{
+		Domain:    domain,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if _, err := AddRoute(connectionsConfig, &forward, "/", targets, strategy); err != nil {
+		return nil, err
+	}
+
+	connectionsConfig.Forwards = append(connectionsConfig.Forwards, forward)
+
+	return &connectionsConfig.Forwards[len(connectionsConfig.Forwards)-1], nil
+}
+
+// SetTargets replaces the targets of the route, each a "server:port".
+func SetTargets(connectionsConfig *types.ConnectionsConfig, route *types.ForwardRoute, targets []string) error {
+	if len(targets) == 0 {
+		return errors.New("at least one target is needed")
+	}
+
+	parsed := make([]types.ForwardTarget, 0, len(targets))
+	for _, spec := range targets {
+		target, err := ParseTarget(connectionsConfig, spec)
+		if err != nil {
+			return err
+		}
+
+		for _, existing := range parsed {
+			if existing == target {
+				return fmt.Errorf("target %s given twice", spec)
+			}
+		}
+
+		parsed = append(parsed, target)
+	}
+
+	route.Targets = parsed
+
+	return nil
+}
+
+// ParseTarget parses a "server:port" target, server being a peer ID or an IP
+// address. The IP of a peer is stored as the peer, so the forward follows it
+// when its address changes.
+func ParseTarget(connectionsConfig *types.ConnectionsConfig, spec string) (types.ForwardTarget, error) {
+	server, portValue, err := net.SplitHostPort(spec)
+	if err != nil {
+		return types.ForwardTarget{}, fmt.Errorf("invalid target '%s', expected <server>:<port>", spec)
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return types.ForwardTarget{}, fmt.Errorf("invalid port in target '%s'", spec)
+	}
+
+	target := types.ForwardTarget{}
+	if err := SetServer(connectionsConfig, &target, server); err != nil {
+		return types.ForwardTarget{}, err
+	}
+
+	if err := SetPort(&target, port); err != nil {
+		return types.ForwardTarget{}, err
+	}
+
+	return target, nil
+}
+
+// SetServer points the target to server, a peer ID or an IP address.
+func SetServer(connectionsConfig *types.ConnectionsConfig, target *types.ForwardTarget, server string) error {
+	for _, network := range connectionsConfig.Networks {
+		for _, peer := range network.Peers {
+			if peer.ID == server || peerIP(&peer) == server {
+				target.PeerID = peer.ID
+				target.Address = ""
+				return nil
+			}
+		}
+	}
+
+	if net.ParseIP(server) == nil {
+		return fmt.Errorf("server '%s' not found in connections", server)
+	}
+
+	target.PeerID = ""
+	target.Address = server
+
+	return nil
+}
+
+// SetPort changes the port the target receives the traffic on.
+func SetPort(target *types.ForwardTarget, port int) error {
+	if err := checkPort(port); err != nil {
+		return err
+	}
+
+	target.Port = port
+
+	return nil
+}
+
+// SetStrategy changes how the traffic is balanced across the targets, an
+// empty strategy is round robin.
+func SetStrategy(route *types.ForwardRoute, strategy string) error {
+	if strategy == "" || strategy == StrategyRoundRobin {
+		route.Strategy = ""
+		return nil
+	}
+
+	for _, known := range Strategies {
+		if strategy == known {
+			route.Strategy = strategy
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown strategy %s, expected one of %s", strategy, strings.Join(Strategies, ", "))
+}
+
+// Strategy returns the load balancing strategy of the route.
+func Strategy(route *types.ForwardRoute) string {
+	if route.Strategy == "" {
+		return StrategyRoundRobin
+	}
+
+	return route.Strategy
+}
+
+// SetTLS enables or disables HTTPS on the forward, HSTS needs TLS.
+func SetTLS(forward *types.Forward, tls bool, hsts bool) error {
+	if hsts && !tls {
+		return errors.New("HSTS needs TLS")
+	}
+
+	if tls && forward.Passthrough {
+		return errors.New("TLS is terminated by the targets of passthrough forwards")
+	}
+
+	if tls && strings.HasPrefix(forward.Domain, "*.") {
+		return errors.New("wildcard domains cannot get a certificate over the ACME HTTP challenge")
+	}
+
+	forward.TLS = tls
+	forward.HSTS = hsts
+
+	return nil
+}
+
+// SetPassthrough makes the forward route the TLS connections of the domain to
+// the targets without decrypting them, or serve it over HTTP again. The
+// requests are not seen by the tower, so passthrough forwards have a single
+// route of the / path without options.
+func SetPassthrough(forward *types.Forward, passthrough bool) error {
+	if passthrough && forward.TLS {
+		return errors.New("TLS is terminated by the targets of passthrough forwards, turn TLS off")
+	}
+
+	if passthrough {
+		if forward.Auth != nil {
+			return errors.New("the requests of passthrough forwards are not seen by the tower, remove their access policy first")
+		}
+		if len(forward.Routes) != 1 || forward.Routes[0].Path != "/" {
+			return errors.New("passthrough forwards cannot route paths, they only have a route of /")
+		}
+		if hasOptions(&forward.Routes[0]) {
+			return errors.New("passthrough forwards cannot strip prefixes, set headers, body sizes or timeouts")
+		}
+	}
+
+	forward.Passthrough = passthrough
+
+	return nil
+}
+
+// ResolveTarget returns the "ip:port" address the traffic sent to the target
+// goes to.
+func ResolveTarget(connectionsConfig *types.ConnectionsConfig, target *types.ForwardTarget) (string, error) {
+	if target.PeerID == "" {
+		return net.JoinHostPort(target.Address, strconv.Itoa(target.Port)), nil
+	}
+
+	for _, network := range connectionsConfig.Networks {
+		for _, peer := range network.Peers {
+			if peer.ID != target.PeerID {
+				continue
+			}
+
+			ip := peerIP(&peer)
+			if ip == "" {
+				return "", fmt.Errorf("peer %s has no address", peer.ID)
+			}
+			return net.JoinHostPort(ip, strconv.Itoa(target.Port)), nil
+		}
+	}
+
+	return "", fmt.Errorf("peer %s not found", target.PeerID)
+}
+
+// Server returns the peer ID or the address the target points to.
+func Server(target *types.ForwardTarget) string {
+	if target.PeerID != "" {
+		return target.PeerID
+	}
+
+	return target.Address
+}
+
+// Target returns the "server:port" the target points to.
+func Target(target *types.ForwardTarget) string {
+	return net.JoinHostPort(Server(target), strconv.Itoa(target.Port))
+}
+
+// Targets returns the targets as "server:port".
+func Targets(targets []types.ForwardTarget) []string {
+	specs := make([]string, 0, len(targets))
+	for i := range targets {
+		specs = append(specs, Target(&targets[i]))
+	}
+
+	return specs
+}
+
+// AllTargets returns the targets of all the routes of the forward, once each.
+func AllTargets(forward *types.Forward) []types.ForwardTarget {
+	var targets []types.ForwardTarget
+	seen := make(map[types.ForwardTarget]bool)
+
+	for _, route := range forward.Routes {
+		for _, target := range route.Targets {
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	return targets
+}
+
+// ResolveTargets returns the addresses of the targets that can be resolved,
+// and the errors of the others.
+func ResolveTargets(connectionsConfig *types.ConnectionsConfig, targets []types.ForwardTarget) ([]string, []error) {
+	var addresses []string
+	var errs []error
+
+	for i := range targets {
+		address, err := ResolveTarget(connectionsConfig, &targets[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, errs
+}
+
+// ReconcileForwards brings the Nginx sites, stream servers and SNI router in
+// line with the forwards of the connections config, reloading Nginx once when
+// anything changed. It returns a description of every change made.
+func ReconcileForwards(tx *system.Transaction, connectionsConfig *types.ConnectionsConfig) ([]string, error) {
+	health, err := LoadHealth()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the health of the targets: %v", err)
+	}
+
+	// the state is edited by hand at times, a domain must not reach the Nginx
+	// directives and file names unchecked
+	for _, forward := range connectionsConfig.Forwards {
+		if err := CheckDomain(forward.Domain); err != nil {
+			return nil, fmt.Errorf("invalid forward, remove it with 'upduck dns remove': %v", err)
+		}
+	}
+
+	var changes []string
+	var routes []system.NginxSNIRoute
+	desired := make(map[string]bool)
+
+	for _, forward := range connectionsConfig.Forwards {
+		if !forward.Passthrough {
+			continue
+		}
+
+		route := FindRoute(&forward, "/")
+		if route == nil {
+			continue
+		}
+
+		addresses, _ := ResolveTargets(connectionsConfig, route.Targets)
+		if len(addresses) == 0 {
+			continue
+		}
+
+		balancing := route.Strategy
+		if balancing == StrategyIPHash {
+			// stream upstreams have no ip_hash, the client address comes
+			// from the PROXY protocol header of the first hop
+			balancing = "hash $proxy_protocol_addr consistent"
+		}
+
+		routes = append(routes, system.NginxSNIRoute{
+			Domain:    forward.Domain,
+			Servers:   upstreamServers(addresses, health),
+			Balancing: balancing,
+		})
+	}
+
+	for _, forward := range connectionsConfig.Forwards {
+		if forward.Passthrough {
+			continue
+		}
+
+		site := nginxSite(connectionsConfig, &forward, health, len(routes) > 0)
+		if len(site.Locations) == 0 {
+			continue
+		}
+		desired[forward.Domain] = true
+
+		changed, err := system.CreateNginxConfig(tx, site)
+		if err != nil {
+			return changes, fmt.Errorf("failed to write Nginx site of %s: %v", forward.Domain, err)
+		}
+		if changed {
+			changes = append(changes, fmt.Sprintf("wrote Nginx site of %s -> %s", forward.Domain, describeLocations(site.Locations)))
+		}
+	}
+
+	sites, err := system.ListManagedNginxSites()
+	if err != nil {
+		return changes, fmt.Errorf("failed to list Nginx sites: %v", err)
+	}
+
+	for _, domain := range sites {
+		if desired[domain] {
+			continue
+		}
+
+		if err := system.RemoveNginxConfig(tx, domain); err != nil {
+			return changes, fmt.Errorf("failed to remove Nginx site of %s: %v", domain, err)
+		}
+
+		index := FindForward(connectionsConfig, domain)
+		switch {
+		case index != -1 && connectionsConfig.Forwards[index].Passthrough:
+			changes = append(changes, fmt.Sprintf("removed Nginx site of %s, routed by the SNI router", domain))
+		case index != -1:
+			_, errs := ResolveTargets(connectionsConfig, AllTargets(&connectionsConfig.Forwards[index]))
+			changes = append(changes, fmt.Sprintf("removed Nginx site of %s, %v", domain, errors.Join(errs...)))
+		default:
+			changes = append(changes, fmt.Sprintf("removed Nginx site of %s", domain))
+		}
+	}
+
+	streamChanges, err := reconcileStreams(tx, connectionsConfig, routes)
+	changes = append(changes, streamChanges...)
+	if err != nil {
+		return changes, err
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	if err := system.ReloadNginx(tx); err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
+
+// nginxSite describes the site of the forward, with a location for each
+// route having targets that resolve. TLS forwards serve the ACME challenges
+// over HTTP, and HTTPS once their certificate is issued, behind the SNI router
+// when there is one.
+func nginxSite(connectionsConfig *types.ConnectionsConfig, forward *types.Forward, health Health, sniRouter bool) system.NginxSite {
+	site := system.NginxSite{Domain: forward.Domain}
+
+	for _, route := range forward.Routes {
+		addresses, _ := ResolveTargets(connectionsConfig, route.Targets)
+		if len(addresses) == 0 {
+			continue
+		}
+
+		location := system.NginxLocation{
+			Path:           route.Path,
+			Servers:        upstreamServers(addresses, health),
+			Balancing:      route.Strategy,
+			StripPrefix:    route.StripPrefix,
+			MaxBodySize:    route.MaxBodySize,
+			ConnectTimeout: route.ConnectTimeout,
+			Timeout:        route.Timeout,
+		}
+		for _, name := range headerNames(&route) {
+			location.Headers = append(location.Headers, system.NginxHeader{Name: name, Value: route.Headers[name]})
+		}
+
+		site.Locations = append(site.Locations, location)
+	}
+
+	if auth := forward.Auth; auth != nil {
+		site.Access = &system.NginxAccess{
+			Allow:          auth.Allow,
+			Deny:           auth.Deny,
+			ForwardAuthURL: auth.ForwardAuthURL,
+			SignInURL:      auth.SignInURL,
+		}
+		for _, user := range auth.Users {
+			site.Access.Users = append(site.Access.Users, user.Name+":"+user.PasswordHash)
+		}
+	}
+
+	if !forward.TLS {
+		return site
+	}
+
+	site.ChallengeDir = config.ACMEChallengeDir
+	if certs.Exists(forward.Domain) {
+		site.TLS = &system.NginxTLS{
+			CertificateFile: certs.CertificateFile(forward.Domain),
+			KeyFile:         certs.KeyFile(forward.Domain),
+			HSTS:            forward.HSTS,
+			BehindSNIRouter: sniRouter,
+		}
+	}
+
+	return site
+}
+
+// upstreamServers returns the upstream servers of the addresses. Failing
+// targets are marked down, unless they all fail: Nginx then keeps trying
+// them rather than answering every request with an error.
+func upstreamServers(addresses []string, health Health) []system.NginxUpstreamServer {
+	var servers []system.NginxUpstreamServer
+
+	allDown := true
+	for _, address := range addresses {
+		down := health.Down(address)
+		allDown = allDown && down
+		servers = append(servers, system.NginxUpstreamServer{Address: address, Down: down})
+	}
+
+	if allDown {
+		for i := range servers {
+			servers[i].Down = false
+		}
+	}
+
+	return servers
+}
+
+func describeLocations(locations []system.NginxLocation) string {
+	if len(locations) == 1 && locations[0].Path == "/" {
+		return describeServers(locations[0].Servers)
+	}
+
+	descriptions := make([]string, 0, len(locations))
+	for _, location := range locations {
+		descriptions = append(descriptions, location.Path+" "+describeServers(location.Servers))
+	}
+
+	return strings.Join(descriptions, "; ")
+}
+
+func describeServers(servers []system.NginxUpstreamServer) string {
+	descriptions := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server.Down {
+			descriptions = append(descriptions, server.Address+" (down)")
+		} else {
+			descriptions = append(descriptions, server.Address)
+		}
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+func peerIP(peer *types.Peer) string {
+	ip, _, err := net.ParseCIDR(peer.Address)
+	if err != nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+func checkPort(port int) error {
+	if port < 1 || port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+
+	return nil
+}
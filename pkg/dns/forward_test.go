@@ -0,0 +1,186 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// testConnections has two peers on one network.
+func testConnections() *types.ConnectionsConfig {
+	return &types.ConnectionsConfig{
+		Networks: []types.Network{{
+			ID:      "net1",
+			Address: "10.8.0.0/24",
+			Peers: []types.Peer{
+				{ID: "peerA", Address: "10.8.0.2/32"},
+				{ID: "peerB", Address: "10.8.0.3/32"},
+			},
+		}},
+	}
+}
+
+func TestSetTargets(t *testing.T) {
+	tests := []struct {
+		targets []string
+		want    []types.ForwardTarget
+		wantErr bool
+	}{
+		{targets: []string{"peerA:3000"}, want: []types.ForwardTarget{{PeerID: "peerA", Port: 3000}}},
+		{targets: []string{"10.8.0.3:80"}, want: []types.ForwardTarget{{PeerID: "peerB", Port: 80}}},
+		{targets: []string{"192.168.1.10:80"}, want: []types.ForwardTarget{{Address: "192.168.1.10", Port: 80}}},
+		{
+			targets: []string{"peerA:3000", "peerB:3000"},
+			want:    []types.ForwardTarget{{PeerID: "peerA", Port: 3000}, {PeerID: "peerB", Port: 3000}},
+		},
+		{targets: nil, wantErr: true},
+		{targets: []string{"peerA:3000", "10.8.0.2:3000"}, wantErr: true},
+		{targets: []string{"unknown:3000"}, wantErr: true},
+		{targets: []string{"peerA"}, wantErr: true},
+		{targets: []string{"peerA:0"}, wantErr: true},
+		{targets: []string{"peerA:65536"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var route types.ForwardRoute
+		err := SetTargets(testConnections(), &route, tt.targets)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("SetTargets(%v): expected an error, got %v", tt.targets, route.Targets)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("SetTargets(%v): %v", tt.targets, err)
+		} else if !reflect.DeepEqual(route.Targets, tt.want) {
+			t.Errorf("SetTargets(%v) = %v, want %v", tt.targets, route.Targets, tt.want)
+		}
+	}
+}
+
+func TestSetStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+		wantErr  bool
+	}{
+		{strategy: "", want: ""},
+		{strategy: StrategyRoundRobin, want: ""},
+		{strategy: StrategyLeastConn, want: StrategyLeastConn},
+		{strategy: StrategyIPHash, want: StrategyIPHash},
+		{strategy: StrategyRandom, want: StrategyRandom},
+		{strategy: "weighted", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		route := types.ForwardRoute{Strategy: StrategyLeastConn}
+		err := SetStrategy(&route, tt.strategy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetStrategy(%q): unexpected error %v", tt.strategy, err)
+			continue
+		}
+
+		if !tt.wantErr && route.Strategy != tt.want {
+			t.Errorf("SetStrategy(%q) stored %q, want %q", tt.strategy, route.Strategy, tt.want)
+		}
+	}
+}
+
+func TestUpstreamServers(t *testing.T) {
+	down := &TargetHealth{Healthy: false}
+	up := &TargetHealth{Healthy: true}
+
+	tests := []struct {
+		name   string
+		health Health
+		want   []bool
+	}{
+		{name: "never checked", health: Health{}, want: []bool{false, false}},
+		{name: "one down", health: Health{"10.8.0.3:80": down, "10.8.0.2:80": up}, want: []bool{false, true}},
+		{name: "all down", health: Health{"10.8.0.2:80": down, "10.8.0.3:80": down}, want: []bool{false, false}},
+	}
+
+	for _, tt := range tests {
+		servers := upstreamServers([]string{"10.8.0.2:80", "10.8.0.3:80"}, tt.health)
+
+		var got []bool
+		for _, server := range servers {
+			got = append(got, server.Down)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: down = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNginxSiteBalancing(t *testing.T) {
+	connectionsConfig := testConnections()
+	forward := types.Forward{
+		Domain: "app.example.com",
+		Routes: []types.ForwardRoute{{
+			Path:     "/",
+			Strategy: StrategyLeastConn,
+			Targets: []types.ForwardTarget{
+				{PeerID: "peerA", Port: 3000},
+				{PeerID: "gone", Port: 3000},
+				{Address: "192.168.1.10", Port: 8080},
+			},
+		}},
+	}
+
+	site := nginxSite(connectionsConfig, &forward, Health{}, false)
+
+	want := []system.NginxLocation{{
+		Path:      "/",
+		Balancing: StrategyLeastConn,
+		Servers:   []system.NginxUpstreamServer{{Address: "10.8.0.2:3000"}, {Address: "192.168.1.10:8080"}},
+	}}
+	if !reflect.DeepEqual(site.Locations, want) {
+		t.Errorf("locations = %+v, want %+v", site.Locations, want)
+	}
+
+	if site.TLS != nil || site.ChallengeDir != "" {
+		t.Errorf("expected a plain HTTP site, got %+v", site)
+	}
+}
+
+func TestSetPassthrough(t *testing.T) {
+	root := types.ForwardRoute{Path: "/", Targets: []types.ForwardTarget{{PeerID: "peerA", Port: 443}}}
+	api := types.ForwardRoute{Path: "/api", Targets: root.Targets}
+	timed := root
+	timed.Timeout = "30s"
+
+	tests := []struct {
+		name    string
+		forward types.Forward
+		wantErr bool
+	}{
+		{name: "single route", forward: types.Forward{Routes: []types.ForwardRoute{root}}},
+		{name: "tls", forward: types.Forward{Routes: []types.ForwardRoute{root}, TLS: true}, wantErr: true},
+		{name: "access policy", forward: types.Forward{Routes: []types.ForwardRoute{root}, Auth: &types.ForwardAuth{Allow: []string{"10.0.0.0/8"}}}, wantErr: true},
+		{name: "path routes", forward: types.Forward{Routes: []types.ForwardRoute{root, api}}, wantErr: true},
+		{name: "route options", forward: types.Forward{Routes: []types.ForwardRoute{timed}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		forward := tt.forward
+		forward.Domain = "app.example.com"
+
+		err := SetPassthrough(&forward, true)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if forward.Passthrough == tt.wantErr {
+			t.Errorf("%s: passthrough = %v", tt.name, forward.Passthrough)
+		}
+
+		// turning passthrough off is always allowed
+		if err := SetPassthrough(&forward, false); err != nil || forward.Passthrough {
+			t.Errorf("%s: failed to turn passthrough off: %v", tt.name, err)
+		}
+	}
+}
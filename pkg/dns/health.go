@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+const (
+	// healthCheckInterval is how often every target is probed.
+	healthCheckInterval = 10 * time.Second
+
+	// healthCheckTimeout bounds the connection to a target.
+	healthCheckTimeout = 3 * time.Second
+
+	// unhealthyAfter failed probes in a row take a target out of rotation,
+	// healthyAfter successful ones put it back.
+	unhealthyAfter = 3
+	healthyAfter   = 2
+)
+
+// TargetHealth is the result of the active health checks of a target.
+type TargetHealth struct {
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Health is the health of the targets by "ip:port" address, as last seen by
+// the daemon. Targets missing from it were not found failing.
+type Health map[string]*TargetHealth
+
+// LoadHealth returns the health of the targets, empty when the daemon did
+// not check any yet.
+func LoadHealth() (Health, error) {
+	health := Health{}
+
+	data, err := os.ReadFile(config.ForwardHealthFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return health, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &health); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", config.ForwardHealthFile, err)
+	}
+
+	return health, nil
+}
+
+// Down reports whether the target at address failed its health checks.
+func (h Health) Down(address string) bool {
+	target, ok := h[address]
+	return ok && !target.Healthy
+}
+
+func saveHealth(health Health) error {
+	data, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return system.WriteFile(config.ForwardHealthFile, data, 0644)
+}
+
+// HealthChecker probes the targets of the forwards of the tower over the
+// WireGuard networks with TCP connections. It runs in the daemon.
+type HealthChecker struct {
+	onChange func(reason string)
+
+	// failures and successes count the probes in a row with the same result.
+	failures  map[string]int
+	successes map[string]int
+}
+
+// NewHealthChecker returns a checker calling onChange when a target goes
+// down or comes back, so the Nginx sites can be regenerated.
+func NewHealthChecker(onChange func(reason string)) *HealthChecker {
+	return &HealthChecker{
+		onChange:  onChange,
+		failures:  make(map[string]int),
+		successes: make(map[string]int),
+	}
+}
+
+// Run probes the targets at startup and then periodically until ctx is done.
+func (c *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *HealthChecker) check(ctx context.Context) {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		log.Printf("Error checking forward targets: %v", err)
+		return
+	}
+
+	health, err := LoadHealth()
+	if err != nil {
+		log.Printf("Warning: %v, starting over", err)
+		health = Health{}
+	}
+
+	targets := make(map[string]bool)
+	for _, forward := range connectionsConfig.Forwards {
+		addresses, _ := ResolveTargets(connectionsConfig, AllTargets(&forward))
+		for _, address := range addresses {
+			targets[address] = true
+		}
+	}
+
+	results := probeTargets(ctx, targets)
+	if ctx.Err() != nil {
+		return
+	}
+
+	// changed tells whether the health has to be saved, transitions whether
+	// the sites have to be regenerated
+	var changed bool
+	var transitions []string
+	now := time.Now().UTC()
+
+	for address, probeErr := range results {
+		target, known := health[address]
+		if !known {
+			target = &TargetHealth{Healthy: true, Since: now}
+			health[address] = target
+			changed = true
+		}
+
+		if probeErr != nil {
+			c.successes[address] = 0
+			c.failures[address]++
+			if target.LastError != probeErr.Error() {
+				target.LastError = probeErr.Error()
+				changed = true
+			}
+
+			if target.Healthy && c.failures[address] >= unhealthyAfter {
+				target.Healthy = false
+				target.Since = now
+				log.Printf("Forward target %s is down: %v", address, probeErr)
+				transitions = append(transitions, fmt.Sprintf("forward target %s down", address))
+			}
+			continue
+		}
+
+		c.failures[address] = 0
+		c.successes[address]++
+		if target.LastError != "" {
+			target.LastError = ""
+			changed = true
+		}
+
+		if !target.Healthy && c.successes[address] >= healthyAfter {
+			target.Healthy = true
+			target.Since = now
+			log.Printf("Forward target %s is back up", address)
+			transitions = append(transitions, fmt.Sprintf("forward target %s up", address))
+		}
+	}
+
+	for address := range health {
+		if !targets[address] {
+			delete(health, address)
+			delete(c.failures, address)
+			delete(c.successes, address)
+			changed = true
+		}
+	}
+
+	if !changed && len(transitions) == 0 {
+		return
+	}
+
+	if err := saveHealth(health); err != nil {
+		log.Printf("Error saving the health of the forward targets: %v", err)
+		return
+	}
+
+	for _, transition := range transitions {
+		c.onChange(transition)
+	}
+}
+
+// probeTargets connects to every target concurrently and returns the error
+// of each, nil when it accepted the connection.
+func probeTargets(ctx context.Context, targets map[string]bool) map[string]error {
+	results := make(map[string]error, len(targets))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for address := range targets {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			dialer := net.Dialer{Timeout: healthCheckTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+
+			mu.Lock()
+			results[address] = err
+			mu.Unlock()
+		}(address)
+	}
+
+	wg.Wait()
+
+	return results
+}
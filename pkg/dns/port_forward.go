@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// reservedTCPPorts are the ports Nginx serves the HTTP forwards on, and the
+// default port of the upduck API. A daemon started on another port is caught
+// by the host check of network.CheckPublicPort.
+var reservedTCPPorts = map[string]string{
+	"80":                  "HTTP forwards",
+	"443":                 "HTTPS forwards",
+	config.DefaultAPIPort: "upduck API",
+}
+
+// FindPortForward returns the index of the forward of the public port, or -1.
+func FindPortForward(connectionsConfig *types.ConnectionsConfig, protocol string, publicPort int) int {
+	for i, forward := range connectionsConfig.PortForwards {
+		if forward.Protocol == protocol && forward.PublicPort == publicPort {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// AddPortForward adds a forward of the public port of the tower to the port
+// of server, a peer ID or an IP address. A public port can only be claimed by
+// one forward.
+func AddPortForward(connectionsConfig *types.ConnectionsConfig, protocol string, publicPort int, server string, port int) (*types.PortForward, error) {
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		return nil, fmt.Errorf("unknown protocol %s, expected %s or %s", protocol, ProtocolTCP, ProtocolUDP)
+	}
+
+	if err := checkPort(publicPort); err != nil {
+		return nil, fmt.Errorf("invalid public port: %v", err)
+	}
+
+	if index := FindPortForward(connectionsConfig, protocol, publicPort); index != -1 {
+		return nil, fmt.Errorf("%s port %d is already forwarded to %s", protocol, publicPort, Target(&connectionsConfig.PortForwards[index].Target))
+	}
+
+	if usage, ok := reservedTCPPorts[strconv.Itoa(publicPort)]; ok && protocol == ProtocolTCP {
+		return nil, fmt.Errorf("tcp port %d is used by the %s", publicPort, usage)
+	}
+
+	forward := types.PortForward{
+		Protocol:   protocol,
+		PublicPort: publicPort,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if err := SetServer(connectionsConfig, &forward.Target, server); err != nil {
+		return nil, err
+	}
+
+	if err := SetPort(&forward.Target, port); err != nil {
+		return nil, err
+	}
+
+	connectionsConfig.PortForwards = append(connectionsConfig.PortForwards, forward)
+
+	return &connectionsConfig.PortForwards[len(connectionsConfig.PortForwards)-1], nil
+}
+
+// reconcileStreams writes the Nginx stream servers of the port forwards and
+// the SNI router of the passthrough routes, and removes the ones upduck
+// generated for forwards that no longer exist, like ReconcileForwards does
+// for the sites.
+func reconcileStreams(tx *system.Transaction, connectionsConfig *types.ConnectionsConfig, routes []system.NginxSNIRoute) ([]string, error) {
+	var changes []string
+	desired := make(map[string]bool)
+
+	if len(routes) > 0 {
+		desired[system.NginxSNIRouterName] = true
+
+		changed, err := system.CreateNginxSNIRouter(tx, routes)
+		if err != nil {
+			return changes, fmt.Errorf("failed to write Nginx SNI router: %v", err)
+		}
+		if changed {
+			domains := make([]string, 0, len(routes))
+			for _, route := range routes {
+				domains = append(domains, route.Domain+" -> "+describeServers(route.Servers))
+			}
+			changes = append(changes, fmt.Sprintf("wrote Nginx SNI router (%s)", strings.Join(domains, ", ")))
+		}
+	}
+
+	for _, forward := range connectionsConfig.PortForwards {
+		address, err := ResolveTarget(connectionsConfig, &forward.Target)
+		if err != nil {
+			continue
+		}
+
+		name := system.NginxStreamName(forward.Protocol, forward.PublicPort)
+		desired[name] = true
+
+		changed, err := system.CreateNginxStream(tx, system.NginxStream{
+			Protocol:   forward.Protocol,
+			ListenPort: forward.PublicPort,
+			Address:    address,
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to write Nginx stream of %s: %v", name, err)
+		}
+		if changed {
+			changes = append(changes, fmt.Sprintf("wrote Nginx stream of %s port %d -> %s", forward.Protocol, forward.PublicPort, address))
+		}
+	}
+
+	streams, err := system.ListManagedNginxStreams()
+	if err != nil {
+		return changes, fmt.Errorf("failed to list Nginx streams: %v", err)
+	}
+
+	for _, name := range streams {
+		if desired[name] {
+			continue
+		}
+
+		if err := system.RemoveNginxStream(tx, name); err != nil {
+			return changes, fmt.Errorf("failed to remove Nginx stream %s: %v", name, err)
+		}
+		changes = append(changes, fmt.Sprintf("removed Nginx stream %s", name))
+	}
+
+	changed, err := system.EnableNginxStreams(tx, len(desired) > 0)
+	if err != nil {
+		return changes, fmt.Errorf("failed to update the Nginx stream block: %v", err)
+	}
+	if changed && len(desired) > 0 {
+		changes = append(changes, "enabled the Nginx stream block")
+	} else if changed {
+		changes = append(changes, "disabled the Nginx stream block")
+	}
+
+	return changes, nil
+}
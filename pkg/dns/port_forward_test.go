@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func TestAddPortForward(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   string
+		publicPort int
+		server     string
+		port       int
+		want       types.ForwardTarget
+		wantErr    bool
+	}{
+		{name: "tcp to a peer", protocol: ProtocolTCP, publicPort: 2222, server: "peerA", port: 22, want: types.ForwardTarget{PeerID: "peerA", Port: 22}},
+		{name: "udp to an address", protocol: ProtocolUDP, publicPort: 53, server: "192.168.1.10", port: 53, want: types.ForwardTarget{Address: "192.168.1.10", Port: 53}},
+		{name: "udp on the HTTP port", protocol: ProtocolUDP, publicPort: 443, server: "peerB", port: 443, want: types.ForwardTarget{PeerID: "peerB", Port: 443}},
+		{name: "port already forwarded", protocol: ProtocolTCP, publicPort: 5432, server: "peerB", port: 5432, wantErr: true},
+		{name: "tcp on the HTTP port", protocol: ProtocolTCP, publicPort: 80, server: "peerA", port: 80, wantErr: true},
+		{name: "tcp on the HTTPS port", protocol: ProtocolTCP, publicPort: 443, server: "peerA", port: 443, wantErr: true},
+		{name: "tcp on the API port", protocol: ProtocolTCP, publicPort: 8080, server: "peerA", port: 8080, wantErr: true},
+		{name: "unknown protocol", protocol: "sctp", publicPort: 9000, server: "peerA", port: 9000, wantErr: true},
+		{name: "invalid public port", protocol: ProtocolTCP, publicPort: 70000, server: "peerA", port: 22, wantErr: true},
+		{name: "invalid target port", protocol: ProtocolTCP, publicPort: 2222, server: "peerA", port: 0, wantErr: true},
+		{name: "unknown server", protocol: ProtocolTCP, publicPort: 2222, server: "peerC", port: 22, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		connectionsConfig := testConnections()
+		connectionsConfig.PortForwards = []types.PortForward{
+			{Protocol: ProtocolTCP, PublicPort: 5432, Target: types.ForwardTarget{PeerID: "peerA", Port: 5432}},
+		}
+
+		forward, err := AddPortForward(connectionsConfig, tt.protocol, tt.publicPort, tt.server, tt.port)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			if len(connectionsConfig.PortForwards) != 1 {
+				t.Errorf("%s: a refused forward was added", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if forward.Target != tt.want || forward.Protocol != tt.protocol || forward.PublicPort != tt.publicPort {
+			t.Errorf("%s: got %+v, want %s/%d -> %+v", tt.name, forward, tt.protocol, tt.publicPort, tt.want)
+		}
+
+		if FindPortForward(connectionsConfig, tt.protocol, tt.publicPort) != 1 {
+			t.Errorf("%s: forward not found after being added", tt.name)
+		}
+	}
+}
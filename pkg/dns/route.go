@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+var (
+	routePathRegexp   = regexp.MustCompile(`^/[A-Za-z0-9._~!$&()*+,=:@%/-]*$`)
+	headerNameRegexp  = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+	bodySizeRegexp    = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	nginxTimeRegexp   = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+	invalidHeaderByte = regexp.MustCompile(`["\\\x00-\x1f\x7f]`)
+)
+
+// NormalizePath cleans the path of a route, "/api/" and "/api" are the same
+// route.
+func NormalizePath(routePath string) (string, error) {
+	if !strings.HasPrefix(routePath, "/") {
+		return "", fmt.Errorf("invalid path '%s', it must start with /", routePath)
+	}
+
+	cleaned := path.Clean(routePath)
+	if !routePathRegexp.MatchString(cleaned) {
+		return "", fmt.Errorf("invalid path '%s'", routePath)
+	}
+
+	return cleaned, nil
+}
+
+// FindRoute returns the route of the path of the forward, or nil.
+func FindRoute(forward *types.Forward, routePath string) *types.ForwardRoute {
+	for i := range forward.Routes {
+		if forward.Routes[i].Path == routePath {
+			return &forward.Routes[i]
+		}
+	}
+
+	return nil
+}
+
+// AddRoute adds a route of the path to the forward, balanced across targets
+// given as "server:port". The routes are kept sorted by path.
+func AddRoute(connectionsConfig *types.ConnectionsConfig, forward *types.Forward, routePath string, targets []string, strategy string) (*types.ForwardRoute, error) {
+	routePath, err := NormalizePath(routePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if forward.Passthrough {
+		return nil, fmt.Errorf("forward %s is a passthrough forward, it cannot route paths", forward.Domain)
+	}
+
+	if FindRoute(forward, routePath) != nil {
+		return nil, fmt.Errorf("route %s of %s already exists", routePath, forward.Domain)
+	}
+
+	route := types.ForwardRoute{Path: routePath}
+
+	if err := SetTargets(connectionsConfig, &route, targets); err != nil {
+		return nil, err
+	}
+
+	if err := SetStrategy(&route, strategy); err != nil {
+		return nil, err
+	}
+
+	index := sort.Search(len(forward.Routes), func(i int) bool {
+		return forward.Routes[i].Path > routePath
+	})
+	forward.Routes = append(forward.Routes, types.ForwardRoute{})
+	copy(forward.Routes[index+1:], forward.Routes[index:])
+	forward.Routes[index] = route
+
+	return &forward.Routes[index], nil
+}
+
+// RemoveRoute removes the route of the path from the forward.
+func RemoveRoute(forward *types.Forward, routePath string) error {
+	for i := range forward.Routes {
+		if forward.Routes[i].Path == routePath {
+			forward.Routes = append(forward.Routes[:i:i], forward.Routes[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("route %s of %s not found", routePath, forward.Domain)
+}
+
+// SetStripPrefix makes the route remove its path from the requests sent to
+// the targets, /api/users reaching them as /users.
+func SetStripPrefix(route *types.ForwardRoute, stripPrefix bool) error {
+	if stripPrefix && route.Path == "/" {
+		return errors.New("the route of / has no prefix to strip")
+	}
+
+	route.StripPrefix = stripPrefix
+
+	return nil
+}
+
+// ParseHeader parses a "Name=Value" header.
+func ParseHeader(spec string) (string, string, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid header '%s', expected <name>=<value>", spec)
+	}
+
+	return name, value, nil
+}
+
+// SetHeader sets a header on the requests the route sends to the targets,
+// replacing the one upduck sets by default. The value can use Nginx
+// variables like $host, an empty value removes the header.
+func SetHeader(route *types.ForwardRoute, name string, value string) error {
+	if !headerNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid header name '%s'", name)
+	}
+
+	if invalidHeaderByte.MatchString(value) {
+		return fmt.Errorf("invalid value of header %s, quotes, backslashes and control characters are not allowed", name)
+	}
+
+	if route.Headers == nil {
+		route.Headers = make(map[string]string)
+	}
+	route.Headers[textproto.CanonicalMIMEHeaderKey(name)] = value
+
+	return nil
+}
+
+// RemoveHeader stops setting a header, the default of upduck applies again.
+func RemoveHeader(route *types.ForwardRoute, name string) error {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if _, ok := route.Headers[name]; !ok {
+		return fmt.Errorf("header %s is not set on route %s", name, route.Path)
+	}
+
+	delete(route.Headers, name)
+	if len(route.Headers) == 0 {
+		route.Headers = nil
+	}
+
+	return nil
+}
+
+// SetMaxBodySize changes the largest request body the route accepts, like
+// 10m, an empty size keeps the Nginx default of 1m and 0 disables the check.
+func SetMaxBodySize(route *types.ForwardRoute, size string) error {
+	if size != "" && !bodySizeRegexp.MatchString(size) {
+		return fmt.Errorf("invalid body size '%s', expected a number of bytes with an optional k, m or g unit", size)
+	}
+
+	route.MaxBodySize = size
+
+	return nil
+}
+
+// SetConnectTimeout changes how long the route waits for a target to accept
+// the connection before trying the next one, 5s when empty.
+func SetConnectTimeout(route *types.ForwardRoute, timeout string) error {
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+
+	route.ConnectTimeout = timeout
+
+	return nil
+}
+
+// SetTimeout changes how long the route waits between two reads or writes of
+// a response, 60s when empty.
+func SetTimeout(route *types.ForwardRoute, timeout string) error {
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+
+	route.Timeout = timeout
+
+	return nil
+}
+
+// RouteOptions describes the options of the route, in the order of the flags.
+func RouteOptions(route *types.ForwardRoute) []string {
+	var options []string
+
+	if route.StripPrefix {
+		options = append(options, "strip prefix")
+	}
+	for _, name := range headerNames(route) {
+		options = append(options, fmt.Sprintf("%s=%s", name, route.Headers[name]))
+	}
+	if route.MaxBodySize != "" {
+		options = append(options, "max body "+route.MaxBodySize)
+	}
+	if route.ConnectTimeout != "" {
+		options = append(options, "connect timeout "+route.ConnectTimeout)
+	}
+	if route.Timeout != "" {
+		options = append(options, "timeout "+route.Timeout)
+	}
+
+	return options
+}
+
+func hasOptions(route *types.ForwardRoute) bool {
+	return len(RouteOptions(route)) > 0
+}
+
+// headerNames returns the names of the headers of the route, sorted so the
+// generated site does not change between runs.
+func headerNames(route *types.ForwardRoute) []string {
+	names := make([]string, 0, len(route.Headers))
+	for name := range route.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func checkTimeout(timeout string) error {
+	if timeout != "" && !nginxTimeRegexp.MatchString(timeout) {
+		return fmt.Errorf("invalid timeout '%s', expected a number with an optional ms, s, m, h or d unit", timeout)
+	}
+
+	return nil
+}
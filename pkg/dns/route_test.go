@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/", want: "/"},
+		{path: "/api", want: "/api"},
+		{path: "/api/", want: "/api"},
+		{path: "/api//v1/../v2", want: "/api/v2"},
+		{path: "/static/app.v2~", want: "/static/app.v2~"},
+		{path: "api", wantErr: true},
+		{path: "", wantErr: true},
+		{path: "/api v1", wantErr: true},
+		{path: "/api;", wantErr: true},
+		{path: "/api{1}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizePath(tt.path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NormalizePath(%q): expected an error, got %q", tt.path, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizePath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddRoute(t *testing.T) {
+	connectionsConfig := testConnections()
+	forward := types.Forward{Domain: "app.example.com"}
+
+	for _, path := range []string{"/", "/web/", "/api"} {
+		if _, err := AddRoute(connectionsConfig, &forward, path, []string{"peerA:3000"}, ""); err != nil {
+			t.Fatalf("AddRoute(%s): %v", path, err)
+		}
+	}
+
+	var paths []string
+	for _, route := range forward.Routes {
+		paths = append(paths, route.Path)
+	}
+	if want := []string{"/", "/api", "/web"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("routes = %v, want %v", paths, want)
+	}
+
+	if _, err := AddRoute(connectionsConfig, &forward, "/api/", []string{"peerB:3000"}, ""); err == nil {
+		t.Error("expected an error for a route added twice")
+	}
+
+	if _, err := AddRoute(connectionsConfig, &forward, "/admin", []string{"unknown:3000"}, ""); err == nil {
+		t.Error("expected an error for an unknown target")
+	}
+
+	if _, err := AddRoute(connectionsConfig, &forward, "/admin", []string{"peerA:3000"}, "weighted"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+
+	if len(forward.Routes) != 3 {
+		t.Errorf("refused routes were added: %+v", forward.Routes)
+	}
+
+	passthrough := types.Forward{Domain: "tls.example.com", Passthrough: true}
+	if _, err := AddRoute(connectionsConfig, &passthrough, "/api", []string{"peerA:443"}, ""); err == nil {
+		t.Error("expected an error for a route of a passthrough forward")
+	}
+}
+
+func TestRemoveRoute(t *testing.T) {
+	forward := types.Forward{Domain: "app.example.com", Routes: []types.ForwardRoute{{Path: "/"}, {Path: "/api"}, {Path: "/web"}}}
+
+	if err := RemoveRoute(&forward, "/api"); err != nil {
+		t.Fatal(err)
+	}
+	if len(forward.Routes) != 2 || forward.Routes[0].Path != "/" || forward.Routes[1].Path != "/web" {
+		t.Errorf("routes = %+v, want / and /web", forward.Routes)
+	}
+
+	if err := RemoveRoute(&forward, "/api"); err == nil {
+		t.Error("expected an error for a missing route")
+	}
+}
+
+func TestSetStripPrefix(t *testing.T) {
+	root := types.ForwardRoute{Path: "/"}
+	if err := SetStripPrefix(&root, true); err == nil {
+		t.Error("expected an error for the route of /")
+	}
+	if err := SetStripPrefix(&root, false); err != nil {
+		t.Errorf("turning strip prefix off on /: %v", err)
+	}
+
+	api := types.ForwardRoute{Path: "/api"}
+	if err := SetStripPrefix(&api, true); err != nil || !api.StripPrefix {
+		t.Errorf("SetStripPrefix(/api) = %v, strip prefix %v", err, api.StripPrefix)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		spec    string
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{spec: "X-Env=prod", name: "X-Env", value: "prod"},
+		{spec: "X-Query=a=b", name: "X-Query", value: "a=b"},
+		{spec: "X-Remove=", name: "X-Remove", value: ""},
+		{spec: "X-Env", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		name, value, err := ParseHeader(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHeader(%q): unexpected error %v", tt.spec, err)
+			continue
+		}
+
+		if name != tt.name || value != tt.value {
+			t.Errorf("ParseHeader(%q) = %q, %q, want %q, %q", tt.spec, name, value, tt.name, tt.value)
+		}
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		stored  string
+		wantErr bool
+	}{
+		{name: "x-env", value: "prod", stored: "X-Env"},
+		{name: "Host", value: "$host:8080", stored: "Host"},
+		{name: "X-Forwarded-For", value: "", stored: "X-Forwarded-For"},
+		{name: "X Env", value: "prod", wantErr: true},
+		{name: "X-Env:", value: "prod", wantErr: true},
+		{name: "X-Env", value: `"prod"`, wantErr: true},
+		{name: "X-Env", value: `prod\`, wantErr: true},
+		{name: "X-Env", value: "prod\nX-Other: 1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var route types.ForwardRoute
+		err := SetHeader(&route, tt.name, tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("SetHeader(%q, %q): expected an error", tt.name, tt.value)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("SetHeader(%q, %q): %v", tt.name, tt.value, err)
+		} else if value, ok := route.Headers[tt.stored]; !ok || value != tt.value {
+			t.Errorf("SetHeader(%q, %q) stored %v", tt.name, tt.value, route.Headers)
+		}
+	}
+}
+
+func TestRemoveHeader(t *testing.T) {
+	route := types.ForwardRoute{Path: "/", Headers: map[string]string{"X-Env": "prod"}}
+
+	if err := RemoveHeader(&route, "x-env"); err != nil {
+		t.Fatal(err)
+	}
+	if route.Headers != nil {
+		t.Errorf("headers = %v, want nil", route.Headers)
+	}
+
+	if err := RemoveHeader(&route, "X-Env"); err == nil {
+		t.Error("expected an error for a header that is not set")
+	}
+}
+
+func TestRouteLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(*types.ForwardRoute, string) error
+		value   string
+		wantErr bool
+	}{
+		{name: "body size", set: SetMaxBodySize, value: "10m"},
+		{name: "body size in bytes", set: SetMaxBodySize, value: "1048576"},
+		{name: "unlimited body size", set: SetMaxBodySize, value: "0"},
+		{name: "default body size", set: SetMaxBodySize, value: ""},
+		{name: "body size unit", set: SetMaxBodySize, value: "10mb", wantErr: true},
+		{name: "negative body size", set: SetMaxBodySize, value: "-1", wantErr: true},
+		{name: "connect timeout", set: SetConnectTimeout, value: "500ms"},
+		{name: "connect timeout unit", set: SetConnectTimeout, value: "5 s", wantErr: true},
+		{name: "timeout", set: SetTimeout, value: "1h"},
+		{name: "timeout in seconds", set: SetTimeout, value: "300"},
+		{name: "timeout unit", set: SetTimeout, value: "1w", wantErr: true},
+		{name: "fractional timeout", set: SetTimeout, value: "1.5s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var route types.ForwardRoute
+		if err := tt.set(&route, tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("%s %q: unexpected error %v", tt.name, tt.value, err)
+		}
+	}
+}
+
+func TestRouteOptions(t *testing.T) {
+	route := types.ForwardRoute{
+		Path:           "/api",
+		StripPrefix:    true,
+		Headers:        map[string]string{"X-Env": "prod", "Host": "$host"},
+		MaxBodySize:    "10m",
+		ConnectTimeout: "2s",
+		Timeout:        "1h",
+	}
+
+	want := []string{"strip prefix", "Host=$host", "X-Env=prod", "max body 10m", "connect timeout 2s", "timeout 1h"}
+	if got := RouteOptions(&route); !reflect.DeepEqual(got, want) {
+		t.Errorf("RouteOptions = %v, want %v", got, want)
+	}
+
+	if got := RouteOptions(&types.ForwardRoute{Path: "/"}); got != nil {
+		t.Errorf("RouteOptions of a plain route = %v, want nil", got)
+	}
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// ErrKeyUnknown is returned by AuthorizeKey when the key is not allowed on
+// any network.
+var ErrKeyUnknown = errors.New("key not allowed")
+
+// AuthorizeKey checks that the key digest may join the network, it needs an
+// authorization for the network that is not expired and has peers left.
+func AuthorizeKey(connectionsConfig *types.ConnectionsConfig, keyDigest string, networkID string) error {
+	known := false
+	for _, authorization := range connectionsConfig.Authorizations {
+		if authorization.KeyDigest != keyDigest {
+			continue
+		}
+		known = true
+
+		if authorization.NetworkID != networkID {
+			continue
+		}
+
+		if !authorization.ExpiresAt.IsZero() && time.Now().After(authorization.ExpiresAt) {
+			return fmt.Errorf("key %s authorization for network %s expired on %s", keyDigest, networkID, authorization.ExpiresAt.Format(time.RFC3339))
+		}
+
+		if authorization.MaxPeers > 0 {
+			peers := countKeyPeers(connectionsConfig, keyDigest, networkID)
+			if peers >= authorization.MaxPeers {
+				return fmt.Errorf("key %s already has %d of %d allowed peer(s) on network %s", keyDigest, peers, authorization.MaxPeers, networkID)
+			}
+		}
+
+		return nil
+	}
+
+	if known {
+		return fmt.Errorf("key %s is not allowed on network %s", keyDigest, networkID)
+	}
+
+	return ErrKeyUnknown
+}
+
+// AllowKey records or replaces the authorization of the key digest for the network.
+func AllowKey(connectionsConfig *types.ConnectionsConfig, authorization types.KeyAuthorization) {
+	authorization.CreatedAt = time.Now().UTC()
+
+	for i, existing := range connectionsConfig.Authorizations {
+		if existing.KeyDigest == authorization.KeyDigest && existing.NetworkID == authorization.NetworkID {
+			connectionsConfig.Authorizations[i] = authorization
+			return
+		}
+	}
+
+	connectionsConfig.Authorizations = append(connectionsConfig.Authorizations, authorization)
+}
+
+// DisallowKey removes the authorization of the key digest for the network.
+func DisallowKey(connectionsConfig *types.ConnectionsConfig, keyDigest string, networkID string) {
+	authorizations := []types.KeyAuthorization{}
+	for _, authorization := range connectionsConfig.Authorizations {
+		if authorization.KeyDigest != keyDigest || authorization.NetworkID != networkID {
+			authorizations = append(authorizations, authorization)
+		}
+	}
+	connectionsConfig.Authorizations = authorizations
+}
+
+func countKeyPeers(connectionsConfig *types.ConnectionsConfig, keyDigest string, networkID string) int {
+	peerDigests := make(map[string]string)
+	for _, key := range connectionsConfig.EncryptionKeys {
+		peerDigests[key.ID] = crypto.GetPublicKeyDigest(key.PublicKey)
+	}
+
+	count := 0
+	for _, netw := range connectionsConfig.Networks {
+		if netw.ID != networkID {
+			continue
+		}
+
+		for _, peer := range netw.Peers {
+			if peerDigests[peer.ID] == keyDigest {
+				count++
+			}
+		}
+	}
+
+	return count
+}
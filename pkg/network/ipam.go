@@ -0,0 +1,287 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	DefaultNetworkPrefix = 24
+	MinNetworkPrefix     = 8
+	MaxNetworkPrefix     = 30
+)
+
+var (
+	privateBlocks = []*net.IPNet{
+		mustParseCIDR("10.0.0.0/8"),
+		mustParseCIDR("172.16.0.0/12"),
+		mustParseCIDR("192.168.0.0/16"),
+	}
+
+	// defaultNetworkPool is where network blocks are allocated from when no CIDR is given.
+	defaultNetworkPool = mustParseCIDR("10.5.0.0/16")
+)
+
+// ParseNetworkBlock parses and validates a CIDR to be used as a network block.
+// The block must be aligned and fully contained in a RFC1918 range.
+func ParseNetworkBlock(cidr string) (*net.IPNet, error) {
+	ip, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %s: %v", cidr, err)
+	}
+
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("only IPv4 network blocks are supported")
+	}
+
+	if !ip.Equal(block.IP) {
+		return nil, fmt.Errorf("%s is not a network address, did you mean %s?", cidr, block.String())
+	}
+
+	ones, _ := block.Mask.Size()
+	if ones < MinNetworkPrefix || ones > MaxNetworkPrefix {
+		return nil, fmt.Errorf("prefix size must be between /%d and /%d", MinNetworkPrefix, MaxNetworkPrefix)
+	}
+
+	for _, private := range privateBlocks {
+		privateOnes, _ := private.Mask.Size()
+		if private.Contains(block.IP) && ones >= privateOnes {
+			return block, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not inside a private (RFC1918) range", cidr)
+}
+
+// CheckNetworkBlockAvailable makes sure the block does not overlap any
+// existing network nor any route already present on the host.
+func CheckNetworkBlockAvailable(connectionsConfig *types.ConnectionsConfig, block *net.IPNet) error {
+	for _, network := range connectionsConfig.Networks {
+		_, netBlock, err := net.ParseCIDR(network.Address)
+		if err != nil {
+			continue
+		}
+
+		if blocksOverlap(block, netBlock) {
+			return fmt.Errorf("%s overlaps network %s (%s)", block, network.ID, netBlock)
+		}
+	}
+
+	routes, err := hostRoutes()
+	if err != nil {
+		return fmt.Errorf("failed to list host routes: %v", err)
+	}
+
+	for _, route := range routes {
+		if blocksOverlap(block, route) {
+			return fmt.Errorf("%s overlaps the host route %s", block, route)
+		}
+	}
+
+	return nil
+}
+
+// GetNextAvailableNetworkBlock returns the first block of the given prefix size
+// inside the default pool that is not used by a network or a host route.
+func GetNextAvailableNetworkBlock(connectionsConfig *types.ConnectionsConfig, prefix int) (*net.IPNet, error) {
+	poolOnes, _ := defaultNetworkPool.Mask.Size()
+	if prefix < poolOnes || prefix > MaxNetworkPrefix {
+		return nil, fmt.Errorf("prefix size must be between /%d and /%d", poolOnes, MaxNetworkPrefix)
+	}
+
+	poolStart := ipToUint32(defaultNetworkPool.IP)
+	blockSize := uint32(1) << (32 - prefix)
+	blockCount := uint32(1) << (prefix - poolOnes)
+
+	for i := uint32(0); i < blockCount; i++ {
+		block := &net.IPNet{
+			IP:   uint32ToIP(poolStart + i*blockSize),
+			Mask: net.CIDRMask(prefix, 32),
+		}
+
+		if CheckNetworkBlockAvailable(connectionsConfig, block) == nil {
+			return block, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no available /%d network blocks in %s", prefix, defaultNetworkPool)
+}
+
+// AllocateAddress leases the next free host address of the network to the
+// peer. If the peer already holds a lease, that address is returned.
+func AllocateAddress(network *types.Network, peerID string) (*net.IPNet, error) {
+	_, block, err := net.ParseCIDR(network.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network address: %v", err)
+	}
+
+	syncLeases(network)
+
+	used := make(map[uint32]bool)
+	for _, lease := range network.Leases {
+		ip, _, err := net.ParseCIDR(lease.Address)
+		if err != nil {
+			continue
+		}
+
+		if lease.PeerID == peerID {
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		used[ipToUint32(ip)] = true
+	}
+
+	// first address is the "Network Address" (also used by the tower) and
+	// the last one is the "Broadcast Address"
+	first, last := hostRange(block)
+	for nextIntIP := first; nextIntIP <= last; nextIntIP++ {
+		if used[nextIntIP] {
+			continue
+		}
+
+		address := &net.IPNet{IP: uint32ToIP(nextIntIP), Mask: net.CIDRMask(32, 32)}
+		network.Leases = append(network.Leases, types.Lease{
+			Address:   address.String(),
+			PeerID:    peerID,
+			CreatedAt: time.Now().UTC(),
+		})
+
+		return address, nil
+	}
+
+	return nil, fmt.Errorf("no allocatable address in %s", block)
+}
+
+// ReserveAddress pins the peer to a static address inside the network block
+// and updates the peer record accordingly.
+func ReserveAddress(network *types.Network, peerID string, ipAddress string) (*net.IPNet, error) {
+	_, block, err := net.ParseCIDR(network.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network address: %v", err)
+	}
+
+	ip := net.ParseIP(ipAddress).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %s", ipAddress)
+	}
+
+	first, last := hostRange(block)
+	if !block.Contains(ip) || ipToUint32(ip) < first || ipToUint32(ip) > last {
+		return nil, fmt.Errorf("%s is not a usable host address of %s", ipAddress, block)
+	}
+
+	peerIndex := -1
+	for i, peer := range network.Peers {
+		if peer.ID == peerID {
+			peerIndex = i
+			break
+		}
+	}
+
+	if peerIndex < 0 {
+		return nil, fmt.Errorf("peer %s not found in network %s", peerID, network.ID)
+	}
+
+	syncLeases(network)
+
+	address := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	leases := []types.Lease{}
+	for _, lease := range network.Leases {
+		if lease.PeerID == peerID {
+			continue
+		}
+
+		if lease.Address == address.String() {
+			return nil, fmt.Errorf("%s is already leased to peer %s", ipAddress, lease.PeerID)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	network.Leases = append(leases, types.Lease{
+		Address:   address.String(),
+		PeerID:    peerID,
+		Static:    true,
+		CreatedAt: time.Now().UTC(),
+	})
+	network.Peers[peerIndex].Address = address.String()
+
+	return address, nil
+}
+
+// ReleaseAddress drops the lease held by the peer so its address can be reused.
+func ReleaseAddress(network *types.Network, peerID string) {
+	leases := []types.Lease{}
+	for _, lease := range network.Leases {
+		if lease.PeerID != peerID {
+			leases = append(leases, lease)
+		}
+	}
+	network.Leases = leases
+}
+
+// syncLeases records a lease for peers that predate lease tracking and
+// reclaims leases whose peer no longer exists.
+func syncLeases(network *types.Network) {
+	peers := make(map[string]bool)
+	leased := make(map[string]bool)
+
+	for _, peer := range network.Peers {
+		peers[peer.ID] = true
+	}
+
+	leases := []types.Lease{}
+	for _, lease := range network.Leases {
+		if peers[lease.PeerID] {
+			leases = append(leases, lease)
+			leased[lease.PeerID] = true
+		}
+	}
+
+	for _, peer := range network.Peers {
+		if leased[peer.ID] || peer.Address == "" {
+			continue
+		}
+
+		leases = append(leases, types.Lease{
+			Address:   peer.Address,
+			PeerID:    peer.ID,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+
+	network.Leases = leases
+}
+
+func hostRange(block *net.IPNet) (uint32, uint32) {
+	ones, _ := block.Mask.Size()
+	start := ipToUint32(block.IP)
+	size := uint32(1) << (32 - ones)
+	return start + 1, start + size - 2
+}
+
+func blocksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func TestParseNetworkBlock(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "10.8.0.0/24", want: "10.8.0.0/24"},
+		{cidr: "172.16.4.0/22", want: "172.16.4.0/22"},
+		{cidr: "192.168.10.0/30", want: "192.168.10.0/30"},
+		{cidr: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{cidr: "10.8.0.1/24", wantErr: true},
+		{cidr: "10.8.0.0/31", wantErr: true},
+		{cidr: "172.16.0.0/11", wantErr: true},
+		{cidr: "100.64.0.0/24", wantErr: true},
+		{cidr: "fd00::/64", wantErr: true},
+		{cidr: "10.8.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		block, err := ParseNetworkBlock(tt.cidr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseNetworkBlock(%s): expected an error, got %s", tt.cidr, block)
+			}
+			continue
+		}
+
+		if err != nil || block.String() != tt.want {
+			t.Errorf("ParseNetworkBlock(%s) = %v, %v, want %s", tt.cidr, block, err, tt.want)
+		}
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	netw := &types.Network{
+		ID:      "net1",
+		Address: "10.8.0.0/29",
+		Peers: []types.Peer{
+			{ID: "peerA", Address: "10.8.0.1/32"},
+			// a peer from before the leases were tracked
+			{ID: "legacy", Address: "10.8.0.2/32"},
+		},
+		Leases: []types.Lease{
+			{Address: "10.8.0.1/32", PeerID: "peerA"},
+			// the lease of a peer that is gone is reclaimed
+			{Address: "10.8.0.3/32", PeerID: "gone"},
+		},
+	}
+
+	steps := []struct {
+		peerID string
+		want   string
+	}{
+		{peerID: "peerB", want: "10.8.0.3/32"},
+		{peerID: "peerA", want: "10.8.0.1/32"},
+		{peerID: "peerC", want: "10.8.0.4/32"},
+		{peerID: "peerB", want: "10.8.0.3/32"},
+		{peerID: "peerD", want: "10.8.0.5/32"},
+		{peerID: "peerE", want: "10.8.0.6/32"},
+	}
+
+	for _, step := range steps {
+		address, err := AllocateAddress(netw, step.peerID)
+		if err != nil {
+			t.Fatalf("AllocateAddress(%s): %v", step.peerID, err)
+		}
+
+		if address.String() != step.want {
+			t.Errorf("AllocateAddress(%s) = %s, want %s", step.peerID, address, step.want)
+		}
+
+		netw.Peers = append(netw.Peers, types.Peer{ID: step.peerID, Address: address.String()})
+	}
+
+	// .0 is the tower and .7 the broadcast address
+	if address, err := AllocateAddress(netw, "peerF"); err == nil {
+		t.Errorf("expected the network to be full, got %s", address)
+	}
+
+	ReleaseAddress(netw, "peerC")
+	netw.Peers = removeTestPeer(netw.Peers, "peerC")
+
+	if address, err := AllocateAddress(netw, "peerF"); err != nil || address.String() != "10.8.0.4/32" {
+		t.Errorf("AllocateAddress(peerF) = %v, %v, want the released 10.8.0.4/32", address, err)
+	}
+}
+
+func TestReserveAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		peerID  string
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{name: "free address", peerID: "peerA", ip: "10.8.0.10", want: "10.8.0.10/32"},
+		{name: "own address", peerID: "peerB", ip: "10.8.0.3", want: "10.8.0.3/32"},
+		{name: "address of another peer", peerID: "peerA", ip: "10.8.0.3", wantErr: true},
+		{name: "network address", peerID: "peerA", ip: "10.8.0.0", wantErr: true},
+		{name: "broadcast address", peerID: "peerA", ip: "10.8.0.255", wantErr: true},
+		{name: "outside the network", peerID: "peerA", ip: "10.9.0.10", wantErr: true},
+		{name: "not an IPv4 address", peerID: "peerA", ip: "fd00::10", wantErr: true},
+		{name: "unknown peer", peerID: "peerC", ip: "10.8.0.10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		netw := &types.Network{
+			ID:      "net1",
+			Address: "10.8.0.0/24",
+			Peers: []types.Peer{
+				{ID: "peerA", Address: "10.8.0.2/32"},
+				{ID: "peerB", Address: "10.8.0.3/32"},
+			},
+			Leases: []types.Lease{{Address: "10.8.0.2/32", PeerID: "peerA"}},
+		}
+
+		address, err := ReserveAddress(netw, tt.peerID, tt.ip)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.name, address)
+			}
+			continue
+		}
+
+		if err != nil || address.String() != tt.want {
+			t.Errorf("%s: ReserveAddress = %v, %v, want %s", tt.name, address, err, tt.want)
+			continue
+		}
+
+		var lease *types.Lease
+		for i := range netw.Leases {
+			if netw.Leases[i].PeerID == tt.peerID {
+				if lease != nil {
+					t.Errorf("%s: peer %s holds two leases", tt.name, tt.peerID)
+				}
+				lease = &netw.Leases[i]
+			}
+		}
+
+		if lease == nil || lease.Address != tt.want || !lease.Static {
+			t.Errorf("%s: lease = %+v, want a static lease of %s", tt.name, lease, tt.want)
+		}
+
+		for _, peer := range netw.Peers {
+			if peer.ID == tt.peerID && peer.Address != tt.want {
+				t.Errorf("%s: peer address = %s, want %s", tt.name, peer.Address, tt.want)
+			}
+		}
+	}
+}
+
+func removeTestPeer(peers []types.Peer, peerID string) []types.Peer {
+	var kept []types.Peer
+	for _, peer := range peers {
+		if peer.ID != peerID {
+			kept = append(kept, peer)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,231 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+// ensureLink creates the WireGuard link if it does not exist yet and brings it up.
+func ensureLink(name string) ([]string, error) {
+	var changes []string
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to lookup link %s: %v", name, err)
+		}
+
+		wgLink := &netlink.Wireguard{LinkAttrs: netlink.NewLinkAttrs()}
+		wgLink.LinkAttrs.Name = name
+		err := system.Do(fmt.Sprintf("create link %s", name), func() error {
+			return netlink.LinkAdd(wgLink)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create link %s: %v", name, err)
+		}
+		changes = append(changes, fmt.Sprintf("created link %s", name))
+
+		if system.DryRun() {
+			return append(changes, fmt.Sprintf("set link %s up", name)), nil
+		}
+
+		link, err = netlink.LinkByName(name)
+		if err != nil {
+			return changes, fmt.Errorf("failed to lookup link %s after creating it: %v", name, err)
+		}
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		err := system.Do(fmt.Sprintf("set link %s up", name), func() error {
+			return netlink.LinkSetUp(link)
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to set link %s up: %v", name, err)
+		}
+		changes = append(changes, fmt.Sprintf("set link %s up", name))
+	}
+
+	return changes, nil
+}
+
+// lookupLink returns the link, or nil when it is missing in a dry run, where
+// ensureLink only pretended to create it.
+func lookupLink(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok && system.DryRun() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lookup link %s: %v", name, err)
+	}
+
+	return link, nil
+}
+
+// syncLinkAddress makes the given CIDR the only IPv4 address on the link.
+func syncLinkAddress(name string, address *net.IPNet) ([]string, error) {
+	link, err := lookupLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netlink.Addr
+	if link != nil {
+		addrs, err = netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %s: %v", name, err)
+		}
+	}
+
+	var changes []string
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == address.String() {
+			found = true
+			continue
+		}
+
+		err := system.Do(fmt.Sprintf("remove address %s from %s", addr.IPNet, name), func() error {
+			return netlink.AddrDel(link, &addr)
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to remove address %s from %s: %v", addr.IPNet, name, err)
+		}
+		changes = append(changes, fmt.Sprintf("removed address %s from %s", addr.IPNet, name))
+	}
+
+	if found {
+		return changes, nil
+	}
+
+	err = system.Do(fmt.Sprintf("add address %s to %s", address, name), func() error {
+		return netlink.AddrReplace(link, &netlink.Addr{IPNet: address})
+	})
+	if err != nil {
+		return changes, fmt.Errorf("failed to add address %s to %s: %v", address, name, err)
+	}
+	changes = append(changes, fmt.Sprintf("added address %s to %s", address, name))
+
+	return changes, nil
+}
+
+// syncLinkRoutes routes each destination through the link, skipping the ones
+// already covered by the link's own address, and drops routes that are no
+// longer wanted. Only routes created by upduck (static protocol) are removed.
+func syncLinkRoutes(name string, address *net.IPNet, dsts []*net.IPNet) ([]string, error) {
+	link, err := lookupLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, connected, _ := net.ParseCIDR(address.String())
+
+	desired := make(map[string]*net.IPNet)
+	for _, dst := range dsts {
+		ones, _ := dst.Mask.Size()
+		connectedOnes, _ := connected.Mask.Size()
+		if connected.Contains(dst.IP) && ones >= connectedOnes {
+			continue
+		}
+		desired[dst.String()] = dst
+	}
+
+	var routes []netlink.Route
+	if link != nil {
+		routes, err = netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes of %s: %v", name, err)
+		}
+	}
+
+	var changes []string
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+
+		if _, ok := desired[route.Dst.String()]; ok {
+			delete(desired, route.Dst.String())
+			continue
+		}
+
+		if route.Protocol != unix.RTPROT_STATIC {
+			continue
+		}
+
+		err := system.Do(fmt.Sprintf("remove route %s from %s", route.Dst, name), func() error {
+			return netlink.RouteDel(&route)
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to remove route %s from %s: %v", route.Dst, name, err)
+		}
+		changes = append(changes, fmt.Sprintf("removed route %s from %s", route.Dst, name))
+	}
+
+	for _, dst := range desired {
+		err := system.Do(fmt.Sprintf("add route %s to %s", dst, name), func() error {
+			return netlink.RouteReplace(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       dst,
+				Scope:     netlink.SCOPE_LINK,
+				Protocol:  unix.RTPROT_STATIC,
+			})
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to add route %s to %s: %v", dst, name, err)
+		}
+		changes = append(changes, fmt.Sprintf("added route %s to %s", dst, name))
+	}
+
+	return changes, nil
+}
+
+// deleteLink removes the link if it exists.
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup link %s: %v", name, err)
+	}
+
+	err = system.Do(fmt.Sprintf("delete link %s", name), func() error {
+		return netlink.LinkDel(link)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete link %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// hostRoutes lists the destinations of the IPv4 routes present on the host.
+func hostRoutes() ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsts []*net.IPNet
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+
+		dsts = append(dsts, route.Dst)
+	}
+
+	return dsts, nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+var errLinkUnsupported = fmt.Errorf("managing WireGuard links is only supported on linux")
+
+func ensureLink(name string) ([]string, error) {
+	return nil, errLinkUnsupported
+}
+
+func syncLinkAddress(name string, address *net.IPNet) ([]string, error) {
+	return nil, errLinkUnsupported
+}
+
+func syncLinkRoutes(name string, address *net.IPNet, dsts []*net.IPNet) ([]string, error) {
+	return nil, errLinkUnsupported
+}
+
+func deleteLink(name string) error {
+	return errLinkUnsupported
+}
+
+func hostRoutes() ([]*net.IPNet, error) {
+	return nil, nil
+}
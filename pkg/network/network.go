@@ -1,12 +1,12 @@
 package network
 
 import (
+	"bytes"
 	"crypto/rand"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strings"
 	"text/template"
 	"time"
@@ -16,12 +16,13 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/system"
 	"github.com/duck-labs/upduck/pkg/types"
 )
 
 const wgConfigTowerTemplate = `[Interface]
 PrivateKey = {{.PrivateKey}}
-ListenPort = 51820
+ListenPort = {{.ListenPort}}
 Address = {{.Address}}
 
 PostUp = iptables -A FORWARD -i "{{.Name}}" -s {{.Address}} -d {{.Address}} -j ACCEPT
@@ -45,7 +46,7 @@ Address = {{.Address}}
 [Peer]
 PublicKey = {{.PublicKey}}
 AllowedIPs = {{.Address}}
-Endpoint = {{.Endpoint}}:51820
+Endpoint = {{.Endpoint}}
 PersistentKeepalive = 25
 {{end}}`
 
@@ -63,72 +64,30 @@ func GenerateWireguardKeys() (*types.WireguardConfig, error) {
 	}, nil
 }
 
-func GetNextAvailableNetworkAddress(connectionsConfig *types.ConnectionsConfig, networkBlock *net.IPNet) (*net.IPNet, error) {
-	used := make(map[uint32]bool)
-
-	if len(connectionsConfig.Networks) > 0 {
-		for _, peer := range connectionsConfig.Networks[0].Peers {
-			ipInt := binary.BigEndian.Uint32([]byte(peer.Address))
-			used[ipInt] = true
-		}
-	}
-
-	netIP := networkBlock.IP.To4()
-	ipInt := binary.BigEndian.Uint32(netIP)
-	// first address (+0) is the "Network Address"
-	// the last address (+255) is the "Broadcast Address"
-	// the usable ranges between Net+1 and Net+254 (< net + 255)
-	for nextIntIP := ipInt + 1; nextIntIP < ipInt+255; nextIntIP++ {
-		if !used[nextIntIP] {
-			nextNetIP := make(net.IP, 4)
-			binary.BigEndian.PutUint32(nextNetIP, nextIntIP)
-			return &net.IPNet{IP: nextNetIP, Mask: net.CIDRMask(32, 32)}, nil
-		}
-	}
-
-	return nil, fmt.Errorf("no allocatable address")
-}
-
-func GetNextAvailableNetworkBlock(connectionsConfig *types.ConnectionsConfig) (*net.IPNet, error) {
-	usedSubnets := make(map[int]bool)
-
-	for _, network := range connectionsConfig.Networks {
-		_, netBlock, err := net.ParseCIDR(network.Address)
-		if err != nil {
-			continue
-		}
-
-		if len(netBlock.IP) >= 3 && netBlock.IP[0] == 10 && netBlock.IP[1] == 5 {
-			usedSubnets[int(netBlock.IP[2])] = true
-		}
-	}
-
-	for subnet := 0; subnet < 256; subnet++ {
-		if !usedSubnets[subnet] {
-			return &net.IPNet{
-				IP:   net.IP{10, 5, byte(subnet), 0},
-				Mask: net.CIDRMask(24, 32),
-			}, nil
-		}
-	}
-
-	return nil, fmt.Errorf("no available network blocks in 10.5.x.0/24 range")
-}
-
-func WriteWireguardInterfaces(serverType string) error {
+// ReconcileInterfaces compares the WireGuard interfaces described by the
+// connections config with the kernel state (devices, peers, addresses, routes
+// and firewall rules) and fixes any drift, including interfaces changed by
+// hand. It returns a description of every change made. Errors on one network
+// do not stop the others from being reconciled.
+func ReconcileInterfaces(serverType string) ([]string, error) {
 	connectionsConfig, err := config.LoadConnectionsConfig()
 	if err != nil {
-		return fmt.Errorf("error loading connections: %v", err)
+		return nil, fmt.Errorf("error loading connections: %v", err)
 	}
 
 	wgConfig, err := config.LoadWireguardConfig()
 	if err != nil {
-		return fmt.Errorf("error loading wireguard config: %v", err)
+		return nil, fmt.Errorf("error loading wireguard config: %v", err)
+	}
+
+	privateKey, err := wgtypes.ParseKey(wgConfig.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing wireguard private key: %v", err)
 	}
 
 	err = config.EnsureWireguardDir()
 	if err != nil {
-		return fmt.Errorf("failed to create folder: %v", err)
+		return nil, fmt.Errorf("failed to create folder: %v", err)
 	}
 
 	var wgTemplate string
@@ -141,20 +100,20 @@ func WriteWireguardInterfaces(serverType string) error {
 		wgTemplate = wgConfigServerTemplate
 	}
 
-	for nindex, network := range connectionsConfig.Networks {
-		netName := fmt.Sprintf("udck-%c%d", serverType[0], nindex)
-		configPath := fmt.Sprintf("%s/%s.conf", config.WireguardConfigDir, netName)
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start wgClient: %v", err)
+	}
+	defer wgClient.Close()
 
-		tmpl, err := template.New(netName).Parse(wgTemplate)
-		if err != nil {
-			return fmt.Errorf("failed to parse template: %v", err)
-		}
+	var changes []string
+	var errs []error
+	activeInterfaces := make(map[string]bool)
 
-		file, err := os.OpenFile(configPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-		if err != nil {
-			return fmt.Errorf("failed to open wg file: %v", err)
-		}
-		defer file.Close()
+	for _, network := range connectionsConfig.Networks {
+		netName := InterfaceName(serverType, &network)
+		configPath := fmt.Sprintf("%s/%s.conf", config.WireguardConfigDir, netName)
+		activeInterfaces[netName] = true
 
 		var peers []map[string]interface{}
 
@@ -165,7 +124,7 @@ func WriteWireguardInterfaces(serverType string) error {
 			}
 
 			if serverType == "server" {
-				peer["Endpoint"] = np.Endpoint
+				peer["Endpoint"] = net.JoinHostPort(np.Endpoint, fmt.Sprint(EndpointPort(&np)))
 			}
 
 			peers = append(peers, peer)
@@ -175,79 +134,258 @@ func WriteWireguardInterfaces(serverType string) error {
 			"Name":       netName,
 			"PrivateKey": wgConfig.PrivateKey,
 			"Address":    network.Address,
+			"ListenPort": ListenPort(&network),
 			"Peers":      peers,
 		}
 
-		err = tmpl.Execute(file, wgInterfaceConfig)
+		// the wg-quick config is only kept once the interface is applied, a
+		// failure leaves the last working one in place. Firewall rules added
+		// on the way stay, the interface must not run without them.
+		tx := system.NewTransaction()
+
+		written, err := writeWireguardConfigFile(tx, netName, configPath, wgTemplate, wgInterfaceConfig)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		iface, err := buildWireguardInterface(serverType, netName, privateKey, network)
 		if err != nil {
-			return fmt.Errorf("failed to execute template: %v", err)
+			errs = append(errs, fmt.Errorf("failed to build wg interface %s: %v", netName, err), tx.Rollback())
+			continue
 		}
 
-		err = startWireGuardInterface(netName, configPath)
+		ifaceChanges, err := applyWireguardInterface(wgClient, iface)
 		if err != nil {
-			return fmt.Errorf("failed to start wg interface: %v", err)
+			errs = append(errs, fmt.Errorf("failed to apply wg interface: %v", err), tx.Rollback())
+			changes = append(changes, ifaceChanges...)
+			continue
+		}
+		tx.Commit()
+
+		if written {
+			changes = append(changes, fmt.Sprintf("wrote %s", configPath))
 		}
+		changes = append(changes, ifaceChanges...)
 	}
 
-	return nil
-}
+	prefix := fmt.Sprintf("udck-%c", serverType[0])
 
-func startWireGuardInterface(netName string, configPath string) error {
-	wgClient, err := wgctrl.New()
+	devices, err := wgClient.Devices()
 	if err != nil {
-		return fmt.Errorf("failed to start wgClient: %v", err)
+		errs = append(errs, fmt.Errorf("failed to list wg devices: %v", err))
 	}
 
-	_, err = wgClient.Device(netName)
-	if err == nil {
-		downCmd := exec.Command("wg-quick", "down", configPath)
-		output, err := downCmd.CombinedOutput()
+	for _, device := range devices {
+		if !strings.HasPrefix(device.Name, prefix) || activeInterfaces[device.Name] {
+			continue
+		}
+
+		if err := deleteLink(device.Name); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove stale wg interface: %v", err))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("removed stale interface %s", device.Name))
+	}
+
+	if serverType == "tower" {
+		ruleChanges, err := removeStaleFirewallRules(prefix, activeInterfaces)
+		changes = append(changes, ruleChanges...)
 		if err != nil {
-			if !strings.Contains(string(output), "does not exist") {
-				return fmt.Errorf("failed to stop wg interface: %v | %s", err, string(output))
+			errs = append(errs, err)
+		}
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// removeStaleFirewallRules drops the FORWARD rules left behind by interfaces
+// that are no longer part of the connections config.
+func removeStaleFirewallRules(prefix string, activeInterfaces map[string]bool) ([]string, error) {
+	rules, err := system.ListIptablesRules("FORWARD")
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	for _, rule := range rules {
+		netName := ""
+		for i := 0; i+1 < len(rule); i++ {
+			if rule[i] == "-i" {
+				netName = rule[i+1]
 			}
 		}
 
-		time.Sleep(1 * time.Second)
+		if !strings.HasPrefix(netName, prefix) || activeInterfaces[netName] {
+			continue
+		}
+
+		if err := system.DeleteIptablesRule("FORWARD", rule...); err != nil {
+			return changes, fmt.Errorf("failed to remove stale firewall rule %q: %v", strings.Join(rule, " "), err)
+		}
+		changes = append(changes, fmt.Sprintf("removed stale firewall rule %q", strings.Join(rule, " ")))
 	}
 
-	upCmd := exec.Command("wg-quick", "up", configPath)
-	output, err := upCmd.CombinedOutput()
+	return changes, nil
+}
+
+// writeWireguardConfigFile renders the wg-quick config of the interface and
+// writes it when it differs from the file on disk, reporting whether it did.
+func writeWireguardConfigFile(tx *system.Transaction, netName string, configPath string, wgTemplate string, data map[string]interface{}) (bool, error) {
+	tmpl, err := template.New(netName).Parse(wgTemplate)
 	if err != nil {
-		return fmt.Errorf("failed to start wg interface: %v | %s", err, string(output))
+		return false, fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	var content bytes.Buffer
+	if err := tmpl.Execute(&content, data); err != nil {
+		return false, fmt.Errorf("failed to execute template: %v", err)
+	}
+
+	current, err := os.ReadFile(configPath)
+	if err == nil && bytes.Equal(current, content.Bytes()) {
+		return false, nil
+	}
+
+	if err := tx.WriteFile(configPath, content.Bytes(), 0600); err != nil {
+		return false, fmt.Errorf("failed to write wg file: %v", err)
 	}
 
-	_, err = wgClient.Device(netName)
+	return true, nil
+}
+
+func buildWireguardInterface(serverType string, netName string, privateKey wgtypes.Key, network types.Network) (*wireguardInterface, error) {
+	address, err := parseInterfaceAddress(network.Address)
 	if err != nil {
-		return fmt.Errorf("failed to get wg interface after starting: %v", err)
+		return nil, fmt.Errorf("failed to parse network address: %v", err)
+	}
+
+	iface := &wireguardInterface{
+		Name:       netName,
+		PrivateKey: privateKey,
+		Address:    address,
+	}
+
+	if serverType == "tower" {
+		iface.ListenPort = ListenPort(&network)
+		iface.FirewallRules = towerFirewallRules(netName, network.Address)
+	}
+
+	for _, np := range network.Peers {
+		publicKey, err := wgtypes.ParseKey(np.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for peer %s: %v", np.ID, err)
+		}
+
+		_, allowedIPs, err := net.ParseCIDR(np.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address for peer %s: %v", np.ID, err)
+		}
+
+		peer := wgtypes.PeerConfig{
+			PublicKey:  publicKey,
+			AllowedIPs: []net.IPNet{*allowedIPs},
+		}
+
+		if serverType == "server" {
+			endpoint, err := net.ResolveUDPAddr("udp", net.JoinHostPort(np.Endpoint, fmt.Sprint(EndpointPort(&np))))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve endpoint for peer %s: %v", np.ID, err)
+			}
+
+			keepalive := persistentKeepalive
+			peer.Endpoint = endpoint
+			peer.PersistentKeepaliveInterval = &keepalive
+		}
+
+		iface.Peers = append(iface.Peers, peer)
 	}
 
-	return nil
+	return iface, nil
 }
 
-func GenerateTimeOrderedID() string {
-	entropy := ulid.Monotonic(rand.Reader, 0)
-	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
+// CreateNetwork adds a tower network on the given block, with its own
+// interface and a listen port taken from the port range.
+func CreateNetwork(connectionsConfig *types.ConnectionsConfig, block *net.IPNet, name string, portRange string) (*types.Network, error) {
+	if err := CheckNetworkBlockAvailable(connectionsConfig, block); err != nil {
+		return nil, fmt.Errorf("network block is not available: %v", err)
+	}
+
+	listenPort, err := AllocateListenPort(connectionsConfig, portRange)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate listen port: %v", err)
+	}
+
+	networkID := GenerateTimeOrderedID()
+	connectionsConfig.Networks = append(connectionsConfig.Networks, types.Network{
+		ID:         networkID,
+		Name:       name,
+		Address:    block.String(),
+		Peers:      []types.Peer{},
+		Interface:  GenerateInterfaceName("tower", networkID),
+		ListenPort: listenPort,
+	})
+
+	return &connectionsConfig.Networks[len(connectionsConfig.Networks)-1], nil
 }
 
-func ResolveServerToIP(connectionsConfig *types.ConnectionsConfig, server string) (string, error) {
-	if net.ParseIP(server) != nil {
-		return server, nil
+// DeleteNetwork removes a tower network with its peers, and the allowed keys,
+// join tokens and join requests scoped to it. It returns the removed network.
+func DeleteNetwork(connectionsConfig *types.ConnectionsConfig, networkID string) (*types.Network, error) {
+	var removed *types.Network
+	for _, netw := range connectionsConfig.Networks {
+		if netw.ID == networkID {
+			removed = &netw
+			break
+		}
 	}
 
-	for _, network := range connectionsConfig.Networks {
-		for _, peer := range network.Peers {
-			if peer.ID == server {
-				ip, _, err := net.ParseCIDR(peer.Address)
+	if removed == nil {
+		return nil, fmt.Errorf("network %s not found", networkID)
+	}
 
-				if err != nil {
-					return "", fmt.Errorf("failed to parse address")
-				}
+	for _, peer := range removed.Peers {
+		if _, _, err := RemovePeer(connectionsConfig, peer.ID); err != nil {
+			return nil, err
+		}
+	}
 
-				return ip.String(), nil
-			}
+	networks := []types.Network{}
+	for _, netw := range connectionsConfig.Networks {
+		if netw.ID != networkID {
+			networks = append(networks, netw)
+		}
+	}
+	connectionsConfig.Networks = networks
+
+	authorizations := []types.KeyAuthorization{}
+	for _, authorization := range connectionsConfig.Authorizations {
+		if authorization.NetworkID != networkID {
+			authorizations = append(authorizations, authorization)
 		}
 	}
+	connectionsConfig.Authorizations = authorizations
 
-	return "", fmt.Errorf("server '%s' not found in connections", server)
+	joinTokens := []types.JoinToken{}
+	for _, token := range connectionsConfig.JoinTokens {
+		if token.NetworkID != networkID {
+			joinTokens = append(joinTokens, token)
+		}
+	}
+	connectionsConfig.JoinTokens = joinTokens
+
+	joinRequests := []types.JoinRequest{}
+	for _, request := range connectionsConfig.JoinRequests {
+		if request.NetworkID != networkID {
+			joinRequests = append(joinRequests, request)
+		}
+	}
+	connectionsConfig.JoinRequests = joinRequests
+
+	return removed, nil
+}
+
+func GenerateTimeOrderedID() string {
+	entropy := ulid.Monotonic(rand.Reader, 0)
+	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
 }
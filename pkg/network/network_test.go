@@ -0,0 +1,53 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func TestDeleteNetwork(t *testing.T) {
+	connectionsConfig := &types.ConnectionsConfig{
+		Networks: []types.Network{
+			{
+				ID:      "net1",
+				Address: "10.8.0.0/24",
+				Peers:   []types.Peer{{ID: "peerA", Address: "10.8.0.2/32"}},
+				Leases:  []types.Lease{{Address: "10.8.0.2/32", PeerID: "peerA"}},
+			},
+			{ID: "net2", Address: "10.9.0.0/24", Peers: []types.Peer{}},
+		},
+		EncryptionKeys: []types.EncryptionKey{{ID: "peerA", PublicKey: "key"}},
+		Authorizations: []types.KeyAuthorization{{KeyDigest: "digest1", NetworkID: "net1"}, {KeyDigest: "digest1", NetworkID: "net2"}},
+		JoinTokens:     []types.JoinToken{{ID: "token1", NetworkID: "net1"}, {ID: "token2", NetworkID: "net2"}},
+		JoinRequests:   []types.JoinRequest{{ID: "request1", NetworkID: "net1"}},
+	}
+
+	removed, err := DeleteNetwork(connectionsConfig, "net1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed.ID != "net1" {
+		t.Errorf("removed network %s, want net1", removed.ID)
+	}
+
+	if len(connectionsConfig.Networks) != 1 || connectionsConfig.Networks[0].ID != "net2" {
+		t.Errorf("networks = %+v, want net2", connectionsConfig.Networks)
+	}
+	if len(connectionsConfig.EncryptionKeys) != 0 {
+		t.Errorf("encryption keys = %+v, want the key of peerA removed", connectionsConfig.EncryptionKeys)
+	}
+	if len(connectionsConfig.Authorizations) != 1 || connectionsConfig.Authorizations[0].NetworkID != "net2" {
+		t.Errorf("authorizations = %+v, want the one of net2", connectionsConfig.Authorizations)
+	}
+	if len(connectionsConfig.JoinTokens) != 1 || connectionsConfig.JoinTokens[0].ID != "token2" {
+		t.Errorf("join tokens = %+v, want token2", connectionsConfig.JoinTokens)
+	}
+	if len(connectionsConfig.JoinRequests) != 0 {
+		t.Errorf("join requests = %+v, want none", connectionsConfig.JoinRequests)
+	}
+
+	if _, err := DeleteNetwork(connectionsConfig, "net1"); err == nil {
+		t.Error("expected an error deleting a missing network")
+	}
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// RemovePeer removes a peer from the tower connections: the peer itself, its
+// address lease, its encryption key and the authorization of that key for the network.
+// It returns the network the peer belonged to and the removed peer.
+func RemovePeer(connectionsConfig *types.ConnectionsConfig, peerID string) (*types.Network, *types.Peer, error) {
+	for i := range connectionsConfig.Networks {
+		netw := &connectionsConfig.Networks[i]
+
+		for j, peer := range netw.Peers {
+			if peer.ID != peerID {
+				continue
+			}
+
+			netw.Peers = append(netw.Peers[:j:j], netw.Peers[j+1:]...)
+			ReleaseAddress(netw, peerID)
+
+			encryptionKeys := []types.EncryptionKey{}
+			for _, key := range connectionsConfig.EncryptionKeys {
+				if key.ID == peerID {
+					DisallowKey(connectionsConfig, crypto.GetPublicKeyDigest(key.PublicKey), netw.ID)
+					continue
+				}
+				encryptionKeys = append(encryptionKeys, key)
+			}
+			connectionsConfig.EncryptionKeys = encryptionKeys
+
+			return netw, &peer, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("peer %s not found", peerID)
+}
+
+// ApplyServerAddress stores the address a tower assigned to this server on a
+// network the server is already connected to, through the tower peer of the
+// response. It reports whether the network was found.
+func ApplyServerAddress(connectionsConfig *types.ConnectionsConfig, response *types.ConnectResponse) bool {
+	for i := range connectionsConfig.Networks {
+		netw := &connectionsConfig.Networks[i]
+		if netw.ID != response.NetworkID {
+			continue
+		}
+
+		for _, peer := range netw.Peers {
+			if peer.ID == response.PeerID {
+				netw.Address = response.WGAddress
+				return true
+			}
+		}
+	}
+
+	return false
+}
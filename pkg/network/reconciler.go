@@ -0,0 +1,158 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/system"
+)
+
+const (
+	// reconcileDebounce is how long the reconciler waits for the events to
+	// settle before reconciling, so a burst of changes is applied at once.
+	reconcileDebounce = 500 * time.Millisecond
+
+	// reconcileMaxDelay bounds the debounce, so a steady stream of events
+	// cannot hold the reconcile back forever.
+	reconcileMaxDelay = 5 * time.Second
+
+	// reconcileResync is the interval of the periodic reconcile, catching the
+	// drift no event is emitted for, like peers or firewall rules changed by hand.
+	reconcileResync = time.Minute
+)
+
+// Reconciler keeps the WireGuard interfaces of the node, and the Nginx sites
+// of the forwards on towers, in line with the connections config. It
+// reconciles when the config changes, in this process or on disk, when upduck
+// interfaces change in the kernel and periodically.
+type Reconciler struct {
+	nodeType string
+	triggers chan string
+}
+
+func NewReconciler(nodeType string) *Reconciler {
+	return &Reconciler{
+		nodeType: nodeType,
+		triggers: make(chan string, 64),
+	}
+}
+
+// Trigger schedules a reconcile. It never blocks, triggers received while one
+// is already pending are coalesced into it.
+func (r *Reconciler) Trigger(reason string) {
+	select {
+	case r.triggers <- reason:
+	default:
+	}
+}
+
+// Run reconciles once at startup and then on every trigger until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	config.OnConnectionsChange(func() {
+		r.Trigger("connections config updated")
+	})
+
+	if err := watchConfigDir(ctx, r.Trigger); err != nil {
+		log.Printf("Warning: Failed to watch the config directory: %v", err)
+	}
+
+	if err := watchLinks(ctx, r.nodeType, r.Trigger); err != nil {
+		log.Printf("Warning: Failed to watch network interfaces: %v", err)
+	}
+
+	resync := time.NewTicker(reconcileResync)
+	defer resync.Stop()
+
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+
+	pending := map[string]bool{"startup": true}
+	pendingSince := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reason := <-r.triggers:
+			if len(pending) == 0 {
+				pendingSince = time.Now()
+			}
+			pending[reason] = true
+
+			delay := reconcileDebounce
+			if time.Since(pendingSince) > reconcileMaxDelay {
+				delay = 0
+			}
+			debounce.Reset(delay)
+		case <-resync.C:
+			pending["periodic resync"] = true
+			debounce.Reset(0)
+		case <-debounce.C:
+			if len(pending) == 0 {
+				continue
+			}
+
+			reasons := make([]string, 0, len(pending))
+			for reason := range pending {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+			pending = make(map[string]bool)
+
+			r.reconcile(strings.Join(reasons, ", "))
+		}
+	}
+}
+
+func (r *Reconciler) reconcile(reason string) {
+	changes, err := ReconcileInterfaces(r.nodeType)
+
+	if len(changes) > 0 {
+		log.Printf("Reconciled WireGuard interfaces (%s):", reason)
+		for _, change := range changes {
+			log.Printf("  %s", change)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error reconciling WireGuard interfaces (%s): %v", reason, err)
+	}
+
+	if r.nodeType == "tower" {
+		r.reconcileForwards(reason)
+	}
+}
+
+// reconcileForwards regenerates the Nginx sites from the forwards in the
+// connections config, so forwards follow the peers when their address changes.
+func (r *Reconciler) reconcileForwards(reason string) {
+	connectionsConfig, err := config.LoadConnectionsConfig()
+	if err != nil {
+		log.Printf("Error reconciling DNS forwards (%s): %v", reason, err)
+		return
+	}
+
+	tx := system.NewTransaction()
+	changes, err := dns.ReconcileForwards(tx, connectionsConfig)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+		}
+		log.Printf("Error reconciling DNS forwards (%s): %v", reason, err)
+		return
+	}
+	tx.Commit()
+
+	if len(changes) > 0 {
+		log.Printf("Reconciled DNS forwards (%s):", reason)
+		for _, change := range changes {
+			log.Printf("  %s", change)
+		}
+	}
+}
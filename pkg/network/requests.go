@@ -0,0 +1,87 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestApproved = "approved"
+	JoinRequestRejected = "rejected"
+
+	// maxPendingJoinRequests bounds how many unknown keys can queue up on the tower.
+	maxPendingJoinRequests = 100
+)
+
+// RecordJoinRequest records a connection attempt from an unknown key, or
+// refreshes the existing request of the same key for the same network.
+func RecordJoinRequest(connectionsConfig *types.ConnectionsConfig, request types.JoinRequest) (*types.JoinRequest, error) {
+	pending := 0
+	for i := range connectionsConfig.JoinRequests {
+		existing := &connectionsConfig.JoinRequests[i]
+		if existing.KeyDigest == request.KeyDigest && existing.NetworkID == request.NetworkID {
+			existing.WGPublicKey = request.WGPublicKey
+			existing.Hostname = request.Hostname
+			existing.SourceIP = request.SourceIP
+			return existing, nil
+		}
+
+		if existing.Status == JoinRequestPending {
+			pending++
+		}
+	}
+
+	if pending >= maxPendingJoinRequests {
+		return nil, fmt.Errorf("too many pending join requests")
+	}
+
+	request.ID = GenerateTimeOrderedID()
+	request.Status = JoinRequestPending
+	request.CreatedAt = time.Now().UTC()
+
+	connectionsConfig.JoinRequests = append(connectionsConfig.JoinRequests, request)
+	return &connectionsConfig.JoinRequests[len(connectionsConfig.JoinRequests)-1], nil
+}
+
+// DecideJoinRequest approves or rejects a join request. Approving allows the
+// key digest on the requested network, so the server's next connect attempt
+// goes through.
+func DecideJoinRequest(connectionsConfig *types.ConnectionsConfig, requestID string, approve bool) (*types.JoinRequest, error) {
+	for i := range connectionsConfig.JoinRequests {
+		request := &connectionsConfig.JoinRequests[i]
+		if request.ID != requestID {
+			continue
+		}
+
+		request.DecidedAt = time.Now().UTC()
+		if !approve {
+			request.Status = JoinRequestRejected
+			return request, nil
+		}
+
+		request.Status = JoinRequestApproved
+		AllowKey(connectionsConfig, types.KeyAuthorization{
+			KeyDigest: request.KeyDigest,
+			NetworkID: request.NetworkID,
+		})
+
+		return request, nil
+	}
+
+	return nil, fmt.Errorf("join request %s not found", requestID)
+}
+
+// ClearJoinRequests drops the join requests of a key for a network, once the
+// server is connected.
+func ClearJoinRequests(connectionsConfig *types.ConnectionsConfig, keyDigest string, networkID string) {
+	requests := []types.JoinRequest{}
+	for _, request := range connectionsConfig.JoinRequests {
+		if request.KeyDigest != keyDigest || request.NetworkID != networkID {
+			requests = append(requests, request)
+		}
+	}
+	connectionsConfig.JoinRequests = requests
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// DefaultHandshakeThreshold is how old the last handshake of a peer can be
+// before it is considered offline. Peers with a persistent keepalive
+// handshake at least every two minutes.
+const DefaultHandshakeThreshold = 3 * time.Minute
+
+// GetNetworksStatus reads the live state of every network interface from the
+// kernel and matches it with the configured peers.
+func GetNetworksStatus(nodeType string, connectionsConfig *types.ConnectionsConfig, threshold time.Duration) ([]types.NetworkStatus, error) {
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start wgClient: %v", err)
+	}
+	defer wgClient.Close()
+
+	statuses := []types.NetworkStatus{}
+
+	for i := range connectionsConfig.Networks {
+		netw := &connectionsConfig.Networks[i]
+		netName := InterfaceName(nodeType, netw)
+
+		status := types.NetworkStatus{
+			ID:        netw.ID,
+			Name:      netw.Name,
+			Interface: netName,
+			Peers:     []types.PeerStatus{},
+		}
+
+		devicePeers := make(map[string]wgtypes.Peer)
+		device, err := wgClient.Device(netName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to get wg device %s: %v", netName, err)
+		}
+
+		if device != nil {
+			status.Up = true
+			for _, peer := range device.Peers {
+				devicePeers[peer.PublicKey.String()] = peer
+			}
+		}
+
+		for _, peer := range netw.Peers {
+			peerStatus := types.PeerStatus{
+				ID:        peer.ID,
+				Address:   peer.Address,
+				PublicKey: peer.PublicKey,
+			}
+
+			if devicePeer, ok := devicePeers[peer.PublicKey]; ok {
+				if devicePeer.Endpoint != nil {
+					peerStatus.Endpoint = devicePeer.Endpoint.String()
+				}
+				peerStatus.LastHandshake = devicePeer.LastHandshakeTime
+				peerStatus.ReceiveBytes = devicePeer.ReceiveBytes
+				peerStatus.TransmitBytes = devicePeer.TransmitBytes
+				peerStatus.Online = !devicePeer.LastHandshakeTime.IsZero() && time.Since(devicePeer.LastHandshakeTime) <= threshold
+			}
+
+			status.Peers = append(status.Peers, peerStatus)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
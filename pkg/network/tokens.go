@@ -0,0 +1,52 @@
+package network
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// UseJoinToken validates the token secret for the network and counts one
+// use. Expired and exhausted tokens are refused.
+func UseJoinToken(connectionsConfig *types.ConnectionsConfig, secret string, networkID string) (*types.JoinToken, error) {
+	secretHash := crypto.HashTokenSecret(secret)
+
+	for i := range connectionsConfig.JoinTokens {
+		token := &connectionsConfig.JoinTokens[i]
+		if subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(secretHash)) != 1 {
+			continue
+		}
+
+		if token.NetworkID != networkID {
+			return nil, fmt.Errorf("join token %s is not valid for network %s", token.ID, networkID)
+		}
+
+		if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+			return nil, fmt.Errorf("join token %s expired", token.ID)
+		}
+
+		if token.MaxUses > 0 && token.Uses >= token.MaxUses {
+			return nil, fmt.Errorf("join token %s has no uses left", token.ID)
+		}
+
+		token.Uses++
+		return token, nil
+	}
+
+	return nil, fmt.Errorf("unknown join token")
+}
+
+// RevokeJoinToken removes the join token with the given ID.
+func RevokeJoinToken(connectionsConfig *types.ConnectionsConfig, tokenID string) error {
+	for i, token := range connectionsConfig.JoinTokens {
+		if token.ID == tokenID {
+			connectionsConfig.JoinTokens = append(connectionsConfig.JoinTokens[:i:i], connectionsConfig.JoinTokens[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("join token %s not found", tokenID)
+}
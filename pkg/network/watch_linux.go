@@ -0,0 +1,132 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/duck-labs/upduck/pkg/config"
+)
+
+// watchConfigDir calls trigger whenever a file the interfaces are built from
+// is written in the config directory, catching the changes made by other
+// processes such as the CLI.
+func watchConfigDir(ctx context.Context, trigger func(reason string)) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to init inotify: %v", err)
+	}
+
+	_, err = unix.InotifyAddWatch(fd, config.ConfigDir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_DELETE)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to watch %s: %v", config.ConfigDir, err)
+	}
+
+	watched := map[string]bool{
+		filepath.Base(config.ConnectionsConfigFile): true,
+		filepath.Base(config.StateDatabaseFile):     true,
+		filepath.Base(config.WireguardConfigFile):   true,
+	}
+
+	// Going through os.File registers the descriptor with the runtime poller,
+	// so closing it unblocks the pending read.
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+				offset = nameStart + int(event.Len)
+
+				if watched[name] {
+					trigger(fmt.Sprintf("%s changed", name))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchLinks calls trigger whenever a link, address or route of an upduck
+// interface of the node changes in the kernel, so changes made by hand are
+// reverted.
+func watchLinks(ctx context.Context, nodeType string, trigger func(reason string)) error {
+	prefix := fmt.Sprintf("udck-%c", nodeType[0])
+
+	linkUpdates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(linkUpdates, ctx.Done()); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+
+	addrUpdates := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribe(addrUpdates, ctx.Done()); err != nil {
+		return fmt.Errorf("failed to subscribe to address updates: %v", err)
+	}
+
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routeUpdates, ctx.Done()); err != nil {
+		return fmt.Errorf("failed to subscribe to route updates: %v", err)
+	}
+
+	linkName := func(index int) string {
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return ""
+		}
+		return link.Attrs().Name
+	}
+
+	go func() {
+		for {
+			select {
+			case update, ok := <-linkUpdates:
+				if !ok {
+					return
+				}
+				if name := update.Attrs().Name; strings.HasPrefix(name, prefix) {
+					trigger(fmt.Sprintf("link %s changed", name))
+				}
+			case update, ok := <-addrUpdates:
+				if !ok {
+					return
+				}
+				if name := linkName(update.LinkIndex); strings.HasPrefix(name, prefix) {
+					trigger(fmt.Sprintf("address of %s changed", name))
+				}
+			case update, ok := <-routeUpdates:
+				if !ok {
+					return
+				}
+				if name := linkName(update.LinkIndex); strings.HasPrefix(name, prefix) {
+					trigger(fmt.Sprintf("route of %s changed", name))
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+)
+
+// watchConfigDir is a no-op outside of linux, the periodic resync and the
+// in-process notifications still trigger reconciles.
+func watchConfigDir(ctx context.Context, trigger func(reason string)) error {
+	return nil
+}
+
+func watchLinks(ctx context.Context, nodeType string, trigger func(reason string)) error {
+	return nil
+}
@@ -0,0 +1,385 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/duck-labs/upduck/pkg/config"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/system"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	DefaultPortRange = "51820-51899"
+
+	wireguardPort         = 51820
+	persistentKeepalive   = 25 * time.Second
+	interfaceSuffixLength = 8
+)
+
+// wireguardInterface is the desired state of a single WireGuard interface.
+type wireguardInterface struct {
+	Name       string
+	PrivateKey wgtypes.Key
+	ListenPort int
+	Address    *net.IPNet
+	Peers      []wgtypes.PeerConfig
+	// FirewallRules are FORWARD chain rules kept in place while the interface exists.
+	FirewallRules [][]string
+}
+
+// applyWireguardInterface converges the kernel state of the interface towards
+// the desired state and describes every change it made. Peers are added,
+// updated or removed one by one, so tunnels to untouched peers are never
+// interrupted.
+func applyWireguardInterface(wgClient *wgctrl.Client, iface *wireguardInterface) ([]string, error) {
+	changes, err := ensureLink(iface.Name)
+	if err != nil {
+		return changes, err
+	}
+
+	device, err := wgClient.Device(iface.Name)
+	if err != nil {
+		if !system.DryRun() {
+			return changes, fmt.Errorf("failed to get wg device %s: %v", iface.Name, err)
+		}
+		// the link was only pretended to be created
+		device = &wgtypes.Device{Name: iface.Name}
+	}
+
+	deviceConfig := wgtypes.Config{
+		Peers: diffPeers(device.Peers, iface.Peers),
+	}
+
+	var deviceChanges []string
+
+	currentKeys := make(map[wgtypes.Key]bool)
+	for _, peer := range device.Peers {
+		currentKeys[peer.PublicKey] = true
+	}
+
+	for _, peer := range deviceConfig.Peers {
+		switch {
+		case peer.Remove:
+			deviceChanges = append(deviceChanges, fmt.Sprintf("removed peer %s from %s", peer.PublicKey, iface.Name))
+		case currentKeys[peer.PublicKey]:
+			deviceChanges = append(deviceChanges, fmt.Sprintf("updated peer %s on %s", peer.PublicKey, iface.Name))
+		default:
+			deviceChanges = append(deviceChanges, fmt.Sprintf("added peer %s to %s", peer.PublicKey, iface.Name))
+		}
+	}
+
+	if device.PrivateKey != iface.PrivateKey {
+		deviceConfig.PrivateKey = &iface.PrivateKey
+		deviceChanges = append(deviceChanges, fmt.Sprintf("set private key of %s", iface.Name))
+	}
+
+	if iface.ListenPort != 0 && device.ListenPort != iface.ListenPort {
+		deviceConfig.ListenPort = &iface.ListenPort
+		deviceChanges = append(deviceChanges, fmt.Sprintf("set listen port of %s to %d", iface.Name, iface.ListenPort))
+	}
+
+	if len(deviceChanges) > 0 {
+		err := system.Do(fmt.Sprintf("configure wg device %s (%s)", iface.Name, strings.Join(deviceChanges, ", ")), func() error {
+			return wgClient.ConfigureDevice(iface.Name, deviceConfig)
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to configure wg device %s: %v", iface.Name, err)
+		}
+		changes = append(changes, deviceChanges...)
+	}
+
+	addressChanges, err := syncLinkAddress(iface.Name, iface.Address)
+	changes = append(changes, addressChanges...)
+	if err != nil {
+		return changes, err
+	}
+
+	var routes []*net.IPNet
+	for _, peer := range iface.Peers {
+		for i := range peer.AllowedIPs {
+			routes = append(routes, &peer.AllowedIPs[i])
+		}
+	}
+
+	routeChanges, err := syncLinkRoutes(iface.Name, iface.Address, routes)
+	changes = append(changes, routeChanges...)
+	if err != nil {
+		return changes, err
+	}
+
+	for _, rule := range iface.FirewallRules {
+		added, err := system.EnsureIptablesRule("FORWARD", rule...)
+		if err != nil {
+			return changes, fmt.Errorf("failed to add firewall rule %q: %v", strings.Join(rule, " "), err)
+		}
+		if added {
+			changes = append(changes, fmt.Sprintf("added firewall rule %q", strings.Join(rule, " ")))
+		}
+	}
+
+	return changes, nil
+}
+
+// diffPeers returns the peer operations needed to go from the current device
+// peers to the desired ones. Peers that already match are left out.
+func diffPeers(current []wgtypes.Peer, desired []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	currentByKey := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, peer := range current {
+		currentByKey[peer.PublicKey] = peer
+	}
+
+	var changes []wgtypes.PeerConfig
+	desiredKeys := make(map[wgtypes.Key]bool)
+
+	for _, peer := range desired {
+		desiredKeys[peer.PublicKey] = true
+
+		existing, ok := currentByKey[peer.PublicKey]
+		if ok && peerMatches(existing, peer) {
+			continue
+		}
+
+		peer.ReplaceAllowedIPs = true
+		changes = append(changes, peer)
+	}
+
+	for _, peer := range current {
+		if !desiredKeys[peer.PublicKey] {
+			changes = append(changes, wgtypes.PeerConfig{
+				PublicKey: peer.PublicKey,
+				Remove:    true,
+			})
+		}
+	}
+
+	return changes
+}
+
+func peerMatches(current wgtypes.Peer, desired wgtypes.PeerConfig) bool {
+	if desired.Endpoint != nil && (current.Endpoint == nil || current.Endpoint.String() != desired.Endpoint.String()) {
+		return false
+	}
+
+	if desired.PersistentKeepaliveInterval != nil && current.PersistentKeepaliveInterval != *desired.PersistentKeepaliveInterval {
+		return false
+	}
+
+	return ipNetsKey(current.AllowedIPs) == ipNetsKey(desired.AllowedIPs)
+}
+
+func ipNetsKey(ipNets []net.IPNet) string {
+	keys := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		keys = append(keys, ipNet.String())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// parseInterfaceAddress parses a CIDR keeping the host part of the address,
+// so "10.5.0.1/24" becomes 10.5.0.1 with a /24 mask.
+func parseInterfaceAddress(address string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.IPNet{IP: ip, Mask: ipNet.Mask}, nil
+}
+
+// RemoveInterfacePeer drops a single peer from a running WireGuard interface
+// without touching the other peers.
+func RemoveInterfacePeer(netName string, publicKey string) error {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to start wgClient: %v", err)
+	}
+	defer wgClient.Close()
+
+	err = system.Do(fmt.Sprintf("remove peer %s from %s", publicKey, netName), func() error {
+		return wgClient.ConfigureDevice(netName, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove peer from %s: %v", netName, err)
+	}
+
+	return nil
+}
+
+// DeleteTowerInterface removes the firewall rules of a tower network and
+// tears down its interface. The rules are put back if the interface could
+// not be removed, so it is never left up without its isolation rules.
+func DeleteTowerInterface(netName string, address string) error {
+	return system.WithTransaction(func(tx *system.Transaction) error {
+		for _, rule := range towerFirewallRules(netName, address) {
+			if err := tx.DeleteIptablesRule("FORWARD", rule...); err != nil {
+				return fmt.Errorf("failed to remove firewall rule %q: %v", strings.Join(rule, " "), err)
+			}
+		}
+
+		return deleteInterface(tx, netName)
+	})
+}
+
+// DeleteInterface tears down a WireGuard interface and removes its generated config file.
+func DeleteInterface(netName string) error {
+	return system.WithTransaction(func(tx *system.Transaction) error {
+		return deleteInterface(tx, netName)
+	})
+}
+
+func deleteInterface(tx *system.Transaction, netName string) error {
+	if err := deleteLink(netName); err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(config.WireguardConfigDir, netName+".conf")
+	if err := tx.RemoveFile(configPath); err != nil {
+		return fmt.Errorf("failed to remove wg config file: %v", err)
+	}
+
+	return nil
+}
+
+// InterfaceName returns the WireGuard interface name of the network. Networks
+// created before names were stored get the name derived from their ID.
+func InterfaceName(nodeType string, network *types.Network) string {
+	if network.Interface != "" {
+		return network.Interface
+	}
+
+	return GenerateInterfaceName(nodeType, network.ID)
+}
+
+// GenerateInterfaceName derives a stable interface name from the network ID,
+// using the random tail of the ID so it fits the 15 characters limit.
+func GenerateInterfaceName(nodeType string, networkID string) string {
+	suffix := strings.ToLower(networkID)
+	if len(suffix) > interfaceSuffixLength {
+		suffix = suffix[len(suffix)-interfaceSuffixLength:]
+	}
+
+	return fmt.Sprintf("udck-%c%s", nodeType[0], suffix)
+}
+
+// ListenPort returns the WireGuard listen port of a tower network.
+func ListenPort(network *types.Network) int {
+	if network.ListenPort != 0 {
+		return network.ListenPort
+	}
+
+	return wireguardPort
+}
+
+// EndpointPort returns the WireGuard port to reach the peer endpoint on.
+func EndpointPort(peer *types.Peer) int {
+	if peer.EndpointPort != 0 {
+		return peer.EndpointPort
+	}
+
+	return wireguardPort
+}
+
+// CheckPublicPort fails when the public port of a port forward is the
+// WireGuard listen port of a network of the tower, or is already bound on the
+// host by another service. Ports of the existing port forwards are bound by
+// their Nginx stream server and are not checked on the host.
+func CheckPublicPort(connectionsConfig *types.ConnectionsConfig, protocol string, publicPort int) error {
+	if protocol == "udp" {
+		for i := range connectionsConfig.Networks {
+			if ListenPort(&connectionsConfig.Networks[i]) == publicPort {
+				return fmt.Errorf("udp port %d is the WireGuard port of network %s", publicPort, connectionsConfig.Networks[i].ID)
+			}
+		}
+	}
+
+	if dns.FindPortForward(connectionsConfig, protocol, publicPort) != -1 {
+		return nil
+	}
+
+	if system.PortInUse(protocol, publicPort) {
+		return fmt.Errorf("%s port %d is already in use on the tower", protocol, publicPort)
+	}
+
+	return nil
+}
+
+// ParsePortRange parses a "start-end" port range, falling back to the default
+// range when empty.
+func ParsePortRange(portRange string) (int, int, error) {
+	if portRange == "" {
+		portRange = DefaultPortRange
+	}
+
+	startPort, endPort, found := strings.Cut(portRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid port range %s, expected <start>-<end>", portRange)
+	}
+
+	start, err := strconv.Atoi(startPort)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range start %s", startPort)
+	}
+
+	end, err := strconv.Atoi(endPort)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range end %s", endPort)
+	}
+
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %s", portRange)
+	}
+
+	return start, end, nil
+}
+
+// AllocateListenPort returns the first port of the range that is not used by
+// another network of the tower or a UDP port forward.
+func AllocateListenPort(connectionsConfig *types.ConnectionsConfig, portRange string) (int, error) {
+	start, end, err := ParsePortRange(portRange)
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[int]bool)
+	for i := range connectionsConfig.Networks {
+		used[ListenPort(&connectionsConfig.Networks[i])] = true
+	}
+	for _, forward := range connectionsConfig.PortForwards {
+		if forward.Protocol == "udp" {
+			used[forward.PublicPort] = true
+		}
+	}
+
+	for port := start; port <= end; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no available listen port in range %d-%d", start, end)
+}
+
+func towerFirewallRules(netName string, address string) [][]string {
+	return [][]string{
+		{"-i", netName, "-s", address, "-d", address, "-j", "ACCEPT"},
+		{"-i", netName, "-s", address, "-j", "DROP"},
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+func TestDiffPeers(t *testing.T) {
+	keyA := testKey(t)
+	keyB := testKey(t)
+	keyC := testKey(t)
+
+	endpoint := &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51820}
+	otherEndpoint := &net.UDPAddr{IP: net.ParseIP("203.0.113.11"), Port: 51820}
+	keepalive := persistentKeepalive
+
+	current := []wgtypes.Peer{
+		{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.3/32", "10.8.0.2/32"), Endpoint: endpoint, PersistentKeepaliveInterval: keepalive},
+		{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.4/32")},
+	}
+
+	tests := []struct {
+		name    string
+		desired []wgtypes.PeerConfig
+		want    []wgtypes.PeerConfig
+	}{
+		{
+			name: "unchanged",
+			desired: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32"), Endpoint: endpoint, PersistentKeepaliveInterval: &keepalive},
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.4/32")},
+			},
+		},
+		{
+			name: "unset endpoint and keepalive are left alone",
+			desired: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32")},
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.4/32")},
+			},
+		},
+		{
+			name: "new allowed ips",
+			desired: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32")},
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.5/32")},
+			},
+			want: []wgtypes.PeerConfig{
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.5/32"), ReplaceAllowedIPs: true},
+			},
+		},
+		{
+			name: "new endpoint",
+			desired: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32"), Endpoint: otherEndpoint},
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.4/32"), Endpoint: endpoint},
+			},
+			want: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32"), Endpoint: otherEndpoint, ReplaceAllowedIPs: true},
+				{PublicKey: keyB, AllowedIPs: testIPNets(t, "10.8.0.4/32"), Endpoint: endpoint, ReplaceAllowedIPs: true},
+			},
+		},
+		{
+			name: "added and removed peers",
+			desired: []wgtypes.PeerConfig{
+				{PublicKey: keyA, AllowedIPs: testIPNets(t, "10.8.0.2/32", "10.8.0.3/32")},
+				{PublicKey: keyC, AllowedIPs: testIPNets(t, "10.8.0.6/32")},
+			},
+			want: []wgtypes.PeerConfig{
+				{PublicKey: keyC, AllowedIPs: testIPNets(t, "10.8.0.6/32"), ReplaceAllowedIPs: true},
+				{PublicKey: keyB, Remove: true},
+			},
+		},
+		{
+			name: "no peers",
+			want: []wgtypes.PeerConfig{
+				{PublicKey: keyA, Remove: true},
+				{PublicKey: keyB, Remove: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := diffPeers(current, tt.desired); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffPeers = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInterfaceAddress(t *testing.T) {
+	address, err := parseInterfaceAddress("10.5.0.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address.String() != "10.5.0.1/24" {
+		t.Errorf("parseInterfaceAddress = %s, want 10.5.0.1/24", address)
+	}
+}
+
+func TestCheckPublicPort(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	boundPort := listener.Addr().(*net.TCPAddr).Port
+
+	connectionsConfig := &types.ConnectionsConfig{
+		Networks: []types.Network{{ID: "net1", ListenPort: 51821}},
+	}
+
+	tests := []struct {
+		name      string
+		protocol  string
+		port      int
+		forwarded bool
+		wantErr   bool
+	}{
+		{name: "free tcp port", protocol: "tcp", port: 2222},
+		{name: "tcp on the WireGuard port", protocol: "tcp", port: 51821},
+		{name: "udp on the WireGuard port", protocol: "udp", port: 51821, wantErr: true},
+		{name: "port bound on the host", protocol: "tcp", port: boundPort, wantErr: true},
+		{name: "port of an existing forward", protocol: "tcp", port: boundPort, forwarded: true},
+	}
+
+	for _, tt := range tests {
+		connectionsConfig.PortForwards = nil
+		if tt.forwarded {
+			connectionsConfig.PortForwards = []types.PortForward{{Protocol: tt.protocol, PublicPort: tt.port}}
+		}
+
+		err := CheckPublicPort(connectionsConfig, tt.protocol, tt.port)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func testKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key.PublicKey()
+}
+
+func testIPNets(t *testing.T, cidrs ...string) []net.IPNet {
+	t.Helper()
+
+	var ipNets []net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipNets = append(ipNets, *ipNet)
+	}
+
+	return ipNets
+}
@@ -0,0 +1,785 @@
+package spec
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/crypto"
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/network"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+const (
+	ActionCreate = "+"
+	ActionUpdate = "~"
+	ActionDelete = "-"
+)
+
+// Change is a single entry of the plan computed by Apply.
+type Change struct {
+	Action  string
+	Kind    string
+	Name    string
+	Details []string
+}
+
+func (c Change) String() string {
+	line := fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+	if len(c.Details) > 0 {
+		line += ": " + strings.Join(c.Details, ", ")
+	}
+	return line
+}
+
+// CreatedToken is a join token created by Apply with a new secret.
+type CreatedToken struct {
+	NetworkID string
+	TokenID   string
+	Secret    string
+}
+
+// CreatedPassword is a basic auth user created by Apply with a new password.
+type CreatedPassword struct {
+	Domain   string
+	User     string
+	Password string
+}
+
+// Result is the plan computed by Apply. The connections config changes are
+// already made, the Nginx sites of the forwards and the interfaces of the
+// removed networks are left to the caller.
+type Result struct {
+	Changes         []Change
+	Warnings        []string
+	Tokens          []CreatedToken
+	Passwords       []CreatedPassword
+	RemovedNetworks []types.Network
+}
+
+type Options struct {
+	// PortRange is the range listen ports of new networks are taken from.
+	PortRange string
+	// Force deletes the networks missing from the spec even if they still have peers.
+	Force bool
+}
+
+// Apply converges the connections config towards the spec and returns the
+// changes it made. Tower state missing from the spec is removed. Nothing is
+// partially applied when an error is returned, as long as the config is
+// discarded by the caller.
+func Apply(connectionsConfig *types.ConnectionsConfig, spec *Spec, options Options) (*Result, error) {
+	result := &Result{}
+
+	matched, err := matchNetworks(connectionsConfig, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]bool)
+	for _, networkID := range matched {
+		kept[networkID] = true
+	}
+
+	for _, netw := range append([]types.Network{}, connectionsConfig.Networks...) {
+		if kept[netw.ID] {
+			continue
+		}
+
+		if err := removeNetwork(connectionsConfig, netw, options.Force); err != nil {
+			return nil, err
+		}
+
+		change := Change{Action: ActionDelete, Kind: "network", Name: networkLabel(netw.ID, netw.Name), Details: []string{netw.Address}}
+		if len(netw.Peers) > 0 {
+			change.Details = append(change.Details, fmt.Sprintf("%d peer(s) revoked", len(netw.Peers)))
+		}
+		result.Changes = append(result.Changes, change)
+		result.RemovedNetworks = append(result.RemovedNetworks, netw)
+	}
+
+	for i, specNetwork := range spec.Networks {
+		networkID := matched[i]
+
+		if networkID == "" {
+			block, _ := network.ParseNetworkBlock(specNetwork.CIDR)
+			created, err := network.CreateNetwork(connectionsConfig, block, specNetwork.Name, options.PortRange)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create network %s: %v", specNetwork.CIDR, err)
+			}
+			networkID = created.ID
+
+			result.Changes = append(result.Changes, Change{
+				Action:  ActionCreate,
+				Kind:    "network",
+				Name:    networkLabel(created.ID, created.Name),
+				Details: []string{created.Address, fmt.Sprintf("interface %s, port %d", created.Interface, created.ListenPort)},
+			})
+		} else {
+			netw := findNetwork(connectionsConfig, networkID)
+			if specNetwork.Name != "" && specNetwork.Name != netw.Name {
+				result.Changes = append(result.Changes, Change{
+					Action:  ActionUpdate,
+					Kind:    "network",
+					Name:    networkLabel(netw.ID, netw.Name),
+					Details: []string{fmt.Sprintf("name %q -> %q", netw.Name, specNetwork.Name)},
+				})
+				netw.Name = specNetwork.Name
+			}
+		}
+
+		if err := applyAllowedKeys(connectionsConfig, networkID, specNetwork.AllowedKeys, result); err != nil {
+			return nil, err
+		}
+
+		if err := applyTokens(connectionsConfig, networkID, specNetwork.Tokens, result); err != nil {
+			return nil, err
+		}
+
+		if err := applyStaticIPs(findNetwork(connectionsConfig, networkID), specNetwork.StaticIPs, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyForwards(connectionsConfig, spec.Forwards, result); err != nil {
+		return nil, err
+	}
+
+	if err := applyPortForwards(connectionsConfig, spec.PortForwards, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// matchNetworks returns, for every network of the spec, the ID of the tower
+// network it describes or an empty string when it has to be created.
+func matchNetworks(connectionsConfig *types.ConnectionsConfig, spec *Spec) ([]string, error) {
+	matched := make([]string, len(spec.Networks))
+	used := make(map[string]int)
+
+	for i, specNetwork := range spec.Networks {
+		if specNetwork.CIDR == "" {
+			return nil, fmt.Errorf("network %s has no cidr", networkLabel(specNetwork.ID, specNetwork.Name))
+		}
+
+		block, err := network.ParseNetworkBlock(specNetwork.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %v", networkLabel(specNetwork.ID, specNetwork.Name), err)
+		}
+
+		var netw *types.Network
+		for j := range connectionsConfig.Networks {
+			candidate := &connectionsConfig.Networks[j]
+			if specNetwork.ID != "" && candidate.ID == specNetwork.ID {
+				netw = candidate
+				break
+			}
+		}
+
+		for j := range connectionsConfig.Networks {
+			candidate := &connectionsConfig.Networks[j]
+			if netw == nil && specNetwork.Name != "" && candidate.Name == specNetwork.Name {
+				netw = candidate
+			}
+		}
+
+		for j := range connectionsConfig.Networks {
+			candidate := &connectionsConfig.Networks[j]
+			if netw == nil && candidate.Address == block.String() {
+				netw = candidate
+			}
+		}
+
+		if netw == nil {
+			continue
+		}
+
+		if previous, ok := used[netw.ID]; ok {
+			return nil, fmt.Errorf("networks %s and %s of the spec both describe network %s", networkLabel(spec.Networks[previous].ID, spec.Networks[previous].Name), networkLabel(specNetwork.ID, specNetwork.Name), netw.ID)
+		}
+		used[netw.ID] = i
+
+		if netw.Address != block.String() {
+			return nil, fmt.Errorf("network %s is %s but the spec declares %s, changing the CIDR of a network is not supported", networkLabel(netw.ID, netw.Name), netw.Address, block)
+		}
+
+		matched[i] = netw.ID
+	}
+
+	return matched, nil
+}
+
+// removeNetwork drops the network with its peers, authorizations, join
+// tokens and join requests.
+func removeNetwork(connectionsConfig *types.ConnectionsConfig, netw types.Network, force bool) error {
+	if len(netw.Peers) > 0 && !force {
+		return fmt.Errorf("network %s is missing from the spec but still has %d peer(s), revoke them first or use --force", networkLabel(netw.ID, netw.Name), len(netw.Peers))
+	}
+
+	_, err := network.DeleteNetwork(connectionsConfig, netw.ID)
+	return err
+}
+
+func applyAllowedKeys(connectionsConfig *types.ConnectionsConfig, networkID string, allowedKeys []AllowedKey, result *Result) error {
+	desired := make(map[string]AllowedKey)
+	for _, allowedKey := range allowedKeys {
+		if allowedKey.Digest == "" {
+			return fmt.Errorf("an allowed key of network %s has no digest", networkID)
+		}
+		if _, ok := desired[allowedKey.Digest]; ok {
+			return fmt.Errorf("allowed key %s is declared twice on network %s", allowedKey.Digest, networkID)
+		}
+		desired[allowedKey.Digest] = allowedKey
+	}
+
+	current := make(map[string]types.KeyAuthorization)
+	for _, authorization := range connectionsConfig.Authorizations {
+		if authorization.NetworkID != networkID {
+			continue
+		}
+		current[authorization.KeyDigest] = authorization
+
+		if _, ok := desired[authorization.KeyDigest]; !ok {
+			network.DisallowKey(connectionsConfig, authorization.KeyDigest, networkID)
+			result.Changes = append(result.Changes, Change{Action: ActionDelete, Kind: "allowed key", Name: authorization.KeyDigest, Details: []string{"network " + networkID}})
+		}
+	}
+
+	for _, allowedKey := range allowedKeys {
+		authorization := types.KeyAuthorization{
+			KeyDigest: allowedKey.Digest,
+			NetworkID: networkID,
+			MaxPeers:  allowedKey.MaxPeers,
+			ExpiresAt: allowedKey.Expires.UTC(),
+		}
+
+		existing, ok := current[allowedKey.Digest]
+		if !ok {
+			network.AllowKey(connectionsConfig, authorization)
+			result.Changes = append(result.Changes, Change{Action: ActionCreate, Kind: "allowed key", Name: allowedKey.Digest, Details: append([]string{"network " + networkID}, describeLimits("max peers", allowedKey.MaxPeers, allowedKey.Expires)...)})
+			continue
+		}
+
+		details := diffLimits("max peers", existing.MaxPeers, allowedKey.MaxPeers, existing.ExpiresAt, allowedKey.Expires)
+		if len(details) == 0 {
+			continue
+		}
+
+		network.AllowKey(connectionsConfig, authorization)
+		result.Changes = append(result.Changes, Change{Action: ActionUpdate, Kind: "allowed key", Name: allowedKey.Digest, Details: append([]string{"network " + networkID}, details...)})
+	}
+
+	return nil
+}
+
+func applyTokens(connectionsConfig *types.ConnectionsConfig, networkID string, tokens []Token, result *Result) error {
+	desired := make(map[string]Token)
+	for _, token := range tokens {
+		if token.ID == "" {
+			return fmt.Errorf("a token of network %s has no id", networkID)
+		}
+		if _, ok := desired[token.ID]; ok {
+			return fmt.Errorf("token %s is declared twice", token.ID)
+		}
+		desired[token.ID] = token
+	}
+
+	joinTokens := []types.JoinToken{}
+	current := make(map[string]bool)
+	for _, joinToken := range connectionsConfig.JoinTokens {
+		if joinToken.NetworkID != networkID {
+			joinTokens = append(joinTokens, joinToken)
+			continue
+		}
+
+		token, ok := desired[joinToken.ID]
+		if !ok {
+			result.Changes = append(result.Changes, Change{Action: ActionDelete, Kind: "token", Name: joinToken.ID, Details: []string{"network " + networkID}})
+			continue
+		}
+		current[joinToken.ID] = true
+
+		details := diffLimits("max uses", joinToken.MaxUses, token.MaxUses, joinToken.ExpiresAt, token.Expires)
+		if token.SecretHash != "" && token.SecretHash != joinToken.SecretHash {
+			details = append(details, "secret changed")
+			joinToken.SecretHash = token.SecretHash
+		}
+
+		if len(details) > 0 {
+			joinToken.MaxUses = token.MaxUses
+			joinToken.ExpiresAt = token.Expires.UTC()
+			result.Changes = append(result.Changes, Change{Action: ActionUpdate, Kind: "token", Name: joinToken.ID, Details: append([]string{"network " + networkID}, details...)})
+		}
+
+		joinTokens = append(joinTokens, joinToken)
+	}
+
+	for _, token := range tokens {
+		if current[token.ID] {
+			continue
+		}
+
+		for _, joinToken := range connectionsConfig.JoinTokens {
+			if joinToken.ID == token.ID {
+				return fmt.Errorf("token %s of network %s already exists on network %s", token.ID, networkID, joinToken.NetworkID)
+			}
+		}
+
+		joinToken := types.JoinToken{
+			ID:         token.ID,
+			NetworkID:  networkID,
+			SecretHash: token.SecretHash,
+			MaxUses:    token.MaxUses,
+			ExpiresAt:  token.Expires.UTC(),
+			CreatedAt:  time.Now().UTC(),
+		}
+
+		if joinToken.SecretHash == "" {
+			secret, err := crypto.GenerateTokenSecret()
+			if err != nil {
+				return err
+			}
+			joinToken.SecretHash = crypto.HashTokenSecret(secret)
+			result.Tokens = append(result.Tokens, CreatedToken{NetworkID: networkID, TokenID: token.ID, Secret: secret})
+		}
+
+		joinTokens = append(joinTokens, joinToken)
+		result.Changes = append(result.Changes, Change{Action: ActionCreate, Kind: "token", Name: token.ID, Details: append([]string{"network " + networkID}, describeLimits("max uses", token.MaxUses, token.Expires)...)})
+	}
+
+	connectionsConfig.JoinTokens = joinTokens
+
+	return nil
+}
+
+// applyStaticIPs reserves the declared addresses and turns the static leases
+// missing from the spec back into regular ones. Peers that did not connect
+// yet are skipped with a warning, their address is reserved by a later apply.
+func applyStaticIPs(netw *types.Network, staticIPs map[string]string, result *Result) error {
+	for i, lease := range netw.Leases {
+		if !lease.Static {
+			continue
+		}
+
+		if _, ok := staticIPs[lease.PeerID]; ok {
+			continue
+		}
+
+		netw.Leases[i].Static = false
+		result.Changes = append(result.Changes, Change{Action: ActionDelete, Kind: "static ip", Name: lease.PeerID, Details: []string{lease.Address + " is no longer reserved"}})
+	}
+
+	peerIDs := make([]string, 0, len(staticIPs))
+	for peerID := range staticIPs {
+		peerIDs = append(peerIDs, peerID)
+	}
+	sort.Strings(peerIDs)
+
+	for _, peerID := range peerIDs {
+		ip := net.ParseIP(staticIPs[peerID]).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid static IP %s for peer %s", staticIPs[peerID], peerID)
+		}
+		address := (&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String()
+
+		var peer *types.Peer
+		for j := range netw.Peers {
+			if netw.Peers[j].ID == peerID {
+				peer = &netw.Peers[j]
+			}
+		}
+
+		if peer == nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("peer %s is not connected to network %s, its static IP %s is reserved on a later apply", peerID, netw.ID, ip))
+			continue
+		}
+
+		alreadyStatic := false
+		for _, lease := range netw.Leases {
+			if lease.PeerID == peerID && lease.Static && lease.Address == address {
+				alreadyStatic = true
+			}
+		}
+
+		if alreadyStatic {
+			continue
+		}
+
+		previous := peer.Address
+		if _, err := network.ReserveAddress(netw, peerID, ip.String()); err != nil {
+			return fmt.Errorf("failed to reserve %s for peer %s: %v", ip, peerID, err)
+		}
+
+		change := Change{Action: ActionCreate, Kind: "static ip", Name: peerID, Details: []string{address}}
+		if previous != address {
+			change.Action = ActionUpdate
+			change.Details = []string{fmt.Sprintf("%s -> %s", previous, address), "the server must update its own interface address"}
+		}
+		result.Changes = append(result.Changes, change)
+	}
+
+	return nil
+}
+
+func applyForwards(connectionsConfig *types.ConnectionsConfig, forwards []Forward, result *Result) error {
+	declared := make(map[string]bool)
+	for _, forward := range forwards {
+		if err := dns.CheckDomain(forward.Domain); err != nil {
+			return fmt.Errorf("invalid forward: %v", err)
+		}
+
+		if declared[forward.Domain] {
+			return fmt.Errorf("forward %s is declared twice", forward.Domain)
+		}
+		declared[forward.Domain] = true
+
+		target := types.Forward{Domain: forward.Domain}
+
+		targets, err := routeTargets(forward.Server, forward.Port, forward.Targets)
+		if err != nil {
+			return fmt.Errorf("invalid forward %s: %v", forward.Domain, err)
+		}
+		if len(targets) > 0 {
+			if _, err := dns.AddRoute(connectionsConfig, &target, "/", targets, forward.Strategy); err != nil {
+				return fmt.Errorf("invalid targets of forward %s: %v", forward.Domain, err)
+			}
+		}
+
+		for _, route := range forward.Routes {
+			if err := applyRoute(connectionsConfig, &target, route); err != nil {
+				return fmt.Errorf("invalid route %s of forward %s: %v", route.Path, forward.Domain, err)
+			}
+		}
+
+		if len(target.Routes) == 0 {
+			return fmt.Errorf("forward %s needs a server and port, targets or routes", forward.Domain)
+		}
+
+		index := dns.FindForward(connectionsConfig, forward.Domain)
+
+		var current *types.Forward
+		if index != -1 {
+			current = &connectionsConfig.Forwards[index]
+		}
+
+		auth, passwords, err := forwardAuth(forward.Domain, forward.Auth, current)
+		if err != nil {
+			return err
+		}
+
+		if err := dns.SetTLS(&target, forward.TLS, forward.HSTS); err != nil {
+			return fmt.Errorf("invalid forward %s: %v", forward.Domain, err)
+		}
+
+		if err := dns.SetPassthrough(&target, forward.Passthrough); err != nil {
+			return fmt.Errorf("invalid forward %s: %v", forward.Domain, err)
+		}
+
+		if err := dns.SetAuth(&target, auth); err != nil {
+			return fmt.Errorf("invalid access policy of forward %s: %v", forward.Domain, err)
+		}
+		result.Passwords = append(result.Passwords, passwords...)
+
+		if current == nil {
+			target.CreatedAt = time.Now().UTC()
+			connectionsConfig.Forwards = append(connectionsConfig.Forwards, target)
+			result.Changes = append(result.Changes, Change{Action: ActionCreate, Kind: "forward", Name: forward.Domain, Details: []string{forwardTarget(&target)}})
+			continue
+		}
+
+		var details []string
+		if forwardTarget(current) != forwardTarget(&target) {
+			details = append(details, fmt.Sprintf("%s -> %s", forwardTarget(current), forwardTarget(&target)))
+		}
+		for _, name := range changedPasswords(current, &target) {
+			details = append(details, fmt.Sprintf("password of %s changed", name))
+		}
+		if len(details) == 0 {
+			continue
+		}
+
+		result.Changes = append(result.Changes, Change{Action: ActionUpdate, Kind: "forward", Name: forward.Domain, Details: details})
+		current.Routes = target.Routes
+		current.Auth = target.Auth
+		current.TLS = target.TLS
+		current.HSTS = target.HSTS
+		current.Passthrough = target.Passthrough
+	}
+
+	var kept []types.Forward
+	for _, forward := range connectionsConfig.Forwards {
+		if declared[forward.Domain] {
+			kept = append(kept, forward)
+			continue
+		}
+
+		result.Changes = append(result.Changes, Change{Action: ActionDelete, Kind: "forward", Name: forward.Domain, Details: []string{forwardTarget(&forward)}})
+	}
+	connectionsConfig.Forwards = kept
+
+	return nil
+}
+
+// applyRoute adds the route of the spec to the forward.
+func applyRoute(connectionsConfig *types.ConnectionsConfig, forward *types.Forward, route Route) error {
+	targets, err := routeTargets(route.Server, route.Port, route.Targets)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("route needs a server and port or targets")
+	}
+
+	added, err := dns.AddRoute(connectionsConfig, forward, route.Path, targets, route.Strategy)
+	if err != nil {
+		return err
+	}
+
+	if err := dns.SetStripPrefix(added, route.StripPrefix); err != nil {
+		return err
+	}
+
+	for name, value := range route.Headers {
+		if err := dns.SetHeader(added, name, value); err != nil {
+			return err
+		}
+	}
+
+	if err := dns.SetMaxBodySize(added, route.MaxBodySize); err != nil {
+		return err
+	}
+
+	if err := dns.SetConnectTimeout(added, route.ConnectTimeout); err != nil {
+		return err
+	}
+
+	return dns.SetTimeout(added, route.Timeout)
+}
+
+// forwardAuth returns the access policy of the spec. Users declared without
+// a password hash keep the one of the current forward, or get a new password.
+func forwardAuth(domain string, auth *Auth, current *types.Forward) (*types.ForwardAuth, []CreatedPassword, error) {
+	if auth == nil {
+		return nil, nil, nil
+	}
+
+	forwardAuth := &types.ForwardAuth{
+		Allow:          auth.Allow,
+		Deny:           auth.Deny,
+		ForwardAuthURL: auth.ForwardAuth,
+		SignInURL:      auth.SignIn,
+	}
+
+	var passwords []CreatedPassword
+	for _, user := range auth.Users {
+		hash := user.PasswordHash
+
+		if hash == "" && current != nil && current.Auth != nil {
+			for _, existing := range current.Auth.Users {
+				if existing.Name == user.Name {
+					hash = existing.PasswordHash
+				}
+			}
+		}
+
+		if hash == "" {
+			password, err := crypto.GeneratePassword()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			hash, err = crypto.HashPassword(password)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			passwords = append(passwords, CreatedPassword{Domain: domain, User: user.Name, Password: password})
+		}
+
+		forwardAuth.Users = append(forwardAuth.Users, types.ForwardUser{Name: user.Name, PasswordHash: hash})
+	}
+
+	return forwardAuth, passwords, nil
+}
+
+// changedPasswords returns the users of both forwards whose password hash
+// differs, forwardTarget does not show the hashes.
+func changedPasswords(current *types.Forward, target *types.Forward) []string {
+	if current.Auth == nil || target.Auth == nil {
+		return nil
+	}
+
+	var names []string
+	for _, user := range target.Auth.Users {
+		for _, existing := range current.Auth.Users {
+			if existing.Name == user.Name && existing.PasswordHash != user.PasswordHash {
+				names = append(names, user.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// routeTargets returns the targets declared either as a server and port or
+// as a list of "server:port".
+func routeTargets(server string, port int, targets []string) ([]string, error) {
+	if server == "" && port == 0 {
+		return targets, nil
+	}
+
+	if len(targets) > 0 {
+		return nil, fmt.Errorf("a server and targets cannot be declared together")
+	}
+
+	return []string{net.JoinHostPort(server, strconv.Itoa(port))}, nil
+}
+
+// forwardTarget describes where the forward sends the traffic and how, two
+// forwards with the same description are the same.
+func forwardTarget(forward *types.Forward) string {
+	routes := make([]string, 0, len(forward.Routes))
+	for i := range forward.Routes {
+		route := &forward.Routes[i]
+
+		description := strings.Join(dns.Targets(route.Targets), ", ")
+		if len(route.Targets) > 1 {
+			description += " (" + dns.Strategy(route) + ")"
+		}
+		if options := dns.RouteOptions(route); len(options) > 0 {
+			description += " [" + strings.Join(options, ", ") + "]"
+		}
+		if len(forward.Routes) > 1 || route.Path != "/" {
+			description = route.Path + " " + description
+		}
+
+		routes = append(routes, description)
+	}
+	target := strings.Join(routes, "; ")
+
+	switch {
+	case forward.Passthrough:
+		target += " (passthrough)"
+	case forward.HSTS:
+		target += " (tls, hsts)"
+	case forward.TLS:
+		target += " (tls)"
+	}
+
+	if access := dns.AuthOptions(forward); len(access) > 0 {
+		target += " (" + strings.Join(access, ", ") + ")"
+	}
+	return target
+}
+
+func applyPortForwards(connectionsConfig *types.ConnectionsConfig, forwards []PortForward, result *Result) error {
+	// the ports are checked while the current forwards are still in place,
+	// their ports are bound by their own stream servers
+	for _, forward := range forwards {
+		protocol := portForwardProtocol(&forward)
+		if err := network.CheckPublicPort(connectionsConfig, protocol, forward.PublicPort); err != nil {
+			return fmt.Errorf("invalid port forward %s/%d: %v", protocol, forward.PublicPort, err)
+		}
+	}
+
+	current := connectionsConfig.PortForwards
+	connectionsConfig.PortForwards = nil
+
+	for _, forward := range forwards {
+		protocol := portForwardProtocol(&forward)
+		name := fmt.Sprintf("%s/%d", protocol, forward.PublicPort)
+
+		added, err := dns.AddPortForward(connectionsConfig, protocol, forward.PublicPort, forward.Server, forward.Port)
+		if err != nil {
+			return fmt.Errorf("invalid port forward %s: %v", name, err)
+		}
+
+		index := -1
+		for i := range current {
+			if current[i].Protocol == protocol && current[i].PublicPort == forward.PublicPort {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			result.Changes = append(result.Changes, Change{Action: ActionCreate, Kind: "port forward", Name: name, Details: []string{dns.Target(&added.Target)}})
+			continue
+		}
+
+		previous := current[index]
+		current = append(current[:index:index], current[index+1:]...)
+
+		added.CreatedAt = previous.CreatedAt
+		if previous.Target != added.Target {
+			result.Changes = append(result.Changes, Change{Action: ActionUpdate, Kind: "port forward", Name: name, Details: []string{fmt.Sprintf("%s -> %s", dns.Target(&previous.Target), dns.Target(&added.Target))}})
+		}
+	}
+
+	for _, forward := range current {
+		result.Changes = append(result.Changes, Change{Action: ActionDelete, Kind: "port forward", Name: fmt.Sprintf("%s/%d", forward.Protocol, forward.PublicPort), Details: []string{dns.Target(&forward.Target)}})
+	}
+
+	return nil
+}
+
+func portForwardProtocol(forward *PortForward) string {
+	if forward.Protocol == "" {
+		return dns.ProtocolTCP
+	}
+	return forward.Protocol
+}
+
+func findNetwork(connectionsConfig *types.ConnectionsConfig, networkID string) *types.Network {
+	for i := range connectionsConfig.Networks {
+		if connectionsConfig.Networks[i].ID == networkID {
+			return &connectionsConfig.Networks[i]
+		}
+	}
+	return nil
+}
+
+func networkLabel(id string, name string) string {
+	switch {
+	case name == "":
+		return id
+	case id == "":
+		return name
+	default:
+		return fmt.Sprintf("%s (%s)", name, id)
+	}
+}
+
+func describeLimits(limitName string, limit int, expires time.Time) []string {
+	var details []string
+	if limit > 0 {
+		details = append(details, fmt.Sprintf("%s %d", limitName, limit))
+	}
+	if !expires.IsZero() {
+		details = append(details, "expires "+expires.UTC().Format(time.RFC3339))
+	}
+	return details
+}
+
+func diffLimits(limitName string, currentLimit int, desiredLimit int, currentExpires time.Time, desiredExpires time.Time) []string {
+	var details []string
+	if currentLimit != desiredLimit {
+		details = append(details, fmt.Sprintf("%s %d -> %d", limitName, currentLimit, desiredLimit))
+	}
+	if !currentExpires.Equal(desiredExpires) {
+		details = append(details, fmt.Sprintf("expires %s -> %s", formatTime(currentExpires), formatTime(desiredExpires)))
+	}
+	return details
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
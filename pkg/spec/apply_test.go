@@ -0,0 +1,388 @@
+package spec
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// testTower is a tower with one network of two peers, a forward, a port
+// forward, an allowed key and a join token.
+func testTower() *types.ConnectionsConfig {
+	return &types.ConnectionsConfig{
+		Networks: []types.Network{{
+			ID:      "net1",
+			Name:    "home",
+			Address: "10.8.0.0/24",
+			Peers: []types.Peer{
+				{ID: "peerA", Address: "10.8.0.2/32"},
+				{ID: "peerB", Address: "10.8.0.3/32"},
+			},
+			Leases: []types.Lease{
+				{Address: "10.8.0.2/32", PeerID: "peerA"},
+				{Address: "10.8.0.3/32", PeerID: "peerB", Static: true},
+			},
+			Interface:  "wg-tower-net1",
+			ListenPort: 51820,
+		}},
+		Authorizations: []types.KeyAuthorization{{KeyDigest: "digest1", NetworkID: "net1", MaxPeers: 2}},
+		JoinTokens:     []types.JoinToken{{ID: "token1", NetworkID: "net1", SecretHash: "hash1", MaxUses: 5}},
+		Forwards: []types.Forward{{
+			Domain: "app.example.com",
+			Routes: []types.ForwardRoute{{Path: "/", Targets: []types.ForwardTarget{{PeerID: "peerA", Port: 3000}}}},
+			TLS:    true,
+		}},
+		PortForwards: []types.PortForward{
+			{Protocol: "tcp", PublicPort: 2222, Target: types.ForwardTarget{PeerID: "peerA", Port: 22}},
+		},
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(spec *Spec)
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "exported state",
+			edit: func(spec *Spec) {},
+		},
+		{
+			name: "new forward",
+			edit: func(spec *Spec) {
+				spec.Forwards = append(spec.Forwards, Forward{Domain: "api.example.com", Targets: []string{"peerA:8080", "peerB:8080"}, Strategy: "least_conn"})
+			},
+			want: []string{"+ forward api.example.com: peerA:8080, peerB:8080 (least_conn)"},
+		},
+		{
+			name: "forward with routes",
+			edit: func(spec *Spec) {
+				spec.Forwards[0].Routes = []Route{{Path: "/api/", Server: "peerB", Port: 8080, StripPrefix: true, Timeout: "1h"}}
+			},
+			want: []string{"~ forward app.example.com: peerA:3000 (tls) -> / peerA:3000; /api peerB:8080 [strip prefix, timeout 1h] (tls)"},
+		},
+		{
+			name: "changed forward",
+			edit: func(spec *Spec) { spec.Forwards[0].Server = "192.168.1.10" },
+			want: []string{"~ forward app.example.com: peerA:3000 (tls) -> 192.168.1.10:3000 (tls)"},
+		},
+		{
+			name: "hsts",
+			edit: func(spec *Spec) { spec.Forwards[0].HSTS = true },
+			want: []string{"~ forward app.example.com: peerA:3000 (tls) -> peerA:3000 (tls, hsts)"},
+		},
+		{
+			name:    "hsts without tls",
+			edit:    func(spec *Spec) { spec.Forwards[0].TLS = false; spec.Forwards[0].HSTS = true },
+			wantErr: "invalid forward app.example.com",
+		},
+		{
+			name: "access policy",
+			edit: func(spec *Spec) { spec.Forwards[0].Auth = &Auth{Allow: []string{"10.0.0.0/8"}} },
+			want: []string{"~ forward app.example.com: peerA:3000 (tls) -> peerA:3000 (tls) (allow 10.0.0.0/8)"},
+		},
+		{
+			name: "removed forward",
+			edit: func(spec *Spec) { spec.Forwards = nil },
+			want: []string{"- forward app.example.com: peerA:3000 (tls)"},
+		},
+		{
+			name: "port forwards",
+			edit: func(spec *Spec) {
+				spec.PortForwards = []PortForward{
+					{PublicPort: 2222, Server: "peerB", Port: 22},
+					{Protocol: "udp", PublicPort: 53, Server: "192.168.1.10", Port: 53},
+				}
+			},
+			want: []string{
+				"~ port forward tcp/2222: peerA:22 -> peerB:22",
+				"+ port forward udp/53: 192.168.1.10:53",
+			},
+		},
+		{
+			name: "removed port forward",
+			edit: func(spec *Spec) { spec.PortForwards = nil },
+			want: []string{"- port forward tcp/2222: peerA:22"},
+		},
+		{
+			name: "renamed network",
+			edit: func(spec *Spec) { spec.Networks[0].Name = "lab" },
+			want: []string{`~ network home (net1): name "home" -> "lab"`},
+		},
+		{
+			name: "network matched by cidr",
+			edit: func(spec *Spec) { spec.Networks[0].ID = ""; spec.Networks[0].Name = "" },
+		},
+		{
+			name: "allowed keys",
+			edit: func(spec *Spec) {
+				spec.Networks[0].AllowedKeys = []AllowedKey{
+					{Digest: "digest1", MaxPeers: 3},
+					{Digest: "digest2", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+				}
+			},
+			want: []string{
+				"~ allowed key digest1: network net1, max peers 2 -> 3",
+				"+ allowed key digest2: network net1, expires 2030-01-01T00:00:00Z",
+			},
+		},
+		{
+			name: "removed allowed key",
+			edit: func(spec *Spec) { spec.Networks[0].AllowedKeys = nil },
+			want: []string{"- allowed key digest1: network net1"},
+		},
+		{
+			name: "tokens",
+			edit: func(spec *Spec) {
+				spec.Networks[0].Tokens = []Token{{ID: "token1", SecretHash: "hash2", MaxUses: 5}, {ID: "token2", SecretHash: "hash3"}}
+			},
+			want: []string{
+				"~ token token1: network net1, secret changed",
+				"+ token token2: network net1",
+			},
+		},
+		{
+			name: "static ips",
+			edit: func(spec *Spec) {
+				spec.Networks[0].StaticIPs = map[string]string{"peerA": "10.8.0.10", "peerC": "10.8.0.11"}
+			},
+			want: []string{
+				"- static ip peerB: 10.8.0.3/32 is no longer reserved",
+				"~ static ip peerA: 10.8.0.2/32 -> 10.8.0.10/32, the server must update its own interface address",
+			},
+		},
+		{
+			name:    "network with peers removed",
+			edit:    func(spec *Spec) { spec.Networks = nil; spec.Forwards = nil; spec.PortForwards = nil },
+			wantErr: "still has 2 peer(s)",
+		},
+		{
+			name:    "changed cidr",
+			edit:    func(spec *Spec) { spec.Networks[0].CIDR = "10.9.0.0/24" },
+			wantErr: "changing the CIDR of a network is not supported",
+		},
+		{
+			name:    "forward declared twice",
+			edit:    func(spec *Spec) { spec.Forwards = append(spec.Forwards, spec.Forwards[0]) },
+			wantErr: "declared twice",
+		},
+		{
+			name:    "forward without targets",
+			edit:    func(spec *Spec) { spec.Forwards[0].Server = ""; spec.Forwards[0].Port = 0 },
+			wantErr: "needs a server and port, targets or routes",
+		},
+		{
+			name:    "forward to an unknown peer",
+			edit:    func(spec *Spec) { spec.Forwards[0].Server = "peerC" },
+			wantErr: "invalid targets of forward app.example.com",
+		},
+		{
+			name:    "invalid domain",
+			edit:    func(spec *Spec) { spec.Forwards[0].Domain = "app_example.com" },
+			wantErr: "invalid forward",
+		},
+		{
+			name: "port forward on the WireGuard port",
+			edit: func(spec *Spec) {
+				spec.PortForwards[0] = PortForward{Protocol: "udp", PublicPort: 51820, Server: "peerA", Port: 51820}
+			},
+			wantErr: "WireGuard port of network net1",
+		},
+		{
+			name:    "port forward on the API port",
+			edit:    func(spec *Spec) { spec.PortForwards[0].PublicPort = 8080 },
+			wantErr: "used by the upduck API",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connectionsConfig := testTower()
+			spec := Export(connectionsConfig)
+			tt.edit(spec)
+
+			result, err := Apply(connectionsConfig, spec, Options{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var changes []string
+			for _, change := range result.Changes {
+				changes = append(changes, change.String())
+			}
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(changes, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			// the state reached matches the spec, applying it again is a no-op
+			again, err := Apply(connectionsConfig, spec, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(again.Changes) != 0 {
+				t.Errorf("applying the spec again changed %v", again.Changes)
+			}
+		})
+	}
+}
+
+func TestApplyCreatesNetworks(t *testing.T) {
+	connectionsConfig := testTower()
+	spec := Export(connectionsConfig)
+	spec.Networks = append(spec.Networks, Network{
+		Name:   "lab",
+		CIDR:   "10.9.0.0/24",
+		Tokens: []Token{{ID: "token2", MaxUses: 1}},
+	})
+
+	result, err := Apply(connectionsConfig, spec, Options{PortRange: "51820-51830"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(connectionsConfig.Networks) != 2 {
+		t.Fatalf("networks = %+v, want 2", connectionsConfig.Networks)
+	}
+	created := connectionsConfig.Networks[1]
+
+	want := []string{
+		"+ network lab (" + created.ID + "): 10.9.0.0/24, interface " + created.Interface + ", port 51821",
+		"+ token token2: network " + created.ID + ", max uses 1",
+	}
+	var changes []string
+	for _, change := range result.Changes {
+		changes = append(changes, change.String())
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+
+	if len(result.Tokens) != 1 || result.Tokens[0].TokenID != "token2" || result.Tokens[0].Secret == "" {
+		t.Errorf("created tokens = %+v, want a secret for token2", result.Tokens)
+	}
+}
+
+func TestApplyRemovesNetworks(t *testing.T) {
+	connectionsConfig := testTower()
+	connectionsConfig.Networks = append(connectionsConfig.Networks, types.Network{ID: "net2", Address: "10.9.0.0/24", Peers: []types.Peer{}})
+	connectionsConfig.JoinTokens = append(connectionsConfig.JoinTokens, types.JoinToken{ID: "token2", NetworkID: "net2"})
+
+	spec := Export(connectionsConfig)
+	spec.Networks = spec.Networks[:1]
+
+	result, err := Apply(connectionsConfig, spec, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Changes) != 1 || result.Changes[0].String() != "- network net2: 10.9.0.0/24" {
+		t.Errorf("changes = %v, want the removal of net2", result.Changes)
+	}
+	if len(result.RemovedNetworks) != 1 || result.RemovedNetworks[0].ID != "net2" {
+		t.Errorf("removed networks = %+v, want net2", result.RemovedNetworks)
+	}
+	if len(connectionsConfig.JoinTokens) != 1 || connectionsConfig.JoinTokens[0].ID != "token1" {
+		t.Errorf("join tokens = %+v, want the ones of net1", connectionsConfig.JoinTokens)
+	}
+}
+
+func TestApplyForceRevokesPeers(t *testing.T) {
+	connectionsConfig := testTower()
+	spec := &Spec{Version: Version}
+
+	result, err := Apply(connectionsConfig, spec, Options{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"- network home (net1): 10.8.0.0/24, 2 peer(s) revoked",
+		"- forward app.example.com: peerA:3000 (tls)",
+		"- port forward tcp/2222: peerA:22",
+	}
+	var changes []string
+	for _, change := range result.Changes {
+		changes = append(changes, change.String())
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+
+	if len(connectionsConfig.Networks) != 0 || len(connectionsConfig.Authorizations) != 0 || len(connectionsConfig.JoinTokens) != 0 {
+		t.Errorf("state of the removed network left: %+v", connectionsConfig)
+	}
+}
+
+func TestApplyKeepsPasswords(t *testing.T) {
+	connectionsConfig := testTower()
+	spec := Export(connectionsConfig)
+	spec.Forwards[0].Auth = &Auth{Users: []AuthUser{{Name: "alice"}}}
+
+	result, err := Apply(connectionsConfig, spec, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Passwords) != 1 || result.Passwords[0].User != "alice" || result.Passwords[0].Password == "" {
+		t.Fatalf("created passwords = %+v, want one for alice", result.Passwords)
+	}
+
+	before, _ := json.Marshal(connectionsConfig.Forwards)
+
+	// a user declared without a hash keeps the password it was given
+	result, err = Apply(connectionsConfig, spec, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 0 || len(result.Passwords) != 0 {
+		t.Errorf("applying again changed %v and created passwords %+v", result.Changes, result.Passwords)
+	}
+
+	if after, _ := json.Marshal(connectionsConfig.Forwards); string(after) != string(before) {
+		t.Errorf("forwards changed:\n%s\n%s", before, after)
+	}
+}
+
+func TestApplyPortForwardsOnBoundPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	boundPort := listener.Addr().(*net.TCPAddr).Port
+
+	// a port bound by another service is refused
+	connectionsConfig := testTower()
+	spec := Export(connectionsConfig)
+	spec.PortForwards = append(spec.PortForwards, PortForward{PublicPort: boundPort, Server: "peerB", Port: 22})
+
+	if _, err := Apply(connectionsConfig, spec, Options{}); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("expected the bound port to be refused, got %v", err)
+	}
+
+	// the port of a forward that exists already is bound by its own stream
+	connectionsConfig = testTower()
+	connectionsConfig.PortForwards[0].PublicPort = boundPort
+	spec = Export(connectionsConfig)
+	spec.PortForwards[0].Server = "peerB"
+
+	result, err := Apply(connectionsConfig, spec, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Action != ActionUpdate {
+		t.Errorf("changes = %v, want the update of the port forward", result.Changes)
+	}
+}
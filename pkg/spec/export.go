@@ -0,0 +1,133 @@
+package spec
+
+import (
+	"net"
+
+	"github.com/duck-labs/upduck/pkg/dns"
+	"github.com/duck-labs/upduck/pkg/types"
+)
+
+// Export describes the current tower state as a spec. Applying the result
+// to the same tower changes nothing.
+func Export(connectionsConfig *types.ConnectionsConfig) *Spec {
+	spec := &Spec{
+		Version:  Version,
+		Networks: []Network{},
+	}
+
+	for _, netw := range connectionsConfig.Networks {
+		specNetwork := Network{
+			ID:   netw.ID,
+			Name: netw.Name,
+			CIDR: netw.Address,
+		}
+
+		for _, lease := range netw.Leases {
+			if !lease.Static {
+				continue
+			}
+
+			ip, _, err := net.ParseCIDR(lease.Address)
+			if err != nil {
+				continue
+			}
+
+			if specNetwork.StaticIPs == nil {
+				specNetwork.StaticIPs = make(map[string]string)
+			}
+			specNetwork.StaticIPs[lease.PeerID] = ip.String()
+		}
+
+		for _, authorization := range connectionsConfig.Authorizations {
+			if authorization.NetworkID != netw.ID {
+				continue
+			}
+
+			specNetwork.AllowedKeys = append(specNetwork.AllowedKeys, AllowedKey{
+				Digest:   authorization.KeyDigest,
+				MaxPeers: authorization.MaxPeers,
+				Expires:  authorization.ExpiresAt,
+			})
+		}
+
+		for _, token := range connectionsConfig.JoinTokens {
+			if token.NetworkID != netw.ID {
+				continue
+			}
+
+			specNetwork.Tokens = append(specNetwork.Tokens, Token{
+				ID:         token.ID,
+				SecretHash: token.SecretHash,
+				MaxUses:    token.MaxUses,
+				Expires:    token.ExpiresAt,
+			})
+		}
+
+		spec.Networks = append(spec.Networks, specNetwork)
+	}
+
+	for _, forward := range connectionsConfig.Forwards {
+		specForward := Forward{
+			Domain:      forward.Domain,
+			TLS:         forward.TLS,
+			HSTS:        forward.HSTS,
+			Passthrough: forward.Passthrough,
+		}
+
+		for _, route := range forward.Routes {
+			specRoute := Route{
+				Path:           route.Path,
+				Strategy:       route.Strategy,
+				StripPrefix:    route.StripPrefix,
+				Headers:        route.Headers,
+				MaxBodySize:    route.MaxBodySize,
+				ConnectTimeout: route.ConnectTimeout,
+				Timeout:        route.Timeout,
+			}
+
+			if len(route.Targets) == 1 {
+				specRoute.Server = dns.Server(&route.Targets[0])
+				specRoute.Port = route.Targets[0].Port
+			} else {
+				specRoute.Targets = dns.Targets(route.Targets)
+			}
+
+			// the / route is declared on the forward itself unless it has
+			// options, as forwards to a single path always were
+			if route.Path == "/" && len(dns.RouteOptions(&route)) == 0 {
+				specForward.Server = specRoute.Server
+				specForward.Port = specRoute.Port
+				specForward.Targets = specRoute.Targets
+				specForward.Strategy = specRoute.Strategy
+				continue
+			}
+
+			specForward.Routes = append(specForward.Routes, specRoute)
+		}
+
+		if auth := forward.Auth; auth != nil {
+			specForward.Auth = &Auth{
+				Allow:       auth.Allow,
+				Deny:        auth.Deny,
+				ForwardAuth: auth.ForwardAuthURL,
+				SignIn:      auth.SignInURL,
+			}
+			for _, user := range auth.Users {
+				specForward.Auth.Users = append(specForward.Auth.Users, AuthUser{Name: user.Name, PasswordHash: user.PasswordHash})
+			}
+		}
+
+		spec.Forwards = append(spec.Forwards, specForward)
+	}
+
+	for _, forward := range connectionsConfig.PortForwards {
+		spec.PortForwards = append(spec.PortForwards, PortForward{
+			Protocol:   forward.Protocol,
+			PublicPort: forward.PublicPort,
+			Server:     dns.Server(&forward.Target),
+			Port:       forward.Target.Port,
+		})
+	}
+
+	return spec
+}
@@ -0,0 +1,149 @@
+package spec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the current version of the spec format.
+const Version = 1
+
+// Spec is the declarative description of a tower, as written by
+// 'upduck export' and read by 'upduck apply'.
+type Spec struct {
+	Version int `yaml:"version"`
+	// Address is the tower API address embedded in the join tokens created
+	// by apply. It is only required when the spec declares new tokens
+	// without a secret hash.
+	Address      string        `yaml:"address,omitempty"`
+	Networks     []Network     `yaml:"networks"`
+	Forwards     []Forward     `yaml:"forwards,omitempty"`
+	PortForwards []PortForward `yaml:"port_forwards,omitempty"`
+}
+
+// Network is matched against the tower networks by ID, then by name and
+// then by CIDR, so the same spec can be applied to several towers.
+type Network struct {
+	ID   string `yaml:"id,omitempty"`
+	Name string `yaml:"name,omitempty"`
+	CIDR string `yaml:"cidr"`
+	// StaticIPs maps peer IDs to the address reserved for them.
+	StaticIPs   map[string]string `yaml:"static_ips,omitempty"`
+	AllowedKeys []AllowedKey      `yaml:"allowed_keys,omitempty"`
+	Tokens      []Token           `yaml:"tokens,omitempty"`
+}
+
+type AllowedKey struct {
+	Digest   string    `yaml:"digest"`
+	MaxPeers int       `yaml:"max_peers,omitempty"`
+	Expires  time.Time `yaml:"expires,omitempty"`
+}
+
+// Token is a join token of the network. Tokens declared without a secret
+// hash get a new secret when created, printed once by apply.
+type Token struct {
+	ID         string    `yaml:"id"`
+	SecretHash string    `yaml:"secret_hash,omitempty"`
+	MaxUses    int       `yaml:"max_uses,omitempty"`
+	Expires    time.Time `yaml:"expires,omitempty"`
+}
+
+// Forward is a DNS forward of the / path to a single Server, either a peer ID
+// or an IP address, and Port, or balanced across Targets given as
+// "server:port". Routes send other paths to other targets, or the / path
+// when it needs options.
+type Forward struct {
+	Domain      string   `yaml:"domain"`
+	Server      string   `yaml:"server,omitempty"`
+	Port        int      `yaml:"port,omitempty"`
+	Targets     []string `yaml:"targets,omitempty"`
+	Strategy    string   `yaml:"strategy,omitempty"`
+	Routes      []Route  `yaml:"routes,omitempty"`
+	Auth        *Auth    `yaml:"auth,omitempty"`
+	TLS         bool     `yaml:"tls,omitempty"`
+	HSTS        bool     `yaml:"hsts,omitempty"`
+	Passthrough bool     `yaml:"passthrough,omitempty"`
+}
+
+// Route sends the requests under Path to a single Server and Port, or across
+// Targets, like the forward does for the / path.
+type Route struct {
+	Path           string            `yaml:"path"`
+	Server         string            `yaml:"server,omitempty"`
+	Port           int               `yaml:"port,omitempty"`
+	Targets        []string          `yaml:"targets,omitempty"`
+	Strategy       string            `yaml:"strategy,omitempty"`
+	StripPrefix    bool              `yaml:"strip_prefix,omitempty"`
+	Headers        map[string]string `yaml:"headers,omitempty"`
+	MaxBodySize    string            `yaml:"max_body_size,omitempty"`
+	ConnectTimeout string            `yaml:"connect_timeout,omitempty"`
+	Timeout        string            `yaml:"timeout,omitempty"`
+}
+
+// Auth is the access policy of a forward. Users declared without a password
+// hash get a new password when created, printed once by apply.
+type Auth struct {
+	Allow       []string   `yaml:"allow,omitempty"`
+	Deny        []string   `yaml:"deny,omitempty"`
+	Users       []AuthUser `yaml:"users,omitempty"`
+	ForwardAuth string     `yaml:"forward_auth,omitempty"`
+	SignIn      string     `yaml:"signin,omitempty"`
+}
+
+type AuthUser struct {
+	Name         string `yaml:"name"`
+	PasswordHash string `yaml:"password_hash,omitempty"`
+}
+
+// PortForward forwards a TCP or UDP port of the tower, tcp when Protocol is
+// empty, to Port of Server, either a peer ID or an IP address.
+type PortForward struct {
+	Protocol   string `yaml:"protocol,omitempty"`
+	PublicPort int    `yaml:"public_port"`
+	Server     string `yaml:"server"`
+	Port       int    `yaml:"port"`
+}
+
+// Load reads a spec file, "-" reads it from stdin. Unknown fields are
+// refused so typos do not silently drop part of the spec.
+func Load(path string) (*Spec, error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+
+	var spec Spec
+	if err := decoder.Decode(&spec); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	if spec.Version > Version {
+		return nil, fmt.Errorf("%s has version %d, this upduck supports up to %d", path, spec.Version, Version)
+	}
+
+	return &spec, nil
+}
+
+// Write encodes the spec as YAML.
+func Write(w io.Writer, spec *Spec) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(spec); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,281 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Executor carries out the side effects commands have on the host: writing
+// files, running commands, managing services and changing the kernel state.
+// Read-only queries do not go through it.
+type Executor interface {
+	// Run runs a command that changes the host.
+	Run(name string, args ...string) error
+	// WriteFile atomically replaces the content of the file.
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// Remove removes the file, a missing file is not an error.
+	Remove(path string) error
+	Symlink(target string, path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// Service runs a systemctl action (start, stop, reload...) on a service.
+	Service(action string, service string) error
+	// Do performs a change without a command or file behind it, like a
+	// netlink call. The description completes "would ..." in dry runs.
+	Do(description string, action func() error) error
+}
+
+var (
+	executorMu sync.RWMutex
+	executor   Executor = hostExecutor{}
+)
+
+// SetDryRun makes every side effect going through the package functions
+// print what it would do to out instead of doing it.
+func SetDryRun(out io.Writer) {
+	executorMu.Lock()
+	defer executorMu.Unlock()
+
+	executor = &dryRunExecutor{out: out}
+}
+
+// DryRun reports whether side effects are only recorded.
+func DryRun() bool {
+	_, ok := currentExecutor().(*dryRunExecutor)
+	return ok
+}
+
+// DryRunChanges returns how many side effects were recorded by the dry run.
+func DryRunChanges() int {
+	if dryRun, ok := currentExecutor().(*dryRunExecutor); ok {
+		return dryRun.count()
+	}
+	return 0
+}
+
+// ShowChange prints the diff of a change made to state not stored in a plain
+// file, like the bolt state database, and counts it. It does nothing outside
+// of dry runs, where the change is persisted by the caller itself.
+func ShowChange(name string, before []byte, after []byte) {
+	if dryRun, ok := currentExecutor().(*dryRunExecutor); ok {
+		dryRun.showChange(name, before, after)
+	}
+}
+
+func currentExecutor() Executor {
+	executorMu.RLock()
+	defer executorMu.RUnlock()
+
+	return executor
+}
+
+func RunCommand(command string, args ...string) error {
+	return currentExecutor().Run(command, args...)
+}
+
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return currentExecutor().WriteFile(path, data, perm)
+}
+
+func RemoveFile(path string) error {
+	return currentExecutor().Remove(path)
+}
+
+func Symlink(target string, path string) error {
+	return currentExecutor().Symlink(target, path)
+}
+
+func MkdirAll(path string, perm os.FileMode) error {
+	return currentExecutor().MkdirAll(path, perm)
+}
+
+func Systemctl(action string, service string) error {
+	return currentExecutor().Service(action, service)
+}
+
+func Do(description string, action func() error) error {
+	return currentExecutor().Do(description, action)
+}
+
+type hostExecutor struct{}
+
+// Run runs the command and returns its output with the error when it fails,
+// since commands like "nginx -t" only explain the failure on stderr.
+func (hostExecutor) Run(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return fmt.Errorf("%v: %s", err, output)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// WriteFile writes data to a temporary file next to path, syncs it and
+// renames it over path, so the file is either the old or the new content.
+func (hostExecutor) WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+
+	return dirFile.Sync()
+}
+
+func (hostExecutor) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (hostExecutor) Symlink(target string, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (hostExecutor) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (e hostExecutor) Service(action string, service string) error {
+	return e.Run("systemctl", action, service)
+}
+
+func (hostExecutor) Do(description string, action func() error) error {
+	return action()
+}
+
+// dryRunExecutor prints the side effects instead of performing them. The
+// content of files not readable by everyone is not printed, they hold keys
+// and password hashes.
+type dryRunExecutor struct {
+	mu      sync.Mutex
+	out     io.Writer
+	changes int
+}
+
+func (e *dryRunExecutor) printf(format string, args ...interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.changes++
+	fmt.Fprintf(e.out, format, args...)
+}
+
+func (e *dryRunExecutor) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.changes
+}
+
+func (e *dryRunExecutor) Run(name string, args ...string) error {
+	e.printf("[dry-run] would run: %s\n", strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+func (e *dryRunExecutor) WriteFile(path string, data []byte, perm os.FileMode) error {
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	action := "create"
+	if err == nil {
+		action = "update"
+	}
+
+	if perm&0004 == 0 {
+		e.printf("[dry-run] would %s %s (%s, %d bytes, content hidden)\n", action, path, perm, len(data))
+		return nil
+	}
+
+	e.printf("[dry-run] would %s %s (%s):\n%s", action, path, perm, unifiedDiff(current, data))
+	return nil
+}
+
+func (e *dryRunExecutor) Remove(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	e.printf("[dry-run] would remove %s\n", path)
+	return nil
+}
+
+func (e *dryRunExecutor) Symlink(target string, path string) error {
+	e.printf("[dry-run] would link %s -> %s\n", path, target)
+	return nil
+}
+
+func (e *dryRunExecutor) MkdirAll(path string, perm os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	e.printf("[dry-run] would create directory %s\n", path)
+	return nil
+}
+
+func (e *dryRunExecutor) Service(action string, service string) error {
+	e.printf("[dry-run] would %s service %s\n", action, service)
+	return nil
+}
+
+func (e *dryRunExecutor) Do(description string, action func() error) error {
+	e.printf("[dry-run] would %s\n", description)
+	return nil
+}
+
+func (e *dryRunExecutor) showChange(name string, before []byte, after []byte) {
+	if bytes.Equal(before, after) {
+		return
+	}
+
+	e.printf("[dry-run] would update %s:\n%s", name, unifiedDiff(before, after))
+}
@@ -0,0 +1,37 @@
+package system
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRunWriteFileHidesContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		perm       os.FileMode
+		wantHidden bool
+	}{
+		{name: "owner only", perm: 0600, wantHidden: true},
+		{name: "group readable", perm: 0640, wantHidden: true},
+		{name: "world readable", perm: 0644, wantHidden: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			dryRun := &dryRunExecutor{out: &out}
+
+			path := filepath.Join(t.TempDir(), "file")
+			if err := dryRun.WriteFile(path, []byte("user:$6$secret\n"), tt.perm); err != nil {
+				t.Fatal(err)
+			}
+
+			if hidden := !strings.Contains(out.String(), "$6$secret"); hidden != tt.wantHidden {
+				t.Errorf("content hidden = %v, want %v:\n%s", hidden, tt.wantHidden, out.String())
+			}
+		})
+	}
+}
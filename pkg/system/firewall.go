@@ -0,0 +1,55 @@
+package system
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// EnsureIptablesRule appends the rule to the given chain unless an identical
+// rule is already present, so it can be called on every reload. It reports
+// whether the rule was added.
+func EnsureIptablesRule(chain string, rule ...string) (bool, error) {
+	if iptablesRuleExists(chain, rule...) {
+		return false, nil
+	}
+
+	if err := RunCommand("iptables", append([]string{"-A", chain}, rule...)...); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteIptablesRule removes the rule from the given chain if it is present.
+func DeleteIptablesRule(chain string, rule ...string) error {
+	if !iptablesRuleExists(chain, rule...) {
+		return nil
+	}
+
+	return RunCommand("iptables", append([]string{"-D", chain}, rule...)...)
+}
+
+// ListIptablesRules returns the rules of the given chain, without the leading
+// "-A <chain>", in the form accepted by EnsureIptablesRule and DeleteIptablesRule.
+func ListIptablesRules(chain string) ([][]string, error) {
+	output, err := exec.Command("iptables", "-S", chain).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iptables rules of %s: %v", chain, err)
+	}
+
+	var rules [][]string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || fields[1] != chain {
+			continue
+		}
+		rules = append(rules, fields[2:])
+	}
+
+	return rules, nil
+}
+
+func iptablesRuleExists(chain string, rule ...string) bool {
+	return exec.Command("iptables", append([]string{"-C", chain}, rule...)...).Run() == nil
+}
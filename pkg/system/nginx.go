@@ -0,0 +1,584 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	NginxSitesAvailableDir = "/etc/nginx/sites-available"
+	NginxSitesEnabledDir   = "/etc/nginx/sites-enabled"
+	// NginxAuthDir holds the basic auth password files of the sites.
+	NginxAuthDir = "/etc/nginx/upduck-auth"
+)
+
+// nginxManagedMarker starts the sites generated from the upduck state, the
+// other sites are left alone.
+const nginxManagedMarker = "# managed by upduck, changes are overwritten"
+
+// nginxLegacySiteRegexp matches a site written by the versions of upduck that
+// did not keep the forwards in the state, exactly as their template wrote it.
+// Sites edited since, or written by hand, do not match.
+var nginxLegacySiteRegexp = regexp.MustCompile(`^map \$http_x_forwarded_proto \$forwarded_proto \{
+    default \$scheme;
+    "~\." \$http_x_forwarded_proto;
+\}
+server \{
+    server_name ([A-Za-z0-9.-]+);
+
+    location / \{
+        proxy_pass http://([0-9]{1,3}(?:\.[0-9]{1,3}){3}):([0-9]+);
+        proxy_set_header Host \$host;
+        proxy_set_header X-Real-IP \$remote_addr;
+        proxy_set_header X-Forwarded-For \$proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto \$forwarded_proto;;
+    \}
+\}\n?$`)
+
+// nginxMaxFails and nginxFailTimeout are the passive health check of the
+// upstream servers: a server failing nginxMaxFails requests within
+// nginxFailTimeout is left out for nginxFailTimeout.
+const (
+	nginxMaxFails    = 3
+	nginxFailTimeout = "30s"
+)
+
+var nginxSiteTemplate = template.Must(template.New("site").Parse(`{{.Marker}}
+map $http_x_forwarded_proto $forwarded_proto {
+    default $scheme;
+    "~." $http_x_forwarded_proto;
+}
+{{- range .Locations}}
+upstream {{.Upstream}} {
+{{- if .Balancing}}
+    {{.Balancing}};
+{{- end}}
+{{- range .Servers}}
+    server {{.Address}} max_fails={{$.MaxFails}} fail_timeout={{$.FailTimeout}}{{if .Down}} down{{end}};
+{{- end}}
+}
+{{- end}}
+server {
+    server_name {{.Domain}};
+{{- if .ChallengeDir}}
+
+    location ^~ /.well-known/acme-challenge/ {
+        root {{.ChallengeDir}};
+        default_type text/plain;
+    }
+{{- end}}
+{{- if .TLS}}
+
+    location / {
+        return 301 https://$host$request_uri;
+    }
+}
+server {
+{{- if .TLS.BehindSNIRouter}}
+    listen unix:{{.HTTPSSocket}} ssl proxy_protocol;
+    set_real_ip_from unix:;
+    real_ip_header proxy_protocol;
+{{- else}}
+    listen 443 ssl;
+{{- end}}
+    server_name {{.Domain}};
+
+    ssl_certificate {{.TLS.CertificateFile}};
+    ssl_certificate_key {{.TLS.KeyFile}};
+{{- if .TLS.HSTS}}
+    add_header Strict-Transport-Security "max-age=31536000" always;
+{{- end}}
+{{- end}}
+{{- with .Access}}
+{{- if or .Deny .Allow}}
+{{range .Deny}}
+    deny {{.}};
+{{- end}}
+{{- range .Allow}}
+    allow {{.}};
+{{- end}}
+{{- if .Allow}}
+    deny all;
+{{- end}}
+{{- end}}
+{{- if .Users}}
+
+    auth_basic "{{$.Domain}}";
+    auth_basic_user_file {{$.PasswordFile}};
+{{- end}}
+{{- if .ForwardAuthURL}}
+
+    auth_request /_upduck_auth;
+    auth_request_set $upduck_auth_user $upstream_http_x_auth_request_user;
+    auth_request_set $upduck_auth_email $upstream_http_x_auth_request_email;
+{{- if .SignInURL}}
+    error_page 401 = @upduck_sign_in;
+{{- end}}
+
+    location = /_upduck_auth {
+        internal;
+        proxy_pass {{.ForwardAuthURL}};
+        proxy_pass_request_body off;
+        proxy_set_header Content-Length "";
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Original-URL $forwarded_proto://$host$request_uri;
+        proxy_set_header X-Original-Method $request_method;
+        proxy_set_header X-Forwarded-Proto $forwarded_proto;
+        proxy_set_header X-Forwarded-Host $host;
+        proxy_set_header X-Forwarded-Uri $request_uri;
+        proxy_set_header X-Forwarded-Method $request_method;
+    }
+{{- if .SignInURL}}
+
+    location @upduck_sign_in {
+        return 302 {{$.SignInRedirect}};
+    }
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if not .HasRoot}}
+
+    location / {
+        return 404;
+    }
+{{- end}}
+{{- range .Locations}}
+{{- if eq .Path "/"}}
+
+    location / {
+{{- template "proxy" .}}
+    }
+{{- else}}
+
+    location = {{.Path}} {
+{{- template "proxy" .}}
+    }
+
+    location {{.Path}}/ {
+{{- template "proxy" .}}
+    }
+{{- end}}
+{{- end}}
+}
+{{- define "proxy"}}
+        proxy_pass http://{{.Upstream}}{{if .StripPrefix}}/{{end}};
+        proxy_next_upstream error timeout http_502 http_503 http_504;
+        proxy_connect_timeout {{.ConnectTimeout}};
+{{- if .Timeout}}
+        proxy_read_timeout {{.Timeout}};
+        proxy_send_timeout {{.Timeout}};
+{{- end}}
+{{- if .MaxBodySize}}
+        client_max_body_size {{.MaxBodySize}};
+{{- end}}
+{{- range .Headers}}
+        proxy_set_header {{.Name}} {{.Value}};
+{{- end}}
+{{- end}}
+`))
+
+// nginxDefaultHeaders are set on the requests sent to the upstreams, unless
+// a location sets them itself.
+var nginxDefaultHeaders = []NginxHeader{
+	{Name: "Host", Value: "$host"},
+	{Name: "X-Real-IP", Value: "$remote_addr"},
+	{Name: "X-Forwarded-For", Value: "$proxy_add_x_forwarded_for"},
+	{Name: "X-Forwarded-Proto", Value: "$forwarded_proto"},
+}
+
+// nginxForwardAuthHeaders pass the user the forward auth service let in to
+// the upstreams, as oauth2-proxy reports it.
+var nginxForwardAuthHeaders = []NginxHeader{
+	{Name: "X-Auth-Request-User", Value: "$upduck_auth_user"},
+	{Name: "X-Auth-Request-Email", Value: "$upduck_auth_email"},
+}
+
+const nginxDefaultConnectTimeout = "5s"
+
+type NginxForward struct {
+	Domain   string
+	ServerIP string
+	Port     string
+}
+
+// NginxSite is the site generated for a forwarded domain, all its locations
+// are served by one server block. Requests matching none of them get a 404.
+type NginxSite struct {
+	Domain    string
+	Locations []NginxLocation
+	// ChallengeDir is served under /.well-known/acme-challenge/ over HTTP,
+	// for the ACME HTTP-01 challenges.
+	ChallengeDir string
+	// TLS serves the domain over HTTPS, HTTP is redirected to it.
+	TLS *NginxTLS
+	// Access restricts who reaches the locations, over HTTPS when there is
+	// TLS: the HTTP redirect and the ACME challenges stay open.
+	Access *NginxAccess
+}
+
+// NginxAccess restricts who reaches the locations of a site, a request must
+// pass every check. Deny is checked before Allow, and a non-empty Allow
+// refuses the other clients.
+type NginxAccess struct {
+	Allow []string
+	Deny  []string
+	// Users are the lines of the basic auth password file, "name:hash".
+	Users []string
+	// ForwardAuthURL is asked about every request through auth_request, a 401
+	// redirects to SignInURL when set, with the original URL as rd.
+	ForwardAuthURL string
+	SignInURL      string
+}
+
+// NginxLocation proxies the requests under a path to its upstream servers.
+// A path other than / matches itself and what is below it, not its siblings
+// sharing a prefix: /api matches /api/users but not /apis.
+type NginxLocation struct {
+	Path    string
+	Servers []NginxUpstreamServer
+	// Balancing is the load balancing directive of the upstream, like
+	// least_conn, round robin when empty.
+	Balancing string
+	// StripPrefix removes the path from the requests sent upstream.
+	StripPrefix bool
+	// Headers replace the default headers of the same name, an empty value
+	// removes the header.
+	Headers     []NginxHeader
+	MaxBodySize string
+	// ConnectTimeout defaults to 5s, Timeout applies to reading the response
+	// and sending the request.
+	ConnectTimeout string
+	Timeout        string
+}
+
+type NginxHeader struct {
+	Name  string
+	Value string
+}
+
+// NginxUpstreamServer is a server the traffic of a site is balanced across.
+// Down servers are kept in the upstream but get no traffic.
+type NginxUpstreamServer struct {
+	Address string
+	Down    bool
+}
+
+type NginxTLS struct {
+	CertificateFile string
+	KeyFile         string
+	HSTS            bool
+	// BehindSNIRouter listens on NginxHTTPSSocket instead of port 443, which
+	// the SNI router owns while there are passthrough forwards.
+	BehindSNIRouter bool
+}
+
+// CreateNginxConfig writes and enables the site forwarding a domain, replacing
+// any previous site of the domain. It reports whether anything changed.
+func CreateNginxConfig(tx *Transaction, site NginxSite) (bool, error) {
+	content, err := renderNginxSite(site)
+	if err != nil {
+		return false, err
+	}
+
+	passwordsChanged, err := writeNginxPasswordFile(tx, site)
+	if err != nil {
+		return false, err
+	}
+
+	configPath := filepath.Join(NginxSitesAvailableDir, site.Domain)
+	enabledPath := filepath.Join(NginxSitesEnabledDir, site.Domain)
+
+	current, err := os.ReadFile(configPath)
+	if err == nil && bytes.Equal(current, content) {
+		if target, err := os.Readlink(enabledPath); err == nil && target == configPath {
+			return passwordsChanged, nil
+		}
+	}
+
+	if err := tx.WriteFile(configPath, content, 0644); err != nil {
+		return false, err
+	}
+
+	if err := tx.Symlink(configPath, enabledPath); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// renderNginxSite returns the content of the site.
+func renderNginxSite(site NginxSite) ([]byte, error) {
+	type location struct {
+		NginxLocation
+		Upstream string
+	}
+
+	data := struct {
+		NginxSite
+		Locations      []location
+		HasRoot        bool
+		Marker         string
+		MaxFails       int
+		FailTimeout    string
+		HTTPSSocket    string
+		PasswordFile   string
+		SignInRedirect string
+	}{site, nil, false, nginxManagedMarker, nginxMaxFails, nginxFailTimeout, NginxHTTPSSocket, nginxPasswordFile(site.Domain), ""}
+
+	defaultHeaders := nginxDefaultHeaders
+	if site.Access != nil && site.Access.ForwardAuthURL != "" {
+		defaultHeaders = append(slices.Clone(defaultHeaders), nginxForwardAuthHeaders...)
+
+		separator := "?"
+		if strings.Contains(site.Access.SignInURL, "?") {
+			separator = "&"
+		}
+		data.SignInRedirect = site.Access.SignInURL + separator + "rd=$forwarded_proto://$host$request_uri"
+	}
+
+	if len(site.Locations) == 0 {
+		return nil, fmt.Errorf("no locations for %s", site.Domain)
+	}
+
+	for i, l := range site.Locations {
+		if len(l.Servers) == 0 {
+			return nil, fmt.Errorf("no upstream servers for %s%s", site.Domain, l.Path)
+		}
+
+		if l.ConnectTimeout == "" {
+			l.ConnectTimeout = nginxDefaultConnectTimeout
+		}
+		l.Headers = nginxHeaders(defaultHeaders, l.Headers)
+
+		data.Locations = append(data.Locations, location{l, nginxUpstreamName(site.Domain, i)})
+		data.HasRoot = data.HasRoot || l.Path == "/"
+	}
+
+	var content bytes.Buffer
+	err := nginxSiteTemplate.Execute(&content, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render Nginx site: %v", err)
+	}
+
+	return content.Bytes(), nil
+}
+
+// nginxUpstreamName returns the name of the upstream of a location of a
+// domain, unique across the sites since upstreams share the http context.
+func nginxUpstreamName(domain string, location int) string {
+	return fmt.Sprintf("upduck_%s_%d", nginxName(domain), location)
+}
+
+// nginxName returns the domain as part of an Nginx name, the * of wildcard
+// domains becoming _, which domains cannot hold.
+func nginxName(domain string) string {
+	return strings.ReplaceAll(domain, "*", "_")
+}
+
+// nginxPasswordFile returns the path of the basic auth password file of a
+// domain.
+func nginxPasswordFile(domain string) string {
+	return filepath.Join(NginxAuthDir, domain+".htpasswd")
+}
+
+// nginxGroups are the groups the Nginx workers run as, on Debian and on Red Hat
+// based distributions.
+var nginxGroups = []string{"www-data", "nginx"}
+
+// nginxWorkerGroup returns the gid of the group the Nginx workers run as, or
+// false when the host has none of the known groups.
+func nginxWorkerGroup() (int, bool) {
+	for _, name := range nginxGroups {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			continue
+		}
+		return gid, true
+	}
+	return 0, false
+}
+
+// writeNginxPasswordFile writes the basic auth password file of the site, or
+// removes it when the site has no users. Only the Nginx workers group may read
+// it, without a known group it stays readable by root only. It reports whether
+// anything changed.
+func writeNginxPasswordFile(tx *Transaction, site NginxSite) (bool, error) {
+	path := nginxPasswordFile(site.Domain)
+
+	if site.Access == nil || len(site.Access.Users) == 0 {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return false, nil
+		}
+		return true, tx.RemoveFile(path)
+	}
+
+	content := []byte(strings.Join(site.Access.Users, "\n") + "\n")
+
+	perm := os.FileMode(0600)
+	gid, hasGroup := nginxWorkerGroup()
+	if hasGroup {
+		perm = 0640
+	}
+
+	// files written world readable by earlier versions are rewritten
+	current, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(current, content) {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm() == perm {
+			return false, nil
+		}
+	}
+
+	if err := MkdirAll(NginxAuthDir, 0755); err != nil {
+		return false, err
+	}
+
+	if err := tx.WriteFile(path, content, perm); err != nil {
+		return false, err
+	}
+
+	if hasGroup {
+		err := Do(fmt.Sprintf("change the group of %s to %d", path, gid), func() error {
+			return os.Chown(path, -1, gid)
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// nginxHeaders returns the headers set by a location, the defaults it does
+// not replace followed by its own, with their values quoted when needed.
+func nginxHeaders(defaults []NginxHeader, headers []NginxHeader) []NginxHeader {
+	var merged []NginxHeader
+
+	for _, header := range defaults {
+		replaced := false
+		for _, custom := range headers {
+			replaced = replaced || strings.EqualFold(custom.Name, header.Name)
+		}
+		if !replaced {
+			merged = append(merged, header)
+		}
+	}
+
+	for _, header := range headers {
+		if header.Value == "" || strings.ContainsAny(header.Value, " \t;{}#'") {
+			header.Value = `"` + header.Value + `"`
+		}
+		merged = append(merged, header)
+	}
+
+	return merged
+}
+
+// ListManagedNginxSites returns the domains of the sites generated by upduck.
+func ListManagedNginxSites() ([]string, error) {
+	entries, err := os.ReadDir(NginxSitesAvailableDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var domains []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(NginxSitesAvailableDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(string(data), nginxManagedMarker) {
+			domains = append(domains, entry.Name())
+		}
+	}
+
+	return domains, nil
+}
+
+// ListNginxForwards returns the domain forwards of the Nginx sites written by
+// the versions of upduck that did not keep them in the state. Only the sites
+// matching their template and named after their server_name are returned,
+// the other sites are left alone.
+func ListNginxForwards() ([]NginxForward, error) {
+	entries, err := os.ReadDir(NginxSitesAvailableDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var forwards []NginxForward
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(NginxSitesAvailableDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		match := nginxLegacySiteRegexp.FindStringSubmatch(string(data))
+		if match == nil || match[1] != entry.Name() {
+			continue
+		}
+
+		forwards = append(forwards, NginxForward{
+			Domain:   match[1],
+			ServerIP: match[2],
+			Port:     match[3],
+		})
+	}
+
+	return forwards, nil
+}
+
+// RemoveNginxConfig removes the site config of a domain, its enabled symlink
+// and its password file.
+func RemoveNginxConfig(tx *Transaction, domain string) error {
+	if err := tx.RemoveFile(filepath.Join(NginxSitesEnabledDir, domain)); err != nil {
+		return err
+	}
+
+	if err := tx.RemoveFile(nginxPasswordFile(domain)); err != nil {
+		return err
+	}
+
+	return tx.RemoveFile(filepath.Join(NginxSitesAvailableDir, domain))
+}
+
+// ReloadNginx validates the nginx configuration and reloads the service. A
+// failed test leaves Nginx running on its previous configuration, rolling the
+// transaction back restores the sites it was loaded from.
+func ReloadNginx(tx *Transaction) error {
+	if err := RunCommand("nginx", "-t"); err != nil {
+		return fmt.Errorf("nginx configuration test failed: %w", err)
+	}
+
+	if err := tx.Systemctl("reload", "nginx"); err != nil {
+		return fmt.Errorf("failed to reload Nginx: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	NginxConfigFile = "/etc/nginx/nginx.conf"
+
+	// NginxStreamConfigFile holds the stream block including the streams,
+	// nginx.conf includes it while there are streams.
+	NginxStreamConfigFile = "/etc/nginx/upduck-stream.conf"
+	NginxStreamsDir       = "/etc/nginx/upduck-streams"
+
+	// NginxHTTPSSocket is where the HTTPS sites listen while the SNI router
+	// owns port 443, nginxPassthroughSocket the hop of the passthrough
+	// connections. Unix sockets cannot clash with the port forwards.
+	NginxHTTPSSocket       = "/run/upduck-nginx-https.sock"
+	nginxPassthroughSocket = "/run/upduck-nginx-passthrough.sock"
+
+	// NginxSNIRouterName is the stream name of the SNI router.
+	NginxSNIRouterName = "sni-443"
+)
+
+// nginxStreamInclude is the line added to nginx.conf, at the end of the file
+// so it lands in the main context where stream blocks are allowed.
+var nginxStreamInclude = fmt.Sprintf("include %s; %s", NginxStreamConfigFile, nginxManagedMarker)
+
+var nginxStreamConfig = fmt.Sprintf(`%s
+stream {
+    include %s/*.conf;
+}
+`, nginxManagedMarker, NginxStreamsDir)
+
+var nginxStreamTemplate = template.Must(template.New("stream").Parse(`{{.Marker}}
+server {
+    listen {{.ListenPort}}{{if eq .Protocol "udp"}} udp{{end}};
+    proxy_pass {{.Address}};
+{{- if eq .Protocol "tcp"}}
+    proxy_connect_timeout 5s;
+    # idle connections, like SSH sessions, are kept for an hour
+    proxy_timeout 1h;
+{{- end}}
+}
+`))
+
+// nginxSNIRouterTemplate routes the TLS connections on port 443 by server
+// name without decrypting them. Both hops speak the PROXY protocol, so the
+// HTTPS sites and the passthrough hop still see the client address, but the
+// passthrough upstreams get the raw stream.
+var nginxSNIRouterTemplate = template.Must(template.New("sni").Parse(`{{.Marker}}
+map $ssl_preread_server_name $upduck_sni_route {
+    hostnames;
+{{- range .Routes}}
+    {{.Domain}} unix:{{$.PassthroughSocket}};
+{{- end}}
+    default unix:{{.HTTPSSocket}};
+}
+map $ssl_preread_server_name $upduck_sni_upstream {
+    hostnames;
+{{- range .Routes}}
+    {{.Domain}} {{.Upstream}};
+{{- end}}
+}
+{{- range .Routes}}
+upstream {{.Upstream}} {
+{{- if .Balancing}}
+    {{.Balancing}};
+{{- end}}
+{{- range .Servers}}
+    server {{.Address}} max_fails={{$.MaxFails}} fail_timeout={{$.FailTimeout}}{{if .Down}} down{{end}};
+{{- end}}
+}
+{{- end}}
+server {
+    listen 443;
+    ssl_preread on;
+    proxy_protocol on;
+    proxy_pass $upduck_sni_route;
+}
+server {
+    listen unix:{{.PassthroughSocket}} proxy_protocol;
+    ssl_preread on;
+    proxy_pass $upduck_sni_upstream;
+    proxy_connect_timeout 5s;
+    proxy_timeout 1h;
+}
+`))
+
+// NginxSNIRoute sends the TLS connections of a domain to its servers.
+type NginxSNIRoute struct {
+	Domain    string
+	Servers   []NginxUpstreamServer
+	Balancing string
+}
+
+// NginxStream is the stream server generated for a port forward.
+type NginxStream struct {
+	Protocol   string
+	ListenPort int
+	Address    string
+}
+
+// NginxStreamName returns the name of the stream server listening on the
+// port, the protocols have separate port spaces.
+func NginxStreamName(protocol string, port int) string {
+	return fmt.Sprintf("%s-%d", protocol, port)
+}
+
+// CreateNginxStream writes the stream server of a port forward, replacing any
+// previous one on the port. It reports whether anything changed.
+func CreateNginxStream(tx *Transaction, stream NginxStream) (bool, error) {
+	content, err := renderNginxStream(stream)
+	if err != nil {
+		return false, err
+	}
+
+	return writeNginxStream(tx, NginxStreamName(stream.Protocol, stream.ListenPort), content)
+}
+
+// renderNginxStream returns the content of the stream server.
+func renderNginxStream(stream NginxStream) ([]byte, error) {
+	var content bytes.Buffer
+	err := nginxStreamTemplate.Execute(&content, struct {
+		NginxStream
+		Marker string
+	}{stream, nginxManagedMarker})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render Nginx stream: %v", err)
+	}
+
+	return content.Bytes(), nil
+}
+
+// CreateNginxSNIRouter writes the stream server owning port 443 while there
+// are passthrough routes, the other server names go to the HTTPS sites
+// listening on NginxHTTPSSocket. It reports whether anything changed.
+func CreateNginxSNIRouter(tx *Transaction, routes []NginxSNIRoute) (bool, error) {
+	content, err := renderNginxSNIRouter(routes)
+	if err != nil {
+		return false, err
+	}
+
+	return writeNginxStream(tx, NginxSNIRouterName, content)
+}
+
+// renderNginxSNIRouter returns the content of the SNI router.
+func renderNginxSNIRouter(routes []NginxSNIRoute) ([]byte, error) {
+	type route struct {
+		NginxSNIRoute
+		Upstream string
+	}
+
+	data := struct {
+		Marker            string
+		Routes            []route
+		HTTPSSocket       string
+		PassthroughSocket string
+		MaxFails          int
+		FailTimeout       string
+	}{nginxManagedMarker, nil, NginxHTTPSSocket, nginxPassthroughSocket, nginxMaxFails, nginxFailTimeout}
+
+	for _, r := range routes {
+		if len(r.Servers) == 0 {
+			return nil, fmt.Errorf("no upstream servers for %s", r.Domain)
+		}
+		data.Routes = append(data.Routes, route{r, "upduck_sni_" + nginxName(r.Domain)})
+	}
+
+	var content bytes.Buffer
+	if err := nginxSNIRouterTemplate.Execute(&content, data); err != nil {
+		return nil, fmt.Errorf("failed to render Nginx SNI router: %v", err)
+	}
+
+	return content.Bytes(), nil
+}
+
+func writeNginxStream(tx *Transaction, name string, content []byte) (bool, error) {
+	configPath := filepath.Join(NginxStreamsDir, name+".conf")
+
+	current, err := os.ReadFile(configPath)
+	if err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+
+	if err := MkdirAll(NginxStreamsDir, 0755); err != nil {
+		return false, err
+	}
+
+	if err := tx.WriteFile(configPath, content, 0644); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ListManagedNginxStreams returns the names of the stream servers generated
+// by upduck.
+func ListManagedNginxStreams() ([]string, error) {
+	entries, err := os.ReadDir(NginxStreamsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".conf") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(NginxStreamsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(string(data), nginxManagedMarker) {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".conf"))
+		}
+	}
+
+	return names, nil
+}
+
+// RemoveNginxStream removes a stream server.
+func RemoveNginxStream(tx *Transaction, name string) error {
+	return tx.RemoveFile(filepath.Join(NginxStreamsDir, name+".conf"))
+}
+
+// EnableNginxStreams adds the stream block to the Nginx configuration, or
+// removes it when disabled. The block is only kept while there are streams:
+// it needs the stream module, which HTTP forwards can do without. It reports
+// whether anything changed.
+func EnableNginxStreams(tx *Transaction, enabled bool) (bool, error) {
+	data, err := os.ReadFile(NginxConfigFile)
+	if os.IsNotExist(err) && !enabled {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", NginxConfigFile, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	var kept []string
+	included := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == nginxStreamInclude {
+			included = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	changed := false
+
+	if enabled {
+		current, err := os.ReadFile(NginxStreamConfigFile)
+		if err != nil || string(current) != nginxStreamConfig {
+			if err := tx.WriteFile(NginxStreamConfigFile, []byte(nginxStreamConfig), 0644); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+
+		if !included {
+			kept = append(kept, nginxStreamInclude)
+			if err := tx.WriteFile(NginxConfigFile, []byte(strings.Join(kept, "\n")+"\n"), 0644); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+
+		return changed, nil
+	}
+
+	if included {
+		if err := tx.WriteFile(NginxConfigFile, []byte(strings.Join(kept, "\n")+"\n"), 0644); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	if _, err := os.Stat(NginxStreamConfigFile); err == nil {
+		if err := tx.RemoveFile(NginxStreamConfigFile); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,105 @@
+package system
+
+import "testing"
+
+func TestRenderNginxStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   NginxStream
+		contains []string
+		excludes []string
+	}{
+		{
+			name:   "tcp",
+			stream: NginxStream{Protocol: "tcp", ListenPort: 2222, Address: "10.8.0.2:22"},
+			contains: []string{
+				nginxManagedMarker + "\nserver {\n    listen 2222;\n    proxy_pass 10.8.0.2:22;\n",
+				"    proxy_connect_timeout 5s;\n",
+				"    proxy_timeout 1h;\n",
+			},
+			excludes: []string{"udp"},
+		},
+		{
+			name:     "udp",
+			stream:   NginxStream{Protocol: "udp", ListenPort: 51820, Address: "10.8.0.3:51820"},
+			contains: []string{"    listen 51820 udp;\n    proxy_pass 10.8.0.3:51820;\n}"},
+			excludes: []string{"proxy_connect_timeout", "proxy_timeout"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := renderNginxStream(tt.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRendered(t, string(content), tt.contains, tt.excludes)
+		})
+	}
+}
+
+func TestNginxStreamName(t *testing.T) {
+	if name := NginxStreamName("udp", 53); name != "udp-53" {
+		t.Errorf("NginxStreamName = %s, want udp-53", name)
+	}
+}
+
+func TestRenderNginxSNIRouter(t *testing.T) {
+	tests := []struct {
+		name     string
+		routes   []NginxSNIRoute
+		contains []string
+		excludes []string
+	}{
+		{
+			name:   "one route",
+			routes: []NginxSNIRoute{{Domain: "app.example.com", Servers: []NginxUpstreamServer{{Address: "10.8.0.2:443"}}}},
+			contains: []string{
+				nginxManagedMarker + "\nmap $ssl_preread_server_name $upduck_sni_route {\n    hostnames;\n" +
+					"    app.example.com unix:" + nginxPassthroughSocket + ";\n" +
+					"    default unix:" + NginxHTTPSSocket + ";\n}",
+				"map $ssl_preread_server_name $upduck_sni_upstream {\n    hostnames;\n    app.example.com upduck_sni_app.example.com;\n}",
+				"upstream upduck_sni_app.example.com {\n    server 10.8.0.2:443 max_fails=3 fail_timeout=30s;\n}",
+				"server {\n    listen 443;\n    ssl_preread on;\n    proxy_protocol on;\n    proxy_pass $upduck_sni_route;\n}",
+				"    listen unix:" + nginxPassthroughSocket + " proxy_protocol;\n    ssl_preread on;\n    proxy_pass $upduck_sni_upstream;\n",
+			},
+		},
+		{
+			name: "balanced routes",
+			routes: []NginxSNIRoute{
+				{
+					Domain:    "app.example.com",
+					Balancing: "hash $proxy_protocol_addr consistent",
+					Servers:   []NginxUpstreamServer{{Address: "10.8.0.2:443"}, {Address: "10.8.0.3:443", Down: true}},
+				},
+				{Domain: "*.example.org", Servers: []NginxUpstreamServer{{Address: "10.8.0.3:8443"}}},
+			},
+			contains: []string{
+				"    app.example.com unix:" + nginxPassthroughSocket + ";\n    *.example.org unix:" + nginxPassthroughSocket + ";\n",
+				"    *.example.org upduck_sni__.example.org;\n",
+				"upstream upduck_sni_app.example.com {\n    hash $proxy_protocol_addr consistent;\n" +
+					"    server 10.8.0.2:443 max_fails=3 fail_timeout=30s;\n" +
+					"    server 10.8.0.3:443 max_fails=3 fail_timeout=30s down;\n}",
+				"upstream upduck_sni__.example.org {\n    server 10.8.0.3:8443 max_fails=3 fail_timeout=30s;\n}",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := renderNginxSNIRouter(tt.routes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRendered(t, string(content), tt.contains, tt.excludes)
+		})
+	}
+}
+
+func TestRenderNginxSNIRouterErrors(t *testing.T) {
+	if _, err := renderNginxSNIRouter([]NginxSNIRoute{{Domain: "app.example.com"}}); err == nil {
+		t.Error("expected an error for a route without servers")
+	}
+}
@@ -0,0 +1,311 @@
+package system
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rootLocation is a location of / with a single server, the smallest site.
+var rootLocation = NginxLocation{Path: "/", Servers: []NginxUpstreamServer{{Address: "10.8.0.2:3000"}}}
+
+func TestRenderNginxSite(t *testing.T) {
+	tests := []struct {
+		name     string
+		site     NginxSite
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "http forward",
+			site: NginxSite{Domain: "app.example.com", Locations: []NginxLocation{rootLocation}},
+			contains: []string{
+				nginxManagedMarker + "\n",
+				"upstream upduck_app.example.com_0 {\n    server 10.8.0.2:3000 max_fails=3 fail_timeout=30s;\n}",
+				"    server_name app.example.com;\n",
+				"    location / {\n        proxy_pass http://upduck_app.example.com_0;\n",
+				"        proxy_connect_timeout 5s;\n",
+				"        proxy_set_header Host $host;\n",
+				"        proxy_set_header X-Forwarded-Proto $forwarded_proto;\n",
+			},
+			excludes: []string{"listen 443", "acme-challenge", "return 404", "return 301"},
+		},
+		{
+			name: "tls waiting for its certificate",
+			site: NginxSite{
+				Domain:       "app.example.com",
+				Locations:    []NginxLocation{rootLocation},
+				ChallengeDir: "/var/lib/upduck/acme",
+			},
+			contains: []string{
+				"    location ^~ /.well-known/acme-challenge/ {\n        root /var/lib/upduck/acme;\n",
+				"    location / {\n        proxy_pass http://upduck_app.example.com_0;\n",
+			},
+			excludes: []string{"listen 443", "return 301"},
+		},
+		{
+			name: "tls",
+			site: NginxSite{
+				Domain:       "app.example.com",
+				Locations:    []NginxLocation{rootLocation},
+				ChallengeDir: "/var/lib/upduck/acme",
+				TLS: &NginxTLS{
+					CertificateFile: "/etc/upduck/certs/app.example.com/fullchain.pem",
+					KeyFile:         "/etc/upduck/certs/app.example.com/privkey.pem",
+				},
+			},
+			contains: []string{
+				"    location ^~ /.well-known/acme-challenge/ {\n",
+				"    location / {\n        return 301 https://$host$request_uri;\n    }\n}\nserver {\n    listen 443 ssl;\n",
+				"    ssl_certificate /etc/upduck/certs/app.example.com/fullchain.pem;\n",
+				"    ssl_certificate_key /etc/upduck/certs/app.example.com/privkey.pem;\n",
+				"    location / {\n        proxy_pass http://upduck_app.example.com_0;\n",
+			},
+			excludes: []string{"Strict-Transport-Security", "proxy_protocol"},
+		},
+		{
+			name: "tls with hsts behind the sni router",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				TLS:       &NginxTLS{CertificateFile: "cert.pem", KeyFile: "key.pem", HSTS: true, BehindSNIRouter: true},
+			},
+			contains: []string{
+				"    listen unix:" + NginxHTTPSSocket + " ssl proxy_protocol;\n    set_real_ip_from unix:;\n    real_ip_header proxy_protocol;\n",
+				"    add_header Strict-Transport-Security \"max-age=31536000\" always;\n",
+			},
+			excludes: []string{"listen 443"},
+		},
+		{
+			name: "balanced targets",
+			site: NginxSite{Domain: "app.example.com", Locations: []NginxLocation{{
+				Path:      "/",
+				Balancing: "least_conn",
+				Servers: []NginxUpstreamServer{
+					{Address: "10.8.0.2:3000"},
+					{Address: "10.8.0.3:3000", Down: true},
+				},
+			}}},
+			contains: []string{
+				"upstream upduck_app.example.com_0 {\n    least_conn;\n" +
+					"    server 10.8.0.2:3000 max_fails=3 fail_timeout=30s;\n" +
+					"    server 10.8.0.3:3000 max_fails=3 fail_timeout=30s down;\n}",
+				"        proxy_next_upstream error timeout http_502 http_503 http_504;\n",
+			},
+		},
+		{
+			name:     "round robin",
+			site:     NginxSite{Domain: "app.example.com", Locations: []NginxLocation{rootLocation}},
+			contains: []string{"upstream upduck_app.example.com_0 {\n    server "},
+		},
+		{
+			name: "path routes without a root",
+			site: NginxSite{Domain: "app.example.com", Locations: []NginxLocation{
+				{Path: "/api", Servers: []NginxUpstreamServer{{Address: "10.8.0.2:3000"}}},
+				{Path: "/web", Servers: []NginxUpstreamServer{{Address: "10.8.0.3:8080"}}, StripPrefix: true},
+			}},
+			contains: []string{
+				"upstream upduck_app.example.com_0 {\n    server 10.8.0.2:3000 ",
+				"upstream upduck_app.example.com_1 {\n    server 10.8.0.3:8080 ",
+				"    location / {\n        return 404;\n    }",
+				"    location = /api {\n        proxy_pass http://upduck_app.example.com_0;\n",
+				"    location /api/ {\n        proxy_pass http://upduck_app.example.com_0;\n",
+				"    location = /web {\n        proxy_pass http://upduck_app.example.com_1/;\n",
+				"    location /web/ {\n        proxy_pass http://upduck_app.example.com_1/;\n",
+			},
+			excludes: []string{"location /api {", "location /web {"},
+		},
+		{
+			name: "route options",
+			site: NginxSite{Domain: "app.example.com", Locations: []NginxLocation{{
+				Path:    "/",
+				Servers: []NginxUpstreamServer{{Address: "10.8.0.2:3000"}},
+				Headers: []NginxHeader{
+					{Name: "Host", Value: "internal.example.com"},
+					{Name: "X-Forwarded-For", Value: ""},
+					{Name: "X-Env", Value: "prod; staging"},
+				},
+				MaxBodySize:    "10m",
+				ConnectTimeout: "2s",
+				Timeout:        "1h",
+			}}},
+			contains: []string{
+				"        proxy_connect_timeout 2s;\n" +
+					"        proxy_read_timeout 1h;\n" +
+					"        proxy_send_timeout 1h;\n" +
+					"        client_max_body_size 10m;\n",
+				"        proxy_set_header X-Real-IP $remote_addr;\n" +
+					"        proxy_set_header X-Forwarded-Proto $forwarded_proto;\n" +
+					"        proxy_set_header Host internal.example.com;\n" +
+					"        proxy_set_header X-Forwarded-For \"\";\n" +
+					"        proxy_set_header X-Env \"prod; staging\";\n",
+			},
+			excludes: []string{"proxy_connect_timeout 5s", "Host $host", "$proxy_add_x_forwarded_for", "return 404"},
+		},
+		{
+			name: "address lists",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				Access:    &NginxAccess{Allow: []string{"10.0.0.0/8", "192.168.1.10"}, Deny: []string{"10.0.0.5"}},
+			},
+			contains: []string{"    server_name app.example.com;\n\n    deny 10.0.0.5;\n    allow 10.0.0.0/8;\n    allow 192.168.1.10;\n    deny all;\n"},
+			excludes: []string{"auth_basic", "auth_request"},
+		},
+		{
+			name: "deny list only",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				Access:    &NginxAccess{Deny: []string{"10.0.0.5"}},
+			},
+			contains: []string{"    deny 10.0.0.5;\n"},
+			excludes: []string{"allow", "deny all"},
+		},
+		{
+			name: "basic auth over tls",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				TLS:       &NginxTLS{CertificateFile: "cert.pem", KeyFile: "key.pem"},
+				Access:    &NginxAccess{Users: []string{"alice:$6$salt$hash"}},
+			},
+			contains: []string{
+				"    listen 443 ssl;\n",
+				"    ssl_certificate_key key.pem;\n\n    auth_basic \"app.example.com\";\n" +
+					"    auth_basic_user_file " + NginxAuthDir + "/app.example.com.htpasswd;\n",
+			},
+			excludes: []string{"alice", "auth_request"},
+		},
+		{
+			name: "forward auth",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				Access:    &NginxAccess{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth"},
+			},
+			contains: []string{
+				"    auth_request /_upduck_auth;\n",
+				"    location = /_upduck_auth {\n        internal;\n        proxy_pass http://10.8.0.2:4180/oauth2/auth;\n",
+				"        proxy_set_header X-Original-URL $forwarded_proto://$host$request_uri;\n",
+				"        proxy_set_header X-Auth-Request-User $upduck_auth_user;\n" +
+					"        proxy_set_header X-Auth-Request-Email $upduck_auth_email;\n",
+			},
+			excludes: []string{"error_page 401", "@upduck_sign_in", "auth_basic"},
+		},
+		{
+			name: "forward auth with sign in",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				Access:    &NginxAccess{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", SignInURL: "https://auth.example.com/oauth2/start"},
+			},
+			contains: []string{
+				"    error_page 401 = @upduck_sign_in;\n",
+				"    location @upduck_sign_in {\n        return 302 https://auth.example.com/oauth2/start?rd=$forwarded_proto://$host$request_uri;\n    }",
+			},
+		},
+		{
+			name: "sign in URL with a query",
+			site: NginxSite{
+				Domain:    "app.example.com",
+				Locations: []NginxLocation{rootLocation},
+				Access:    &NginxAccess{ForwardAuthURL: "http://10.8.0.2:4180/oauth2/auth", SignInURL: "https://auth.example.com/start?provider=github"},
+			},
+			contains: []string{"        return 302 https://auth.example.com/start?provider=github&rd=$forwarded_proto://$host$request_uri;\n"},
+		},
+		{
+			name:     "wildcard domain",
+			site:     NginxSite{Domain: "*.example.com", Locations: []NginxLocation{rootLocation}},
+			contains: []string{"upstream upduck__.example.com_0 {", "    server_name *.example.com;\n", "proxy_pass http://upduck__.example.com_0;"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkRendered(t, renderSite(t, tt.site), tt.contains, tt.excludes)
+		})
+	}
+}
+
+func TestRenderNginxSiteErrors(t *testing.T) {
+	sites := map[string]NginxSite{
+		"no locations": {Domain: "app.example.com"},
+		"no servers":   {Domain: "app.example.com", Locations: []NginxLocation{{Path: "/"}}},
+	}
+
+	for name, site := range sites {
+		if _, err := renderNginxSite(site); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func renderSite(t *testing.T, site NginxSite) string {
+	t.Helper()
+
+	content, err := renderNginxSite(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// checkRendered checks that the rendered config holds every snippet of
+// contains and none of excludes.
+func checkRendered(t *testing.T, rendered string, contains []string, excludes []string) {
+	t.Helper()
+
+	for _, snippet := range contains {
+		if !strings.Contains(rendered, snippet) {
+			t.Errorf("expected %q in:\n%s", snippet, rendered)
+		}
+	}
+
+	for _, snippet := range excludes {
+		if strings.Contains(rendered, snippet) {
+			t.Errorf("unexpected %q in:\n%s", snippet, rendered)
+		}
+	}
+}
+
+func TestNginxLegacySiteRegexp(t *testing.T) {
+	legacy := `map $http_x_forwarded_proto $forwarded_proto {
+    default $scheme;
+    "~." $http_x_forwarded_proto;
+}
+server {
+    server_name app.example.com;
+
+    location / {
+        proxy_pass http://10.8.0.2:3000;
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $forwarded_proto;;
+    }
+}
+`
+
+	match := nginxLegacySiteRegexp.FindStringSubmatch(legacy)
+	if want := []string{legacy, "app.example.com", "10.8.0.2", "3000"}; !reflect.DeepEqual(match, want) {
+		t.Fatalf("match = %q, want %q", match, want)
+	}
+
+	edited := map[string]string{
+		"extra directive":  strings.Replace(legacy, "    location / {\n", "    client_max_body_size 10m;\n\n    location / {\n", 1),
+		"second location":  strings.Replace(legacy, "    }\n}\n", "    }\n\n    location /api {\n        proxy_pass http://10.8.0.3:8080;\n    }\n}\n", 1),
+		"several names":    strings.Replace(legacy, "server_name app.example.com;", "server_name app.example.com www.example.com;", 1),
+		"upstream by name": strings.Replace(legacy, "http://10.8.0.2:3000", "http://backend:3000", 1),
+		"ssl server":       strings.Replace(legacy, "server {\n", "server {\n    listen 443 ssl;\n", 1),
+		"trailing content": legacy + "server {\n    server_name other.example.com;\n}\n",
+		"current template": renderSite(t, NginxSite{Domain: "app.example.com", Locations: []NginxLocation{rootLocation}}),
+	}
+
+	for name, site := range edited {
+		if nginxLegacySiteRegexp.MatchString(site) {
+			t.Errorf("%s: an edited site matched the old template", name)
+		}
+	}
+}
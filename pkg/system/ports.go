@@ -0,0 +1,32 @@
+package system
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// PortInUse reports whether a service of the host already listens on the tcp
+// or udp port. Binding it is the only portable way to tell, ports that cannot
+// be bound for another reason, like missing privileges, are not reported.
+func PortInUse(protocol string, port int) bool {
+	address := net.JoinHostPort("", strconv.Itoa(port))
+
+	var err error
+	if protocol == "udp" {
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", address)
+		if err == nil {
+			conn.Close()
+		}
+	} else {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", address)
+		if err == nil {
+			listener.Close()
+		}
+	}
+
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -2,9 +2,7 @@ package system
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
-	"path/filepath"
 )
 
 func IsWireguardInstalled() bool {
@@ -33,8 +31,7 @@ func InstallWireguard() error {
 
 	for _, manager := range managers {
 		if _, err := exec.LookPath(manager[0]); err == nil {
-			cmd := exec.Command("sh", "-c", fmt.Sprintf("sudo %s", exec.Command(manager[0], manager[1:]...).String()))
-			if err := cmd.Run(); err == nil {
+			if err := RunCommand("sh", "-c", fmt.Sprintf("sudo %s", exec.Command(manager[0], manager[1:]...).String())); err == nil {
 				return nil
 			}
 		}
@@ -45,23 +42,21 @@ func InstallWireguard() error {
 
 func InstallK3s() error {
 	fmt.Println("Installing K3s...")
-	cmd := exec.Command("sh", "-c", "curl -sfL https://get.k3s.io | sh -")
-	return cmd.Run()
+	return RunCommand("sh", "-c", "curl -sfL https://get.k3s.io | sh -")
 }
 
 func InstallNginx() error {
 	fmt.Println("Installing Nginx...")
 
 	managers := [][]string{
-		{"apt", "update", "&&", "apt", "install", "-y", "nginx"},
-		{"yum", "install", "-y", "nginx"},
+		{"apt", "update", "&&", "apt", "install", "-y", "nginx", "libnginx-mod-stream"},
+		{"yum", "install", "-y", "nginx", "nginx-mod-stream"},
 		{"pacman", "-S", "--noconfirm", "nginx"},
 	}
 
 	for _, manager := range managers {
 		if _, err := exec.LookPath(manager[0]); err == nil {
-			cmd := exec.Command("sh", "-c", fmt.Sprintf("sudo %s", exec.Command(manager[0], manager[1:]...).String()))
-			if err := cmd.Run(); err == nil {
+			if err := RunCommand("sh", "-c", fmt.Sprintf("sudo %s", exec.Command(manager[0], manager[1:]...).String())); err == nil {
 				return nil
 			}
 		}
@@ -69,34 +64,3 @@ func InstallNginx() error {
 
 	return fmt.Errorf("failed to install Nginx - no supported package manager found")
 }
-
-func CreateNginxConfig(domain, serverIP, port string) error {
-	configContent := fmt.Sprintf(`map $http_x_forwarded_proto $forwarded_proto {
-    default $scheme;
-    "~." $http_x_forwarded_proto;
-}
-server {
-    server_name %s;
-
-    location / {
-        proxy_pass http://%s:%s;
-        proxy_set_header Host $host;
-        proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-        proxy_set_header X-Forwarded-Proto $forwarded_proto;;
-    }
-}`, domain, serverIP, port)
-
-	configPath := filepath.Join("/etc/nginx/sites-available", domain)
-	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
-		return err
-	}
-
-	enabledPath := filepath.Join("/etc/nginx/sites-enabled", domain)
-	return os.Symlink(configPath, enabledPath)
-}
-
-func RunCommand(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
-	return cmd.Run()
-}
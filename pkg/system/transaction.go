@@ -0,0 +1,284 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Transaction groups the side effects of a multi-step operation, like writing
+// an Nginx site and reloading Nginx, so they can be undone together when a
+// later step fails. Every step saves what is needed to restore the previous
+// state before going through the executor.
+type Transaction struct {
+	undo []func() error
+
+	// daemonReload and services are replayed after the undo steps, once the
+	// previous files are back in place.
+	daemonReload bool
+	services     []serviceAction
+
+	done bool
+}
+
+type serviceAction struct {
+	action  string
+	service string
+}
+
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// WithTransaction runs fn in a new transaction and rolls it back when fn
+// returns an error, which is returned along with any rollback failure.
+func WithTransaction(fn func(tx *Transaction) error) error {
+	tx := NewTransaction()
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// Commit keeps the changes made so far, a later Rollback does nothing.
+func (tx *Transaction) Commit() {
+	tx.done = true
+}
+
+// Rollback undoes the steps in reverse order, then reloads systemd and
+// restarts or reloads the services touched by the transaction so they pick
+// the restored files up. It keeps going on errors and returns them all.
+// Nothing is done in dry runs, where nothing was changed in the first place.
+func (tx *Transaction) Rollback() error {
+	if tx.done || DryRun() {
+		return nil
+	}
+	tx.done = true
+
+	if len(tx.undo) == 0 && !tx.daemonReload && len(tx.services) == 0 {
+		return nil
+	}
+
+	fmt.Println("Rolling back system changes...")
+
+	var errs []error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if tx.daemonReload {
+		if err := RunCommand("systemctl", "daemon-reload"); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload systemd: %v", err))
+		}
+	}
+
+	for _, service := range tx.services {
+		if err := Systemctl(service.action, service.service); err != nil {
+			errs = append(errs, fmt.Errorf("failed to %s %s: %v", service.action, service.service, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WriteFile writes the file, restoring its previous content, or removing it
+// if it did not exist, on rollback.
+func (tx *Transaction) WriteFile(path string, data []byte, perm os.FileMode) error {
+	undo, err := restoreFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFile(path, data, perm); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// RemoveFile removes the file or symlink, recreating it on rollback.
+func (tx *Transaction) RemoveFile(path string) error {
+	undo, err := restoreFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := RemoveFile(path); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// Symlink points path to target, replacing whatever was at path, so it can be
+// run again over a previous attempt.
+func (tx *Transaction) Symlink(target string, path string) error {
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+
+	if err := tx.RemoveFile(path); err != nil {
+		return err
+	}
+
+	if err := Symlink(target, path); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return RemoveFile(path)
+	})
+	return nil
+}
+
+// EnsureIptablesRule adds the rule if missing, deleting it again on rollback.
+func (tx *Transaction) EnsureIptablesRule(chain string, rule ...string) (bool, error) {
+	added, err := EnsureIptablesRule(chain, rule...)
+	if err != nil || !added {
+		return added, err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return DeleteIptablesRule(chain, rule...)
+	})
+	return true, nil
+}
+
+// DeleteIptablesRule deletes the rule if present, adding it back on rollback.
+func (tx *Transaction) DeleteIptablesRule(chain string, rule ...string) error {
+	if !iptablesRuleExists(chain, rule...) {
+		return nil
+	}
+
+	if err := DeleteIptablesRule(chain, rule...); err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		_, err := EnsureIptablesRule(chain, rule...)
+		return err
+	})
+	return nil
+}
+
+// DaemonReload reloads the systemd units, and again on rollback once the
+// previous unit files are restored.
+func (tx *Transaction) DaemonReload() error {
+	if err := RunCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+
+	tx.daemonReload = true
+	return nil
+}
+
+// Systemctl runs a systemctl action on the service and records how to bring
+// the service back to its previous state: services started or enabled by the
+// transaction are stopped or disabled, services it stopped are started again
+// and services it reloaded or restarted are reloaded or restarted again.
+func (tx *Transaction) Systemctl(action string, service string) error {
+	switch action {
+	case "start":
+		wasActive := systemctlCheck("is-active", service)
+		if err := Systemctl(action, service); err != nil {
+			return err
+		}
+		if !wasActive {
+			tx.undo = append(tx.undo, func() error {
+				return Systemctl("stop", service)
+			})
+		}
+	case "stop":
+		wasActive := systemctlCheck("is-active", service)
+		if err := Systemctl(action, service); err != nil {
+			return err
+		}
+		if wasActive {
+			tx.addService("start", service)
+		}
+	case "enable", "disable":
+		wasEnabled := systemctlCheck("is-enabled", service)
+		if err := Systemctl(action, service); err != nil {
+			return err
+		}
+		if wasEnabled != (action == "enable") {
+			break
+		}
+		undo := "disable"
+		if wasEnabled {
+			undo = "enable"
+		}
+		tx.undo = append(tx.undo, func() error {
+			return Systemctl(undo, service)
+		})
+	default:
+		if err := Systemctl(action, service); err != nil {
+			return err
+		}
+		tx.addService(action, service)
+	}
+
+	return nil
+}
+
+func (tx *Transaction) addService(action string, service string) {
+	for _, existing := range tx.services {
+		if existing.service == service && existing.action == action {
+			return
+		}
+	}
+
+	tx.services = append(tx.services, serviceAction{action: action, service: service})
+}
+
+// restoreFile returns a function bringing path back to its current state:
+// same content and mode, same symlink target, or no file at all.
+func restoreFile(path string) (func() error, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return func() error {
+			return RemoveFile(path)
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return func() error {
+			if err := RemoveFile(path); err != nil {
+				return err
+			}
+			return Symlink(target, path)
+		}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return WriteFile(path, content, info.Mode().Perm())
+	}, nil
+}
+
+func systemctlCheck(check string, service string) bool {
+	return exec.Command("systemctl", check, "--quiet", service).Run() == nil
+}
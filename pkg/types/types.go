@@ -1,10 +1,18 @@
 package types
 
+import "time"
+
 type NodeConfig struct {
-	Type string `json:"node_type"`
+	Version       int    `json:"version"`
+	Type          string `json:"node_type"`
+	WGPortRange   string `json:"wg_port_range,omitempty"`
+	StateBackend  string `json:"state_backend,omitempty"`
+	ACMEDirectory string `json:"acme_directory,omitempty"`
+	ACMEEmail     string `json:"acme_email,omitempty"`
 }
 
 type WireguardConfig struct {
+	Version    int    `json:"version"`
 	PrivateKey string `json:"private_key"`
 	PublicKey  string `json:"public_key"`
 }
@@ -15,33 +23,160 @@ type RSAKeysConfig struct {
 }
 
 type Peer struct {
-	ID        string `json:"id"`
-	PublicKey string `json:"public_key"`
-	Address   string `json:"address,omitempty"`
-	Endpoint  string `json:"endpoint,omitempty"`
+	ID           string `json:"id"`
+	PublicKey    string `json:"public_key"`
+	Address      string `json:"address,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	EndpointPort int    `json:"endpoint_port,omitempty"`
+}
+
+type Lease struct {
+	Address   string    `json:"address"`
+	PeerID    string    `json:"peer_id"`
+	Static    bool      `json:"static,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Network struct {
-	ID      string `json:"id"`
-	Address string `json:"address,omitempty"`
-	Peers   []Peer `json:"peers"`
+	ID               string  `json:"id"`
+	Name             string  `json:"name,omitempty"`
+	Address          string  `json:"address,omitempty"`
+	Peers            []Peer  `json:"peers"`
+	Leases           []Lease `json:"leases,omitempty"`
+	Interface        string  `json:"interface,omitempty"`
+	ListenPort       int     `json:"listen_port,omitempty"`
+	TowerAddress     string  `json:"tower_address,omitempty"`
+	TowerKey         string  `json:"tower_key,omitempty"`
+	TowerFingerprint string  `json:"tower_fingerprint,omitempty"`
 }
 
 type EncryptionKey struct {
 	ID        string `json:"id"`
-	Type 	  string `json:"type"`
+	Type      string `json:"type"`
 	PublicKey string `json:"public_key"`
 }
 
+type JoinToken struct {
+	ID         string    `json:"id"`
+	NetworkID  string    `json:"network_id"`
+	SecretHash string    `json:"secret_hash"`
+	MaxUses    int       `json:"max_uses"`
+	Uses       int       `json:"uses"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type JoinTokenPayload struct {
+	TowerAddress     string `json:"a"`
+	NetworkID        string `json:"n"`
+	TowerKeyDigest   string `json:"f"`
+	TowerFingerprint string `json:"t,omitempty"`
+	Secret           string `json:"s"`
+}
+
+type JoinRequest struct {
+	ID          string    `json:"id"`
+	NetworkID   string    `json:"network_id"`
+	KeyDigest   string    `json:"key_digest"`
+	WGPublicKey string    `json:"wg_public_key"`
+	Hostname    string    `json:"hostname,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	DecidedAt   time.Time `json:"decided_at,omitempty"`
+}
+
+type KeyAuthorization struct {
+	KeyDigest string    `json:"key_digest"`
+	NetworkID string    `json:"network_id"`
+	MaxPeers  int       `json:"max_peers,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ForwardTarget is a port of a peer, or of a fixed address outside the
+// networks, traffic of a forward is sent to.
+type ForwardTarget struct {
+	PeerID  string `json:"peer_id,omitempty"`
+	Address string `json:"address,omitempty"`
+	Port    int    `json:"port"`
+}
+
+// ForwardRoute sends the requests under a path of a forwarded domain to its
+// targets, balanced with the strategy. Empty options keep the Nginx defaults.
+type ForwardRoute struct {
+	Path     string          `json:"path"`
+	Targets  []ForwardTarget `json:"targets"`
+	Strategy string          `json:"strategy,omitempty"`
+	// StripPrefix removes the path from the requests sent to the targets.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// Headers are set on the requests sent to the targets, an empty value
+	// removes the header.
+	Headers        map[string]string `json:"headers,omitempty"`
+	MaxBodySize    string            `json:"max_body_size,omitempty"`
+	ConnectTimeout string            `json:"connect_timeout,omitempty"`
+	Timeout        string            `json:"timeout,omitempty"`
+}
+
+// ForwardAuth restricts who reaches the routes of a forward, a request must
+// pass every check configured. Deny and Allow hold IP addresses and CIDR
+// blocks: a client in Deny is refused, and so is one outside Allow when it is
+// not empty. Users log in with HTTP basic auth. ForwardAuthURL is asked about
+// every request, like an OIDC proxy answering 2xx to let it through and 401
+// to send the client to SignInURL.
+type ForwardAuth struct {
+	Allow          []string      `json:"allow,omitempty"`
+	Deny           []string      `json:"deny,omitempty"`
+	Users          []ForwardUser `json:"users,omitempty"`
+	ForwardAuthURL string        `json:"forward_auth_url,omitempty"`
+	SignInURL      string        `json:"sign_in_url,omitempty"`
+}
+
+// ForwardUser is a basic auth user, PasswordHash is a crypt(3) hash.
+type ForwardUser struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+}
+
+// Forward sends the HTTP traffic of a domain to the targets of its routes.
+// With TLS, HTTPS is served with an ACME certificate and HTTP is redirected
+// to it. With Passthrough, the TLS connections of the domain are routed to
+// the targets of its only route by server name without being decrypted.
+type Forward struct {
+	Domain      string         `json:"domain"`
+	Routes      []ForwardRoute `json:"routes"`
+	Auth        *ForwardAuth   `json:"auth,omitempty"`
+	TLS         bool           `json:"tls,omitempty"`
+	HSTS        bool           `json:"hsts,omitempty"`
+	Passthrough bool           `json:"passthrough,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// PortForward sends the TCP or UDP traffic received on a public port of the
+// tower to a target, for services that do not speak HTTP.
+type PortForward struct {
+	Protocol   string        `json:"protocol"`
+	PublicPort int           `json:"public_port"`
+	Target     ForwardTarget `json:"target"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
 type ConnectionsConfig struct {
-	Networks       []Network       `json:"networks"`
-	AllowedKeys    []string        `json:"allowed_keys,omitempty"`
-	EncryptionKeys []EncryptionKey `json:"encryption_keys,omitempty"`
+	Version        int                `json:"version"`
+	Networks       []Network          `json:"networks"`
+	Authorizations []KeyAuthorization `json:"authorizations,omitempty"`
+	EncryptionKeys []EncryptionKey    `json:"encryption_keys,omitempty"`
+	JoinTokens     []JoinToken        `json:"join_tokens,omitempty"`
+	JoinRequests   []JoinRequest      `json:"join_requests,omitempty"`
+	Forwards       []Forward          `json:"forwards,omitempty"`
+	PortForwards   []PortForward      `json:"port_forwards,omitempty"`
 }
 
 type ConnectRequest struct {
 	PublicKey   string `json:"public_key"`
 	WGPublicKey string `json:"wg_public_key"`
+	JoinToken   string `json:"join_token,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
 }
 
 type ConnectResponse struct {
@@ -51,4 +186,37 @@ type ConnectResponse struct {
 	PublicKey      string `json:"public_key"`
 	NetworkID      string `json:"network_id"`
 	PeerID         string `json:"peer_id"`
+	WGPort         int    `json:"wg_port,omitempty"`
+}
+
+type Envelope struct {
+	KeyDigest    string `json:"key_digest"`
+	Timestamp    int64  `json:"timestamp"`
+	Nonce        string `json:"nonce"`
+	EncryptedKey string `json:"encrypted_key"`
+	Ciphertext   string `json:"ciphertext"`
+	Signature    string `json:"signature"`
+}
+
+type TowerKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+type PeerStatus struct {
+	ID            string    `json:"id"`
+	Address       string    `json:"address,omitempty"`
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	LastHandshake time.Time `json:"last_handshake,omitempty"`
+	ReceiveBytes  int64     `json:"rx_bytes"`
+	TransmitBytes int64     `json:"tx_bytes"`
+	Online        bool      `json:"online"`
+}
+
+type NetworkStatus struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name,omitempty"`
+	Interface string       `json:"interface"`
+	Up        bool         `json:"up"`
+	Peers     []PeerStatus `json:"peers"`
 }